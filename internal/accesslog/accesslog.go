@@ -0,0 +1,91 @@
+// Package accesslog writes one JSON object per line (JSONL) for every proxied
+// connection, separately from the main log, for offline analysis.
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Connection modes for Record.Mode.
+const (
+	ModeMITM   = "mitm"
+	ModeDirect = "direct"
+)
+
+// Record describes one connection from the CONNECT (or SOCKS5 / transparent
+// redirect) until it was closed.
+type Record struct {
+	Time         time.Time          `json:"time"`                    // When the connection was accepted
+	ID           uint64             `json:"id"`                      // Connection ID, unique per process
+	Client       string             `json:"client"`                  // Client address
+	Host         string             `json:"host"`                    // Host from the CONNECT request
+	Port         string             `json:"port"`                    // Port from the CONNECT request
+	Mode         string             `json:"mode"`                    // ModeMITM or ModeDirect
+	ClientSNI    string             `json:"client_sni,omitempty"`    // SNI presented by the client (MITM only)
+	TargetSNI    string             `json:"target_sni"`              // SNI sent to the remote, empty when stripped or direct
+	ECH          bool               `json:"ech,omitempty"`           // Whether TargetSNI was encrypted with ECH
+	RemoteAddr   string             `json:"remote_addr,omitempty"`   // Address the remote was reached at
+	DNS          string             `json:"dns,omitempty"`           // DNS upstream that resolved the host, or hosts/cache/system
+	ALPN         string             `json:"alpn,omitempty"`          // Protocol negotiated with the remote (MITM only)
+	Verify       string             `json:"verify,omitempty"`        // Certificate check: passed, failed or skipped (MITM only)
+	VerifyReason string             `json:"verify_reason,omitempty"` // Why verification failed or was skipped
+	BytesIn      int64              `json:"bytes_in"`                // Bytes received from the client while tunnelling
+	BytesOut     int64              `json:"bytes_out"`               // Bytes sent to the client while tunnelling
+	PhasesMs     map[string]float64 `json:"phases_ms"`               // Time spent in each phase, in milliseconds
+	DurationMs   float64            `json:"duration_ms"`             // Lifetime of the connection, in milliseconds
+	CloseReason  string             `json:"close_reason"`            // Why the connection ended
+	Error        string             `json:"error,omitempty"`         // Error that ended the connection, if any
+}
+
+// Logger appends Records to a file. A nil *Logger discards them.
+type Logger struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// Open opens path for appending, creating it and its directory if needed.
+func Open(path string) (*Logger, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("create access log directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open access log: %w", err)
+	}
+	return &Logger{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Write appends rec as one line. Errors are returned but the caller may
+// ignore them; a failing access log never affects the connection.
+func (l *Logger) Write(rec *Record) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return os.ErrClosed
+	}
+	return l.enc.Encode(rec)
+}
+
+// Close closes the file. Later writes fail with os.ErrClosed.
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
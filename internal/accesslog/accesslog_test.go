@@ -0,0 +1,59 @@
+package accesslog
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLogger_WritesOneLinePerRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "access.jsonl")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	for i := uint64(1); i <= 2; i++ {
+		rec := &Record{Time: time.Now(), ID: i, Host: "example.com", Mode: ModeDirect, BytesIn: 10, PhasesMs: map[string]float64{"direct_dial": 1.5}}
+		if err := l.Write(rec); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := l.Write(&Record{}); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Write after Close = %v, want os.ErrClosed", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open log: %v", err)
+	}
+	defer f.Close()
+	var ids []uint64
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var rec Record
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatalf("line %q: %v", sc.Text(), err)
+		}
+		ids = append(ids, rec.ID)
+	}
+	if len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+		t.Errorf("read IDs %v, want [1 2]", ids)
+	}
+}
+
+func TestLogger_NilDiscards(t *testing.T) {
+	var l *Logger
+	if err := l.Write(&Record{}); err != nil {
+		t.Errorf("nil Write = %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Errorf("nil Close = %v", err)
+	}
+}
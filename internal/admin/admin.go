@@ -0,0 +1,349 @@
+// Package admin implements the management API of a running Snirect instance
+// and the client that "snirect admin" uses to drive it. The API speaks JSON
+// over HTTP on a loopback address or a unix socket, authenticated with a
+// Bearer token.
+package admin
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"snirect/internal/accesslog"
+	"snirect/internal/config"
+	"snirect/internal/interfaces"
+	"snirect/internal/logger"
+	"snirect/internal/proxy"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// TokenFile is the file in the config directory that holds the generated
+// token when admin.token is not set.
+const TokenFile = "admin.token"
+
+// unixPrefix marks a unix socket path in admin.listen.
+const unixPrefix = "unix:"
+
+// Connection is a live connection as returned by GET /v1/connections.
+type Connection struct {
+	ID         uint64    `json:"id"`
+	Client     string    `json:"client"`
+	Host       string    `json:"host"`
+	Port       string    `json:"port"`
+	Mode       string    `json:"mode"`  // accesslog.ModeMITM or accesslog.ModeDirect
+	Phase      string    `json:"phase"` // Phase of the CONNECT state machine, empty before it starts
+	TargetSNI  string    `json:"target_sni,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Start      time.Time `json:"start"`
+}
+
+// Throughput is the throughput of a set of tunnels in bytes per second and
+// its limits, 0 meaning unlimited, as returned by GET /v1/bandwidth.
+type Throughput struct {
+	Name          string `json:"name,omitempty"` // Client IP, [bandwidth] pattern or host, empty for all tunnels
+	Tunnels       int    `json:"tunnels"`
+	Upload        int64  `json:"upload"`
+	Download      int64  `json:"download"`
+	UploadLimit   int64  `json:"upload_limit"`
+	DownloadLimit int64  `json:"download_limit"`
+}
+
+// Bandwidth is the throughput of all tunnels and of each client IP and host,
+// or [bandwidth] pattern, with open tunnels, busiest first, as returned by GET /v1/bandwidth.
+type Bandwidth struct {
+	Total   Throughput   `json:"total"`
+	Clients []Throughput `json:"clients"`
+	Hosts   []Throughput `json:"hosts"`
+}
+
+// Server serves the admin API. The hooks are optional; endpoints whose hook
+// is nil answer 501 Not Implemented.
+type Server struct {
+	Proxy    *proxy.ProxyServer
+	Resolver interfaces.Resolver
+	Token    string
+
+	Reload         func() error            // Re-reads config.toml and rules.toml and applies them
+	FetchRules     func() error            // Downloads the upstream rules, then reloads
+	SetSystemProxy func(enable bool) error // Points the system proxy at the PAC file, or clears it
+
+	mu  sync.Mutex
+	srv *http.Server
+}
+
+// flusher is implemented by resolvers that can drop their whole cache.
+type flusher interface {
+	Flush()
+}
+
+// Handler returns the API routes behind token authentication.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/connections", s.handleConnections)
+	mux.HandleFunc("DELETE /v1/connections/{id}", s.handleKill)
+	mux.HandleFunc("GET /v1/bandwidth", s.handleBandwidth)
+	mux.HandleFunc("POST /v1/dns/flush", s.handleFlushDNS)
+	mux.HandleFunc("POST /v1/reload", func(w http.ResponseWriter, r *http.Request) { runHook(w, s.Reload) })
+	mux.HandleFunc("POST /v1/rules/fetch", func(w http.ResponseWriter, r *http.Request) { runHook(w, s.FetchRules) })
+	mux.HandleFunc("GET /v1/config", s.handleConfig)
+	mux.HandleFunc("POST /v1/system-proxy", s.handleSystemProxy)
+	return s.authenticate(mux)
+}
+
+// authenticate rejects requests without the Bearer token.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || s.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleConnections(w http.ResponseWriter, r *http.Request) {
+	live := s.Proxy.Connections()
+	list := make([]Connection, len(live))
+	for i, c := range live {
+		mode := accesslog.ModeDirect
+		if c.Intercept {
+			mode = accesslog.ModeMITM
+		}
+		list[i] = Connection{
+			ID:         c.ID,
+			Client:     c.ClientAddr,
+			Host:       c.Host,
+			Port:       c.Port,
+			Mode:       mode,
+			Phase:      string(c.Phase),
+			TargetSNI:  c.TargetSNI,
+			RemoteAddr: c.RemoteAddr,
+			Start:      c.Start,
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) handleBandwidth(w http.ResponseWriter, r *http.Request) {
+	total, clients, hosts := s.Proxy.Bandwidth()
+	writeJSON(w, http.StatusOK, Bandwidth{
+		Total:   Throughput(total),
+		Clients: throughputs(clients),
+		Hosts:   throughputs(hosts),
+	})
+}
+
+func throughputs(list []proxy.Throughput) []Throughput {
+	out := make([]Throughput, len(list))
+	for i, t := range list {
+		out[i] = Throughput(t)
+	}
+	return out
+}
+
+func (s *Server) handleKill(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid connection id %q", r.PathValue("id")))
+		return
+	}
+	if !s.Proxy.CloseConnection(id) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no connection %d", id))
+		return
+	}
+	logger.Info("Admin: closed connection %d", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleFlushDNS drops the cached answers for ?host=, or all of them.
+func (s *Server) handleFlushDNS(w http.ResponseWriter, r *http.Request) {
+	if host := r.URL.Query().Get("host"); host != "" {
+		s.Resolver.Invalidate(host)
+		logger.Info("Admin: flushed DNS cache for %s", host)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	f, ok := s.Resolver.(flusher)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, errors.New("resolver cannot flush its cache"))
+		return
+	}
+	f.Flush()
+	logger.Info("Admin: flushed DNS cache")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runHook calls fn and reports its outcome; a nil fn is not implemented.
+func runHook(w http.ResponseWriter, fn func() error) {
+	if fn == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("not supported by this instance"))
+		return
+	}
+	if err := fn(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleConfig writes the effective configuration as TOML, without secrets.
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	data, err := toml.Marshal(redact(s.Proxy.EffectiveConfig()))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/toml")
+	w.Write(data)
+}
+
+// handleSystemProxy expects {"enabled": bool}.
+func (s *Server) handleSystemProxy(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Enabled == nil {
+		writeError(w, http.StatusBadRequest, errors.New(`expected {"enabled": true|false}`))
+		return
+	}
+	if s.SetSystemProxy == nil {
+		runHook(w, nil)
+		return
+	}
+	runHook(w, func() error { return s.SetSystemProxy(*body.Enabled) })
+}
+
+// redacted replaces secrets in the configuration served by handleConfig.
+const redacted = "REDACTED"
+
+// redact returns a copy of cfg with the access control passwords, the admin
+// token and the password of the outbound proxy replaced.
+func redact(cfg *config.Config) *config.Config {
+	out := *cfg
+	if len(cfg.AccessControl.Users) > 0 {
+		out.AccessControl.Users = make(map[string]string, len(cfg.AccessControl.Users))
+		for user := range cfg.AccessControl.Users {
+			out.AccessControl.Users[user] = redacted
+		}
+	}
+	if out.Admin.Token != "" {
+		out.Admin.Token = redacted
+	}
+	if u, err := url.Parse(out.Outbound.Proxy); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			out.Outbound.Proxy = u.String()
+		}
+	}
+	return &out
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// Listen opens the listener for addr, a loopback "host:port" or
+// "unix:/path/to/socket". A stale socket file is replaced and the new one is
+// made accessible to the owner only; any other file at the path is an error.
+func Listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("admin socket path %s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("remove stale admin socket: %w", err)
+		}
+		ln, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, 0600); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("restrict admin socket: %w", err)
+		}
+		return ln, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid admin address %q: %w", addr, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("admin API must listen on a loopback address or a unix socket, not %q", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Serve answers API requests on ln until Shutdown is called.
+func (s *Server) Serve(ln net.Listener) error {
+	srv := &http.Server{Handler: s.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	s.mu.Lock()
+	s.srv = srv
+	s.mu.Unlock()
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops the server started by Serve.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	srv := s.srv
+	s.mu.Unlock()
+	if srv == nil {
+		return nil
+	}
+	return srv.Shutdown(ctx)
+}
+
+// LoadToken returns the configured token, or the one stored in TokenFile in
+// appDir.
+func LoadToken(appDir, configured string) (string, error) {
+	if configured != "" {
+		return configured, nil
+	}
+	data, err := os.ReadFile(filepath.Join(appDir, TokenFile))
+	if err != nil {
+		return "", fmt.Errorf("read admin token: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// EnsureToken is LoadToken that first generates TokenFile when no token is
+// configured and the file does not exist yet.
+func EnsureToken(appDir, configured string) (string, error) {
+	if token, err := LoadToken(appDir, configured); err == nil && token != "" {
+		return token, nil
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	if err := os.WriteFile(filepath.Join(appDir, TokenFile), []byte(token+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("write admin token: %w", err)
+	}
+	return token, nil
+}
@@ -0,0 +1,136 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client calls the admin API of a running instance.
+type Client struct {
+	http  *http.Client
+	base  string
+	token string
+}
+
+// NewClient returns a client for the API listening on addr, in the format of
+// admin.listen.
+func NewClient(addr, token string) *Client {
+	transport := &http.Transport{}
+	base := "http://" + addr
+	if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+		base = "http://snirect"
+	}
+	return &Client{
+		http:  &http.Client{Transport: transport, Timeout: 2 * time.Minute},
+		base:  base,
+		token: token,
+	}
+}
+
+// do sends the request and decodes a JSON response into out, if not nil.
+// Responses other than 2xx are returned as errors carrying the API message.
+func (c *Client) do(ctx context.Context, method, path string, body, out any) error {
+	var rd io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, rd)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Error != "" {
+			return fmt.Errorf("%s: %s", resp.Status, apiErr.Error)
+		}
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	if w, ok := out.(io.Writer); ok {
+		_, err = io.Copy(w, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Connections lists the live connections.
+func (c *Client) Connections(ctx context.Context) ([]Connection, error) {
+	var list []Connection
+	err := c.do(ctx, http.MethodGet, "/v1/connections", nil, &list)
+	return list, err
+}
+
+// Bandwidth returns the current throughput and bandwidth limits.
+func (c *Client) Bandwidth(ctx context.Context) (*Bandwidth, error) {
+	var b Bandwidth
+	if err := c.do(ctx, http.MethodGet, "/v1/bandwidth", nil, &b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// CloseConnection closes the connection with the given ID.
+func (c *Client) CloseConnection(ctx context.Context, id uint64) error {
+	return c.do(ctx, http.MethodDelete, "/v1/connections/"+strconv.FormatUint(id, 10), nil, nil)
+}
+
+// FlushDNS drops the cached answers for host, or all of them if host is empty.
+func (c *Client) FlushDNS(ctx context.Context, host string) error {
+	path := "/v1/dns/flush"
+	if host != "" {
+		path += "?host=" + url.QueryEscape(host)
+	}
+	return c.do(ctx, http.MethodPost, path, nil, nil)
+}
+
+// Reload makes the instance re-read config.toml and rules.toml.
+func (c *Client) Reload(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/v1/reload", nil, nil)
+}
+
+// FetchRules makes the instance download the upstream rules and reload.
+func (c *Client) FetchRules(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/v1/rules/fetch", nil, nil)
+}
+
+// Config writes the effective configuration, as TOML, to w.
+func (c *Client) Config(ctx context.Context, w io.Writer) error {
+	return c.do(ctx, http.MethodGet, "/v1/config", nil, w)
+}
+
+// SetSystemProxy enables or disables the system PAC setting.
+func (c *Client) SetSystemProxy(ctx context.Context, enabled bool) error {
+	return c.do(ctx, http.MethodPost, "/v1/system-proxy", map[string]bool{"enabled": enabled}, nil)
+}
@@ -15,6 +15,8 @@ import (
 	"os"
 	"sync"
 	"time"
+
+	"snirect/internal/metrics"
 )
 
 // CertificateManager manages the Root CA and signs leaf certificates for proxying.
@@ -23,6 +25,7 @@ type CertificateManager struct {
 	RootKey   interface{}
 	certCache sync.Map // map[string]*tls.Certificate
 	stopChan  chan struct{}
+	closeOnce sync.Once
 }
 
 // NewCertificateManager creates a new CertificateManager, loading existing CA files or generating new ones.
@@ -57,9 +60,9 @@ func NewCertificateManager(caCertPath, caKeyPath string) (*CertificateManager, e
 	return cm, nil
 }
 
-// Close stops the background cleanup routine.
+// Close stops the background cleanup routine. It is safe to call Close more than once.
 func (cm *CertificateManager) Close() error {
-	close(cm.stopChan)
+	cm.closeOnce.Do(func() { close(cm.stopChan) })
 	return nil
 }
 
@@ -228,6 +231,7 @@ func (cm *CertificateManager) SignLeafCert(hosts []string) ([]byte, interface{},
 	if err != nil {
 		return nil, nil, err
 	}
+	metrics.CertsIssued.With().Inc()
 
 	return derBytes, priv, nil
 }
@@ -0,0 +1,228 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"snirect/internal/admin"
+	"snirect/internal/config"
+
+	"github.com/spf13/cobra"
+)
+
+var adminCmd = &cobra.Command{
+	Use:   "admin",
+	Short: "Control the running Snirect instance",
+	Long: `Talks to the admin API of a running instance. Enable it by setting
+admin.listen in config.toml, e.g. "127.0.0.1:7656" or "unix:/path/to/snirect.sock".`,
+}
+
+var adminConnsCmd = &cobra.Command{
+	Use:     "conns",
+	Aliases: []string{"connections"},
+	Short:   "List live connections",
+	Args:    cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withAdmin(func(ctx context.Context, c *admin.Client) error {
+			list, err := c.Connections(ctx)
+			if err != nil {
+				return err
+			}
+			tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, "ID\tCLIENT\tHOST\tMODE\tPHASE\tSNI\tREMOTE\tAGE")
+			for _, conn := range list {
+				host := conn.Host + ":" + conn.Port
+				age := time.Since(conn.Start).Round(time.Second)
+				fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", conn.ID, conn.Client, host, conn.Mode, conn.Phase, conn.TargetSNI, conn.RemoteAddr, age)
+			}
+			return tw.Flush()
+		})
+	},
+}
+
+var adminBandwidthCmd = &cobra.Command{
+	Use:     "bandwidth",
+	Aliases: []string{"bw"},
+	Short:   "Show the current throughput and bandwidth limits",
+	Args:    cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withAdmin(func(ctx context.Context, c *admin.Client) error {
+			b, err := c.Bandwidth(ctx)
+			if err != nil {
+				return err
+			}
+			tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, "\tTUNNELS\tUPLOAD\tDOWNLOAD\tUPLOAD LIMIT\tDOWNLOAD LIMIT")
+			row := func(name string, t admin.Throughput) {
+				fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\n", name, t.Tunnels,
+					formatRate(t.Upload), formatRate(t.Download), formatLimit(t.UploadLimit), formatLimit(t.DownloadLimit))
+			}
+			row("total", b.Total)
+			for _, t := range b.Clients {
+				row("client "+t.Name, t)
+			}
+			for _, t := range b.Hosts {
+				row("host "+t.Name, t)
+			}
+			return tw.Flush()
+		})
+	},
+}
+
+// formatRate formats a throughput in bytes per second.
+func formatRate(bps int64) string {
+	switch {
+	case bps >= 1<<20:
+		return fmt.Sprintf("%.1f MiB/s", float64(bps)/(1<<20))
+	case bps >= 1<<10:
+		return fmt.Sprintf("%.1f KiB/s", float64(bps)/(1<<10))
+	}
+	return fmt.Sprintf("%d B/s", bps)
+}
+
+// formatLimit formats a bandwidth limit in bytes per second, 0 meaning none.
+func formatLimit(bps int64) string {
+	if bps == 0 {
+		return "-"
+	}
+	return formatRate(bps)
+}
+
+var adminKillCmd = &cobra.Command{
+	Use:   "kill <id>",
+	Short: "Close a live connection",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		id, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid connection id %q", args[0])
+		}
+		return withAdmin(func(ctx context.Context, c *admin.Client) error {
+			if err := c.CloseConnection(ctx, id); err != nil {
+				return err
+			}
+			fmt.Printf("[+] Connection %d closed\n", id)
+			return nil
+		})
+	},
+}
+
+var adminFlushDNSCmd = &cobra.Command{
+	Use:   "flush-dns [host]",
+	Short: "Flush the DNS cache, or only the entries of one host",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		host := ""
+		if len(args) == 1 {
+			host = args[0]
+		}
+		return withAdmin(func(ctx context.Context, c *admin.Client) error {
+			if err := c.FlushDNS(ctx, host); err != nil {
+				return err
+			}
+			fmt.Println("[+] DNS cache flushed")
+			return nil
+		})
+	},
+}
+
+var adminReloadCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "Reload config.toml and rules.toml",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withAdmin(func(ctx context.Context, c *admin.Client) error {
+			if err := c.Reload(ctx); err != nil {
+				return err
+			}
+			fmt.Println("[+] Configuration reloaded")
+			return nil
+		})
+	},
+}
+
+var adminConfigCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Print the effective configuration",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withAdmin(func(ctx context.Context, c *admin.Client) error {
+			return c.Config(ctx, os.Stdout)
+		})
+	},
+}
+
+var adminPACCmd = &cobra.Command{
+	Use:       "pac <on|off>",
+	Short:     "Set or clear the system PAC proxy",
+	Args:      cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+	ValidArgs: []string{"on", "off"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		enable := args[0] == "on"
+		return withAdmin(func(ctx context.Context, c *admin.Client) error {
+			if err := c.SetSystemProxy(ctx, enable); err != nil {
+				return err
+			}
+			fmt.Printf("[+] System proxy %s\n", args[0])
+			return nil
+		})
+	},
+}
+
+var adminFetchRulesCmd = &cobra.Command{
+	Use:   "fetch-rules",
+	Short: "Fetch rules from upstream and reload them",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withAdmin(func(ctx context.Context, c *admin.Client) error {
+			if err := c.FetchRules(ctx); err != nil {
+				return err
+			}
+			fmt.Println("[+] Rules updated and reloaded")
+			return nil
+		})
+	},
+}
+
+// errAdminDisabled is returned by newAdminClient when admin.listen is not set.
+var errAdminDisabled = errors.New("admin API is disabled: set admin.listen in config.toml")
+
+// newAdminClient returns a client for the admin API configured in config.toml.
+func newAdminClient() (*admin.Client, error) {
+	appDir, err := config.GetAppDataDir()
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := config.LoadConfig(filepath.Join(appDir, "config.toml"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	if cfg.Admin.Listen == "" {
+		return nil, errAdminDisabled
+	}
+	token, err := admin.LoadToken(appDir, cfg.Admin.Token)
+	if err != nil {
+		return nil, err
+	}
+	return admin.NewClient(cfg.Admin.Listen, token), nil
+}
+
+// withAdmin runs fn with a client for the running instance.
+func withAdmin(fn func(ctx context.Context, c *admin.Client) error) error {
+	c, err := newAdminClient()
+	if err != nil {
+		return err
+	}
+	return fn(context.Background(), c)
+}
+
+func init() {
+	adminCmd.AddCommand(adminConnsCmd, adminBandwidthCmd, adminKillCmd, adminFlushDNSCmd, adminReloadCmd, adminConfigCmd, adminPACCmd, adminFetchRulesCmd)
+	RootCmd.AddCommand(adminCmd)
+}
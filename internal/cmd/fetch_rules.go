@@ -1,10 +1,12 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"path/filepath"
 
 	"snirect/internal/config"
+	"snirect/internal/logger"
 	"snirect/internal/update"
 
 	"github.com/spf13/cobra"
@@ -16,9 +18,20 @@ var fetchRulesCmd = &cobra.Command{
 	Long: `Downloads the latest rules from the upstream source (Ceiling-Host) and updates them locally.
 This will replace the current rules with the latest version.
 
-Rules are fetched using Snirect's internal network stack.`,
+Rules are fetched using Snirect's internal network stack. When the admin API
+is enabled and Snirect is running, the running instance fetches the rules and
+reloads them.`,
 	Example: `  snirect fetch-rules`,
 	RunE: func(cmd *cobra.Command, args []string) error {
+		if c, err := newAdminClient(); err == nil {
+			err := c.FetchRules(context.Background())
+			if err == nil {
+				fmt.Println("[+] Rules updated and reloaded by the running instance!")
+				return nil
+			}
+			logger.Debug("Admin API fetch failed, fetching locally: %v", err)
+		}
+
 		appDir, err := config.EnsureConfig(false)
 		if err != nil {
 			return fmt.Errorf("failed to initialize config: %w", err)
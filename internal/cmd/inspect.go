@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"snirect/internal/config"
+	"snirect/internal/passthrough"
 	"sort"
 	"strings"
 
@@ -15,7 +16,8 @@ var inspectCmd = &cobra.Command{
 	Use:   "inspect",
 	Short: "输出当前已加载的配置和规则 (合并默认值后)",
 	Long: `该命令显示 Snirect 当前使用的完整配置和分流规则。
-它会显示合并了硬编码默认值、嵌入的默认配置文件以及用户自定义配置文件后的最终状态。`,
+它会显示合并了硬编码默认值、嵌入的默认配置文件以及用户自定义配置文件后的最终状态，
+以及自动学习的直连域名 (passthrough.json)。`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		appDir, err := config.GetAppDataDir()
 		if err != nil {
@@ -104,6 +106,18 @@ var inspectCmd = &cobra.Command{
 			}
 		}
 
+		list, err := passthrough.Load(filepath.Join(appDir, passthrough.FileName))
+		if err != nil {
+			return err
+		}
+		if entries := list.Entries(); len(entries) > 0 {
+			fmt.Printf("\n%s%s=== 自动直连 (%s) ===%s\n", bold, cyan, passthrough.FileName, reset)
+			for _, e := range entries {
+				fmt.Printf("  %s%s%s -> %s%s%s (学习于 %s，%s 过期)\n", green, e.Host, reset, cyan, e.Reason, reset,
+					e.Learned.Format("2006-01-02 15:04"), e.Expires.Format("2006-01-02 15:04"))
+			}
+		}
+
 		return nil
 	},
 }
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"snirect/internal/config"
+	"snirect/internal/learned"
+
+	"github.com/spf13/cobra"
+)
+
+var learnedCmd = &cobra.Command{
+	Use:   "learned",
+	Short: "List the alter_hostname rules learned by block detection",
+	Long: `Lists the rules that block_detection learned for hosts whose direct
+connections looked blocked, from learned.toml in the config directory. A running
+instance picks up changes made with "snirect learned forget" on its next reload.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		layer, err := loadLearned()
+		if err != nil {
+			return err
+		}
+		entries := layer.Entries()
+		if len(entries) == 0 {
+			fmt.Println("No learned rules")
+			return nil
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "HOST\tSNI\tREASON\tLEARNED\tEXPIRES")
+		for _, e := range entries {
+			sni := e.SNI
+			if sni == "" {
+				sni = "(stripped)"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", e.Host, sni, e.Reason,
+				e.Learned.Local().Format(time.DateTime), e.Expires.Local().Format(time.DateTime))
+		}
+		return tw.Flush()
+	},
+}
+
+var learnedForgetAll bool
+
+var learnedForgetCmd = &cobra.Command{
+	Use:   "forget [host...]",
+	Short: "Remove learned rules for the given hosts, or all with --all",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 && !learnedForgetAll {
+			return errors.New("name the hosts to forget, or pass --all")
+		}
+		if len(args) > 0 && learnedForgetAll {
+			return errors.New("--all takes no hosts")
+		}
+		layer, err := loadLearned()
+		if err != nil {
+			return err
+		}
+		n, err := layer.Remove(args...)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("[+] Removed %d learned rule(s)\n", n)
+		return nil
+	},
+}
+
+func loadLearned() (*learned.Layer, error) {
+	appDir, err := config.GetAppDataDir()
+	if err != nil {
+		return nil, err
+	}
+	return learned.Load(filepath.Join(appDir, learned.FileName))
+}
+
+func init() {
+	learnedForgetCmd.Flags().BoolVar(&learnedForgetAll, "all", false, "Remove every learned rule")
+	learnedCmd.AddCommand(learnedForgetCmd)
+	RootCmd.AddCommand(learnedCmd)
+}
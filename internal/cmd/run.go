@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	_ "net/http/pprof"
@@ -8,12 +9,22 @@ import (
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"sync"
+	"syscall"
 	"time"
 
+	"snirect/internal/accesslog"
+	"snirect/internal/admin"
 	"snirect/internal/cert"
 	"snirect/internal/config"
 	"snirect/internal/container"
+	"snirect/internal/interfaces"
+	"snirect/internal/learned"
 	"snirect/internal/logger"
+	"snirect/internal/pac"
+	"snirect/internal/passthrough"
+	"snirect/internal/proxy"
+	"snirect/internal/reload"
 	"snirect/internal/sysproxy"
 	"snirect/internal/update"
 
@@ -42,6 +53,12 @@ func runProxy(cmd *cobra.Command) error {
 		}
 	}
 
+	// Refuse an invalid or exposed configuration, as a reload would, before
+	// touching the CA or the system proxy.
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("%s: %w", filepath.Base(configPath), err)
+	}
+
 	if update.HasPendingUpdate(appDir) {
 		logger.Info("Pending update detected. Performing self-update...")
 		if err := update.PerformSelfUpdate(appDir); err != nil {
@@ -63,6 +80,7 @@ func runProxy(cmd *cobra.Command) error {
 			} else {
 				logger.Info("Rules auto-updated successfully")
 			}
+			mgr.Close()
 		}
 	}
 
@@ -101,6 +119,7 @@ func runProxy(cmd *cobra.Command) error {
 			} else if hasUpdate {
 				logger.Info("Update available: %s (auto-update disabled)", latestVersion)
 			}
+			mgr.Close()
 		}
 	}
 
@@ -151,6 +170,15 @@ func runProxy(cmd *cobra.Command) error {
 
 	logger.Info("Starting Snirect...")
 	logger.Info("Config directory: %s", appDir)
+	if content, err := os.ReadFile(filepath.Join(appDir, pac.LegacyFile)); err == nil && cfg.Server.PACTemplate == "" {
+		if pac.IsLegacyStock(content) {
+			logger.Info("The PAC script is now generated from the rules; %s is no longer used and can be deleted",
+				filepath.Join(appDir, pac.LegacyFile))
+		} else {
+			logger.Info("Using the edited %s as the PAC template; set server.pac_template to use another one",
+				filepath.Join(appDir, pac.LegacyFile))
+		}
+	}
 
 	// Load rules first (needed for container)
 	rules, err := config.LoadRules(rulesPath)
@@ -168,6 +196,7 @@ func runProxy(cmd *cobra.Command) error {
 		return fmt.Errorf("failed to initialize CA: %w", err)
 	}
 	cnt.SetCertManager(certMgr)
+	// Safety net for early returns; the normal path closes explicitly below.
 	defer cnt.Close()
 
 	switch cfg.CAInstall {
@@ -206,6 +235,36 @@ func runProxy(cmd *cobra.Command) error {
 	// Create proxy server via container (uses injected certMgr and resolver)
 	srv := cnt.GetProxyServer()
 
+	if cfg.Log.AccessLog != "" {
+		accessPath := cfg.Log.AccessLog
+		if !filepath.IsAbs(accessPath) {
+			accessPath = filepath.Join(appDir, accessPath)
+		}
+		accessLog, err := accesslog.Open(accessPath)
+		if err != nil {
+			logger.Warn("Access log disabled: %v", err)
+		} else {
+			defer accessLog.Close()
+			srv.AccessLog = accessLog
+			logger.Info("Access log: %s", accessPath)
+		}
+	}
+
+	if layer, err := learned.Load(filepath.Join(appDir, learned.FileName)); err != nil {
+		logger.Warn("Block detection cannot save rules: %v", err)
+	} else {
+		srv.Learned = layer
+	}
+
+	if list, err := passthrough.Load(filepath.Join(appDir, passthrough.FileName)); err != nil {
+		logger.Warn("Learned passthrough list ignored: %v", err)
+	} else {
+		srv.Passthrough = list
+		if n := len(list.Entries()); n > 0 {
+			logger.Info("Learned passthrough: %d host(s) tunnelled directly", n)
+		}
+	}
+
 	serverErr := make(chan error, 1)
 	go func() {
 		if err := srv.Start(); err != nil {
@@ -213,26 +272,178 @@ func runProxy(cmd *cobra.Command) error {
 		}
 	}()
 
+	// Edits to config.toml and rules.toml are applied on SIGHUP, when the
+	// files change, through the admin API and after automatic rules updates.
+	reloader := reload.New(configPath, rulesPath, func(newCfg *config.Config, newRules *config.Rules) {
+		cnt.Reload(newCfg, newRules)
+		if logLevel == "" {
+			logger.SetLevel(newCfg.Log.Level)
+		}
+	})
+	reloader.Learned = srv.Learned
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	if cfg.Reload.Watch {
+		go reloader.Watch(bgCtx, time.Duration(cfg.Reload.WatchInterval)*time.Second)
+	}
+	go autoFetchRules(bgCtx, appDir, srv, reloader)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-bgCtx.Done():
+				return
+			case <-hup:
+				reloader.Trigger("SIGHUP")
+			}
+		}
+	}()
+
+	// pacSet is also toggled through the admin API.
+	var pacMu sync.Mutex
+	pacSet := false
+	setSystemProxy := func(enable bool) error {
+		pacMu.Lock()
+		defer pacMu.Unlock()
+		if enable {
+			pacURL := fmt.Sprintf("http://127.0.0.1:%d/pac/?t=%d", cfg.Server.Port, time.Now().Unix())
+			sysproxy.SetPAC(pacURL)
+		} else {
+			sysproxy.ClearPAC()
+		}
+		pacSet = enable
+		return nil
+	}
 	if shouldSetProxy {
 		time.Sleep(100 * time.Millisecond)
-		pacURL := fmt.Sprintf("http://127.0.0.1:%d/pac/?t=%d", cfg.Server.Port, time.Now().Unix())
-		sysproxy.SetPAC(pacURL)
-		defer sysproxy.ClearPAC()
+		setSystemProxy(true)
+	}
+
+	if cfg.Admin.Listen != "" {
+		adminSrv, err := startAdmin(appDir, cfg, srv, cnt.GetResolver(), reloader, setSystemProxy)
+		if err != nil {
+			logger.Warn("Admin API disabled: %v", err)
+		} else {
+			defer adminSrv.Shutdown(context.Background())
+		}
 	}
 
 	printUsageInfo(cfg.Server.Port)
 
+	// SIGTERM is what systemd and launchd send on stop/restart.
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(c)
 
+	var runErr error
 	select {
 	case err := <-serverErr:
-		return fmt.Errorf("server failed: %w", err)
-	case <-c:
-		logger.Info("Shutting down...")
+		runErr = fmt.Errorf("server failed: %w", err)
+	case sig := <-c:
+		logger.Info("Received %v, shutting down...", sig)
 	}
 
-	return nil
+	// Stop routing clients to us before draining, so no new tunnels arrive.
+	pacMu.Lock()
+	if pacSet {
+		sysproxy.ClearPAC()
+		pacSet = false
+	}
+	pacMu.Unlock()
+
+	grace := time.Duration(cfg.Timeout.Shutdown) * time.Second
+	if grace <= 0 {
+		grace = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Warn("Tunnels did not drain within %v: %v", grace, err)
+	}
+
+	if err := cnt.Close(); err != nil {
+		logger.Warn("Cleanup failed: %v", err)
+	}
+	logger.Info("Shutdown complete")
+
+	return runErr
+}
+
+// startAdmin serves the admin API on cfg.Admin.Listen. Reloads go through
+// reloader, so an invalid file is reported and leaves the running
+// configuration untouched.
+func startAdmin(appDir string, cfg *config.Config, srv *proxy.ProxyServer, resolver interfaces.Resolver, reloader *reload.Reloader, setSystemProxy func(bool) error) (*admin.Server, error) {
+	token, err := admin.EnsureToken(appDir, cfg.Admin.Token)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := admin.Listen(cfg.Admin.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	adminSrv := &admin.Server{
+		Proxy:    srv,
+		Resolver: resolver,
+		Token:    token,
+		Reload:   func() error { return reloader.Trigger("admin API") },
+		FetchRules: func() error {
+			mgr := update.NewManager(srv.EffectiveConfig(), &config.Rules{})
+			defer mgr.Close()
+			if err := mgr.FetchRules(appDir); err != nil {
+				return err
+			}
+			return reloader.Trigger("rules update")
+		},
+		SetSystemProxy: setSystemProxy,
+	}
+	go func() {
+		if err := adminSrv.Serve(ln); err != nil {
+			logger.Error("Admin API stopped: %v", err)
+		}
+	}()
+	logger.Info("Admin API listening on %s", cfg.Admin.Listen)
+	return adminSrv, nil
+}
+
+// autoFetchRules downloads the upstream rules whenever the check interval has
+// passed and update.auto_update_rules is on, then reloads them. Both settings
+// are read from the running configuration, so they follow reloads.
+func autoFetchRules(ctx context.Context, appDir string, srv *proxy.ProxyServer, reloader *reload.Reloader) {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		cfg := srv.EffectiveConfig()
+		if !cfg.Update.AutoUpdateRules {
+			continue
+		}
+		shouldCheck, err := config.ShouldCheckRules(appDir, time.Duration(cfg.Update.RulesCheckIntervalHours)*time.Hour)
+		if err != nil {
+			logger.Warn("Failed to check rules timestamp: %v", err)
+			continue
+		}
+		if !shouldCheck {
+			continue
+		}
+		logger.Info("Checking for rules updates...")
+		mgr := update.NewManager(cfg, &config.Rules{})
+		err = mgr.FetchRules(appDir)
+		mgr.Close()
+		if err != nil {
+			logger.Warn("Auto rules update failed: %v", err)
+			continue
+		}
+		reloader.Trigger("rules update")
+	}
 }
 
 func printUsageInfo(port int) {
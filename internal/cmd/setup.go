@@ -101,7 +101,6 @@ var resetConfigCmd = &cobra.Command{
 受影响的文件：
   - config.toml (主配置)
   - rules.toml (SNI 分流规则)
-  - pac (代理自动配置脚本)
 
 您的证书文件 (certs/ 目录下) 不会受到影响。`,
 	Example: `  snirect reset-config       # 重置为默认设置`,
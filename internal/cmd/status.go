@@ -1,15 +1,19 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"snirect/internal/admin"
 	"snirect/internal/config"
 	"snirect/internal/logger"
 	"snirect/internal/sysproxy"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -55,6 +59,12 @@ func printStatus() {
 	} else {
 		fmt.Printf("  配置状态: %s%s%s\n", green, "[+] 已加载", reset)
 		fmt.Printf("  服务器端口: %s%d%s\n", cyan, cfg.Server.Port, reset)
+		if cfg.Server.SocksPort > 0 {
+			fmt.Printf("  SOCKS5 端口: %s%d%s\n", cyan, cfg.Server.SocksPort, reset)
+		}
+		if cfg.Server.TransparentPort > 0 {
+			fmt.Printf("  透明代理端口: %s%d%s (%s)\n", cyan, cfg.Server.TransparentPort, reset, cfg.Server.TransparentMode)
+		}
 	}
 	fmt.Println()
 
@@ -101,6 +111,31 @@ func printStatus() {
 	fmt.Printf("%s服务状态:%s\n", bold, reset)
 	serviceStatus := checkServiceStatus()
 	fmt.Printf("  状态: %s\n", serviceStatus)
+	if c, err := newAdminClient(); err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		conns, err := c.Connections(ctx)
+		var bw *admin.Bandwidth
+		if err == nil {
+			bw, err = c.Bandwidth(ctx)
+		}
+		cancel()
+		if err == nil {
+			fmt.Printf("  活动连接: %s%d%s (snirect admin conns)\n", cyan, len(conns), reset)
+			t := bw.Total
+			limits := ""
+			if t.UploadLimit > 0 || t.DownloadLimit > 0 {
+				limits = fmt.Sprintf("限速 ↑ %s  ↓ %s, ", formatLimit(t.UploadLimit), formatLimit(t.DownloadLimit))
+			}
+			fmt.Printf("  当前吞吐: %s↑ %s  ↓ %s%s (%ssnirect admin bandwidth)\n", cyan,
+				formatRate(t.Upload), formatRate(t.Download), reset, limits)
+		} else {
+			fmt.Printf("  管理接口: %s%s%s (%v)\n", yellow, "[!] 无法连接", reset, err)
+		}
+	} else if errors.Is(err, errAdminDisabled) {
+		fmt.Printf("  管理接口: %s%s%s (在 config.toml 中设置 admin.listen 后可查看连接与吞吐)\n", yellow, "[-] 未开启", reset)
+	} else {
+		fmt.Printf("  管理接口: %s%s%s (%v)\n", yellow, "[!] 不可用", reset, err)
+	}
 	fmt.Println()
 
 	// 5. Check modules
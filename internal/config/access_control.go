@@ -0,0 +1,133 @@
+package config
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// ParseClientPrefix parses an entry of access_control.allow or deny: a CIDR
+// such as "192.168.1.0/24", or a single IP.
+func ParseClientPrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ClientFilter is the parsed form of access_control.allow and deny.
+type ClientFilter struct {
+	allow, deny []netip.Prefix
+}
+
+// ClientFilter parses Allow and Deny. Invalid entries, rejected by Validate,
+// are left out.
+func (a *AccessControlConfig) ClientFilter() *ClientFilter {
+	return &ClientFilter{allow: parsePrefixes(a.Allow), deny: parsePrefixes(a.Deny)}
+}
+
+func parsePrefixes(entries []string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, entry := range entries {
+		if p, err := ParseClientPrefix(entry); err == nil {
+			prefixes = append(prefixes, p)
+		}
+	}
+	return prefixes
+}
+
+// AllowsClient reports whether a client at ip may connect: it must not match
+// deny and, when allow is set, must match allow.
+func (f *ClientFilter) AllowsClient(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if matchPrefixes(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || matchPrefixes(f.allow, ip)
+}
+
+// Empty reports whether the filter lets every client through.
+func (f *ClientFilter) Empty() bool {
+	return len(f.allow) == 0 && len(f.deny) == 0
+}
+
+func matchPrefixes(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate reports whether user and password match an entry of Users.
+func (a *AccessControlConfig) Authenticate(user, password string) bool {
+	want, ok := a.Users[user]
+	return ok && subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+}
+
+// Protected reports whether clients are restricted by users or an allow list.
+func (a *AccessControlConfig) Protected() bool {
+	return len(a.Users) > 0 || len(a.Allow) > 0
+}
+
+func (a *AccessControlConfig) validate() error {
+	for _, list := range []struct {
+		name    string
+		entries []string
+	}{{"allow", a.Allow}, {"deny", a.Deny}} {
+		for _, entry := range list.entries {
+			if _, err := ParseClientPrefix(entry); err != nil {
+				return fmt.Errorf("access_control.%s: invalid entry %q", list.name, entry)
+			}
+		}
+	}
+	for user := range a.Users {
+		if user == "" || strings.Contains(user, ":") {
+			return fmt.Errorf("access_control.users: invalid user name %q", user)
+		}
+	}
+	if a.MaxConnsPerClient < 0 {
+		return fmt.Errorf("access_control.max_connections_per_client: %d is negative", a.MaxConnsPerClient)
+	}
+	return nil
+}
+
+// CheckExposure refuses a non-loopback server.address when no access
+// control is configured, unless access_control.allow_unprotected is set.
+// Redirected connections cannot authenticate, so an exposed transparent_port
+// needs an allow list.
+func (c *Config) CheckExposure() error {
+	acl := &c.AccessControl
+	if isLoopbackHost(c.Server.Address) || acl.AllowUnprotected {
+		return nil
+	}
+	if !acl.Protected() {
+		return fmt.Errorf("server.address %q is reachable from other machines but [access_control] sets neither users nor allow; "+
+			"configure one of them, or set allow_unprotected = true to share the proxy with anyone", c.Server.Address)
+	}
+	if c.Server.TransparentPort > 0 && len(acl.Allow) == 0 {
+		return fmt.Errorf("server.transparent_port is reachable from other machines but redirected connections cannot authenticate; " +
+			"list the redirected clients in access_control.allow, or set allow_unprotected = true to share the proxy with anyone")
+	}
+	return nil
+}
+
+// isLoopbackHost reports whether a listener on host only accepts local
+// clients. An empty host listens on every interface.
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	addr, err := netip.ParseAddr(host)
+	return err == nil && addr.IsLoopback()
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestAllowsClient(t *testing.T) {
+	acl := (&AccessControlConfig{
+		Allow: []string{"192.168.1.0/24", "10.0.0.5"},
+		Deny:  []string{"192.168.1.66"},
+	}).ClientFilter()
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"192.168.1.20", true},
+		{"10.0.0.5", true},
+		{"::ffff:192.168.1.20", true},
+		{"192.168.1.66", false}, // Deny wins over Allow
+		{"10.0.0.6", false},
+		{"203.0.113.1", false},
+	}
+	for _, tt := range tests {
+		if got := acl.AllowsClient(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("AllowsClient(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	open := (&AccessControlConfig{Deny: []string{"203.0.113.0/24"}}).ClientFilter()
+	if !open.AllowsClient(netip.MustParseAddr("198.51.100.1")) {
+		t.Error("an empty allow list refused a client")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	acl := &AccessControlConfig{Users: map[string]string{"phone": "s3cret"}}
+	if !acl.Authenticate("phone", "s3cret") {
+		t.Error("valid credentials refused")
+	}
+	if acl.Authenticate("phone", "s3cre") || acl.Authenticate("tablet", "s3cret") {
+		t.Error("invalid credentials accepted")
+	}
+}
+
+func TestCheckExposure(t *testing.T) {
+	tests := []struct {
+		address     string
+		transparent int
+		acl         AccessControlConfig
+		wantErr     bool
+	}{
+		{"127.0.0.1", 0, AccessControlConfig{}, false},
+		{"::1", 0, AccessControlConfig{}, false},
+		{"localhost", 0, AccessControlConfig{}, false},
+		{"0.0.0.0", 0, AccessControlConfig{}, true},
+		{"", 0, AccessControlConfig{}, true},
+		{"192.168.1.2", 0, AccessControlConfig{Deny: []string{"192.168.1.9"}}, true},
+		{"0.0.0.0", 0, AccessControlConfig{Allow: []string{"192.168.1.0/24"}}, false},
+		{"0.0.0.0", 0, AccessControlConfig{Users: map[string]string{"phone": "s3cret"}}, false},
+		{"0.0.0.0", 0, AccessControlConfig{AllowUnprotected: true}, false},
+		// Redirected connections cannot authenticate.
+		{"0.0.0.0", 7655, AccessControlConfig{Users: map[string]string{"phone": "s3cret"}}, true},
+		{"0.0.0.0", 7655, AccessControlConfig{Allow: []string{"192.168.1.0/24"}}, false},
+		{"0.0.0.0", 7655, AccessControlConfig{AllowUnprotected: true}, false},
+		{"127.0.0.1", 7655, AccessControlConfig{}, false},
+	}
+	for _, tt := range tests {
+		cfg := &Config{Server: ServerConfig{Address: tt.address, TransparentPort: tt.transparent}, AccessControl: tt.acl}
+		if err := cfg.CheckExposure(); (err != nil) != tt.wantErr {
+			t.Errorf("CheckExposure(%q, %d, %+v) = %v, want error %v", tt.address, tt.transparent, tt.acl, err, tt.wantErr)
+		}
+	}
+}
@@ -92,6 +92,157 @@ type Config struct {
 
 	// Security contains certificate verification hardening settings.
 	Security SecurityConfig `toml:"security"`
+
+	// Outbound contains settings for connections made to remote servers.
+	Outbound OutboundConfig `toml:"outbound"`
+
+	// Admin contains settings for the admin API of the running instance.
+	Admin AdminConfig `toml:"admin"`
+
+	// Reload contains settings for applying config and rules edits at runtime.
+	Reload ReloadConfig `toml:"reload"`
+
+	// AccessControl restricts which clients may use the proxy.
+	AccessControl AccessControlConfig `toml:"access_control"`
+
+	// ECH controls Encrypted Client Hello on remote connections.
+	ECH ECHConfig `toml:"ech"`
+
+	// Fingerprint selects the ClientHello profile of remote connections.
+	Fingerprint FingerprintConfig `toml:"fingerprint"`
+
+	// Resumption controls TLS session resumption with remotes and clients.
+	Resumption ResumptionConfig `toml:"resumption"`
+
+	// Warmup keeps pre-dialed remote connections for the busiest hosts.
+	Warmup WarmupConfig `toml:"warmup"`
+
+	// Passthrough controls learning which hosts MITM breaks.
+	Passthrough PassthroughConfig `toml:"passthrough"`
+
+	// BlockDetection controls learning SNI rewrites for blocked hosts.
+	BlockDetection BlockDetectionConfig `toml:"block_detection"`
+
+	// Bandwidth caps the throughput of tunnels.
+	Bandwidth BandwidthConfig `toml:"bandwidth"`
+}
+
+// ResumptionConfig controls TLS session resumption, which saves a round trip
+// and the key exchange on the many short connections browsers open.
+type ResumptionConfig struct {
+	SessionCacheSize  int `toml:"session_cache_size"`  // Remote TLS sessions kept, keyed by IP and SNI (0 = disabled)
+	TicketKeyRotation int `toml:"ticket_key_rotation"` // Hours between rotations of the client-facing session ticket key (0 = no tickets)
+}
+
+// WarmupConfig controls pre-dialed remote connections: after a connection to
+// one of the busiest hosts, another one is dialed and handshaken in advance
+// for the next client.
+type WarmupConfig struct {
+	Hosts   int `toml:"hosts"`    // How many of the busiest hosts to keep warm (0 = disabled)
+	MaxIdle int `toml:"max_idle"` // Seconds a pre-dialed connection may wait before it is closed
+}
+
+// PassthroughConfig controls the learned passthrough list: hosts whose remote
+// asks for a client certificate, or whose client refuses the MITM
+// certificate, are tunnelled directly for a while.
+type PassthroughConfig struct {
+	Learn bool `toml:"learn"` // Learn hosts that MITM breaks
+	TTL   int  `toml:"ttl"`   // Hours a learned host stays on the list
+}
+
+// BlockDetectionConfig controls the blocking learner: a direct tunnel whose
+// remote resets or ignores the ClientHello has its host probed with a
+// stripped or rewritten SNI, and a working SNI is learned as an
+// alter_hostname rule, see package learned.
+type BlockDetectionConfig struct {
+	Enabled bool `toml:"enabled"` // Watch direct tunnels for blocking
+	Timeout int  `toml:"timeout"` // Seconds without an answer to the ClientHello that count as blocked
+	TTL     int  `toml:"ttl"`     // Hours a learned rule is kept
+}
+
+// BandwidthConfig caps tunnel throughput in KiB/s, 0 meaning unlimited. Upload
+// is client to remote, download remote to client. The [bandwidth] rules cap
+// the hosts of each pattern on top of these.
+type BandwidthConfig struct {
+	Upload         int `toml:"upload"`          // All tunnels together
+	Download       int `toml:"download"`        // All tunnels together
+	ClientUpload   int `toml:"client_upload"`   // The tunnels of each client IP
+	ClientDownload int `toml:"client_download"` // The tunnels of each client IP
+}
+
+// ClientHello profiles for fingerprint.profile and the [fingerprint] rules.
+const (
+	FingerprintGo         = "go-default" // Go's own ClientHello
+	FingerprintChrome     = "chrome"     // The ClientHello of current Chrome, via uTLS
+	FingerprintFirefox    = "firefox"    // The ClientHello of current Firefox, via uTLS
+	FingerprintSafari     = "safari"     // The ClientHello of current Safari, via uTLS
+	FingerprintRandomized = "randomized" // Different cipher suites and groups on every connection
+)
+
+// FingerprintConfig selects the ClientHello profile used for remote TLS
+// connections and upstream requests, so they look less like a Go client.
+type FingerprintConfig struct {
+	// Profile applies to hosts without a [fingerprint] rule: go-default,
+	// chrome, firefox, safari or randomized.
+	Profile string `toml:"profile"`
+}
+
+// ECH modes for ech.mode and the [ech] rules.
+const (
+	ECHOff         = "off"              // Never use ECH
+	ECHOnly        = "ech"              // Require ECH; fail when the host publishes no usable ECH configs
+	ECHThenRewrite = "ech-then-rewrite" // Try ECH, fall back to [alter_hostname] and [sni_fallback]
+)
+
+// ECHConfig controls Encrypted Client Hello (ECH) on intercepted remote
+// connections and upstream requests. ECH configs come from the host's HTTPS
+// DNS record and hide the real SNI without a fake one.
+type ECHConfig struct {
+	// Mode applies to hosts without an [ech] rule: off, ech or ech-then-rewrite.
+	Mode string `toml:"mode"`
+}
+
+// AccessControlConfig restricts who may use the proxy listeners, for sharing
+// Snirect on a LAN.
+type AccessControlConfig struct {
+	// Users maps user names to passwords. When set, clients must send Basic
+	// Proxy-Authorization (SOCKS5: username/password); loopback clients are exempt.
+	Users map[string]string `toml:"users"`
+	// Allow lists the client CIDRs or IPs that may connect (empty = any).
+	Allow []string `toml:"allow"`
+	// Deny lists client CIDRs or IPs that are refused, even if allowed.
+	Deny []string `toml:"deny"`
+	// MaxConnsPerClient caps the concurrent tunnels of one client IP (0 = unlimited).
+	MaxConnsPerClient int `toml:"max_connections_per_client"`
+	// AllowUnprotected lets the proxy listen on a non-loopback address without
+	// users or an allow list.
+	AllowUnprotected bool `toml:"allow_unprotected"`
+}
+
+// ReloadConfig controls hot reloading of config.toml and rules.toml.
+type ReloadConfig struct {
+	// Watch reloads both files when either changes on disk. SIGHUP, the admin
+	// API and automatic rules updates reload regardless.
+	Watch bool `toml:"watch"`
+	// WatchInterval is how often the files are checked, in seconds (default 2).
+	WatchInterval int `toml:"watch_interval"`
+}
+
+// AdminConfig controls the local admin API used by "snirect admin".
+type AdminConfig struct {
+	// Listen is a loopback "host:port" or "unix:/path/to/socket" (empty = disabled).
+	Listen string `toml:"listen"`
+	// Token authenticates requests as a Bearer token. When empty, a random
+	// token is kept in admin.token in the config directory.
+	Token string `toml:"token"`
+}
+
+// OutboundConfig controls how remote connections are dialed.
+type OutboundConfig struct {
+	// Proxy chains every remote dial through an upstream proxy, given as
+	// socks5://, socks5h:// or http:// URL (empty = dial directly).
+	// The [outbound_proxy] rules override it per host.
+	Proxy string `toml:"proxy"`
 }
 
 // SecurityConfig controls zero-trust certificate verification.
@@ -157,8 +308,14 @@ type PreferenceConfig struct {
 
 // TimeoutConfig contains timeout settings in seconds.
 type TimeoutConfig struct {
-	Dial int `toml:"dial"` // Dial timeout for remote connections
-	DNS  int `toml:"dns"`  // DNS query timeout
+	Dial     int `toml:"dial"`     // Dial timeout for remote connections
+	DNS      int `toml:"dns"`      // DNS query timeout
+	Shutdown int `toml:"shutdown"` // Grace period for draining tunnels on shutdown
+
+	ClientHandshake int `toml:"client_handshake"` // Client request/TLS handshake deadline (0 = none)
+	RemoteHandshake int `toml:"remote_handshake"` // Remote TLS handshake deadline (0 = none)
+	Idle            int `toml:"idle"`             // Close tunnels without traffic for this long (0 = never)
+	MaxLifetime     int `toml:"max_lifetime"`     // Close tunnels older than this (0 = never)
 }
 
 // LimitConfig contains resource limit settings.
@@ -175,8 +332,9 @@ type DNSConfig struct {
 
 // LogConfig contains logging settings.
 type LogConfig struct {
-	Level string `toml:"loglevel"` // Log level (DEBUG, INFO, WARN, ERROR)
-	File  string `toml:"logfile"`  // Path to log file
+	Level     string `toml:"loglevel"`   // Log level (DEBUG, INFO, WARN, ERROR)
+	File      string `toml:"logfile"`    // Path to log file
+	AccessLog string `toml:"access_log"` // Path to the JSONL access log, one record per connection (empty = disabled)
 }
 
 // ServerConfig contains proxy server settings.
@@ -185,6 +343,18 @@ type ServerConfig struct {
 	Port       int    `toml:"port"`        // Listen port
 	PACHost    string `toml:"pac_host"`    // Hostname for PAC file generation
 	BufferSize int    `toml:"buffer_size"` // Tunnel copy buffer size in bytes (default 65536, min 4096, max 1048576)
+	SocksPort  int    `toml:"socks_port"`  // SOCKS5 listen port (0 = disabled)
+
+	PACTemplate       string `toml:"pac_template"`        // text/template file for /pac/, relative to the config directory (empty = built-in)
+	PACDirectFallback bool   `toml:"pac_direct_fallback"` // Append "; DIRECT" to the PAC proxy so browsers go direct when Snirect is down
+
+	TransparentPort int    `toml:"transparent_port"` // Linux transparent proxy listen port (0 = disabled)
+	TransparentMode string `toml:"transparent_mode"` // "redirect" (SO_ORIGINAL_DST) or "tproxy"
+
+	InterceptPorts []int `toml:"intercept_ports"` // CONNECT ports eligible for MITM (default [443]); [ports] rules override per host
+	DetectTLS      bool  `toml:"detect_tls"`      // Treat every port as eligible and MITM only when a ClientHello arrives
+
+	Metrics bool `toml:"metrics"` // Serve Prometheus metrics at /metrics on the proxy listener
 }
 
 // GetDefaultLogPath returns the platform-specific default log file path.
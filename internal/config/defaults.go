@@ -17,6 +17,3 @@ var UserRulesTOML = ruleslib.UserRulesTOML
 
 //go:embed config.toml
 var SampleConfigTOML string
-
-//go:embed pac
-var DefaultPAC string
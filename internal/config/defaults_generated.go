@@ -14,8 +14,12 @@ var PreparsedDefaultConfig = Config{
 		BootstrapDNS: []string{"tls://223.5.5.5"},
 	},
 	Timeout: TimeoutConfig{
-		Dial: 30,
-		DNS:  5,
+		Dial:            30,
+		DNS:             5,
+		Shutdown:        10,
+		ClientHandshake: 10,
+		RemoteHandshake: 10,
+		Idle:            300,
 	},
 	Limit: LimitConfig{
 		DNSCacheSize: 10000,
@@ -24,9 +28,12 @@ var PreparsedDefaultConfig = Config{
 		Level: "INFO",
 	},
 	Server: ServerConfig{
-		Address: "127.0.0.1",
-		Port:    7654,
-		PACHost: "127.0.0.1",
+		Address:           "127.0.0.1",
+		Port:              7654,
+		PACHost:           "127.0.0.1",
+		PACDirectFallback: true,
+		TransparentMode:   "redirect",
+		InterceptPorts:    []int{443},
 	},
 	Preference: PreferenceConfig{
 		Mode:          "standard",
@@ -51,4 +58,32 @@ var PreparsedDefaultConfig = Config{
 		CheckEKU:       true,
 		CheckValidity:  true,
 	},
+	Reload: ReloadConfig{
+		Watch:         true,
+		WatchInterval: 2,
+	},
+	AccessControl: AccessControlConfig{
+		Allow: []string{},
+		Deny:  []string{},
+	},
+	ECH: ECHConfig{
+		Mode: "off",
+	},
+	Fingerprint: FingerprintConfig{
+		Profile: "go-default",
+	},
+	Resumption: ResumptionConfig{
+		SessionCacheSize:  1024,
+		TicketKeyRotation: 24,
+	},
+	Warmup: WarmupConfig{
+		MaxIdle: 30,
+	},
+	Passthrough: PassthroughConfig{
+		TTL: 168,
+	},
+	BlockDetection: BlockDetectionConfig{
+		Timeout: 10,
+		TTL:     168,
+	},
 }
@@ -4,22 +4,74 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"snirect/internal/learned"
 	"snirect/internal/logger"
 
 	"github.com/pelletier/go-toml/v2"
 	ruleslib "github.com/xihale/snirect-shared/rules"
 )
 
+// Rules wraps the shared rules with the tables only Snirect understands.
 type Rules struct {
 	*ruleslib.Rules
+
+	// HTTPUpgrade lists patterns whose plain-HTTP requests are answered with a
+	// redirect to HTTPS instead of being forwarded: pattern -> enabled.
+	HTTPUpgrade map[string]bool
+
+	// Fragment lists patterns whose direct tunnels split the ClientHello
+	// instead of being intercepted: pattern -> strategy.
+	Fragment map[string]FragmentStrategy
+
+	// OutboundProxy lists patterns whose remote dials go through an upstream
+	// proxy: pattern -> proxy URL, or "direct" to bypass the global proxy.
+	OutboundProxy map[string]string
+
+	// Ports lists patterns whose CONNECTs may be intercepted on other ports
+	// than intercept_ports: pattern -> ports.
+	Ports map[string][]int
+
+	// SNIFallback lists patterns whose remote handshake retries with other
+	// SNIs when the one from alter_hostname fails: pattern -> candidates.
+	SNIFallback map[string][]string
+
+	// HTTPMode lists patterns whose intercepted connections are parsed as
+	// HTTP so headers can be rewritten: pattern -> settings, nil to exempt.
+	HTTPMode map[string]*HTTPMode
+
+	// ECH lists patterns whose remote handshakes use Encrypted Client Hello:
+	// pattern -> ech, ech-then-rewrite or off.
+	ECH map[string]string
+
+	// Fingerprint lists patterns whose remote handshakes use a ClientHello
+	// profile other than fingerprint.profile: pattern -> profile.
+	Fingerprint map[string]string
+
+	// Bandwidth lists patterns whose hosts have their tunnels' throughput
+	// capped, each host on its own: pattern -> limits.
+	Bandwidth map[string]BandwidthLimit
 }
 
+// LoadRules loads the built-in and fetched rules, the learned layer next to
+// path (see package learned) and the user's rules at path, each overriding
+// the ones before.
 func LoadRules(path string) (*Rules, error) {
 	baseRules, err := ruleslib.LoadRules()
 	if err != nil {
 		return nil, fmt.Errorf("failed to load base rules: %w", err)
 	}
 
+	layer, err := learned.Load(filepath.Join(filepath.Dir(path), learned.FileName))
+	if err != nil {
+		logger.Warn("Ignoring learned rules: %v", err)
+	}
+	if alter := layer.AlterHostname(); len(alter) > 0 {
+		learnedRules := ruleslib.NewRules()
+		learnedRules.AlterHostname = alter
+		ruleslib.ApplyOverrides(baseRules, learnedRules, ruleslib.DefaultAutoMarker)
+	}
+
 	data, err := os.ReadFile(path)
 	if os.IsNotExist(err) {
 		return &Rules{Rules: baseRules}, nil
@@ -34,12 +86,23 @@ func LoadRules(path string) (*Rules, error) {
 	}
 
 	ruleslib.ApplyOverrides(baseRules, userRules, ruleslib.DefaultAutoMarker)
-	return &Rules{Rules: baseRules}, nil
+	rules := &Rules{Rules: baseRules}
+	if err := rules.loadExtensions(data); err != nil {
+		return nil, fmt.Errorf("failed to parse user rules: %w", err)
+	}
+	return rules, nil
 }
 
 // LoadConfig loads configuration from a file.
 func LoadConfig(path string) (*Config, error) {
 	cfg := PreparsedDefaultConfig
+	// The decoder reuses slice backing arrays; copy them so that user values
+	// cannot overwrite the shared defaults.
+	cfg.DNS.Nameserver = slices.Clone(cfg.DNS.Nameserver)
+	cfg.DNS.BootstrapDNS = slices.Clone(cfg.DNS.BootstrapDNS)
+	cfg.Server.InterceptPorts = slices.Clone(cfg.Server.InterceptPorts)
+	cfg.AccessControl.Allow = slices.Clone(cfg.AccessControl.Allow)
+	cfg.AccessControl.Deny = slices.Clone(cfg.AccessControl.Deny)
 	if cfg.Log.File == "" {
 		cfg.Log.File = GetDefaultLogPath()
 	}
@@ -64,6 +127,60 @@ func LoadConfig(path string) (*Config, error) {
 	return &cfg, nil
 }
 
+// Validate reports settings that LoadConfig accepts but that the program
+// could not use, such as an unknown mode or a malformed proxy URL.
+func (c *Config) Validate() error {
+	if _, err := ParseCertPolicy(c.CheckHostname); err != nil {
+		return fmt.Errorf("check_hostname: %w", err)
+	}
+	switch c.CAInstall {
+	case "", "auto", "always", "never":
+	default:
+		return fmt.Errorf("ca_install: invalid value %q (expected auto, always or never)", c.CAInstall)
+	}
+	switch c.Preference.Mode {
+	case "", IPPreferenceStandard, IPPreferenceFastest, IPPreferenceIPv6, IPPreferenceIPv4:
+	default:
+		return fmt.Errorf("preference.mode: invalid value %q", c.Preference.Mode)
+	}
+	if !ValidECHMode(c.ECH.Mode) {
+		return fmt.Errorf("ech.mode: invalid value %q", c.ECH.Mode)
+	}
+	if !ValidFingerprint(c.Fingerprint.Profile) {
+		return fmt.Errorf("fingerprint.profile: invalid value %q", c.Fingerprint.Profile)
+	}
+	switch c.Server.TransparentMode {
+	case "", "redirect", "tproxy":
+	default:
+		return fmt.Errorf("server.transparent_mode: invalid value %q", c.Server.TransparentMode)
+	}
+	for _, p := range []struct {
+		name string
+		port int
+	}{{"port", c.Server.Port}, {"socks_port", c.Server.SocksPort}, {"transparent_port", c.Server.TransparentPort}} {
+		if p.port < 0 || p.port > 65535 {
+			return fmt.Errorf("server.%s: %d is not a valid port", p.name, p.port)
+		}
+	}
+	if c.Outbound.Proxy != "" {
+		if _, err := ParseProxyURL(c.Outbound.Proxy); err != nil {
+			return fmt.Errorf("outbound.proxy: %w", err)
+		}
+	}
+	for _, l := range []struct {
+		name  string
+		limit int
+	}{{"upload", c.Bandwidth.Upload}, {"download", c.Bandwidth.Download}, {"client_upload", c.Bandwidth.ClientUpload}, {"client_download", c.Bandwidth.ClientDownload}} {
+		if l.limit < 0 {
+			return fmt.Errorf("bandwidth.%s: %d is negative", l.name, l.limit)
+		}
+	}
+	if err := c.AccessControl.validate(); err != nil {
+		return err
+	}
+	return c.CheckExposure()
+}
+
 // EnsureConfig ensures default config files exist.
 func EnsureConfig(force bool) (string, error) {
 	appDir, err := GetAppDataDir()
@@ -80,9 +197,6 @@ func EnsureConfig(force bool) (string, error) {
 	if err := ensureFile(filepath.Join(appDir, "rules.toml"), UserRulesTOML, force); err != nil {
 		return "", err
 	}
-	if err := ensureFile(filepath.Join(appDir, "pac"), DefaultPAC, force); err != nil {
-		return "", err
-	}
 
 	return appDir, nil
 }
@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -56,3 +57,57 @@ auto_check_update = false
 		t.Errorf("RulesCheckIntervalHours = %d; want 24", cfg.Update.RulesCheckIntervalHours)
 	}
 }
+
+// TestLoadConfigKeepsDefaultSlices ensures that list values from the user
+// config do not overwrite the shared defaults.
+func TestLoadConfigKeepsDefaultSlices(t *testing.T) {
+	cfgPath := filepath.Join(t.TempDir(), "config.toml")
+	content := `[server]
+intercept_ports = [8443, 2053]
+`
+	if err := os.WriteFile(cfgPath, []byte(content), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	cfg, err := LoadConfig(cfgPath)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if len(cfg.Server.InterceptPorts) != 2 || cfg.Server.InterceptPorts[0] != 8443 {
+		t.Errorf("InterceptPorts = %v; want [8443 2053]", cfg.Server.InterceptPorts)
+	}
+	if got := PreparsedDefaultConfig.Server.InterceptPorts; len(got) != 1 || got[0] != 443 {
+		t.Errorf("default InterceptPorts changed to %v", got)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := PreparsedDefaultConfig
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("default config: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+	}{
+		{"ca_install", func(c *Config) { c.CAInstall = "sometimes" }},
+		{"check_hostname", func(c *Config) { c.CheckHostname = 42 }},
+		{"preference.mode", func(c *Config) { c.Preference.Mode = "slowest" }},
+		{"transparent_mode", func(c *Config) { c.Server.TransparentMode = "magic" }},
+		{"socks_port", func(c *Config) { c.Server.SocksPort = 70000 }},
+		{"outbound.proxy", func(c *Config) { c.Outbound.Proxy = "ftp://proxy:21" }},
+		{"access_control.allow", func(c *Config) { c.AccessControl.Allow = []string{"192.168.1.0/33"} }},
+		{"access_control.users", func(c *Config) { c.AccessControl.Users = map[string]string{"a:b": "x"} }},
+		{"server.address", func(c *Config) { c.Server.Address = "0.0.0.0" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := PreparsedDefaultConfig
+			tt.modify(&c)
+			if err := c.Validate(); err == nil || !strings.Contains(err.Error(), tt.name) {
+				t.Errorf("Validate() = %v, want an error about %s", err, tt.name)
+			}
+		})
+	}
+}
@@ -0,0 +1,374 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"golang.org/x/net/http/httpguts"
+)
+
+// extRulesTOML holds the rule tables that only Snirect understands and that
+// the shared rules library therefore ignores.
+type extRulesTOML struct {
+	HTTPUpgrade map[string]bool             `toml:"http_upgrade"`
+	Fragment    map[string]FragmentStrategy `toml:"fragment"`
+
+	OutboundProxy map[string]string `toml:"outbound_proxy"`
+	Ports         map[string][]int  `toml:"ports"`
+
+	SNIFallback map[string][]string `toml:"sni_fallback"`
+
+	HTTPMode map[string]httpModeTOML `toml:"http_mode"`
+
+	ECH map[string]string `toml:"ech"`
+
+	Fingerprint map[string]string `toml:"fingerprint"`
+
+	Bandwidth map[string]BandwidthLimit `toml:"bandwidth"`
+}
+
+// Fragment modes for FragmentStrategy.Mode.
+const (
+	FragmentTLS  = "tls"  // Split into several TLS records sent together
+	FragmentTCP  = "tcp"  // Keep the records, split the bytes into TCP segments
+	FragmentBoth = "both" // Split into TLS records, each sent as its own TCP segment
+	FragmentOff  = "off"  // Disable fragmentation, e.g. to exempt a subdomain
+)
+
+// FragmentStrategy describes how a direct tunnel forwards the client's
+// ClientHello in pieces so that SNI-based filtering cannot match it.
+type FragmentStrategy struct {
+	Mode      string `toml:"mode"`       // tls, tcp, both or off (default tls)
+	SNIPoints []int  `toml:"sni_points"` // Split offsets inside the SNI host name, negative from its end (default: the middle)
+	Size      int    `toml:"size"`       // Also split every Size bytes of the ClientHello (0 = only at SNIPoints)
+	DelayMs   int    `toml:"delay_ms"`   // Pause between TCP segments in milliseconds
+}
+
+// BandwidthLimit caps the throughput of the tunnels of a pattern's hosts
+// together in KiB/s, 0 meaning unlimited.
+type BandwidthLimit struct {
+	Upload   int `toml:"upload"`   // Client to remote
+	Download int `toml:"download"` // Remote to client
+}
+
+// HTTPMode describes how intercepted HTTP traffic is rewritten when it is
+// parsed instead of piped as opaque bytes.
+type HTTPMode struct {
+	StripAltSvc     bool              // Drop Alt-Svc from responses so browsers do not switch to QUIC
+	Via             string            // Pseudonym added to Via headers in both directions (empty = none)
+	RequestHeaders  map[string]string // Header -> value set on requests; "" removes it, Host rewrites the Host header
+	ResponseHeaders map[string]string // Header -> value set on responses; "" removes it
+}
+
+// httpModeTOML is an [http_mode] entry as written; unset switches default to true.
+type httpModeTOML struct {
+	Enabled         *bool             `toml:"enabled"`       // false exempts a host, e.g. a subdomain
+	StripAltSvc     *bool             `toml:"strip_alt_svc"` // Default true
+	Via             string            `toml:"via"`
+	RequestHeaders  map[string]string `toml:"request_headers"`
+	ResponseHeaders map[string]string `toml:"response_headers"`
+}
+
+// loadExtensions parses the Snirect-specific tables from user rules data.
+func (r *Rules) loadExtensions(data []byte) error {
+	var ext extRulesTOML
+	if err := toml.Unmarshal(data, &ext); err != nil {
+		return err
+	}
+	r.HTTPUpgrade = normalizePatterns(ext.HTTPUpgrade)
+
+	for pattern, strat := range ext.Fragment {
+		switch strat.Mode {
+		case "":
+			strat.Mode = FragmentTLS
+		case FragmentTLS, FragmentTCP, FragmentBoth, FragmentOff:
+		default:
+			return fmt.Errorf("fragment %q: unknown mode %q", pattern, strat.Mode)
+		}
+		if strat.Size < 0 || strat.DelayMs < 0 {
+			return fmt.Errorf("fragment %q: size and delay_ms must not be negative", pattern)
+		}
+		ext.Fragment[pattern] = strat
+	}
+	r.Fragment = normalizePatterns(ext.Fragment)
+
+	for pattern, raw := range ext.OutboundProxy {
+		if raw == OutboundDirect {
+			continue
+		}
+		if _, err := ParseProxyURL(raw); err != nil {
+			return fmt.Errorf("outbound_proxy %q: %w", pattern, err)
+		}
+	}
+	r.OutboundProxy = normalizePatterns(ext.OutboundProxy)
+
+	for pattern, ports := range ext.Ports {
+		for _, p := range ports {
+			if p < 1 || p > 65535 {
+				return fmt.Errorf("ports %q: invalid port %d", pattern, p)
+			}
+		}
+	}
+	r.Ports = normalizePatterns(ext.Ports)
+	r.SNIFallback = normalizePatterns(ext.SNIFallback)
+
+	r.HTTPMode = make(map[string]*HTTPMode, len(ext.HTTPMode))
+	for pattern, raw := range ext.HTTPMode {
+		if err := validateHeaders(raw.RequestHeaders, true); err != nil {
+			return fmt.Errorf("http_mode %q: request_headers: %w", pattern, err)
+		}
+		if err := validateHeaders(raw.ResponseHeaders, false); err != nil {
+			return fmt.Errorf("http_mode %q: response_headers: %w", pattern, err)
+		}
+		if !httpguts.ValidHeaderFieldValue(raw.Via) {
+			return fmt.Errorf("http_mode %q: invalid via %q", pattern, raw.Via)
+		}
+		var mode *HTTPMode // nil exempts the pattern
+		if raw.Enabled == nil || *raw.Enabled {
+			mode = &HTTPMode{
+				StripAltSvc:     raw.StripAltSvc == nil || *raw.StripAltSvc,
+				Via:             raw.Via,
+				RequestHeaders:  raw.RequestHeaders,
+				ResponseHeaders: raw.ResponseHeaders,
+			}
+		}
+		r.HTTPMode[strings.TrimPrefix(pattern, "$")] = mode
+	}
+
+	for pattern, mode := range ext.ECH {
+		if mode == "" || !ValidECHMode(mode) {
+			return fmt.Errorf("ech %q: unknown mode %q", pattern, mode)
+		}
+	}
+	r.ECH = normalizePatterns(ext.ECH)
+
+	for pattern, profile := range ext.Fingerprint {
+		if profile == "" || !ValidFingerprint(profile) {
+			return fmt.Errorf("fingerprint %q: unknown profile %q", pattern, profile)
+		}
+	}
+	r.Fingerprint = normalizePatterns(ext.Fingerprint)
+
+	for pattern, limit := range ext.Bandwidth {
+		if limit.Upload < 0 || limit.Download < 0 {
+			return fmt.Errorf("bandwidth %q: limits must not be negative", pattern)
+		}
+	}
+	r.Bandwidth = normalizePatterns(ext.Bandwidth)
+	return nil
+}
+
+// ValidECHMode reports whether mode is an ECH mode; empty means off.
+func ValidECHMode(mode string) bool {
+	switch mode {
+	case "", ECHOff, ECHOnly, ECHThenRewrite:
+		return true
+	}
+	return false
+}
+
+// ValidFingerprint reports whether profile is a ClientHello profile; empty
+// means go-default.
+func ValidFingerprint(profile string) bool {
+	switch profile {
+	case "", FingerprintGo, FingerprintChrome, FingerprintFirefox, FingerprintSafari, FingerprintRandomized:
+		return true
+	}
+	return false
+}
+
+// validateHeaders checks the names and values of an [http_mode] header table.
+func validateHeaders(headers map[string]string, request bool) error {
+	for name, value := range headers {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		if !httpguts.ValidHeaderFieldValue(value) {
+			return fmt.Errorf("invalid value %q for %s", value, name)
+		}
+		if strings.EqualFold(name, "Host") && (!request || value == "") {
+			return errors.New("the Host header can only be rewritten on requests, to a non-empty value")
+		}
+	}
+	return nil
+}
+
+// OutboundDirect is the [outbound_proxy] value that dials without a proxy.
+const OutboundDirect = "direct"
+
+// ParseProxyURL parses an upstream proxy URL and checks its scheme and address.
+// Supported schemes are socks5 (names resolved locally), socks5h (names
+// resolved by the proxy) and http (CONNECT).
+func ParseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return nil, fmt.Errorf("proxy URL %q must include host and port", raw)
+	}
+	return u, nil
+}
+
+// normalizePatterns trims the legacy `$` prefix from keys, matching the shared rules.
+func normalizePatterns[T any](m map[string]T) map[string]T {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]T, len(m))
+	for k, v := range m {
+		out[strings.TrimPrefix(k, "$")] = v
+	}
+	return out
+}
+
+// lookupPattern finds the value for host in a pattern table. An exact key wins;
+// otherwise the longest matching pattern is used, like the shared rules.
+func lookupPattern[T any](m map[string]T, host string) (T, bool) {
+	_, v, ok := matchPattern(m, host)
+	return v, ok
+}
+
+// matchPattern is lookupPattern that also returns the key that matched.
+func matchPattern[T any](m map[string]T, host string) (string, T, bool) {
+	var zero T
+	if len(m) == 0 {
+		return "", zero, false
+	}
+	if v, ok := m[host]; ok {
+		return host, v, true
+	}
+
+	best := ""
+	found := false
+	for k := range m {
+		if !MatchPattern(k, host) {
+			continue
+		}
+		if !found || len(k) > len(best) || (len(k) == len(best) && k < best) {
+			best, found = k, true
+		}
+	}
+	if !found {
+		return "", zero, false
+	}
+	return best, m[best], true
+}
+
+// GetHTTPUpgrade reports whether plain-HTTP requests for host should be
+// redirected to HTTPS instead of being forwarded.
+func (r *Rules) GetHTTPUpgrade(host string) bool {
+	if r == nil {
+		return false
+	}
+	upgrade, _ := lookupPattern(r.HTTPUpgrade, host)
+	return upgrade
+}
+
+// GetOutboundProxy returns the upstream proxy URL for host, or OutboundDirect.
+// It reports false when no rule matches and the global proxy applies.
+func (r *Rules) GetOutboundProxy(host string) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	return lookupPattern(r.OutboundProxy, host)
+}
+
+// GetPorts returns the ports on which CONNECTs to host may be intercepted.
+// It reports false when no rule matches and intercept_ports applies.
+func (r *Rules) GetPorts(host string) ([]int, bool) {
+	if r == nil {
+		return nil, false
+	}
+	return lookupPattern(r.Ports, host)
+}
+
+// GetSNIFallback returns the SNIs to try, in order, after the one chosen by
+// alter_hostname fails the remote handshake. An empty entry strips the SNI
+// and "__AUTO__" stands for the SNI the client sent.
+func (r *Rules) GetSNIFallback(host string) ([]string, bool) {
+	if r == nil {
+		return nil, false
+	}
+	return lookupPattern(r.SNIFallback, host)
+}
+
+// GetFragment returns the ClientHello fragmentation strategy for host.
+// A rule with mode "off" reports no strategy.
+func (r *Rules) GetFragment(host string) (FragmentStrategy, bool) {
+	if r == nil {
+		return FragmentStrategy{}, false
+	}
+	strat, ok := lookupPattern(r.Fragment, host)
+	if !ok || strat.Mode == FragmentOff {
+		return FragmentStrategy{}, false
+	}
+	return strat, true
+}
+
+// Patterns returns the host patterns of alter_hostname, hosts and
+// cert_verify, sorted and without duplicates: the hosts that need the proxy
+// and that the PAC script sends to it.
+func (r *Rules) Patterns() []string {
+	if r == nil || r.Rules == nil {
+		return nil
+	}
+	set := make(map[string]struct{})
+	addKeys(set, r.AlterHostname)
+	addKeys(set, r.Hosts)
+	addKeys(set, r.CertVerify)
+	return slices.Sorted(maps.Keys(set))
+}
+
+func addKeys[T any](set map[string]struct{}, m map[string]T) {
+	for k := range m {
+		set[k] = struct{}{}
+	}
+}
+
+// GetHTTPMode returns the HTTP-aware interception settings for host. A rule
+// with enabled = false reports none.
+func (r *Rules) GetHTTPMode(host string) (*HTTPMode, bool) {
+	if r == nil {
+		return nil, false
+	}
+	mode, ok := lookupPattern(r.HTTPMode, host)
+	return mode, ok && mode != nil
+}
+
+// GetECH returns the [ech] mode for host. It reports false when no rule
+// matches and ech.mode applies.
+func (r *Rules) GetECH(host string) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	return lookupPattern(r.ECH, host)
+}
+
+// GetFingerprint returns the [fingerprint] profile for host. It reports false
+// when no rule matches and fingerprint.profile applies.
+func (r *Rules) GetFingerprint(host string) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	return lookupPattern(r.Fingerprint, host)
+}
+
+// GetBandwidth returns the [bandwidth] pattern that matches host and its
+// limits. The hosts of one pattern share the limits.
+func (r *Rules) GetBandwidth(host string) (pattern string, limit BandwidthLimit, ok bool) {
+	if r == nil {
+		return "", BandwidthLimit{}, false
+	}
+	return matchPattern(r.Bandwidth, host)
+}
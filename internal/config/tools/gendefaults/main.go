@@ -14,19 +14,89 @@ import (
 )
 
 type Config struct {
-	CheckHostname interface{}      `toml:"check_hostname"`
-	SetProxy      bool             `toml:"set_proxy"`
-	CAInstall     string           `toml:"ca_install"`
-	IPv6          bool             `toml:"ipv6"`
-	ECS           string           `toml:"ecs"`
-	DNS           DNSConfig        `toml:"DNS"`
-	Timeout       TimeoutConfig    `toml:"timeout"`
-	Limit         LimitConfig      `toml:"limit"`
-	Log           LogConfig        `toml:"log"`
-	Server        ServerConfig     `toml:"server"`
-	Preference    PreferenceConfig `toml:"preference"`
-	Update        UpdateConfig     `toml:"update"`
-	Security      SecurityConfig   `toml:"security"`
+	CheckHostname interface{}         `toml:"check_hostname"`
+	SetProxy      bool                `toml:"set_proxy"`
+	CAInstall     string              `toml:"ca_install"`
+	IPv6          bool                `toml:"ipv6"`
+	ECS           string              `toml:"ecs"`
+	DNS           DNSConfig           `toml:"DNS"`
+	Timeout       TimeoutConfig       `toml:"timeout"`
+	Limit         LimitConfig         `toml:"limit"`
+	Log           LogConfig           `toml:"log"`
+	Server        ServerConfig        `toml:"server"`
+	Preference    PreferenceConfig    `toml:"preference"`
+	Update        UpdateConfig        `toml:"update"`
+	Security      SecurityConfig      `toml:"security"`
+	Outbound      OutboundConfig      `toml:"outbound"`
+	Admin         AdminConfig         `toml:"admin"`
+	Reload        ReloadConfig        `toml:"reload"`
+	AccessControl AccessControlConfig `toml:"access_control"`
+
+	ECH            ECHConfig            `toml:"ech"`
+	Fingerprint    FingerprintConfig    `toml:"fingerprint"`
+	Resumption     ResumptionConfig     `toml:"resumption"`
+	Warmup         WarmupConfig         `toml:"warmup"`
+	Passthrough    PassthroughConfig    `toml:"passthrough"`
+	BlockDetection BlockDetectionConfig `toml:"block_detection"`
+	Bandwidth      BandwidthConfig      `toml:"bandwidth"`
+}
+
+type ResumptionConfig struct {
+	SessionCacheSize  int `toml:"session_cache_size"`
+	TicketKeyRotation int `toml:"ticket_key_rotation"`
+}
+
+type WarmupConfig struct {
+	Hosts   int `toml:"hosts"`
+	MaxIdle int `toml:"max_idle"`
+}
+
+type PassthroughConfig struct {
+	Learn bool `toml:"learn"`
+	TTL   int  `toml:"ttl"`
+}
+
+type BlockDetectionConfig struct {
+	Enabled bool `toml:"enabled"`
+	Timeout int  `toml:"timeout"`
+	TTL     int  `toml:"ttl"`
+}
+
+type BandwidthConfig struct {
+	Upload         int `toml:"upload"`
+	Download       int `toml:"download"`
+	ClientUpload   int `toml:"client_upload"`
+	ClientDownload int `toml:"client_download"`
+}
+
+type ECHConfig struct {
+	Mode string `toml:"mode"`
+}
+
+type FingerprintConfig struct {
+	Profile string `toml:"profile"`
+}
+
+type OutboundConfig struct {
+	Proxy string `toml:"proxy"`
+}
+
+type AdminConfig struct {
+	Listen string `toml:"listen"`
+	Token  string `toml:"token"`
+}
+
+type AccessControlConfig struct {
+	Users             map[string]string `toml:"users"`
+	Allow             []string          `toml:"allow"`
+	Deny              []string          `toml:"deny"`
+	MaxConnsPerClient int               `toml:"max_connections_per_client"`
+	AllowUnprotected  bool              `toml:"allow_unprotected"`
+}
+
+type ReloadConfig struct {
+	Watch         bool `toml:"watch"`
+	WatchInterval int  `toml:"watch_interval"`
 }
 
 type PreferenceConfig struct {
@@ -58,8 +128,14 @@ type SecurityConfig struct {
 }
 
 type TimeoutConfig struct {
-	Dial int `toml:"dial"`
-	DNS  int `toml:"dns"`
+	Dial     int `toml:"dial"`
+	DNS      int `toml:"dns"`
+	Shutdown int `toml:"shutdown"`
+
+	ClientHandshake int `toml:"client_handshake"`
+	RemoteHandshake int `toml:"remote_handshake"`
+	Idle            int `toml:"idle"`
+	MaxLifetime     int `toml:"max_lifetime"`
 }
 
 type LimitConfig struct {
@@ -73,14 +149,27 @@ type DNSConfig struct {
 }
 
 type LogConfig struct {
-	Level string `toml:"loglevel"`
-	File  string `toml:"logfile"`
+	Level     string `toml:"loglevel"`
+	File      string `toml:"logfile"`
+	AccessLog string `toml:"access_log"`
 }
 
 type ServerConfig struct {
-	Address string `toml:"address"`
-	Port    int    `toml:"port"`
-	PACHost string `toml:"pac_host"`
+	Address   string `toml:"address"`
+	Port      int    `toml:"port"`
+	PACHost   string `toml:"pac_host"`
+	SocksPort int    `toml:"socks_port"`
+
+	PACTemplate       string `toml:"pac_template"`
+	PACDirectFallback bool   `toml:"pac_direct_fallback"`
+
+	TransparentPort int    `toml:"transparent_port"`
+	TransparentMode string `toml:"transparent_mode"`
+
+	InterceptPorts []int `toml:"intercept_ports"`
+	DetectTLS      bool  `toml:"detect_tls"`
+
+	Metrics bool `toml:"metrics"`
 }
 
 func main() {
@@ -60,11 +60,39 @@ func (c *Container) GetProxyServer() *proxy.ProxyServer {
 
 func (c *Container) SetProxyServer(srv *proxy.ProxyServer) { c.proxySrv = srv }
 
+// Reload applies a new configuration and rules to the components created so
+// far. The proxy server passes them on to the resolver and keeps the listener
+// settings of the running configuration; the upstream client gets the result.
+func (c *Container) Reload(cfg *config.Config, rules *config.Rules) {
+	if c.proxySrv != nil {
+		c.proxySrv.Reload(cfg, rules)
+		cfg = c.proxySrv.EffectiveConfig()
+	} else if res, ok := c.resolver.(*dns.Resolver); ok {
+		res.SetConfig(cfg)
+		res.SetRules(rules)
+	}
+	if c.upstream != nil {
+		c.upstream.Reload(cfg, rules)
+	}
+	c.cfg, c.rules = cfg, rules
+}
+
+// Close releases all components in dependency order: the proxy server first
+// (so no tunnel keeps using the others), then the upstream client, the
+// resolver and finally the certificate manager.
 func (c *Container) Close() error {
 	var err error
+	if c.proxySrv != nil {
+		err = c.proxySrv.Close()
+	}
+	if c.upstream != nil {
+		if uerr := c.upstream.Close(); uerr != nil && err == nil {
+			err = uerr
+		}
+	}
 	if c.resolver != nil {
-		if r, ok := c.resolver.(interface{ Close() error }); ok {
-			err = r.Close()
+		if rerr := c.resolver.Close(); rerr != nil && err == nil {
+			err = rerr
 		}
 	}
 	if c.certMgr != nil {
@@ -21,6 +21,10 @@ func (m *mockResolver) Resolve(ctx context.Context, host string, clientIP net.IP
 	return "1.2.3.4", nil
 }
 
+func (m *mockResolver) ResolveAll(ctx context.Context, host string, clientIP net.IP) ([]string, error) {
+	return []string{"1.2.3.4"}, nil
+}
+
 func (m *mockResolver) Invalidate(host string) {}
 
 func (m *mockResolver) Close() error {
@@ -155,6 +159,29 @@ func TestContainer_SetMethods(t *testing.T) {
 	}
 }
 
+func TestContainer_Reload(t *testing.T) {
+	cfg := &config.Config{Server: config.ServerConfig{Port: 7654}}
+	cnt := New(cfg, &config.Rules{})
+	cnt.SetCertManager(&mockCertManager{})
+	cnt.SetResolver(&mockResolver{})
+	srv := cnt.GetProxyServer()
+
+	newCfg := &config.Config{Server: config.ServerConfig{Port: 9999, PACHost: "example.com"}}
+	newRules := &config.Rules{}
+	cnt.Reload(newCfg, newRules)
+
+	if cnt.GetRules() != newRules {
+		t.Error("Reload did not replace the rules")
+	}
+	got := cnt.GetConfig()
+	if got != srv.EffectiveConfig() || got.Server.PACHost != "example.com" {
+		t.Errorf("GetConfig = %+v, want the proxy's effective config", got.Server)
+	}
+	if got.Server.Port != 7654 {
+		t.Errorf("Reload changed the listen port to %d", got.Server.Port)
+	}
+}
+
 func TestContainer_Close(t *testing.T) {
 	// Create fresh container for this test
 	cfg := &config.Config{}
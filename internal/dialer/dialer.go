@@ -0,0 +1,121 @@
+// Package dialer provides the outbound dialers used for remote connections:
+// direct TCP, SOCKS5 and HTTP CONNECT proxies. A Router picks one per host from
+// the global [outbound] proxy and the [outbound_proxy] rules.
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	"snirect/internal/config"
+	"snirect/internal/interfaces"
+)
+
+// Direct dials TCP connections without a proxy.
+type Direct struct {
+	Timeout time.Duration
+}
+
+// DialContext implements interfaces.Dialer.
+func (d Direct) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	nd := net.Dialer{Timeout: d.Timeout}
+	return nd.DialContext(ctx, network, address)
+}
+
+// forwardDialer adapts an interfaces.Dialer to the proxy.Dialer that
+// golang.org/x/net/proxy expects for reaching the SOCKS5 server.
+type forwardDialer struct {
+	interfaces.Dialer
+}
+
+func (f forwardDialer) Dial(network, address string) (net.Conn, error) {
+	return f.DialContext(context.Background(), network, address)
+}
+
+// FromURL returns a dialer that reaches its targets through the proxy at raw,
+// using forward to connect to the proxy itself.
+func FromURL(raw string, forward interfaces.Dialer) (interfaces.Dialer, error) {
+	u, err := config.ParseProxyURL(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		d, err := proxy.SOCKS5("tcp", u.Host, auth, forwardDialer{forward})
+		if err != nil {
+			return nil, err
+		}
+		cd, ok := d.(proxy.ContextDialer)
+		if !ok {
+			return nil, fmt.Errorf("SOCKS5 dialer does not support contexts")
+		}
+		return cd, nil
+	default: // "http", checked by ParseProxyURL
+		return &HTTPConnect{Addr: u.Host, User: u.User, Forward: forward}, nil
+	}
+}
+
+// Route is the outbound path chosen for a host.
+type Route struct {
+	interfaces.Dialer
+	Proxy     string // Proxy URL with the password redacted, empty when dialing directly
+	RemoteDNS bool   // The proxy resolves names (socks5h), so dial the host name rather than a resolved IP
+}
+
+// Router picks the Route for each host from the [outbound_proxy] rules,
+// falling back to the global [outbound] proxy.
+type Router struct {
+	global string
+	rules  *config.Rules
+	direct Direct
+
+	mu     sync.Mutex
+	routes map[string]Route // Proxied routes, keyed by proxy URL
+}
+
+// NewRouter creates a Router. timeout bounds every TCP dial, including the
+// one to the proxy.
+func NewRouter(cfg *config.Config, rules *config.Rules, timeout time.Duration) *Router {
+	return &Router{
+		global: cfg.Outbound.Proxy,
+		rules:  rules,
+		direct: Direct{Timeout: timeout},
+		routes: make(map[string]Route),
+	}
+}
+
+// Route returns the outbound route for host.
+func (r *Router) Route(host string) (Route, error) {
+	raw := r.global
+	if p, ok := r.rules.GetOutboundProxy(host); ok {
+		raw = p
+	}
+	if raw == "" || raw == config.OutboundDirect {
+		return Route{Dialer: r.direct}, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if route, ok := r.routes[raw]; ok {
+		return route, nil
+	}
+	d, err := FromURL(raw, r.direct)
+	if err != nil {
+		return Route{}, fmt.Errorf("outbound proxy: %w", err)
+	}
+	u, _ := config.ParseProxyURL(raw)
+	route := Route{Dialer: d, Proxy: u.Redacted(), RemoteDNS: u.Scheme == "socks5h"}
+	r.routes[raw] = route
+	return route, nil
+}
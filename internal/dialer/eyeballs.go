@@ -0,0 +1,121 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"snirect/internal/interfaces"
+)
+
+// AttemptDelay is the pause before starting the next connection attempt while
+// earlier ones are still pending, as recommended by RFC 8305.
+const AttemptDelay = 250 * time.Millisecond
+
+// DialParallel connects to one of addrs ("ip:port") through d in the style of
+// RFC 8305 (Happy Eyeballs v2). The addresses are interleaved by family,
+// starting with the family of the first one; each attempt starts when the
+// previous one fails or after delay, and the first connection to succeed wins.
+// It returns the connection and the address it reached.
+func DialParallel(ctx context.Context, d interfaces.Dialer, network string, addrs []string, delay time.Duration) (net.Conn, string, error) {
+	if len(addrs) == 0 {
+		return nil, "", errors.New("no addresses to dial")
+	}
+	addrs = interleave(addrs)
+	if len(addrs) == 1 {
+		conn, err := d.DialContext(ctx, network, addrs[0])
+		return conn, addrs[0], err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		addr string
+		err  error
+	}
+	results := make(chan result)
+	attempt := func(addr string) {
+		conn, err := d.DialContext(ctx, network, addr)
+		select {
+		case results <- result{conn, addr, err}:
+		case <-ctx.Done():
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var firstErr error
+	next, pending := 0, 0
+	for {
+		if next < len(addrs) && pending == 0 {
+			// Nothing in flight: start the next attempt right away.
+			go attempt(addrs[next])
+			next++
+			pending++
+			timer.Reset(delay)
+		}
+		if pending == 0 {
+			return nil, "", firstErr
+		}
+
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				return res.conn, res.addr, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		case <-timer.C:
+			if next < len(addrs) {
+				go attempt(addrs[next])
+				next++
+				pending++
+				timer.Reset(delay)
+			}
+		}
+	}
+}
+
+// interleave reorders addrs to alternate between IPv6 and IPv4, starting with
+// the family of addrs[0] and keeping the order within each family.
+func interleave(addrs []string) []string {
+	var first, second []string
+	firstV6 := isIPv6(addrs[0])
+	for _, a := range addrs {
+		if isIPv6(a) == firstV6 {
+			first = append(first, a)
+		} else {
+			second = append(second, a)
+		}
+	}
+	out := make([]string, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
+
+func isIPv6(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
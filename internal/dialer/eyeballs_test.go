@@ -0,0 +1,93 @@
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// closedAddr returns the address of a listener that has already been closed,
+// so dialing it is refused.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// TestDialParallel_FallsThrough tests that a refused address is skipped
+// without waiting for the attempt delay.
+func TestDialParallel_FallsThrough(t *testing.T) {
+	echoAddr := startEcho(t)
+	addrs := []string{closedAddr(t), closedAddr(t), echoAddr}
+
+	start := time.Now()
+	conn, addr, err := DialParallel(context.Background(), Direct{Timeout: time.Second}, "tcp", addrs, time.Minute)
+	if err != nil {
+		t.Fatalf("DialParallel: %v", err)
+	}
+	conn.Close()
+	if addr != echoAddr {
+		t.Errorf("addr = %s, want %s", addr, echoAddr)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("DialParallel took %v, want it to move on as soon as a dial fails", elapsed)
+	}
+}
+
+// TestDialParallel_AllFail tests that the first error is returned when no
+// address is reachable.
+func TestDialParallel_AllFail(t *testing.T) {
+	_, _, err := DialParallel(context.Background(), Direct{Timeout: time.Second}, "tcp", []string{closedAddr(t), closedAddr(t)}, 10*time.Millisecond)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+// TestDialParallel_Staggered tests that a slow first attempt does not hold
+// up the next address past the attempt delay.
+func TestDialParallel_Staggered(t *testing.T) {
+	echoAddr := startEcho(t)
+	stall := make(chan struct{})
+	defer close(stall)
+	d := dialFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address != echoAddr {
+			select {
+			case <-stall:
+			case <-ctx.Done():
+			}
+			return nil, fmt.Errorf("stalled dial to %s", address)
+		}
+		return Direct{}.DialContext(ctx, network, address)
+	})
+
+	conn, addr, err := DialParallel(context.Background(), d, "tcp", []string{"[2001:db8::1]:443", echoAddr}, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("DialParallel: %v", err)
+	}
+	conn.Close()
+	if addr != echoAddr {
+		t.Errorf("addr = %s, want %s", addr, echoAddr)
+	}
+}
+
+func TestInterleave(t *testing.T) {
+	got := interleave([]string{"[2001:db8::1]:443", "[2001:db8::2]:443", "[2001:db8::3]:443", "192.0.2.1:443", "192.0.2.2:443"})
+	want := []string{"[2001:db8::1]:443", "192.0.2.1:443", "[2001:db8::2]:443", "192.0.2.2:443", "[2001:db8::3]:443"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("interleave = %v, want %v", got, want)
+	}
+}
+
+// dialFunc adapts a function to interfaces.Dialer.
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (f dialFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
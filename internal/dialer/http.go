@@ -0,0 +1,100 @@
+package dialer
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"snirect/internal/interfaces"
+)
+
+// HTTPConnect dials through an HTTP proxy using the CONNECT method.
+type HTTPConnect struct {
+	Addr    string            // host:port of the proxy
+	User    *url.Userinfo     // Optional credentials, sent as Basic Proxy-Authorization
+	Forward interfaces.Dialer // Dials the proxy itself
+}
+
+// DialContext implements interfaces.Dialer. Only TCP networks are supported.
+func (h *HTTPConnect) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, fmt.Errorf("HTTP proxy cannot dial %s", network)
+	}
+	conn, err := h.Forward.DialContext(ctx, "tcp", h.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial HTTP proxy %s: %w", h.Addr, err)
+	}
+
+	// Bound the CONNECT exchange by ctx.
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+
+	br, err := h.connect(conn, address)
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// connect sends the CONNECT request for address and reads the response.
+func (h *HTTPConnect) connect(conn net.Conn, address string) (*bufio.Reader, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", address, address)
+	if h.User != nil {
+		password, _ := h.User.Password()
+		cred := base64.StdEncoding.EncodeToString([]byte(h.User.Username() + ":" + password))
+		fmt.Fprintf(&b, "Proxy-Authorization: Basic %s\r\n", cred)
+	}
+	b.WriteString("\r\n")
+	if _, err := conn.Write([]byte(b.String())); err != nil {
+		return nil, fmt.Errorf("write CONNECT to %s: %w", h.Addr, err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, fmt.Errorf("read CONNECT response from %s: %w", h.Addr, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP proxy %s refused CONNECT %s: %s", h.Addr, address, resp.Status)
+	}
+	return br, nil
+}
+
+// bufferedConn returns data the proxy sent right after its CONNECT response
+// before reading from the connection again.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite half-closes the connection when the underlying one supports it.
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -9,10 +9,13 @@ import (
 	"log/slog"
 	"net"
 	"net/http"
+	"slices"
 	"snirect/internal/config"
 	"snirect/internal/logger"
+	"snirect/internal/metrics"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -22,8 +25,18 @@ type dnsBackend interface {
 	Exchange(m *dns.Msg) (*dns.Msg, string, error)
 }
 
+// observeQuery records the outcome and latency of one query to an upstream.
+func observeQuery(upstream string, start time.Time, err error) {
+	result := metrics.ResultOK
+	if err != nil {
+		result = metrics.ResultError
+	}
+	metrics.DNSQueries.With(upstream, result).Inc()
+	metrics.DNSQuerySeconds.With(upstream).Observe(time.Since(start).Seconds())
+}
+
 type cacheEntry struct {
-	ip           string
+	ips          []string
 	expiresAt    time.Time
 	lastAccessed time.Time // LRU: track last access time
 }
@@ -38,6 +51,9 @@ type Resolver struct {
 	Rules   *config.Rules
 	backend dnsBackend
 
+	liveRules  atomic.Pointer[config.Rules]  // Rules installed by SetRules
+	liveConfig atomic.Pointer[config.Config] // Config installed by SetConfig
+
 	cache     map[string]cacheEntry
 	cacheMu   sync.RWMutex
 	prefCache *preferenceCache
@@ -46,7 +62,8 @@ type Resolver struct {
 	autoECSNet6  *net.IPNet
 	autoECSNetMu sync.RWMutex
 
-	stopChan chan struct{}
+	stopChan  chan struct{}
+	closeOnce sync.Once
 }
 
 const defaultTTL = 24 * time.Hour
@@ -156,7 +173,7 @@ func (r *Resolver) detectPublicIP(family int, services []string, wg *sync.WaitGr
 // Resolve resolves a hostname to an IP address, utilizing rules, cache, and upstreams.
 func (r *Resolver) Resolve(ctx context.Context, host string, clientIP net.IP) (string, error) {
 	target := host
-	if v, ok := r.Rules.GetHost(host); ok && v != "" {
+	if v, ok := r.rules().GetHost(host); ok && v != "" {
 		target = v
 	}
 
@@ -177,6 +194,180 @@ func (r *Resolver) Resolve(ctx context.Context, host string, clientIP net.IP) (s
 	return r.resolveSystem(ctx, host, target)
 }
 
+// Sources that ResolveAll reports through WithSource when no upstream server
+// answered.
+const (
+	SourceHosts  = "hosts"  // A [hosts] rule mapped the name to an IP
+	SourceCache  = "cache"  // The address list was cached
+	SourceSystem = "system" // The system resolver answered
+)
+
+type sourceKey struct{}
+
+type portKey struct{}
+
+// WithSource returns a context in which ResolveAll stores into src where its
+// answer came from: the upstream server's address or one of the Source
+// constants. src is left unchanged for IP literals.
+func WithSource(ctx context.Context, src *string) context.Context {
+	return context.WithValue(ctx, sourceKey{}, src)
+}
+
+func setSource(ctx context.Context, source string) {
+	if src, ok := ctx.Value(sourceKey{}).(*string); ok {
+		*src = source
+	}
+}
+
+// WithPort returns a context in which the latency tests of the fastest
+// preference mode probe port, the one about to be dialed, instead of 443.
+func WithPort(ctx context.Context, port string) context.Context {
+	return context.WithValue(ctx, portKey{}, port)
+}
+
+func probePort(ctx context.Context) string {
+	if port, ok := ctx.Value(portKey{}).(string); ok && port != "" {
+		return port
+	}
+	return "443"
+}
+
+// ResolveAll resolves a hostname to all of its addresses for Happy Eyeballs
+// dialing. The preferred address comes first: the cached preference, or in
+// fastest mode the address with the lowest connect latency. The rest keep
+// IPv6 ahead of IPv4 unless IPv6 is disabled or the preference mode is ipv4,
+// in which case only IPv4 addresses are returned.
+func (r *Resolver) ResolveAll(ctx context.Context, host string, clientIP net.IP) ([]string, error) {
+	target := host
+	if v, ok := r.rules().GetHost(host); ok && v != "" {
+		target = v
+	}
+
+	if net.ParseIP(target) != nil {
+		if target != host {
+			setSource(ctx, SourceHosts)
+		}
+		return []string{target}, nil
+	}
+
+	var ttl uint32 // Unknown for cached lists, see setPreference
+	ips, ok := r.getCacheAll(target)
+	if ok {
+		setSource(ctx, SourceCache)
+	} else {
+		var server string
+		var err error
+		if r.backend != nil {
+			ips, ttl, server, err = r.lookupAll(ctx, target, clientIP)
+			if err != nil {
+				logger.Debug("DNS: All upstreams failed for %s: %v. Falling back to System DNS.", target, err)
+			}
+		}
+		if r.backend == nil || err != nil {
+			ips, err = r.lookupAllSystem(ctx, host, target)
+			if err != nil {
+				return nil, err
+			}
+			ttl = 300 // System resolver doesn't expose TTL
+			server = SourceSystem
+		}
+		setSource(ctx, server)
+		r.setCacheAll(target, ips, ttl)
+	}
+
+	if pref, ok := r.getPreference(target); ok {
+		return preferFirst(ips, pref), nil
+	}
+	if r.cfg().Preference.Mode == config.IPPreferenceFastest && len(ips) > 1 {
+		records := make([]ipRecord, len(ips))
+		for i, ip := range ips {
+			records[i] = ipRecord{ip: ip, ttl: ttl}
+		}
+		if best, ok := r.fastest(ctx, target, records); ok {
+			r.setPreference(target, best.ip, best.ttl)
+			return preferFirst(ips, best.ip), nil
+		}
+	}
+	return ips, nil
+}
+
+// preferFirst returns ips with pref moved to the front, if present.
+func preferFirst(ips []string, pref string) []string {
+	for i, ip := range ips {
+		if ip == pref {
+			ordered := append([]string{pref}, ips[:i]...)
+			return append(ordered, ips[i+1:]...)
+		}
+	}
+	return ips
+}
+
+// ipv4Only reports whether only A records should be used.
+func (r *Resolver) ipv4Only() bool {
+	cfg := r.cfg()
+	return !cfg.IPv6 || cfg.Preference.Mode == config.IPPreferenceIPv4
+}
+
+// lookupAll queries AAAA and A records in parallel and returns every address,
+// IPv6 first, with the lowest TTL among them and the upstream that answered.
+func (r *Resolver) lookupAll(ctx context.Context, target string, clientIP net.IP) ([]string, uint32, string, error) {
+	var v6 []ipRecord
+	var v6Server string
+	var v6Err error
+	var wg sync.WaitGroup
+	if !r.ipv4Only() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v6, v6Server, v6Err = r.queryDNS(ctx, target, dns.TypeAAAA, clientIP)
+		}()
+	}
+	v4, server, v4Err := r.queryDNS(ctx, target, dns.TypeA, clientIP)
+	wg.Wait()
+
+	records := append(v6, v4...)
+	if len(records) == 0 {
+		if v4Err == nil {
+			v4Err = v6Err
+		}
+		return nil, 0, "", v4Err
+	}
+	if len(v6) > 0 {
+		server = v6Server
+	}
+
+	ips := make([]string, len(records))
+	ttl := records[0].ttl
+	for i, rec := range records {
+		ips[i] = rec.ip
+		ttl = min(ttl, rec.ttl)
+	}
+	logger.Debug("DNS: %s -> %v (TTL: %d) via %s", target, ips, ttl, server)
+	return ips, ttl, server, nil
+}
+
+// lookupAllSystem resolves target with the system resolver, IPv6 first.
+func (r *Resolver) lookupAllSystem(ctx context.Context, host, target string) ([]string, error) {
+	addrs, err := net.DefaultResolver.LookupHost(ctx, target)
+	if err != nil {
+		return nil, fmt.Errorf("dns: could not resolve %s: %w", host, err)
+	}
+	var v6, v4 []string
+	for _, ip := range addrs {
+		if net.ParseIP(ip).To4() == nil {
+			v6 = append(v6, ip)
+		} else {
+			v4 = append(v4, ip)
+		}
+	}
+	if r.ipv4Only() && len(v4) > 0 {
+		v6 = nil
+	}
+	ips := append(v6, v4...)
+	logger.Debug("DNS: %s -> %v (System DNS)", host, ips)
+	return ips, nil
+}
+
 func (r *Resolver) resolveSystem(ctx context.Context, host, target string) (string, error) {
 	// Check cache for system results as well (use type 0 for system)
 	if ip, ok := r.getCache(target, 0); ok {
@@ -189,7 +380,7 @@ func (r *Resolver) resolveSystem(ctx context.Context, host, target string) (stri
 	}
 
 	selectedIP := ips[0]
-	if r.Config.IPv6 {
+	if r.cfg().IPv6 {
 		for _, ip := range ips {
 			if net.ParseIP(ip).To4() == nil {
 				selectedIP = ip
@@ -211,7 +402,8 @@ func (r *Resolver) resolveWithPreference(ctx context.Context, target string, cli
 	}
 
 	// 2. IPv6 disabled -> IPv4 only
-	if !r.Config.IPv6 {
+	cfg := r.cfg()
+	if !cfg.IPv6 {
 		ip, ttl, err := r.lookupType(ctx, target, dns.TypeA, clientIP)
 		if err == nil {
 			r.setPreference(target, ip, ttl)
@@ -220,7 +412,7 @@ func (r *Resolver) resolveWithPreference(ctx context.Context, target string, cli
 	}
 
 	// 3. Choose based on preference mode
-	mode := r.Config.Preference.Mode
+	mode := cfg.Preference.Mode
 	switch mode {
 	case config.IPPreferenceFastest:
 		return r.resolveFastest(ctx, target, clientIP)
@@ -241,7 +433,7 @@ func (r *Resolver) resolveWithPreference(ctx context.Context, target string, cli
 
 // resolveStandard performs the standard resolution: if IPv6 is enabled, try AAAA first then fallback to A.
 func (r *Resolver) resolveStandard(ctx context.Context, target string, clientIP net.IP) (string, uint32, error) {
-	if r.Config.IPv6 {
+	if r.cfg().IPv6 {
 		if ip, ttl, err := r.lookupType(ctx, target, dns.TypeAAAA, clientIP); err == nil {
 			return ip, ttl, err
 		}
@@ -309,15 +501,6 @@ func (r *Resolver) testIPLatency(ctx context.Context, ip, port string, timeout t
 
 // resolveFastest tests all available IPs and selects the one with lowest latency.
 func (r *Resolver) resolveFastest(ctx context.Context, target string, clientIP net.IP) (string, error) {
-	testTimeout := time.Duration(r.Config.Preference.TestTimeoutMs) * time.Millisecond
-	if testTimeout <= 0 {
-		testTimeout = 500 * time.Millisecond
-	}
-	maxIPs := r.Config.Preference.MaxTestIPs
-	if maxIPs <= 0 {
-		maxIPs = 10
-	}
-
 	// Gather IPs from AAAA and A in parallel with context cancellation
 	type lookupRes struct {
 		ips []ipRecord
@@ -369,9 +552,33 @@ func (r *Resolver) resolveFastest(ctx context.Context, target string, clientIP n
 		ip, _, err := r.resolveStandard(ctx, target, clientIP)
 		return ip, err
 	}
-	if len(allIPs) > maxIPs {
-		allIPs = allIPs[:maxIPs]
+
+	best, ok := r.fastest(ctx, target, allIPs)
+	if !ok {
+		logger.Warn("DNS: Fastest mode: all latency tests failed for %s, falling back", target)
+		ip, _, err := r.resolveStandard(ctx, target, clientIP)
+		return ip, err
+	}
+	r.setPreference(target, best.ip, best.ttl)
+	return best.ip, nil
+}
+
+// fastest tests the connect latency of up to max_test_ips of records on the
+// port from WithPort and returns the quickest. ok is false if every test failed.
+func (r *Resolver) fastest(ctx context.Context, target string, records []ipRecord) (best ipRecord, ok bool) {
+	pref := r.cfg().Preference
+	testTimeout := time.Duration(pref.TestTimeoutMs) * time.Millisecond
+	if testTimeout <= 0 {
+		testTimeout = 500 * time.Millisecond
+	}
+	maxIPs := pref.MaxTestIPs
+	if maxIPs <= 0 {
+		maxIPs = 10
+	}
+	if len(records) > maxIPs {
+		records = records[:maxIPs]
 	}
+	port := probePort(ctx)
 
 	// Test latencies concurrently
 	type testResult struct {
@@ -379,14 +586,14 @@ func (r *Resolver) resolveFastest(ctx context.Context, target string, clientIP n
 		latency time.Duration
 		err     error
 	}
-	testCh := make(chan testResult, len(allIPs))
+	testCh := make(chan testResult, len(records))
 	var wg sync.WaitGroup
 
-	for _, info := range allIPs {
+	for _, info := range records {
 		wg.Add(1)
 		go func(ip string) {
 			defer wg.Done()
-			lat, err := r.testIPLatency(ctx, ip, "443", testTimeout)
+			lat, err := r.testIPLatency(ctx, ip, port, testTimeout)
 			testCh <- testResult{ip: ip, latency: lat, err: err}
 		}(info.ip)
 	}
@@ -403,23 +610,16 @@ func (r *Resolver) resolveFastest(ctx context.Context, target string, clientIP n
 	}
 
 	if bestIP == "" {
-		logger.Warn("DNS: Fastest mode: all latency tests failed for %s, falling back", target)
-		ip, _, err := r.resolveStandard(ctx, target, clientIP)
-		return ip, err
+		return ipRecord{}, false
 	}
-
-	// Find TTL for bestIP
-	bestTTL := uint32(300)
-	for _, info := range allIPs {
+	for _, info := range records {
 		if info.ip == bestIP {
-			bestTTL = info.ttl
+			best = info
 			break
 		}
 	}
-
-	logger.Info("DNS: Fastest selected %s (latency: %v) from %d IPs", bestIP, bestLatency, len(allIPs))
-	r.setPreference(target, bestIP, bestTTL)
-	return bestIP, nil
+	logger.Info("DNS: Fastest selected %s for %s (latency: %v) from %d IPs", bestIP, target, bestLatency, len(records))
+	return best, true
 }
 
 func (r *Resolver) buildMessage(target string, qType uint16, clientIP net.IP) *dns.Msg {
@@ -428,7 +628,7 @@ func (r *Resolver) buildMessage(target string, qType uint16, clientIP net.IP) *d
 	m.Id = dns.Id()
 	m.RecursionDesired = true
 
-	if r.Config.ECS != "" {
+	if r.cfg().ECS != "" {
 		if ecs := r.getECS(qType, clientIP); ecs != nil {
 			o := m.IsEdns0()
 			if o == nil {
@@ -444,7 +644,8 @@ func (r *Resolver) buildMessage(target string, qType uint16, clientIP net.IP) *d
 func (r *Resolver) getECS(qType uint16, clientIP net.IP) *dns.EDNS0_SUBNET {
 	var ipNet *net.IPNet
 
-	if r.Config.ECS == "auto" {
+	ecsSetting := r.cfg().ECS
+	if ecsSetting == "auto" {
 		r.autoECSNetMu.RLock()
 		if qType == dns.TypeAAAA {
 			ipNet = r.autoECSNet6
@@ -469,7 +670,7 @@ func (r *Resolver) getECS(qType uint16, clientIP net.IP) *dns.EDNS0_SUBNET {
 			}
 		}
 	} else {
-		_, parsed, err := net.ParseCIDR(r.Config.ECS)
+		_, parsed, err := net.ParseCIDR(ecsSetting)
 		if err == nil {
 			ipNet = parsed
 		}
@@ -494,7 +695,7 @@ func (r *Resolver) getECS(qType uint16, clientIP net.IP) *dns.EDNS0_SUBNET {
 	}
 
 	// For auto mode, we use full mask to trigger better upstream optimization
-	if r.Config.ECS == "auto" {
+	if ecsSetting == "auto" {
 		if e.Family == 1 {
 			e.SourceNetmask = 32
 		} else {
@@ -510,7 +711,19 @@ func (r *Resolver) cacheKey(host string, qType uint16) string {
 }
 
 func (r *Resolver) getCache(host string, qType uint16) (string, bool) {
-	key := r.cacheKey(host, qType)
+	ips, ok := r.lookupCache(r.cacheKey(host, qType))
+	if !ok {
+		return "", false
+	}
+	return ips[0], true
+}
+
+// getCacheAll returns the cached address list stored by setCacheAll.
+func (r *Resolver) getCacheAll(host string) ([]string, bool) {
+	return r.lookupCache(r.cacheKey(host, dns.TypeANY))
+}
+
+func (r *Resolver) lookupCache(key string) ([]string, bool) {
 	r.cacheMu.RLock()
 	entry, ok := r.cache[key]
 	if ok && time.Now().Before(entry.expiresAt) {
@@ -520,20 +733,31 @@ func (r *Resolver) getCache(host string, qType uint16) (string, bool) {
 		// Double-check entry still exists and not expired (another goroutine may have modified)
 		if e, stillExists := r.cache[key]; stillExists && time.Now().Before(e.expiresAt) {
 			r.cache[key] = cacheEntry{
-				ip:           e.ip,
+				ips:          e.ips,
 				expiresAt:    e.expiresAt,
 				lastAccessed: time.Now(),
 			}
 		}
 		r.cacheMu.Unlock()
-		// Return the IP regardless of double-check outcome (original entry was valid)
-		return entry.ip, true
+		metrics.CacheLookups.With(metrics.CacheDNS, metrics.ResultHit).Inc()
+		// Return the IPs regardless of double-check outcome (original entry was valid)
+		return entry.ips, true
 	}
 	r.cacheMu.RUnlock()
-	return "", false
+	metrics.CacheLookups.With(metrics.CacheDNS, metrics.ResultMiss).Inc()
+	return nil, false
 }
 
 func (r *Resolver) setCache(host, ip string, qType uint16, ttl uint32) {
+	r.storeCache(r.cacheKey(host, qType), []string{ip}, ttl)
+}
+
+// setCacheAll caches the full address list for host, as returned by ResolveAll.
+func (r *Resolver) setCacheAll(host string, ips []string, ttl uint32) {
+	r.storeCache(r.cacheKey(host, dns.TypeANY), ips, ttl)
+}
+
+func (r *Resolver) storeCache(key string, ips []string, ttl uint32) {
 	if ttl == 0 {
 		ttl = 60 // Minimum 1m
 	}
@@ -544,7 +768,7 @@ func (r *Resolver) setCache(host, ip string, qType uint16, ttl uint32) {
 	r.cacheMu.Lock()
 	defer r.cacheMu.Unlock()
 
-	limit := r.Config.Limit.DNSCacheSize
+	limit := r.cfg().Limit.DNSCacheSize
 	if limit <= 0 {
 		limit = 10000
 	}
@@ -567,8 +791,8 @@ func (r *Resolver) setCache(host, ip string, qType uint16, ttl uint32) {
 	}
 
 	now := time.Now()
-	r.cache[r.cacheKey(host, qType)] = cacheEntry{
-		ip:           ip,
+	r.cache[key] = cacheEntry{
+		ips:          ips,
 		expiresAt:    now.Add(time.Duration(ttl) * time.Second),
 		lastAccessed: now,
 	}
@@ -601,16 +825,62 @@ func (r *Resolver) Invalidate(host string) {
 
 	delete(r.cache, r.cacheKey(host, dns.TypeA))
 	delete(r.cache, r.cacheKey(host, dns.TypeAAAA))
-	delete(r.cache, r.cacheKey(host, 0)) // System DNS cache
+	delete(r.cache, r.cacheKey(host, 0))           // System DNS cache
+	delete(r.cache, r.cacheKey(host, dns.TypeANY)) // Address lists from ResolveAll
 
 	r.invalidatePreference(host)
 
 	logger.Debug("DNS: Cache invalidated for %s", host)
 }
 
+// Flush empties the DNS and IP preference caches.
+func (r *Resolver) Flush() {
+	r.cacheMu.Lock()
+	r.cache = make(map[string]cacheEntry)
+	r.cacheMu.Unlock()
+	r.prefCache.clear()
+	logger.Debug("DNS: Cache flushed")
+}
+
+// SetRules replaces the rules whose [hosts] table overrides resolution.
+// Cached answers are flushed, since they may predate the new rules.
+func (r *Resolver) SetRules(rules *config.Rules) {
+	r.liveRules.Store(rules)
+	r.Flush()
+}
+
+// rules returns the rules passed to the last SetRules, or Rules.
+func (r *Resolver) rules() *config.Rules {
+	if rules := r.liveRules.Load(); rules != nil {
+		return rules
+	}
+	return r.Rules
+}
+
+// SetConfig replaces the configuration used for IP selection, ECS, the
+// preference tests and the DNS cache limit. The nameservers are fixed when the
+// resolver is created, so changes to [DNS] need a restart.
+func (r *Resolver) SetConfig(cfg *config.Config) {
+	old := r.cfg()
+	if !slices.Equal(old.DNS.Nameserver, cfg.DNS.Nameserver) || !slices.Equal(old.DNS.BootstrapDNS, cfg.DNS.BootstrapDNS) {
+		logger.Warn("DNS: nameserver changes take effect after a restart")
+	}
+	r.liveConfig.Store(cfg)
+	r.Flush()
+}
+
+// cfg returns the configuration passed to the last SetConfig, or Config.
+func (r *Resolver) cfg() *config.Config {
+	if cfg := r.liveConfig.Load(); cfg != nil {
+		return cfg
+	}
+	return r.Config
+}
+
 // Close gracefully shuts down the resolver, stopping background routines.
+// It is safe to call Close more than once.
 func (r *Resolver) Close() error {
-	close(r.stopChan)
+	r.closeOnce.Do(func() { close(r.stopChan) })
 	return nil
 }
 
@@ -623,7 +893,7 @@ func (r *Resolver) getPreference(host string) (string, bool) {
 // dnsTTL is the TTL from the DNS record (in seconds). If 0, uses default.
 func (r *Resolver) setPreference(host, ip string, dnsTTL uint32) {
 	// Determine TTL for preference cache
-	ttl := time.Duration(r.Config.Preference.CacheTTL) * time.Second
+	ttl := time.Duration(r.cfg().Preference.CacheTTL) * time.Second
 	if ttl <= 0 {
 		// Auto: use half of DNS TTL, with bounds
 		halfDNS := time.Duration(dnsTTL) * 500 * time.Millisecond
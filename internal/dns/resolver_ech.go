@@ -0,0 +1,126 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"snirect/internal/logger"
+
+	"github.com/miekg/dns"
+)
+
+// maxAliasHops bounds how many AliasMode HTTPS records LookupECH follows.
+const maxAliasHops = 4
+
+// echNegativeTTL is how long, in seconds, a name without ECH configs is
+// remembered.
+const echNegativeTTL = 300
+
+// echMinTTL is the shortest time, in seconds, that ECH configs are cached, so
+// that short record TTLs do not cost an HTTPS query per connection.
+const echMinTTL = 300
+
+// echName returns the owner name of the HTTPS record for host:port, per
+// RFC 9460 section 9.1: the host itself for 443, else _port._https.host.
+func echName(host, port string) string {
+	if port == "" || port == "443" {
+		return host
+	}
+	return "_" + port + "._https." + host
+}
+
+// LookupECH returns the ECHConfigList published in the HTTPS record of
+// host:port, or nil when there is none. Answers, including the absence of a
+// record, are cached for the record's TTL, at least echMinTTL. The system resolver cannot query
+// HTTPS records, so without configured nameservers no configs are found.
+func (r *Resolver) LookupECH(ctx context.Context, host, port string) ([]byte, error) {
+	name := echName(strings.ToLower(strings.TrimSuffix(host, ".")), port)
+	key := r.cacheKey(name, dns.TypeHTTPS)
+	if cached, ok := r.lookupCache(key); ok {
+		if len(cached) == 0 {
+			return nil, nil
+		}
+		return []byte(cached[0]), nil
+	}
+	if r.backend == nil {
+		return nil, nil
+	}
+
+	configs, ttl, err := r.queryECH(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(configs) == 0 {
+		logger.Debug("DNS: no ECH configs published for %s", name)
+		r.storeCache(key, []string{}, echNegativeTTL)
+		return nil, nil
+	}
+	logger.Debug("DNS: %s publishes ECH configs (%d bytes, TTL: %d)", name, len(configs), ttl)
+	r.storeCache(key, []string{string(configs)}, max(ttl, echMinTTL))
+	return configs, nil
+}
+
+// StoreECH replaces the cached ECHConfigList of host:port, such as with the
+// retry configs a server sent after rejecting stale ones.
+func (r *Resolver) StoreECH(host, port string, configs []byte) {
+	name := echName(strings.ToLower(strings.TrimSuffix(host, ".")), port)
+	r.storeCache(r.cacheKey(name, dns.TypeHTTPS), []string{string(configs)}, echNegativeTTL)
+}
+
+// queryECH queries the HTTPS records of name and returns the ECH configs of
+// the ServiceMode record with the lowest priority, following AliasMode
+// records to their target.
+func (r *Resolver) queryECH(ctx context.Context, name string) ([]byte, uint32, error) {
+	for hop := 0; hop <= maxAliasHops; hop++ {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+		reply, addr, err := r.backend.Exchange(r.buildMessage(name, dns.TypeHTTPS, nil))
+		if err != nil {
+			return nil, 0, err
+		}
+		switch reply.Rcode {
+		case dns.RcodeSuccess:
+		case dns.RcodeNameError:
+			return nil, 0, nil
+		default:
+			return nil, 0, fmt.Errorf("dns rcode %s from %s", dns.RcodeToString[reply.Rcode], addr)
+		}
+
+		var best *dns.SVCB
+		var alias string
+		for _, ans := range reply.Answer {
+			var rr *dns.SVCB
+			switch v := ans.(type) {
+			case *dns.HTTPS:
+				rr = &v.SVCB
+			case *dns.SVCB:
+				rr = v
+			default:
+				continue
+			}
+			if rr.Priority == 0 {
+				alias = rr.Target
+				continue
+			}
+			if best == nil || rr.Priority < best.Priority {
+				best = rr
+			}
+		}
+		if best == nil {
+			if alias == "" || alias == "." || dns.Fqdn(alias) == dns.Fqdn(name) {
+				return nil, 0, nil
+			}
+			name = strings.TrimSuffix(alias, ".")
+			continue
+		}
+		for _, kv := range best.Value {
+			if ech, ok := kv.(*dns.SVCBECHConfig); ok {
+				return ech.ECH, best.Hdr.Ttl, nil
+			}
+		}
+		return nil, best.Hdr.Ttl, nil
+	}
+	return nil, 0, fmt.Errorf("too many HTTPS alias records for %s", name)
+}
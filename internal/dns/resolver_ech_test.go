@@ -0,0 +1,122 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	miekgdns "github.com/miekg/dns"
+	"snirect/internal/config"
+)
+
+// TestLookupECH tests that LookupECH reads the ECH configs of the preferred
+// HTTPS record from a local DNS server, follows alias records and the port
+// prefix, and caches answers, including their absence.
+func TestLookupECH(t *testing.T) {
+	echList := []byte("ech-configs")
+	https := func(name string, priority uint16, target string, ech []byte) miekgdns.RR {
+		rr := &miekgdns.HTTPS{SVCB: miekgdns.SVCB{
+			Hdr:      miekgdns.RR_Header{Name: name, Rrtype: miekgdns.TypeHTTPS, Class: miekgdns.ClassINET, Ttl: 600},
+			Priority: priority,
+			Target:   target,
+		}}
+		if ech != nil {
+			rr.Value = []miekgdns.SVCBKeyValue{&miekgdns.SVCBECHConfig{ECH: ech}}
+		} else if priority > 0 {
+			rr.Value = []miekgdns.SVCBKeyValue{&miekgdns.SVCBAlpn{Alpn: []string{"h2"}}}
+		}
+		return rr
+	}
+
+	var queries atomic.Int32
+	handler := miekgdns.HandlerFunc(func(w miekgdns.ResponseWriter, req *miekgdns.Msg) {
+		queries.Add(1)
+		m := new(miekgdns.Msg)
+		m.SetReply(req)
+		q := req.Question[0]
+		if q.Qtype != miekgdns.TypeHTTPS {
+			t.Errorf("query type %d, want HTTPS", q.Qtype)
+		}
+		switch q.Name {
+		case "ech.test.":
+			m.Answer = []miekgdns.RR{https(q.Name, 2, ".", []byte("backup")), https(q.Name, 1, ".", echList)}
+		case "alias.test.":
+			m.Answer = []miekgdns.RR{https(q.Name, 0, "ech.test.", nil)}
+		case "_8443._https.ech.test.":
+			m.Answer = []miekgdns.RR{https(q.Name, 1, ".", []byte("port-8443"))}
+		case "short.test.":
+			rr := https(q.Name, 1, ".", echList)
+			rr.Header().Ttl = 1
+			m.Answer = []miekgdns.RR{rr}
+		case "plain.test.":
+			m.Answer = []miekgdns.RR{https(q.Name, 1, ".", nil)}
+		default:
+			m.Rcode = miekgdns.RcodeNameError
+		}
+		w.WriteMsg(m)
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	started := make(chan struct{})
+	srv := &miekgdns.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+	<-started
+
+	cfg := &config.Config{}
+	cfg.DNS.Nameserver = []string{pc.LocalAddr().String()}
+	r := NewResolver(cfg, &config.Rules{})
+	defer r.Close()
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		host, port string
+		want       []byte
+	}{
+		{"ech.test", "443", echList},
+		{"alias.test", "443", echList},
+		{"ech.test", "8443", []byte("port-8443")},
+		{"plain.test", "443", nil},
+		{"missing.test", "443", nil},
+	} {
+		got, err := r.LookupECH(ctx, tc.host, tc.port)
+		if err != nil {
+			t.Fatalf("LookupECH(%s, %s): %v", tc.host, tc.port, err)
+		}
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("LookupECH(%s, %s) = %q, want %q", tc.host, tc.port, got, tc.want)
+		}
+	}
+
+	sent := queries.Load()
+	if got, _ := r.LookupECH(ctx, "ech.test", "443"); !bytes.Equal(got, echList) {
+		t.Errorf("cached LookupECH = %q, want %q", got, echList)
+	}
+	if got, _ := r.LookupECH(ctx, "missing.test", "443"); got != nil {
+		t.Errorf("cached LookupECH(missing.test) = %q, want nil", got)
+	}
+	if n := queries.Load(); n != sent {
+		t.Errorf("cached lookups sent %d queries", n-sent)
+	}
+
+	if _, err := r.LookupECH(ctx, "short.test", "443"); err != nil {
+		t.Fatalf("LookupECH(short.test): %v", err)
+	}
+	r.cacheMu.Lock()
+	entry := r.cache[r.cacheKey("short.test", miekgdns.TypeHTTPS)]
+	r.cacheMu.Unlock()
+	if left := time.Until(entry.expiresAt); left < (echMinTTL-5)*time.Second {
+		t.Errorf("short.test cached for %v, want at least %ds", left, echMinTTL)
+	}
+
+	r.StoreECH("ech.test", "443", []byte("retry"))
+	if got, _ := r.LookupECH(ctx, "ech.test", "443"); string(got) != "retry" {
+		t.Errorf("LookupECH after StoreECH = %q, want retry", got)
+	}
+}
@@ -2,7 +2,10 @@ package dns
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"snirect/internal/metrics"
 )
 
 // preferenceCacheEntry stores a preferred IP and its metadata.
@@ -19,6 +22,8 @@ type preferenceCache struct {
 	mu      sync.RWMutex
 	entries map[string]preferenceCacheEntry
 	limit   int // 0 = unlimited
+
+	hits, misses atomic.Int64
 }
 
 // newPreferenceCache creates a new cache with the given size limit.
@@ -36,8 +41,12 @@ func (c *preferenceCache) get(host string) (ip string, ok bool) {
 
 	entry, exists := c.entries[host]
 	if !exists || time.Now().After(entry.expiresAt) {
+		c.misses.Add(1)
+		metrics.CacheLookups.With(metrics.CachePreference, metrics.ResultMiss).Inc()
 		return "", false
 	}
+	c.hits.Add(1)
+	metrics.CacheLookups.With(metrics.CachePreference, metrics.ResultHit).Inc()
 	return entry.ip, true
 }
 
@@ -82,7 +91,5 @@ func (c *preferenceCache) stats() (size int, hits, misses int) {
 	c.mu.RLock()
 	size = len(c.entries)
 	c.mu.RUnlock()
-	// Note: hits/misses tracking would need atomic counters if we want accuracy
-	// For now just return size. Can be extended later.
-	return size, 0, 0
+	return size, int(c.hits.Load()), int(c.misses.Load())
 }
@@ -103,6 +103,12 @@ func TestPreferenceCacheEviction(t *testing.T) {
 	if size != 2 {
 		t.Fatalf("expected size 2, got %d", size)
 	}
+
+	cache.get("c")
+	cache.get("missing")
+	if _, hits, misses := cache.stats(); hits != 1 || misses != 1 {
+		t.Fatalf("expected 1 hit and 1 miss, got %d and %d", hits, misses)
+	}
 }
 
 func TestPreferenceCacheConcurrent(t *testing.T) {
@@ -436,6 +442,29 @@ func TestResolver_Resolve_WithHostRule(t *testing.T) {
 	// Since we can't inspect query directly, we rely on the fact that mock returns fixed response
 }
 
+// TestResolver_SetRules tests that replaced [hosts] rules apply at once,
+// including to hosts whose answers were cached.
+func TestResolver_SetRules(t *testing.T) {
+	r := &Resolver{
+		Config:    &config.Config{},
+		Rules:     &config.Rules{Rules: ruleslib.NewRules()},
+		backend:   &mockBackend{aResp: makeDNSResponse(miekgdns.TypeA, []string{"192.0.2.1"}, 300)},
+		cache:     make(map[string]cacheEntry),
+		prefCache: newPreferenceCache(0),
+	}
+	if ip, err := r.Resolve(context.Background(), "example.com", nil); err != nil || ip != "192.0.2.1" {
+		t.Fatalf("Resolve = %s, %v", ip, err)
+	}
+
+	newRules := ruleslib.NewRules()
+	newRules.Hosts["example.com"] = "198.51.100.7"
+	r.SetRules(&config.Rules{Rules: newRules})
+
+	if ip, err := r.Resolve(context.Background(), "example.com", nil); err != nil || ip != "198.51.100.7" {
+		t.Errorf("Resolve after SetRules = %s, %v; want the [hosts] address", ip, err)
+	}
+}
+
 // TestResolver_Resolve_IPDirect tests that Resolve returns IP directly if target is already an IP.
 func TestResolver_Resolve_IPDirect(t *testing.T) {
 	r := &Resolver{
@@ -899,3 +928,75 @@ func TestResolver_resolveFastest_PartialFailure(t *testing.T) {
 		t.Errorf("unexpected ip: %s", ip)
 	}
 }
+
+// TestResolver_ResolveAll tests that ResolveAll returns every address, IPv6
+// first with the preferred address moved to the front, and caches the list.
+func TestResolver_ResolveAll(t *testing.T) {
+	aaaaMsg := makeDNSResponse(miekgdns.TypeAAAA, []string{"2001:db8::1"}, 300)
+	aMsg := makeDNSResponse(miekgdns.TypeA, []string{"192.0.2.1", "192.0.2.2"}, 60)
+	backend := &mockBackend{aaaaResp: aaaaMsg, aResp: aMsg}
+	r := &Resolver{
+		Config:    &config.Config{IPv6: true, Timeout: config.TimeoutConfig{DNS: 5}},
+		Rules:     &config.Rules{Rules: ruleslib.NewRules()},
+		backend:   backend,
+		cache:     make(map[string]cacheEntry),
+		prefCache: newPreferenceCache(0),
+	}
+
+	var source string
+	ips, err := r.ResolveAll(WithSource(context.Background(), &source), "example.com", nil)
+	if err != nil {
+		t.Fatalf("ResolveAll error: %v", err)
+	}
+	if want := []string{"2001:db8::1", "192.0.2.1", "192.0.2.2"}; fmt.Sprint(ips) != fmt.Sprint(want) {
+		t.Fatalf("ResolveAll = %v, want %v", ips, want)
+	}
+	if source != "::1" {
+		t.Errorf("source = %q, want the upstream that answered AAAA", source)
+	}
+
+	backend.callCount = 0
+	r.prefCache.set("example.com", "192.0.2.2", 0, time.Minute)
+	ips, err = r.ResolveAll(WithSource(context.Background(), &source), "example.com", nil)
+	if err != nil {
+		t.Fatalf("second ResolveAll error: %v", err)
+	}
+	if want := []string{"192.0.2.2", "2001:db8::1", "192.0.2.1"}; fmt.Sprint(ips) != fmt.Sprint(want) {
+		t.Fatalf("ResolveAll with preference = %v, want %v", ips, want)
+	}
+	if backend.callCount > 0 {
+		t.Fatalf("backend was called after cache hit, calls: %d", backend.callCount)
+	}
+	if source != SourceCache {
+		t.Errorf("source = %q, want %q", source, SourceCache)
+	}
+}
+
+// TestResolver_ResolveAll_IPv4Mode tests that ResolveAll skips AAAA queries
+// when the preference mode is ipv4.
+func TestResolver_ResolveAll_IPv4Mode(t *testing.T) {
+	aMsg := makeDNSResponse(miekgdns.TypeA, []string{"192.0.2.1"}, 300)
+	backend := &mockBackend{aResp: aMsg}
+	r := &Resolver{
+		Config: &config.Config{
+			IPv6:       true,
+			Preference: config.PreferenceConfig{Mode: config.IPPreferenceIPv4},
+			Timeout:    config.TimeoutConfig{DNS: 5},
+		},
+		Rules:     &config.Rules{Rules: ruleslib.NewRules()},
+		backend:   backend,
+		cache:     make(map[string]cacheEntry),
+		prefCache: newPreferenceCache(0),
+	}
+
+	ips, err := r.ResolveAll(context.Background(), "example.com", nil)
+	if err != nil {
+		t.Fatalf("ResolveAll error: %v", err)
+	}
+	if len(ips) != 1 || ips[0] != "192.0.2.1" {
+		t.Fatalf("ResolveAll = %v, want [192.0.2.1]", ips)
+	}
+	if backend.callCount != 1 {
+		t.Fatalf("expected 1 DNS query, got %d", backend.callCount)
+	}
+}
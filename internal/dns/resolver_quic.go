@@ -12,6 +12,18 @@ import (
 	"github.com/miekg/dns"
 )
 
+// observedUpstream records every query to the wrapped upstream in the metrics.
+type observedUpstream struct {
+	upstream.Upstream
+}
+
+func (u observedUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	reply, err := u.Upstream.Exchange(m)
+	observeQuery(u.Address(), start, err)
+	return reply, err
+}
+
 type quicBackend struct {
 	upstreams []upstream.Upstream
 }
@@ -61,7 +73,7 @@ func newBackend(cfg *config.Config, rules *config.Rules) dnsBackend {
 			logger.Warn("DNS: failed to create upstream %s: %v", ns, err)
 			continue
 		}
-		upstreams = append(upstreams, u)
+		upstreams = append(upstreams, observedUpstream{u})
 	}
 
 	if len(upstreams) == 0 {
@@ -27,12 +27,20 @@ type stdUpstream interface {
 	Address() string
 }
 
+// exchangeObserved sends m to u and records the query in the metrics.
+func exchangeObserved(u stdUpstream, m *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	reply, err := u.Exchange(m)
+	observeQuery(u.Address(), start, err)
+	return reply, err
+}
+
 // exchangeParallel sends the same DNS query to multiple upstreams concurrently.
 // It returns the first successful reply, or the last error if all upstreams fail.
 // The caller provides a context for cancellation and timeout control.
 func exchangeParallel(ctx context.Context, m *dns.Msg, upstreams []stdUpstream) (*dns.Msg, string, error) {
 	if len(upstreams) == 1 {
-		reply, err := upstreams[0].Exchange(m)
+		reply, err := exchangeObserved(upstreams[0], m)
 		if err != nil {
 			return nil, "", err
 		}
@@ -52,7 +60,7 @@ func exchangeParallel(ctx context.Context, m *dns.Msg, upstreams []stdUpstream)
 	for _, u := range upstreams {
 		go func(u stdUpstream) {
 			defer wg.Done()
-			reply, err := u.Exchange(m)
+			reply, err := exchangeObserved(u, m)
 			select {
 			case resCh <- result{reply: reply, addr: u.Address(), err: err}:
 			case <-ctx.Done():
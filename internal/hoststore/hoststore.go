@@ -0,0 +1,181 @@
+// Package hoststore keeps per-host entries that expire, backed by a file in
+// the app directory. The file is re-read before every write, so that edits
+// made by another process, such as a CLI command, are not overwritten.
+package hoststore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Format describes the entries of a Store and how they are saved.
+type Format[E any] struct {
+	Name      string // What the file holds, for errors, e.g. "learned rules"
+	Host      func(E) string
+	Expires   func(E) time.Time
+	Marshal   func(entries []E) ([]byte, error)
+	Unmarshal func(data []byte) ([]E, error)
+}
+
+// Store is a set of entries keyed by host, backed by a file.
+type Store[E any] struct {
+	mu      sync.Mutex
+	path    string
+	format  Format[E]
+	entries map[string]E
+	written stamp // The file as the last save left it
+}
+
+// stamp identifies one version of a file on disk.
+type stamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// Load reads the store at path. A missing file is an empty store.
+func Load[E any](path string, format Format[E]) (*Store[E], error) {
+	s := &Store[E]{path: path, format: format}
+	if err := s.readLocked(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// readLocked replaces the entries with the ones in the file that have not
+// expired.
+func (s *Store[E]) readLocked() error {
+	entries := make(map[string]E)
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.entries = entries
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read %s: %w", s.format.Name, err)
+	}
+	list, err := s.format.Unmarshal(data)
+	if err != nil {
+		return fmt.Errorf("parse %s %s: %w", s.format.Name, s.path, err)
+	}
+	now := time.Now()
+	for _, e := range list {
+		if now.Before(s.format.Expires(e)) {
+			entries[Normalize(s.format.Host(e))] = e
+		}
+	}
+	s.entries = entries
+	return nil
+}
+
+// Get returns the entry for host if it has not expired.
+func (s *Store[E]) Get(host string) (E, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[Normalize(host)]
+	if !ok || !time.Now().Before(s.format.Expires(e)) {
+		var zero E
+		return zero, false
+	}
+	return e, true
+}
+
+// Entries returns the entries that have not expired, sorted by host.
+func (s *Store[E]) Entries() []E {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.liveLocked(time.Now())
+}
+
+// Put adds e, replacing the entry for the same host, and saves the store.
+// Entries are re-read from the file first.
+func (s *Store[E]) Put(e E) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.readLocked(); err != nil {
+		return err
+	}
+	s.entries[Normalize(s.format.Host(e))] = e
+	return s.saveLocked()
+}
+
+// Remove forgets hosts, or every entry when none are given, saves the store
+// and returns how many entries it removed. Entries are re-read from the file
+// first.
+func (s *Store[E]) Remove(hosts ...string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.readLocked(); err != nil {
+		return 0, err
+	}
+	n := len(s.entries)
+	if len(hosts) == 0 {
+		clear(s.entries)
+	}
+	for _, host := range hosts {
+		delete(s.entries, Normalize(host))
+	}
+	n -= len(s.entries)
+	if n == 0 {
+		return 0, nil
+	}
+	return n, s.saveLocked()
+}
+
+// Wrote reports whether a file with modTime and size is the one this store
+// last saved, i.e. nobody else changed it since.
+func (s *Store[E]) Wrote(modTime time.Time, size int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.written.modTime.IsZero() && s.written == stamp{modTime: modTime, size: size}
+}
+
+// liveLocked returns the entries that have not expired at now, sorted by host.
+func (s *Store[E]) liveLocked(now time.Time) []E {
+	var entries []E
+	for _, e := range s.entries {
+		if now.Before(s.format.Expires(e)) {
+			entries = append(entries, e)
+		}
+	}
+	slices.SortFunc(entries, func(a, b E) int { return strings.Compare(s.format.Host(a), s.format.Host(b)) })
+	return entries
+}
+
+// saveLocked drops expired entries and writes the rest to the file, through
+// a temporary file so that a crash never leaves it half written.
+func (s *Store[E]) saveLocked() error {
+	entries := s.liveLocked(time.Now())
+	clear(s.entries)
+	for _, e := range entries {
+		s.entries[Normalize(s.format.Host(e))] = e
+	}
+	data, err := s.format.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("create %s directory: %w", s.format.Name, err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("write %s: %w", s.format.Name, err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("write %s: %w", s.format.Name, err)
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.written = stamp{modTime: info.ModTime(), size: info.Size()}
+	}
+	return nil
+}
+
+// Normalize returns host in the form entries are keyed by.
+func Normalize(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
@@ -0,0 +1,76 @@
+package hoststore
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type entry struct {
+	Host    string
+	Expires time.Time
+}
+
+var testFormat = Format[entry]{
+	Name:    "test store",
+	Host:    func(e entry) string { return e.Host },
+	Expires: func(e entry) time.Time { return e.Expires },
+	Marshal: func(entries []entry) ([]byte, error) { return json.Marshal(entries) },
+	Unmarshal: func(data []byte) ([]entry, error) {
+		var entries []entry
+		err := json.Unmarshal(data, &entries)
+		return entries, err
+	},
+}
+
+func TestStore_KeepsEditsFromOtherProcesses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts.json")
+	expires := time.Now().Add(time.Hour)
+	running, err := Load(path, testFormat)
+	if err != nil {
+		t.Fatalf("Load missing file: %v", err)
+	}
+	if err := running.Put(entry{Host: "a.example", Expires: expires}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !running.Wrote(info.ModTime(), info.Size()) {
+		t.Error("Wrote does not recognise the store's own save")
+	}
+
+	// Another process, such as the CLI, adds and removes entries.
+	cli, err := Load(path, testFormat)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if n, err := cli.Remove("A.Example."); n != 1 || err != nil {
+		t.Fatalf("Remove = %d, %v; want 1, nil", n, err)
+	}
+	if err := cli.Put(entry{Host: "b.example", Expires: expires}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	info, _ = os.Stat(path)
+	if running.Wrote(info.ModTime(), info.Size()) {
+		t.Error("Wrote claims a save made by another store")
+	}
+
+	if err := running.Put(entry{Host: "c.example", Expires: expires}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	reloaded, err := Load(path, testFormat)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	entries := reloaded.Entries()
+	if len(entries) != 2 || entries[0].Host != "b.example" || entries[1].Host != "c.example" {
+		t.Fatalf("entries = %+v, want b.example and c.example", entries)
+	}
+	if _, ok := reloaded.Get("a.example"); ok {
+		t.Error("a removed entry came back")
+	}
+}
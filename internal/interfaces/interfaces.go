@@ -18,12 +18,19 @@ type CertificateManager interface {
 }
 
 // Resolver resolves hostnames to IP addresses with caching.
+// ResolveAll returns every address, preferred first, for dialing with failover.
 type Resolver interface {
 	Resolve(ctx context.Context, host string, clientIP net.IP) (string, error)
+	ResolveAll(ctx context.Context, host string, clientIP net.IP) ([]string, error)
 	Invalidate(host string)
 	Close() error
 }
 
+// Dialer opens outbound connections, directly or through an upstream proxy.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
 // HTTPClient performs HTTP requests and file downloads.
 type HTTPClient interface {
 	Get(ctx context.Context, url string) (*http.Response, error)
@@ -34,3 +41,12 @@ type HTTPClient interface {
 type CertVerifier interface {
 	VerifyCert(conn tlsutil.TLSConnection, host, targetSNI string, policy config.CertPolicy, sec config.SecurityConfig) bool
 }
+
+// ECHResolver looks up the Encrypted Client Hello configs a host publishes in
+// its HTTPS record. Resolvers that implement it enable ECH for remote
+// connections; StoreECH keeps the retry configs of a server that rejected
+// stale ones.
+type ECHResolver interface {
+	LookupECH(ctx context.Context, host, port string) ([]byte, error)
+	StoreECH(host, port string, configs []byte)
+}
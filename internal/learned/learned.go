@@ -0,0 +1,127 @@
+// Package learned keeps the alter_hostname rules that the blocking learner
+// found for hosts whose direct connections looked blocked. They form a rules
+// layer of their own, in a TOML file next to rules.toml, between the built-in
+// and fetched rules and the user's rules.toml. Entries expire.
+package learned
+
+import (
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+
+	"snirect/internal/hoststore"
+)
+
+// FileName is the name of the layer in the app directory.
+const FileName = "learned.toml"
+
+// Reasons for Entry.Reason: the failure seen on the direct connection.
+const (
+	ReasonReset   = "reset"   // The remote reset the connection after the ClientHello
+	ReasonTimeout = "timeout" // The remote never answered the ClientHello
+)
+
+// header starts the file, for whoever opens it.
+const header = `# Written by snirect: alter_hostname rules for hosts whose direct connections
+# looked blocked and that worked with the SNI below. Entries expire; review
+# them with "snirect learned" and remove them with "snirect learned forget".
+
+`
+
+// Entry is one learned alter_hostname rule.
+type Entry struct {
+	Host    string    `toml:"host"`
+	SNI     string    `toml:"sni"` // Empty strips the SNI
+	Reason  string    `toml:"reason"`
+	Learned time.Time `toml:"learned"`
+	Expires time.Time `toml:"expires"`
+}
+
+type file struct {
+	AlterHostname []Entry `toml:"alter_hostname"`
+}
+
+// Layer is the set of learned rules, backed by a file. A nil *Layer has no
+// rules and learns nothing.
+type Layer struct {
+	store *hoststore.Store[Entry]
+}
+
+var format = hoststore.Format[Entry]{
+	Name:    "learned rules",
+	Host:    func(e Entry) string { return e.Host },
+	Expires: func(e Entry) time.Time { return e.Expires },
+	Marshal: func(entries []Entry) ([]byte, error) {
+		data, err := toml.Marshal(file{AlterHostname: entries})
+		return append([]byte(header), data...), err
+	},
+	Unmarshal: func(data []byte) ([]Entry, error) {
+		var f file
+		err := toml.Unmarshal(data, &f)
+		return f.AlterHostname, err
+	},
+}
+
+// Load reads the layer at path. A missing file is an empty layer.
+func Load(path string) (*Layer, error) {
+	store, err := hoststore.Load(path, format)
+	if err != nil {
+		return nil, err
+	}
+	return &Layer{store: store}, nil
+}
+
+// Entries returns the rules that have not expired, sorted by host.
+func (l *Layer) Entries() []Entry {
+	if l == nil {
+		return nil
+	}
+	return l.store.Entries()
+}
+
+// AlterHostname returns the rules that have not expired as an alter_hostname
+// table: host -> SNI.
+func (l *Layer) AlterHostname() map[string]string {
+	m := make(map[string]string)
+	for _, e := range l.Entries() {
+		m[e.Host] = e.SNI
+	}
+	return m
+}
+
+// SNI returns the learned SNI for host if its rule has not expired.
+func (l *Layer) SNI(host string) (string, bool) {
+	if l == nil {
+		return "", false
+	}
+	e, ok := l.store.Get(host)
+	return e.SNI, ok
+}
+
+// Add learns sni for host for ttl, replacing an earlier rule, and saves the
+// layer. Rules are re-read from the file first.
+func (l *Layer) Add(host, sni, reason string, ttl time.Duration) error {
+	if l == nil {
+		return nil
+	}
+	now := time.Now()
+	host = hoststore.Normalize(host)
+	return l.store.Put(Entry{Host: host, SNI: sni, Reason: reason, Learned: now, Expires: now.Add(ttl)})
+}
+
+// Remove forgets hosts, or every rule when none are given, saves the layer
+// and returns how many rules it removed. Rules are re-read from the file
+// first.
+func (l *Layer) Remove(hosts ...string) (int, error) {
+	if l == nil {
+		return 0, nil
+	}
+	return l.store.Remove(hosts...)
+}
+
+// Wrote reports whether the file with modTime and size is the one the last
+// Add or Remove through l saved, so that the reloader can tell the proxy's
+// own writes, which it already applied, from edits made elsewhere.
+func (l *Layer) Wrote(modTime time.Time, size int64) bool {
+	return l != nil && l.store.Wrote(modTime, size)
+}
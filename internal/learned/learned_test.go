@@ -0,0 +1,65 @@
+package learned
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLayer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FileName)
+	l, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load missing file: %v", err)
+	}
+	if len(l.AlterHostname()) != 0 {
+		t.Fatal("empty layer has rules")
+	}
+
+	if err := l.Add("Blocked.Example.", "", ReasonReset, time.Hour); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := l.Add("other.example", "cdn.example", ReasonTimeout, time.Hour); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := l.Add("old.example", "", ReasonReset, -time.Second); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "# Written by snirect") || strings.Contains(string(data), "old.example") {
+		t.Errorf("unexpected file:\n%s", data)
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	got := loaded.AlterHostname()
+	if len(got) != 2 || got["blocked.example"] != "" || got["other.example"] != "cdn.example" {
+		t.Fatalf("AlterHostname = %v", got)
+	}
+	if e := loaded.Entries()[0]; e.Host != "blocked.example" || e.Reason != ReasonReset {
+		t.Errorf("first entry = %+v", e)
+	}
+
+	if n, err := loaded.Remove("OTHER.example", "missing.example"); n != 1 || err != nil {
+		t.Fatalf("Remove = %d, %v; want 1, nil", n, err)
+	}
+	if n, err := loaded.Remove(); n != 1 || err != nil {
+		t.Fatalf("Remove all = %d, %v; want 1, nil", n, err)
+	}
+	if reloaded, _ := Load(path); len(reloaded.Entries()) != 0 {
+		t.Errorf("removed rules came back: %v", reloaded.Entries())
+	}
+
+	var nilLayer *Layer
+	if nilLayer.Add("x.example", "", ReasonReset, time.Hour) != nil || len(nilLayer.AlterHostname()) != 0 {
+		t.Fatal("nil layer is not empty")
+	}
+}
@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegistry_WriteTo(t *testing.T) {
+	r := &Registry{}
+	c := &CounterVec{r.register("test_requests_total", "Requests.", "counter", []string{"code"}, func() metric { return &Counter{} })}
+	g := &GaugeVec{r.register("test_open", "Open things.", "gauge", nil, func() metric { return &Gauge{} })}
+
+	c.With("200").Add(3)
+	c.With(`a"b`).Inc()
+	g.With().Inc()
+	g.With().Inc()
+	g.With().Dec()
+
+	var b strings.Builder
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	want := `# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{code="200"} 3
+test_requests_total{code="a\"b"} 1
+# HELP test_open Open things.
+# TYPE test_open gauge
+test_open 1
+`
+	if b.String() != want {
+		t.Errorf("output:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+func TestHistogram_Buckets(t *testing.T) {
+	r := &Registry{}
+	h := &HistogramVec{r.register("test_seconds", "Latency.", "histogram", []string{"side"}, func() metric { return newHistogram([]float64{0.1, 1}) })}
+
+	for _, v := range []float64{0.0625, 0.25, 1, 4} {
+		h.With("client").Observe(v)
+	}
+
+	var b strings.Builder
+	r.WriteTo(&b)
+	for _, line := range []string{
+		`test_seconds_bucket{side="client",le="0.1"} 1`,
+		`test_seconds_bucket{side="client",le="1"} 3`,
+		`test_seconds_bucket{side="client",le="+Inf"} 4`,
+		`test_seconds_sum{side="client"} 5.3125`,
+		`test_seconds_count{side="client"} 4`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("output lacks %q:\n%s", line, b.String())
+		}
+	}
+}
+
+func TestFamily_WrongLabelCount(t *testing.T) {
+	r := &Registry{}
+	c := &CounterVec{r.register("test_total", "Total.", "counter", []string{"a", "b"}, func() metric { return &Counter{} })}
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for a missing label value")
+		}
+	}()
+	c.With("x")
+}
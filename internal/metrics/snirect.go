@@ -0,0 +1,62 @@
+package metrics
+
+// Label values used by several metrics.
+const (
+	ModeMITM   = "mitm"
+	ModeDirect = "direct"
+
+	SideClient = "client"
+	SideRemote = "remote"
+
+	ResultOK    = "ok"
+	ResultError = "error"
+
+	CacheDNS        = "dns"
+	CachePreference = "preference"
+	ResultHit       = "hit"
+	ResultMiss      = "miss"
+
+	ECHAccepted = "accepted" // The server decrypted the inner ClientHello
+	ECHRetried  = "retried"  // Accepted after retrying with the server's configs
+	ECHRejected = "rejected" // The server refused ECH or the handshake failed
+
+	SessionFull    = "full"    // Full TLS handshake
+	SessionResumed = "resumed" // Resumed a cached TLS session
+	SessionWarm    = "warm"    // Took a pre-dialed connection
+)
+
+// Snirect's metrics. Cache hit ratios are hits / (hits + misses) of
+// CacheLookups, e.g. in PromQL.
+var (
+	TunnelsActive = NewGaugeVec("snirect_tunnels_active",
+		"Tunnels currently piping data.", "mode")
+	TunnelsTotal = NewCounterVec("snirect_tunnels_total",
+		"Tunnels opened since start.", "mode")
+
+	HandshakeSeconds = NewHistogramVec("snirect_tls_handshake_seconds",
+		"TLS handshake latency with the client (MITM) or the remote.", DefBuckets, "side", "result")
+	DialSeconds = NewHistogramVec("snirect_dial_seconds",
+		"Latency of TCP dials to remotes, across all resolved addresses.", DefBuckets, "result")
+
+	CertVerifyFailures = NewCounterVec("snirect_cert_verify_failures_total",
+		"Remote certificates rejected, by reason.", "reason")
+	CertsIssued = NewCounterVec("snirect_certificates_issued_total",
+		"Leaf certificates signed by the local CA.")
+
+	DNSQueries = NewCounterVec("snirect_dns_queries_total",
+		"DNS queries sent, by upstream and result.", "upstream", "result")
+	DNSQuerySeconds = NewHistogramVec("snirect_dns_query_seconds",
+		"DNS query latency by upstream.", DefBuckets, "upstream")
+	CacheLookups = NewCounterVec("snirect_cache_lookups_total",
+		"DNS and IP preference cache lookups, by cache and result.", "cache", "result")
+
+	ConnLimitWaitSeconds = NewHistogramVec("snirect_conn_limit_wait_seconds",
+		"Time connections waited for a slot under limit.max_connections.", DefBuckets)
+	ClientsRejected = NewCounterVec("snirect_clients_rejected_total",
+		"Client connections or requests refused by [access_control], by reason.", "reason")
+
+	ECHHandshakes = NewCounterVec("snirect_ech_handshakes_total",
+		"Remote TLS handshakes attempted with Encrypted Client Hello, by result.", "result")
+	RemoteSessions = NewCounterVec("snirect_remote_sessions_total",
+		"Remote TLS connections of intercepted tunnels, by how they were set up: full, resumed or warm.", "kind")
+)
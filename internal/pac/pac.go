@@ -0,0 +1,150 @@
+// Package pac generates the proxy auto-config script served at /pac/ from
+// the loaded rules. Rule patterns are compiled into lookup tables so that the
+// script only falls back to shExpMatch for true wildcards.
+package pac
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// DefaultTemplate is the built-in PAC template.
+//
+//go:embed pac.tmpl
+var DefaultTemplate string
+
+// LegacyFile is the PAC file that older versions installed in the config
+// directory. A copy the user edited is used as the template while
+// server.pac_template is unset.
+const LegacyFile = "pac"
+
+// legacyStockSum is the SHA-256 of LegacyFile as older versions installed it.
+const legacyStockSum = "e4458e8a517e4f8bbc3ddb12f8af8dccef3dd169750ffdd7c233a4cbc8b6c1f4"
+
+// IsLegacyStock reports whether content is LegacyFile as older versions
+// installed it, which the generated script replaces.
+func IsLegacyStock(content []byte) bool {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]) == legacyStockSum
+}
+
+// Exclusion is an "include^exclude" rule pattern: hosts matching Include but
+// not Exclude are proxied.
+type Exclusion struct {
+	Include string `json:"include"`
+	Exclude string `json:"exclude"`
+}
+
+// Data is what a PAC template is executed with.
+type Data struct {
+	Host  string // Proxy host (server.pac_host)
+	Port  int    // Proxy port (server.port)
+	Proxy string // Result for proxied hosts, e.g. "PROXY 127.0.0.1:7654; DIRECT"
+
+	Exact      []string    // Host names matched as they are
+	Domains    []string    // "*.example.com" patterns, kept as "example.com": the domain and its subdomains
+	Suffixes   []string    // "*example.com" patterns, kept as "example.com": any host ending with it
+	Globs      []string    // Other wildcard patterns, for shExpMatch
+	Exclusions []Exclusion // "include^exclude" patterns
+}
+
+// New compiles rule patterns into Data for a proxy at host:port. With
+// directFallback the proxy result ends in "; DIRECT", so that browsers connect
+// directly while Snirect is not running.
+func New(patterns []string, host string, port int, directFallback bool) *Data {
+	d := &Data{Host: host, Port: port, Proxy: fmt.Sprintf("PROXY %s:%d", host, port)}
+	if directFallback {
+		d.Proxy += "; DIRECT"
+	}
+
+	seen := make(map[string]bool)
+	for _, p := range patterns {
+		p = normalize(p)
+		if p == "" || seen[p] || strings.ContainsAny(p[:1], "#$^") {
+			continue
+		}
+		seen[p] = true
+		if include, exclude, ok := strings.Cut(p, "^"); ok {
+			d.Exclusions = append(d.Exclusions, Exclusion{Include: include, Exclude: exclude})
+			continue
+		}
+		d.add(p)
+	}
+
+	for _, list := range [][]string{d.Exact, d.Domains, d.Suffixes, d.Globs} {
+		slices.Sort(list)
+	}
+	slices.SortFunc(d.Exclusions, func(a, b Exclusion) int {
+		return strings.Compare(a.Include+"^"+a.Exclude, b.Include+"^"+b.Exclude)
+	})
+	return d
+}
+
+// add files a pattern without an exclusion under the cheapest lookup that
+// matches like the rules do.
+func (d *Data) add(p string) {
+	switch {
+	case !isWildcard(p):
+		d.Exact = append(d.Exact, p)
+	case strings.HasPrefix(p, "*.") && !isWildcard(p[2:]):
+		d.Domains = append(d.Domains, p[2:])
+	case strings.HasPrefix(p, "*") && !isWildcard(p[1:]):
+		d.Suffixes = append(d.Suffixes, p[1:])
+	default:
+		d.Globs = append(d.Globs, p)
+	}
+}
+
+// normalize cleans a pattern the way the rules matcher does.
+func normalize(p string) string {
+	p = strings.ToLower(strings.TrimSpace(strings.TrimSuffix(p, ".")))
+	p = strings.Trim(p, `"`)
+	p = strings.Trim(p, "'")
+	return strings.TrimSpace(p)
+}
+
+func isWildcard(p string) bool {
+	return strings.ContainsAny(p, `*?[\`)
+}
+
+// Render executes tmpl with d. Besides the fields of Data, templates can use:
+//
+//	js     a value as a JSON (and so JavaScript) literal
+//	jsSet  a list of strings as an object literal with those keys, for lookups
+//	host   Data.Host, for the {{host}} placeholder of older PAC files
+//	port   Data.Port, for the {{port}} placeholder of older PAC files
+func Render(tmpl string, d *Data) ([]byte, error) {
+	t, err := template.New("pac").Funcs(template.FuncMap{
+		"js":    jsLiteral,
+		"jsSet": jsSet,
+		"host":  func() string { return d.Host },
+		"port":  func() int { return d.Port },
+	}).Parse(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, d); err != nil {
+		return nil, err
+	}
+	return []byte(b.String()), nil
+}
+
+func jsLiteral(v any) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func jsSet(keys []string) (string, error) {
+	set := make(map[string]int, len(keys))
+	for _, k := range keys {
+		set[k] = 1
+	}
+	return jsLiteral(set)
+}
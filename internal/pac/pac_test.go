@@ -0,0 +1,85 @@
+package pac
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	d := New([]string{
+		"example.com",
+		"*.google.com",
+		"*wikipedia.org",
+		"*wik*.org^*wiki*edia.org",
+		"*.yahoo.com^*.media.yahoo.com",
+		"cdn?.example.net",
+		"*.*.test",
+		"Upper.Example.COM.",
+		"#disabled.com",
+		"^ignored.com",
+		"example.com",
+	}, "127.0.0.1", 7654, true)
+
+	tests := []struct {
+		name string
+		got  []string
+		want []string
+	}{
+		{"Exact", d.Exact, []string{"example.com", "upper.example.com"}},
+		{"Domains", d.Domains, []string{"google.com"}},
+		{"Suffixes", d.Suffixes, []string{"wikipedia.org"}},
+		{"Globs", d.Globs, []string{"*.*.test", "cdn?.example.net"}},
+	}
+	for _, tt := range tests {
+		if !slices.Equal(tt.got, tt.want) {
+			t.Errorf("%s = %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+	wantExcl := []Exclusion{{"*.yahoo.com", "*.media.yahoo.com"}, {"*wik*.org", "*wiki*edia.org"}}
+	if !slices.Equal(d.Exclusions, wantExcl) {
+		t.Errorf("Exclusions = %v, want %v", d.Exclusions, wantExcl)
+	}
+	if d.Proxy != "PROXY 127.0.0.1:7654; DIRECT" {
+		t.Errorf("Proxy = %q", d.Proxy)
+	}
+	if d := New(nil, "10.0.0.2", 8080, false); d.Proxy != "PROXY 10.0.0.2:8080" {
+		t.Errorf("Proxy without fallback = %q", d.Proxy)
+	}
+}
+
+func TestRender(t *testing.T) {
+	d := New([]string{"example.com", "*.google.com", `evil"</script>.com`}, "127.0.0.1", 7654, true)
+	out, err := Render(DefaultTemplate, d)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	script := string(out)
+	for _, want := range []string{
+		`var proxy = "PROXY 127.0.0.1:7654; DIRECT";`,
+		`"example.com":1`,
+		`var domains = {"google.com":1};`,
+		"function FindProxyForURL(url, host)",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script lacks %q:\n%s", want, script)
+		}
+	}
+	if strings.Contains(script, `evil"`) {
+		t.Error("pattern was not escaped")
+	}
+}
+
+func TestRender_LegacyPlaceholders(t *testing.T) {
+	d := New(nil, "192.168.1.2", 9999, false)
+	out, err := Render(`var proxy = "PROXY {{host}}:{{port}};";`, d)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	if got := string(out); got != `var proxy = "PROXY 192.168.1.2:9999;";` {
+		t.Errorf("Render = %q", got)
+	}
+	if _, err := Render("{{.Nope", d); err == nil {
+		t.Error("invalid template accepted")
+	}
+}
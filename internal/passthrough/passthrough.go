@@ -0,0 +1,87 @@
+// Package passthrough keeps the hosts that must not be intercepted because
+// MITM breaks them: the remote asks for a client certificate, or the client
+// pins the server certificate. Entries expire and are saved as JSON in the app
+// directory, so that what was learned survives a restart.
+package passthrough
+
+import (
+	"encoding/json"
+	"time"
+
+	"snirect/internal/hoststore"
+)
+
+// FileName is the name of the list in the app directory.
+const FileName = "passthrough.json"
+
+// Reasons for Entry.Reason.
+const (
+	ReasonClientCert = "client_cert" // The remote sent a CertificateRequest
+	ReasonPinning    = "pinning"     // The client refused the MITM certificate
+)
+
+// Entry is one learned host.
+type Entry struct {
+	Host    string    `json:"host"`
+	Reason  string    `json:"reason"`
+	Learned time.Time `json:"learned"`
+	Expires time.Time `json:"expires"`
+}
+
+// List is the set of learned hosts, backed by a file. A nil *List contains
+// no hosts and learns nothing.
+type List struct {
+	store *hoststore.Store[Entry]
+}
+
+var format = hoststore.Format[Entry]{
+	Name:    "passthrough list",
+	Host:    func(e Entry) string { return e.Host },
+	Expires: func(e Entry) time.Time { return e.Expires },
+	Marshal: func(entries []Entry) ([]byte, error) {
+		data, err := json.MarshalIndent(append([]Entry{}, entries...), "", "  ")
+		return append(data, '\n'), err
+	},
+	Unmarshal: func(data []byte) ([]Entry, error) {
+		var entries []Entry
+		err := json.Unmarshal(data, &entries)
+		return entries, err
+	},
+}
+
+// Load reads the list at path. A missing file is an empty list.
+func Load(path string) (*List, error) {
+	store, err := hoststore.Load(path, format)
+	if err != nil {
+		return nil, err
+	}
+	return &List{store: store}, nil
+}
+
+// Contains reports whether host was learned and has not expired.
+func (l *List) Contains(host string) bool {
+	if l == nil {
+		return false
+	}
+	_, ok := l.store.Get(host)
+	return ok
+}
+
+// Add learns host for ttl, replacing an earlier entry, and saves the list.
+// Entries are re-read from the file first.
+func (l *List) Add(host, reason string, ttl time.Duration) error {
+	if l == nil {
+		return nil
+	}
+	now := time.Now()
+	host = hoststore.Normalize(host)
+	return l.store.Put(Entry{Host: host, Reason: reason, Learned: now, Expires: now.Add(ttl)})
+}
+
+// Entries returns the hosts that have not expired, sorted by name.
+func (l *List) Entries() []Entry {
+	if l == nil {
+		return nil
+	}
+	return l.store.Entries()
+}
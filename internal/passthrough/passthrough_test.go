@@ -0,0 +1,50 @@
+package passthrough
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FileName)
+	l, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load missing file: %v", err)
+	}
+	if l.Contains("bank.example") {
+		t.Fatal("empty list contains a host")
+	}
+
+	if err := l.Add("Bank.Example.", ReasonClientCert, time.Hour); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := l.Add("old.example", ReasonPinning, -time.Second); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if !l.Contains("bank.example") || l.Contains("old.example") {
+		t.Fatal("Contains does not reflect the added and expired entries")
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	entries := loaded.Entries()
+	if len(entries) != 1 || entries[0].Host != "bank.example" || entries[0].Reason != ReasonClientCert {
+		t.Fatalf("reloaded entries = %+v, want only bank.example", entries)
+	}
+
+	var nilList *List
+	if nilList.Contains("bank.example") || nilList.Add("bank.example", ReasonPinning, time.Hour) != nil || nilList.Entries() != nil {
+		t.Fatal("nil list is not empty")
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Fatal("Load accepted a corrupt file")
+	}
+}
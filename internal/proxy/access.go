@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"time"
+
+	"snirect/internal/accesslog"
+	"snirect/internal/logger"
+)
+
+// logAccess writes the access log record for a finished connection. err is
+// the error runConnect returned, if any.
+func (s *ProxyServer) logAccess(ctx *connectContext, err error) {
+	if s.AccessLog == nil {
+		return
+	}
+	rec := &accesslog.Record{
+		Time:         ctx.start,
+		ID:           ctx.ID,
+		Client:       ctx.ClientAddr,
+		Host:         ctx.Host,
+		Port:         ctx.Port,
+		Mode:         accesslog.ModeDirect,
+		TargetSNI:    ctx.TargetSNI,
+		ECH:          ctx.ECH,
+		RemoteAddr:   ctx.RemoteAddr,
+		DNS:          ctx.DNSSource,
+		ALPN:         ctx.Protocol,
+		Verify:       ctx.Verify,
+		VerifyReason: ctx.VerifyReason,
+		BytesIn:      ctx.BytesIn,
+		BytesOut:     ctx.BytesOut,
+		PhasesMs:     make(map[string]float64, len(ctx.phases)),
+		DurationMs:   milliseconds(time.Since(ctx.start)),
+		CloseReason:  ctx.CloseReason,
+	}
+	if ctx.Intercept {
+		rec.Mode = accesslog.ModeMITM
+		rec.ClientSNI = ctx.ClientHello
+	}
+	for phase, d := range ctx.phases {
+		rec.PhasesMs[string(phase)] = milliseconds(d)
+	}
+	if err != nil {
+		rec.Error = err.Error()
+		if rec.CloseReason == "" {
+			rec.CloseReason = "error"
+		}
+	}
+	if err := s.AccessLog.Write(rec); err != nil {
+		logger.Debug("Access log: %v", err)
+	}
+}
+
+// milliseconds converts d to fractional milliseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
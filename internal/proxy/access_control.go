@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"snirect/internal/config"
+	"snirect/internal/logger"
+	"snirect/internal/metrics"
+)
+
+// Reasons for refusing a client, the label values of metrics.ClientsRejected.
+const (
+	rejectACL   = "acl"
+	rejectAuth  = "auth"
+	rejectLimit = "limit"
+)
+
+// authRealm is sent in Proxy-Authenticate and WWW-Authenticate challenges.
+const authRealm = `Basic realm="snirect"`
+
+// clientIP returns the IP of a "host:port" client address.
+func clientIP(addr string) (netip.Addr, bool) {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ap.Addr().Unmap(), true
+}
+
+// accessControl returns the [access_control] settings in effect.
+func (s *ProxyServer) accessControl() *config.AccessControlConfig {
+	cfg := s.cfg()
+	if cfg == nil {
+		return &config.AccessControlConfig{}
+	}
+	return &cfg.AccessControl
+}
+
+// clientFilter is the parsed allow and deny lists of a configuration.
+type clientFilter struct {
+	cfg *config.Config
+	*config.ClientFilter
+}
+
+// clientFilter returns the allow and deny lists in effect, parsing them again
+// only when the configuration changed.
+func (s *ProxyServer) clientFilter() *config.ClientFilter {
+	cfg := s.cfg()
+	if f := s.filter.Load(); f != nil && f.cfg == cfg {
+		return f.ClientFilter
+	}
+	f := &clientFilter{cfg: cfg, ClientFilter: s.accessControl().ClientFilter()}
+	s.filter.Store(f)
+	return f.ClientFilter
+}
+
+// allowsClient applies access_control.allow and deny to the client at addr.
+func (s *ProxyServer) allowsClient(addr string) bool {
+	filter := s.clientFilter()
+	if filter.Empty() {
+		return true
+	}
+	if ip, ok := clientIP(addr); !ok || !filter.AllowsClient(ip) {
+		logger.Debug("Access control: refused %s", addr)
+		metrics.ClientsRejected.With(rejectACL).Inc()
+		return false
+	}
+	return true
+}
+
+// needsAuth reports whether the client at addr must authenticate: users are
+// configured and the client is not on loopback.
+func (s *ProxyServer) needsAuth(addr string) bool {
+	if len(s.accessControl().Users) == 0 {
+		return false
+	}
+	ip, ok := clientIP(addr)
+	return !ok || !ip.IsLoopback()
+}
+
+// authorized reports whether r carries valid Basic credentials in header, or
+// needs none.
+func (s *ProxyServer) authorized(r *http.Request, header string) bool {
+	if !s.needsAuth(r.RemoteAddr) {
+		return true
+	}
+	encoded, ok := strings.CutPrefix(r.Header.Get(header), "Basic ")
+	if ok {
+		if raw, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+			user, password, _ := strings.Cut(string(raw), ":")
+			if s.accessControl().Authenticate(user, password) {
+				return true
+			}
+		}
+	}
+	logger.Debug("Access control: %s from %s is not authenticated", r.Method, r.RemoteAddr)
+	metrics.ClientsRejected.With(rejectAuth).Inc()
+	return false
+}
+
+// requireProxyAuth answers a proxy request that lacks valid credentials.
+func requireProxyAuth(w http.ResponseWriter) {
+	w.Header().Set("Proxy-Authenticate", authRealm)
+	http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+}
+
+// requireAuth answers a local request (certificate, metrics) that lacks
+// valid credentials.
+func requireAuth(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", authRealm)
+	http.Error(w, "Authentication required", http.StatusUnauthorized)
+}
+
+// reserveClient takes one of the access_control.max_connections_per_client
+// slots of the client at addr. It returns false when the client has none
+// left; otherwise release must be called when the connection ends.
+func (s *ProxyServer) reserveClient(addr string) (release func(), ok bool) {
+	limit := s.accessControl().MaxConnsPerClient
+	ip, valid := clientIP(addr)
+	if limit <= 0 || !valid {
+		return func() {}, true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.perClient[ip] >= limit {
+		logger.Debug("Access control: %s reached max_connections_per_client (%d)", addr, limit)
+		metrics.ClientsRejected.With(rejectLimit).Inc()
+		return nil, false
+	}
+	if s.perClient == nil {
+		s.perClient = make(map[netip.Addr]int)
+	}
+	s.perClient[ip]++
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.perClient[ip]--; s.perClient[ip] <= 0 {
+			delete(s.perClient, ip)
+		}
+	}, true
+}
+
+// aclListener drops connections refused by access_control.allow and deny
+// before they reach the HTTP server.
+type aclListener struct {
+	net.Listener
+	s *ProxyServer
+}
+
+func (l aclListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.s.allowsClient(conn.RemoteAddr().String()) {
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
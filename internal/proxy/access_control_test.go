@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"snirect/internal/config"
+)
+
+// TestServeHTTP_ProxyAuth tests that proxy requests and the certificate need
+// credentials from LAN clients, but not from loopback ones.
+func TestServeHTTP_ProxyAuth(t *testing.T) {
+	ps := newShutdownTestProxy()
+	ps.CA = &mockCertificateManager{}
+	ps.Config.AccessControl.Users = map[string]string{"phone": "s3cret"}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		remote string
+		header string
+		value  string
+		want   int
+	}{
+		{"CONNECT from LAN", http.MethodConnect, "example.com:443", "192.168.1.20:5000", "", "", http.StatusProxyAuthRequired},
+		{"wrong password", http.MethodConnect, "example.com:443", "192.168.1.20:5000", "Proxy-Authorization", "phone:nope", http.StatusProxyAuthRequired},
+		{"forward from LAN", http.MethodGet, "http://example.com/", "192.168.1.20:5000", "", "", http.StatusProxyAuthRequired},
+		{"cert from LAN", http.MethodGet, "/CERT/root.crt", "192.168.1.20:5000", "", "", http.StatusUnauthorized},
+		{"cert with credentials", http.MethodGet, "/CERT/root.crt", "192.168.1.20:5000", "Authorization", "phone:s3cret", http.StatusOK},
+		{"cert from loopback", http.MethodGet, "/CERT/root.crt", "127.0.0.1:5000", "", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			req.RemoteAddr = tt.remote
+			if tt.header != "" {
+				req.Header.Set(tt.header, "Basic "+base64.StdEncoding.EncodeToString([]byte(tt.value)))
+			}
+			rr := httptest.NewRecorder()
+			ps.ServeHTTP(rr, req)
+			if rr.Code != tt.want {
+				t.Errorf("status = %d, want %d", rr.Code, tt.want)
+			}
+			if rr.Code == http.StatusProxyAuthRequired && rr.Header().Get("Proxy-Authenticate") == "" {
+				t.Error("407 without a Proxy-Authenticate challenge")
+			}
+		})
+	}
+}
+
+// TestServe_DeniedClientDropped tests that a denied client is disconnected
+// before it can send a request.
+func TestServe_DeniedClientDropped(t *testing.T) {
+	ps := newShutdownTestProxy()
+	ps.Config.AccessControl.Deny = []string{"127.0.0.0/8"}
+	proxyAddr := startTestProxy(t, ps)
+	defer ps.Close()
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET /CERT/root.crt HTTP/1.1\r\nHost: x\r\n\r\n"))
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read from denied connection = %d, %v; want EOF", n, err)
+	}
+}
+
+// TestReserveClient tests the max_connections_per_client cap.
+func TestReserveClient(t *testing.T) {
+	ps := newShutdownTestProxy()
+	ps.Config.AccessControl.MaxConnsPerClient = 1
+
+	release, ok := ps.reserveClient("192.168.1.20:5000")
+	if !ok {
+		t.Fatal("first connection refused")
+	}
+	if _, ok := ps.reserveClient("192.168.1.20:5001"); ok {
+		t.Error("second connection from the same client accepted")
+	}
+	if r, ok := ps.reserveClient("192.168.1.21:5000"); !ok {
+		t.Error("connection from another client refused")
+	} else {
+		r()
+	}
+	release()
+	if _, ok := ps.reserveClient("192.168.1.20:5002"); !ok {
+		t.Error("connection refused after the slot was released")
+	}
+}
+
+// TestForward_PerClientCap tests that plain-HTTP forwarding counts against
+// max_connections_per_client like CONNECT does.
+func TestForward_PerClientCap(t *testing.T) {
+	ps := newShutdownTestProxy()
+	ps.Config.AccessControl.MaxConnsPerClient = 1
+	release, _ := ps.reserveClient("192.168.1.20:5000")
+	defer release()
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = "192.168.1.20:5001"
+	rr := httptest.NewRecorder()
+	ps.handleForward(rr, req)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusTooManyRequests)
+	}
+}
+
+// TestSOCKS5_PasswordAuth tests the username/password subnegotiation.
+func TestSOCKS5_PasswordAuth(t *testing.T) {
+	acl := &config.AccessControlConfig{Users: map[string]string{"phone": "s3cret"}}
+	for _, tt := range []struct {
+		password string
+		status   byte
+	}{{"s3cret", socksPasswordOK}, {"nope", socksPasswordFailure}} {
+		client, server := net.Pipe()
+		errc := make(chan error, 1)
+		go func() {
+			_, _, _, err := socksHandshake(server, acl.Authenticate)
+			server.Close()
+			errc <- err
+		}()
+
+		client.Write([]byte{socksVersion, 2, socksAuthNone, socksAuthPassword})
+		method := make([]byte, 2)
+		if _, err := io.ReadFull(client, method); err != nil || method[1] != socksAuthPassword {
+			t.Fatalf("method selection: %v, %v", method, err)
+		}
+		msg := []byte{socksPasswordVersion, byte(len("phone"))}
+		msg = append(msg, "phone"...)
+		msg = append(msg, byte(len(tt.password)))
+		msg = append(msg, tt.password...)
+		client.Write(msg)
+		reply := make([]byte, 2)
+		if _, err := io.ReadFull(client, reply); err != nil || reply[1] != tt.status {
+			t.Errorf("password %q: reply %v, %v; want status %d", tt.password, reply, err, tt.status)
+		}
+		if tt.status == socksPasswordOK {
+			client.Write([]byte{socksVersion, socksCmdConnect, 0, socksAtypIPv4, 127, 0, 0, 1, 0, 80})
+		}
+		if err := <-errc; (err == nil) != (tt.status == socksPasswordOK) {
+			t.Errorf("password %q: handshake error %v", tt.password, err)
+		}
+		client.Close()
+	}
+}
@@ -0,0 +1,327 @@
+package proxy
+
+import (
+	"cmp"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+
+	"snirect/internal/config"
+	"snirect/internal/ratelimit"
+)
+
+// flow is the shaping state of a set of tunnels: a token bucket and a
+// throughput meter per direction. Up is client to remote, down the reverse.
+type flow struct {
+	up, down           ratelimit.Bucket
+	upMeter, downMeter ratelimit.Meter
+	tunnels            int // Open tunnels in the flow, guarded by shaper.mu
+}
+
+// setLimits sets the rates of the buckets from limits in KiB/s.
+func (f *flow) setLimits(up, down int) {
+	f.up.SetRate(int64(up) * 1024)
+	f.down.SetRate(int64(down) * 1024)
+}
+
+// throughput reports the flow under name.
+func (f *flow) throughput(name string) Throughput {
+	return Throughput{
+		Name:          name,
+		Tunnels:       f.tunnels,
+		Upload:        f.upMeter.Rate(),
+		Download:      f.downMeter.Rate(),
+		UploadLimit:   f.up.Rate(),
+		DownloadLimit: f.down.Rate(),
+	}
+}
+
+// shaper holds the flows of all tunnels together, of each client IP and of
+// each host, see [bandwidth]; the hosts of one [bandwidth] pattern share a
+// flow of the pattern instead, kept apart so that a host named like a pattern
+// does not join it. Client, host and pattern flows exist while they have open
+// tunnels, and take their limits when they are created; after that only
+// applyBandwidth changes limits. The zero shaper is ready to use.
+type shaper struct {
+	mu       sync.Mutex
+	applied  bool // applyBandwidth has run
+	total    flow
+	clients  map[string]*flow
+	hosts    map[string]*flow // Hosts that no [bandwidth] pattern matches
+	patterns map[string]*flow
+}
+
+// shaping is what one tunnel waits on and counts into: the total flow and
+// those of its client IP and host.
+type shaping struct {
+	s            *ProxyServer
+	client, host string           // Keys of the client and host flows
+	hosts        map[string]*flow // shaper.hosts or shaper.patterns, whichever holds the host flow
+	flows        []*flow
+	up, down     []*ratelimit.Bucket
+}
+
+// shape adds a tunnel from clientAddr to host to the bandwidth flows. The
+// tunnel must call release when it ends.
+func (s *ProxyServer) shape(clientAddr, host string) *shaping {
+	client := clientAddr
+	if ip, ok := clientIP(clientAddr); ok {
+		client = ip.String()
+	}
+	b := &s.bandwidth
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Read under the lock so that a concurrent Reload, which installs the
+	// settings before applying them, cannot leave a new flow with old limits.
+	cfg, rules := s.cfg(), s.rules()
+	if b.clients == nil {
+		b.clients = make(map[string]*flow)
+		b.hosts = make(map[string]*flow)
+		b.patterns = make(map[string]*flow)
+	}
+	if !b.applied {
+		s.applyBandwidthLocked(cfg, rules)
+	}
+	b.total.tunnels++
+
+	hosts := b.hosts
+	pattern, limit, ok := rules.GetBandwidth(host)
+	if ok {
+		host, hosts = pattern, b.patterns
+	}
+	clientFlow, created := joinFlow(b.clients, client)
+	if created {
+		clientFlow.setLimits(cfg.Bandwidth.ClientUpload, cfg.Bandwidth.ClientDownload)
+	}
+	hostFlow, created := joinFlow(hosts, host)
+	if created {
+		hostFlow.setLimits(limit.Upload, limit.Download)
+	}
+
+	sh := &shaping{s: s, client: client, host: host, hosts: hosts, flows: []*flow{&b.total, clientFlow, hostFlow}}
+	for _, f := range sh.flows {
+		sh.up = append(sh.up, &f.up)
+		sh.down = append(sh.down, &f.down)
+	}
+	return sh
+}
+
+// joinFlow adds a tunnel to the flow of key in flows, creating it if needed,
+// and reports whether it did.
+func joinFlow(flows map[string]*flow, key string) (*flow, bool) {
+	f, ok := flows[key]
+	if !ok {
+		f = &flow{}
+		flows[key] = f
+	}
+	f.tunnels++
+	return f, !ok
+}
+
+// leaveFlow removes a tunnel from the flow of key in flows, and the flow when
+// it was the last.
+func leaveFlow(flows map[string]*flow, key string) {
+	if f := flows[key]; f != nil {
+		if f.tunnels--; f.tunnels <= 0 {
+			delete(flows, key)
+		}
+	}
+}
+
+// release removes the tunnel from its flows.
+func (sh *shaping) release() {
+	if sh == nil {
+		return
+	}
+	b := &sh.s.bandwidth
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.total.tunnels--
+	leaveFlow(b.clients, sh.client)
+	leaveFlow(sh.hosts, sh.host)
+}
+
+// chunk returns how many bytes of a size-byte buffer to read at once in the
+// up or down direction.
+func (sh *shaping) chunk(up bool, size int) int {
+	if sh == nil {
+		return size
+	}
+	if up {
+		return ratelimit.Chunk(size, sh.up...)
+	}
+	return ratelimit.Chunk(size, sh.down...)
+}
+
+// wait holds n bytes going up or down until every flow of the tunnel lets
+// them through, then counts them. It returns false if stop is closed first.
+func (sh *shaping) wait(stop <-chan struct{}, up bool, n int) bool {
+	if sh == nil {
+		return true
+	}
+	buckets := sh.down
+	if up {
+		buckets = sh.up
+	}
+	if !ratelimit.Wait(stop, n, buckets...) {
+		return false
+	}
+	for _, f := range sh.flows {
+		if up {
+			f.upMeter.Add(n)
+		} else {
+			f.downMeter.Add(n)
+		}
+	}
+	return true
+}
+
+// read reads into b with read, at most what the up flows let through at
+// once, and waits until they do.
+func (sh *shaping) read(stop <-chan struct{}, read func([]byte) (int, error), b []byte) (int, error) {
+	n, err := read(b[:sh.chunk(true, len(b))])
+	if n > 0 && !sh.wait(stop, true, n) {
+		return n, net.ErrClosed
+	}
+	return n, err
+}
+
+// write writes b with write, in chunks that the down flows let through.
+func (sh *shaping) write(stop <-chan struct{}, write func([]byte) (int, error), b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		chunk = chunk[:sh.chunk(false, len(chunk))]
+		if !sh.wait(stop, false, len(chunk)) {
+			return written, net.ErrClosed
+		}
+		n, err := write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// applyBandwidth sets the limits of the open flows from cfg and rules, so
+// that a reload reaches tunnels that are already open.
+func (s *ProxyServer) applyBandwidth(cfg *config.Config, rules *config.Rules) {
+	b := &s.bandwidth
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s.applyBandwidthLocked(cfg, rules)
+}
+
+func (s *ProxyServer) applyBandwidthLocked(cfg *config.Config, rules *config.Rules) {
+	b := &s.bandwidth
+	b.applied = true
+	b.total.setLimits(cfg.Bandwidth.Upload, cfg.Bandwidth.Download)
+	for _, f := range b.clients {
+		f.setLimits(cfg.Bandwidth.ClientUpload, cfg.Bandwidth.ClientDownload)
+	}
+	for host, f := range b.hosts {
+		_, limit, _ := rules.GetBandwidth(host)
+		f.setLimits(limit.Upload, limit.Download)
+	}
+	for pattern, f := range b.patterns {
+		// A pattern that is gone leaves its flow unlimited; the next
+		// tunnels of its hosts join the flows of the patterns now matching.
+		var limit config.BandwidthLimit
+		if rules != nil {
+			limit = rules.Bandwidth[pattern]
+		}
+		f.setLimits(limit.Upload, limit.Download)
+	}
+}
+
+// Throughput is the current throughput of a set of tunnels in bytes per
+// second, averaged over the last few seconds, and its limits, 0 meaning
+// unlimited.
+type Throughput struct {
+	Name          string // Client IP, [bandwidth] pattern or host, empty for all tunnels
+	Tunnels       int    // Open tunnels
+	Upload        int64  // Client to remote
+	Download      int64  // Remote to client
+	UploadLimit   int64
+	DownloadLimit int64
+}
+
+// Bandwidth returns the throughput of all tunnels together, and of each
+// client IP and host, or [bandwidth] pattern, with open tunnels, busiest
+// first.
+func (s *ProxyServer) Bandwidth() (total Throughput, clients, hosts []Throughput) {
+	b := &s.bandwidth
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.total.throughput(""), listFlows(b.clients), listFlows(b.hosts, b.patterns)
+}
+
+func listFlows(sets ...map[string]*flow) []Throughput {
+	list := []Throughput{}
+	for _, flows := range sets {
+		for name, f := range flows {
+			list = append(list, f.throughput(name))
+		}
+	}
+	slices.SortFunc(list, func(a, b Throughput) int {
+		return cmp.Or(cmp.Compare(b.Upload+b.Download, a.Upload+a.Download), cmp.Compare(a.Name, b.Name))
+	})
+	return list
+}
+
+// shapedConn shapes the client side of a tunnel that tunnel does not pipe,
+// such as an HTTP-mode one: reads from the client go up, writes to it down.
+type shapedConn struct {
+	net.Conn
+	shape *shaping
+	stop  chan struct{}
+	once  sync.Once
+}
+
+func newShapedConn(conn net.Conn, shape *shaping) *shapedConn {
+	return &shapedConn{Conn: conn, shape: shape, stop: make(chan struct{})}
+}
+
+func (c *shapedConn) Read(b []byte) (int, error) {
+	return c.shape.read(c.stop, c.Conn.Read, b)
+}
+
+func (c *shapedConn) Write(b []byte) (int, error) {
+	return c.shape.write(c.stop, c.Conn.Write, b)
+}
+
+func (c *shapedConn) Close() error {
+	c.once.Do(func() { close(c.stop) })
+	return c.Conn.Close()
+}
+
+// shapedBody shapes the body of a forwarded request, which goes up.
+type shapedBody struct {
+	io.ReadCloser
+	shape *shaping
+	stop  <-chan struct{}
+}
+
+func (b *shapedBody) Read(p []byte) (int, error) {
+	return b.shape.read(b.stop, b.ReadCloser.Read, p)
+}
+
+// shapedResponseWriter shapes the response to a forwarded request, which
+// goes down.
+type shapedResponseWriter struct {
+	http.ResponseWriter
+	shape *shaping
+	stop  <-chan struct{}
+}
+
+func (w *shapedResponseWriter) Write(b []byte) (int, error) {
+	return w.shape.write(w.stop, w.ResponseWriter.Write, b)
+}
+
+// Unwrap lets http.ResponseController reach Flush and Hijack.
+func (w *shapedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
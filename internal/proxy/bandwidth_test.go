@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"snirect/internal/config"
+
+	"github.com/xihale/snirect-shared/rules"
+)
+
+// TestTunnel_Bandwidth tests that a tunnel is held to the global download
+// limit, that client IPs and host rules get flows of their own, shared by
+// the hosts of a pattern, and that a reload changes the limits of open
+// tunnels.
+func TestTunnel_Bandwidth(t *testing.T) {
+	cfg := &config.Config{Bandwidth: config.BandwidthConfig{Download: 64}}
+	ps := &ProxyServer{
+		Config: cfg,
+		Rules: &config.Rules{
+			Rules:     rules.NewRules(),
+			Bandwidth: map[string]config.BandwidthLimit{"*slow.test": {Upload: 32}},
+		},
+	}
+
+	client, clientProxy := net.Pipe()
+	remoteProxy, remote := net.Pipe()
+	defer client.Close()
+	defer remote.Close()
+	shape := ps.shape("192.0.2.1:1234", "www.slow.test")
+	done := make(chan struct{})
+	go func() {
+		ps.tunnel(clientProxy, remoteProxy, shape)
+		shape.release()
+		close(done)
+	}()
+
+	download := func() time.Duration {
+		t.Helper()
+		start := time.Now()
+		go remote.Write(make([]byte, 96*1024))
+		if _, err := io.ReadFull(client, make([]byte, 96*1024)); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		return time.Since(start)
+	}
+	// The bucket starts with a second's worth, the rest takes half a second.
+	if d := download(); d < 400*time.Millisecond {
+		t.Errorf("96 KiB at 64 KiB/s took %v", d)
+	}
+
+	total, clients, hosts := ps.Bandwidth()
+	if total.Tunnels != 1 || total.DownloadLimit != 64*1024 || total.UploadLimit != 0 {
+		t.Errorf("total = %+v", total)
+	}
+	if len(clients) != 1 || clients[0].Name != "192.0.2.1" || clients[0].DownloadLimit != 0 {
+		t.Errorf("clients = %+v", clients)
+	}
+	if len(hosts) != 1 || hosts[0].Name != "*slow.test" || hosts[0].UploadLimit != 32*1024 {
+		t.Errorf("hosts = %+v", hosts)
+	}
+	other := ps.shape("192.0.2.1:1235", "api.slow.test")
+	if _, _, hosts := ps.Bandwidth(); len(hosts) != 1 || hosts[0].Tunnels != 2 {
+		t.Errorf("hosts of one pattern do not share a flow: %+v", hosts)
+	}
+	other.release()
+
+	next := *cfg
+	next.Bandwidth.Download = 0
+	ps.Reload(&next, ps.rules())
+	if total, _, _ := ps.Bandwidth(); total.DownloadLimit != 0 {
+		t.Errorf("download limit after reload = %d", total.DownloadLimit)
+	}
+	if d := download(); d > 200*time.Millisecond {
+		t.Errorf("96 KiB without a limit took %v", d)
+	}
+
+	client.Close()
+	remote.Close()
+	<-done
+	total, clients, hosts = ps.Bandwidth()
+	if total.Tunnels != 0 || len(clients) != 0 || len(hosts) != 0 {
+		t.Errorf("flows left after the tunnel closed: %+v %+v %+v", total, clients, hosts)
+	}
+}
+
+// TestShape_PatternNamedLikeHost tests that the flow of a [bandwidth] pattern
+// is kept apart from that of an unshaped host of the same name.
+func TestShape_PatternNamedLikeHost(t *testing.T) {
+	cfg := &config.Config{}
+	ps := &ProxyServer{Config: cfg, Rules: &config.Rules{Rules: rules.NewRules()}}
+	unshaped := ps.shape("192.0.2.1:1234", "slow.test")
+	ps.Reload(cfg, &config.Rules{
+		Rules:     rules.NewRules(),
+		Bandwidth: map[string]config.BandwidthLimit{"slow.test": {Upload: 32}},
+	})
+	shaped := ps.shape("192.0.2.1:1235", "slow.test")
+
+	_, _, hosts := ps.Bandwidth()
+	if len(hosts) != 2 || hosts[0].Tunnels != 1 || hosts[1].Tunnels != 1 {
+		t.Errorf("host and pattern share a flow: %+v", hosts)
+	}
+	unshaped.release()
+	shaped.release()
+	if _, _, hosts := ps.Bandwidth(); len(hosts) != 0 {
+		t.Errorf("flows left after release: %+v", hosts)
+	}
+}
+
+// TestHandleForward_Bandwidth tests that forwarded plain-HTTP responses are
+// held to the download limit.
+func TestHandleForward_Bandwidth(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 96*1024))
+	}))
+	defer backend.Close()
+
+	ps := newShutdownTestProxy()
+	ps.Config.Bandwidth.Download = 64
+	ps.Resolver = &mockResolver{
+		resolveFunc: func(ctx context.Context, host string, clientIP net.IP) (string, error) {
+			return "127.0.0.1", nil
+		},
+	}
+	defer ps.Close()
+
+	req := httptest.NewRequest(http.MethodGet, backend.URL+"/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	rr := httptest.NewRecorder()
+	start := time.Now()
+	ps.handleForward(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.Len() != 96*1024 {
+		t.Fatalf("status %d with %d bytes", rr.Code, rr.Body.Len())
+	}
+	// The bucket starts with a second's worth, the rest takes half a second.
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Errorf("96 KiB at 64 KiB/s took %v", d)
+	}
+	if total, _, _ := ps.Bandwidth(); total.Tunnels != 0 {
+		t.Errorf("tunnels left after the request: %d", total.Tunnels)
+	}
+}
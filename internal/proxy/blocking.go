@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"slices"
+	"time"
+
+	"snirect/internal/config"
+	"snirect/internal/learned"
+	"snirect/internal/logger"
+
+	ruleslib "github.com/xihale/snirect-shared/rules"
+)
+
+// watchBlocking reports whether the direct tunnel of ctx should be watched
+// for blocking: block_detection is on and the host could be intercepted
+// instead, and the client starts with a ClientHello. The ClientHello is
+// peeked here unless an earlier phase already did.
+func (s *ProxyServer) watchBlocking(ctx *connectContext) bool {
+	cfg := s.cfg()
+	if cfg == nil || !cfg.BlockDetection.Enabled || s.Learned == nil || s.CA == nil {
+		return false
+	}
+	if net.ParseIP(ctx.Host) != nil || !s.interceptsPort(ctx.Host, ctx.Port) || s.Passthrough.Contains(ctx.Host) {
+		return false
+	}
+	if _, ok := s.rules().GetFragment(ctx.Host); ok {
+		return false
+	}
+	if ctx.hello == nil {
+		ctx.clientConn.SetReadDeadline(deadlineAfter(s.clientHandshakeTimeout()))
+		hello, conn, err := peekClientHello(ctx.clientConn)
+		ctx.clientConn = conn
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			return false
+		}
+		ctx.hello = hello
+	}
+	return true
+}
+
+// blockTimeout returns block_detection.timeout, defaulting to 10s.
+func (s *ProxyServer) blockTimeout() time.Duration {
+	timeout := time.Duration(s.cfg().BlockDetection.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return timeout
+}
+
+// answerConn is a remote connection given a read deadline by which it must
+// start answering; the first bytes read lift it.
+type answerConn struct {
+	net.Conn
+	answered bool
+}
+
+func (c *answerConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 && !c.answered {
+		c.answered = true
+		c.Conn.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
+
+func (c *answerConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// checkBlocked looks for a blocking signature on a finished direct tunnel
+// that lasted elapsed and whose remote had timeout to answer: the client sent
+// its ClientHello and the remote sent nothing back, but let the timeout pass
+// or failed before. The host is then probed in the background, see
+// probeBlocked.
+func (s *ProxyServer) checkBlocked(ctx *connectContext, elapsed, timeout time.Duration) {
+	var reason string
+	switch {
+	case ctx.BytesIn == 0 || ctx.BytesOut != 0:
+		return
+	case elapsed >= timeout:
+		reason = learned.ReasonTimeout
+	case ctx.CloseReason == closeRemoteError:
+		reason = learned.ReasonReset
+	default:
+		return
+	}
+	if _, busy := s.probing.LoadOrStore(ctx.Host, struct{}{}); busy {
+		return
+	}
+	logger.Info("Block detection: direct connection to %s looks blocked (%s), probing other SNIs", ctx.Host, reason)
+	host, port, clientAddr := ctx.Host, ctx.Port, ctx.ClientAddr
+	go func() {
+		defer s.probing.Delete(host)
+		s.probeBlocked(host, port, clientAddr, reason)
+	}()
+}
+
+// probeBlocked retries the TLS handshake with host the way an intercepted
+// connection would, with the SNI stripped and then with the host's
+// [sni_fallback] candidates. The first SNI whose handshake succeeds and whose
+// certificate verifies for host is learned as an alter_hostname rule.
+func (s *ProxyServer) probeBlocked(host, port, clientAddr, reason string) {
+	candidates := []string{""}
+	if fallback, ok := s.rules().GetSNIFallback(host); ok {
+		for _, sni := range fallback {
+			if sni != ruleslib.DefaultAutoMarker && sni != host && !slices.Contains(candidates, sni) {
+				candidates = append(candidates, sni)
+			}
+		}
+	}
+
+	for _, sni := range candidates {
+		ctx, cancel := context.WithTimeout(context.Background(), s.dialTimeout())
+		conn, err := s.connectToRemote(ctx, host, port, clientAddr, sni, nil)
+		cancel()
+		if err != nil {
+			logger.Debug("Block detection: %s with SNI %q failed: %v", host, sni, err)
+			continue
+		}
+		verified := s.verifyServerCert(conn, host, sni)
+		conn.Close()
+		if !verified {
+			logger.Debug("Block detection: %s with SNI %q returned a certificate that does not verify", host, sni)
+			continue
+		}
+		s.learnRewrite(host, sni, reason)
+		return
+	}
+	logger.Info("Block detection: no SNI reached %s, leaving it direct", host)
+}
+
+// learnRewrite records sni as the learned alter_hostname rule for host and
+// adds it to the running rules, so that the next connection is intercepted
+// with it. The rule concerns neither DNS nor outbound routing, so only the
+// rules are swapped rather than the whole configuration reloaded.
+func (s *ProxyServer) learnRewrite(host, sni, reason string) {
+	ttl := time.Duration(s.cfg().BlockDetection.TTL) * time.Hour
+	if ttl <= 0 {
+		ttl = 7 * 24 * time.Hour
+	}
+	if err := s.Learned.Add(host, sni, reason, ttl); err != nil {
+		logger.Warn("Failed to save learned rules: %v", err)
+	}
+
+	s.updateRules(func(cur *config.Rules) *config.Rules {
+		next := *cur
+		if cur.Rules != nil {
+			next.Rules = cur.Rules.DeepCopy()
+		} else {
+			next.Rules = ruleslib.NewRules()
+		}
+		next.Rules.AlterHostname[host] = sni
+		next.Rules.Init()
+		return &next
+	})
+	time.AfterFunc(ttl, func() { s.forgetRewrite(host, sni) })
+	logger.Info("Block detection: learned alter_hostname %s -> %q (%s), intercepting it for %v", host, sni, reason, ttl)
+}
+
+// forgetRewrite drops the alter_hostname rule learnRewrite added to the
+// running rules once the learned rule for host expired. The reloader skips
+// the proxy's own writes to the learned layer, so nothing else would. A rule
+// learned again since, or replaced by another SNI, is kept.
+func (s *ProxyServer) forgetRewrite(host, sni string) {
+	if _, ok := s.Learned.SNI(host); ok {
+		return
+	}
+	forgot := false
+	s.updateRules(func(cur *config.Rules) *config.Rules {
+		if cur == nil || cur.Rules == nil {
+			return cur
+		}
+		if got, ok := cur.Rules.AlterHostname[host]; !ok || got != sni {
+			return cur
+		}
+		next := *cur
+		next.Rules = cur.Rules.DeepCopy()
+		delete(next.Rules.AlterHostname, host)
+		next.Rules.Init()
+		forgot = true
+		return &next
+	})
+	if forgot {
+		logger.Info("Block detection: learned alter_hostname for %s expired", host)
+	}
+}
@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"snirect/internal/cert"
+	"snirect/internal/learned"
+)
+
+// blockingListener imitates SNI blocking: connections whose ClientHello names
+// blocked are reset, or left unanswered when silent, while the rest are
+// accepted with the ClientHello replayed.
+type blockingListener struct {
+	net.Listener
+	blocked string
+	silent  bool
+
+	mu   sync.Mutex
+	held []net.Conn
+}
+
+func (l *blockingListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		hello, conn, err := peekClientHello(conn)
+		if err != nil || hello.ServerName != l.blocked {
+			return conn, nil
+		}
+		if l.silent {
+			l.mu.Lock()
+			l.held = append(l.held, conn)
+			l.mu.Unlock()
+			continue
+		}
+		conn.(*prefixConn).Conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	}
+}
+
+func (l *blockingListener) Close() error {
+	l.mu.Lock()
+	for _, c := range l.held {
+		c.Close()
+	}
+	l.mu.Unlock()
+	return l.Listener.Close()
+}
+
+// TestProxy_BlockDetection tests that a direct tunnel reset or ignored after
+// a ClientHello naming the host gets the host a learned alter_hostname rule
+// stripping the SNI, and that the next connection is intercepted with it.
+func TestProxy_BlockDetection(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		silent bool
+		reason string
+	}{
+		{"reset", false, learned.ReasonReset},
+		{"timeout", true, learned.ReasonTimeout},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			const host = "blocked.example"
+			certMgr, err := cert.NewCertificateManager(filepath.Join(t.TempDir(), "root.crt"), filepath.Join(t.TempDir(), "root.key"))
+			if err != nil {
+				t.Fatalf("NewCertificateManager: %v", err)
+			}
+			defer certMgr.Close()
+			leaf, err := certMgr.GetCertificate(&tls.ClientHelloInfo{ServerName: host})
+			if err != nil {
+				t.Fatalf("GetCertificate: %v", err)
+			}
+
+			snis := make(chan string, 4)
+			ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				snis <- r.TLS.ServerName
+			}))
+			ts.Listener = &blockingListener{Listener: ts.Listener, blocked: host, silent: tc.silent}
+			ts.TLS = &tls.Config{Certificates: []tls.Certificate{*leaf}}
+			ts.StartTLS()
+			defer ts.Close()
+			_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+			layer, err := learned.Load(filepath.Join(t.TempDir(), learned.FileName))
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			ps := newShutdownTestProxy()
+			portNum, _ := strconv.Atoi(port)
+			ps.Config.Server.InterceptPorts = []int{portNum}
+			ps.Config.BlockDetection.Enabled = true
+			ps.Config.BlockDetection.Timeout = 1
+			ps.CA = certMgr
+			ps.Learned = layer
+			proxyAddr := startTestProxy(t, ps)
+			defer ps.Close()
+
+			if ps.shouldIntercept(host, port) {
+				t.Fatal("host is intercepted before anything was learned")
+			}
+			conn := openDirectTunnel(t, proxyAddr, net.JoinHostPort(host, port))
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+			tlsConn.SetDeadline(time.Now().Add(1500 * time.Millisecond))
+			if err := tlsConn.Handshake(); err == nil {
+				t.Fatal("handshake through a blocked direct tunnel succeeded")
+			}
+			conn.Close()
+
+			// The running rules change once the learned rule was saved.
+			for deadline := time.Now().Add(5 * time.Second); !ps.shouldIntercept(host, port); time.Sleep(10 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatal("nothing was learned")
+				}
+			}
+			if sni, _ := ps.rules().GetAlterHostname(host); sni != "" {
+				t.Errorf("running rules: alter_hostname = %q, want stripped", sni)
+			}
+			if e := layer.Entries(); len(e) != 1 || e[0].Host != host || e[0].SNI != "" || e[0].Reason != tc.reason {
+				t.Errorf("learned %+v, want %s stripped (%s)", e, host, tc.reason)
+			}
+
+			proxyURL, _ := url.Parse("http://" + proxyAddr)
+			client := &http.Client{Transport: &http.Transport{
+				Proxy:           http.ProxyURL(proxyURL),
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			}}
+			defer client.CloseIdleConnections()
+			resp, err := client.Get("https://" + host + ":" + port + "/")
+			if err != nil {
+				t.Fatalf("GET after learning: %v", err)
+			}
+			resp.Body.Close()
+			if sni := <-snis; sni != "" {
+				t.Errorf("intercepted connection sent SNI %q", sni)
+			}
+		})
+	}
+}
+
+// TestProxy_ForgetRewrite tests that a learned alter_hostname rule leaves the
+// running rules once it expired in the learned layer, and not before.
+func TestProxy_ForgetRewrite(t *testing.T) {
+	const host = "blocked.example"
+	layer, err := learned.Load(filepath.Join(t.TempDir(), learned.FileName))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	ps := newShutdownTestProxy()
+	ps.Learned = layer
+	ps.learnRewrite(host, "", learned.ReasonReset)
+	if _, ok := ps.rules().GetAlterHostname(host); !ok {
+		t.Fatal("running rules lack the learned rule")
+	}
+
+	ps.forgetRewrite(host, "")
+	if _, ok := ps.rules().GetAlterHostname(host); !ok {
+		t.Fatal("forgot a rule that has not expired")
+	}
+
+	if err := layer.Add(host, "", learned.ReasonReset, -time.Second); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	ps.forgetRewrite(host, "")
+	if sni, ok := ps.rules().GetAlterHostname(host); ok {
+		t.Errorf("running rules keep the expired rule: %q", sni)
+	}
+}
@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// TLS wire constants used when peeking at a ClientHello.
+const (
+	recordTypeHandshake      = 22
+	recordHeaderLen          = 5
+	maxRecordPayload         = 1<<14 + 2048 // TLSCiphertext limit, tolerated for the first flight
+	handshakeTypeClientHello = 1
+	maxClientHelloSize       = 1 << 16
+
+	extServerName = 0
+	extALPN       = 16
+)
+
+// errNotClientHello is returned when the peeked bytes are not a TLS ClientHello.
+var errNotClientHello = errors.New("not a TLS ClientHello")
+
+// clientHello holds the parts of a TLS ClientHello that routing decisions need.
+type clientHello struct {
+	Raw        []byte   // The TLS records carrying the ClientHello, as read from the wire
+	ServerName string   // SNI host name, empty if absent
+	ALPN       []string // Offered application protocols, in client order
+
+	// SNIStart and SNIEnd locate the host name bytes inside Raw; both are zero
+	// when the ClientHello has no SNI.
+	SNIStart, SNIEnd int
+}
+
+// peekClientHello reads the ClientHello from conn. The returned connection
+// replays every byte read so far, so the handshake can proceed untouched;
+// it is valid even when err is non-nil.
+func peekClientHello(conn net.Conn) (*clientHello, net.Conn, error) {
+	var buf bytes.Buffer
+	hello, err := readClientHello(io.TeeReader(conn, &buf))
+	return hello, newPrefixConn(conn, buf.Bytes()), err
+}
+
+// recordSpan maps a run of handshake message bytes to its position in Raw.
+type recordSpan struct {
+	raw, msg, n int
+}
+
+// readClientHello reads TLS records from r until one complete ClientHello
+// handshake message is available and parses it.
+func readClientHello(r io.Reader) (*clientHello, error) {
+	var (
+		raw   []byte
+		msg   []byte
+		spans []recordSpan
+		need  = -1
+	)
+	for need < 0 || len(msg) < need {
+		hdr := make([]byte, recordHeaderLen)
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return nil, err
+		}
+		if hdr[0] != recordTypeHandshake || hdr[1] != 3 {
+			return nil, errNotClientHello
+		}
+		n := int(binary.BigEndian.Uint16(hdr[3:]))
+		if n == 0 || n > maxRecordPayload {
+			return nil, errNotClientHello
+		}
+
+		raw = append(raw, hdr...)
+		spans = append(spans, recordSpan{raw: len(raw), msg: len(msg), n: n})
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, err
+		}
+		raw = append(raw, payload...)
+		msg = append(msg, payload...)
+
+		if need < 0 && len(msg) >= 4 {
+			if msg[0] != handshakeTypeClientHello {
+				return nil, errNotClientHello
+			}
+			need = 4 + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+			if need > maxClientHelloSize {
+				return nil, errNotClientHello
+			}
+		}
+	}
+
+	hello := &clientHello{Raw: raw}
+	sniOff, sniLen, err := parseClientHello(msg[4:need], hello)
+	if err != nil {
+		return nil, err
+	}
+	if sniLen > 0 {
+		// Offsets are relative to the handshake body; map them onto Raw.
+		hello.SNIStart = rawOffset(spans, 4+sniOff)
+		hello.SNIEnd = rawOffset(spans, 4+sniOff+sniLen-1) + 1
+	}
+	return hello, nil
+}
+
+// rawOffset converts an offset in the reassembled handshake message into an
+// offset in the raw record stream.
+func rawOffset(spans []recordSpan, off int) int {
+	for _, s := range spans {
+		if off < s.msg+s.n {
+			return s.raw + off - s.msg
+		}
+	}
+	return -1
+}
+
+// parseClientHello fills in hello from a ClientHello body and returns the
+// offset and length of the SNI host name within body.
+func parseClientHello(body []byte, hello *clientHello) (int, int, error) {
+	p := &helloParser{b: body}
+	p.skip(2 + 32)  // legacy_version, random
+	p.skip(p.u8())  // legacy_session_id
+	p.skip(p.u16()) // cipher_suites
+	p.skip(p.u8())  // legacy_compression_methods
+	if p.err {
+		return 0, 0, errNotClientHello
+	}
+	if p.off == len(body) {
+		return 0, 0, nil // No extensions
+	}
+
+	sniOff, sniLen := 0, 0
+	end := p.off + p.u16()
+	for !p.err && p.off < end {
+		typ, n := p.u16(), p.u16()
+		extEnd := p.off + n
+		switch typ {
+		case extServerName:
+			listEnd := p.off + p.u16()
+			for !p.err && p.off < listEnd {
+				nameType, nameLen := p.u8(), p.u16()
+				if nameType == 0 && hello.ServerName == "" {
+					sniOff, sniLen = p.off, nameLen
+					hello.ServerName = string(p.bytes(nameLen))
+				} else {
+					p.skip(nameLen)
+				}
+			}
+		case extALPN:
+			listEnd := p.off + p.u16()
+			for !p.err && p.off < listEnd {
+				hello.ALPN = append(hello.ALPN, string(p.bytes(p.u8())))
+			}
+		}
+		if p.off > extEnd {
+			p.err = true
+		}
+		p.off = extEnd
+	}
+	if p.err || p.off > len(body) {
+		return 0, 0, errNotClientHello
+	}
+	return sniOff, sniLen, nil
+}
+
+// helloParser is a bounds-checked cursor over handshake bytes. Reads past the
+// end set err and return zero values.
+type helloParser struct {
+	b   []byte
+	off int
+	err bool
+}
+
+func (p *helloParser) bytes(n int) []byte {
+	if p.err || n < 0 || p.off+n > len(p.b) {
+		p.err = true
+		return nil
+	}
+	v := p.b[p.off : p.off+n]
+	p.off += n
+	return v
+}
+
+func (p *helloParser) skip(n int) { p.bytes(n) }
+
+func (p *helloParser) u8() int {
+	if b := p.bytes(1); b != nil {
+		return int(b[0])
+	}
+	return 0
+}
+
+func (p *helloParser) u16() int {
+	if b := p.bytes(2); b != nil {
+		return int(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+// prefixConn replays bytes already read from a connection before reading more.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func newPrefixConn(conn net.Conn, prefix []byte) net.Conn {
+	if len(prefix) == 0 {
+		return conn
+	}
+	return &prefixConn{Conn: conn, prefix: prefix}
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// CloseWrite half-closes the underlying connection when it supports it.
+func (c *prefixConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// captureClientHello returns the raw ClientHello records a Go TLS client sends with cfg.
+func captureClientHello(t *testing.T, cfg *tls.Config) []byte {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go func() {
+		tls.Client(c1, cfg).Handshake()
+		c1.Close()
+	}()
+
+	hello, err := readClientHello(c2)
+	if err != nil {
+		t.Fatalf("readClientHello: %v", err)
+	}
+	return hello.Raw
+}
+
+// TestReadClientHello tests SNI and ALPN extraction and the SNI offsets.
+func TestReadClientHello(t *testing.T) {
+	raw := captureClientHello(t, &tls.Config{
+		ServerName: "www.example.com",
+		NextProtos: []string{"h2", "http/1.1"},
+	})
+
+	hello, err := readClientHello(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("readClientHello: %v", err)
+	}
+	if hello.ServerName != "www.example.com" {
+		t.Errorf("ServerName = %q, want www.example.com", hello.ServerName)
+	}
+	if len(hello.ALPN) != 2 || hello.ALPN[0] != "h2" || hello.ALPN[1] != "http/1.1" {
+		t.Errorf("ALPN = %v, want [h2 http/1.1]", hello.ALPN)
+	}
+	if got := string(hello.Raw[hello.SNIStart:hello.SNIEnd]); got != "www.example.com" {
+		t.Errorf("Raw[SNIStart:SNIEnd] = %q, want www.example.com", got)
+	}
+}
+
+// TestReadClientHello_NotTLS tests that plain-text data is rejected.
+func TestReadClientHello_NotTLS(t *testing.T) {
+	_, err := readClientHello(bytes.NewReader([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n")))
+	if err != errNotClientHello {
+		t.Fatalf("err = %v, want errNotClientHello", err)
+	}
+}
+
+// TestPeekClientHello_Replays tests that peeked bytes are not consumed.
+func TestPeekClientHello_Replays(t *testing.T) {
+	raw := captureClientHello(t, &tls.Config{ServerName: "replay.example"})
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go func() {
+		c2.Write(append(raw, "trailing"...))
+		c2.Close()
+	}()
+
+	hello, conn, err := peekClientHello(c1)
+	if err != nil {
+		t.Fatalf("peekClientHello: %v", err)
+	}
+	if hello.ServerName != "replay.example" {
+		t.Fatalf("ServerName = %q", hello.ServerName)
+	}
+	all, _ := io.ReadAll(conn)
+	if !bytes.Equal(all, append(raw, "trailing"...)) {
+		t.Fatalf("replayed %d bytes, want %d", len(all), len(raw)+len("trailing"))
+	}
+}
+
+// TestHandleTransparent_DirectDialsDst tests that a redirected connection that
+// is not intercepted is tunnelled to its original destination, not to what its
+// SNI resolves to, with the ClientHello intact.
+func TestHandleTransparent_DirectDialsDst(t *testing.T) {
+	echoAddr := newEchoServer(t)
+	echo, _ := net.ResolveTCPAddr("tcp", echoAddr)
+
+	var mu sync.Mutex
+	var resolved []string
+	ps := newShutdownTestProxy()
+	ps.Resolver = &mockResolver{
+		resolveFunc: func(ctx context.Context, host string, clientIP net.IP) (string, error) {
+			mu.Lock()
+			resolved = append(resolved, host)
+			mu.Unlock()
+			return "192.0.2.1", nil
+		},
+	}
+
+	raw := captureClientHello(t, &tls.Config{ServerName: "sni.example"})
+	client, server := net.Pipe()
+	defer client.Close()
+	go ps.handleTransparent(1, server, echo)
+
+	go client.Write(raw)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(raw))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatalf("read echoed ClientHello: %v", err)
+	}
+	if !bytes.Equal(got, raw) {
+		t.Fatal("ClientHello was modified in transit")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(resolved) != 0 {
+		t.Fatalf("resolved %v, want the original destination dialed", resolved)
+	}
+}
+
+// tproxyListener stands in for a TPROXY socket: the connections it accepts
+// report dst, if set, as their local address, as if they had been made to it.
+type tproxyListener struct {
+	net.Listener
+	dst *net.TCPAddr
+}
+
+type tproxyConn struct {
+	net.Conn
+	local net.Addr
+}
+
+func (c *tproxyConn) LocalAddr() net.Addr { return c.local }
+
+func (l *tproxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil || l.dst == nil {
+		return conn, err
+	}
+	return &tproxyConn{Conn: conn, local: l.dst}, nil
+}
+
+// TestServeTransparent_TProxy tests that in TPROXY mode, where the original
+// destination is the accepted socket's local address, redirected connections
+// are served and only those made straight to the listener are dropped.
+func TestServeTransparent_TProxy(t *testing.T) {
+	echoAddr := newEchoServer(t)
+	echo, _ := net.ResolveTCPAddr("tcp", echoAddr)
+	raw := captureClientHello(t, &tls.Config{ServerName: "sni.example"})
+	originalDstOf = func(conn net.Conn, tproxy bool) (*net.TCPAddr, error) {
+		if !tproxy {
+			t.Error("original destination looked up in REDIRECT mode")
+		}
+		return conn.LocalAddr().(*net.TCPAddr), nil
+	}
+	defer func() { originalDstOf = originalDst }()
+
+	for _, tt := range []struct {
+		name string
+		dst  *net.TCPAddr
+	}{
+		{"redirected", echo},
+		{"straight", nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ps := newShutdownTestProxy()
+			go ps.ServeTransparent(&tproxyListener{Listener: ln, dst: tt.dst}, TransparentTProxy)
+			defer ps.Close()
+
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Write(raw)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			got := make([]byte, len(raw))
+			_, err = io.ReadFull(conn, got)
+			if tt.dst != nil && (err != nil || !bytes.Equal(got, raw)) {
+				t.Fatalf("read %v; want the ClientHello echoed", err)
+			}
+			if tt.dst == nil && err == nil {
+				t.Fatal("a connection straight to the listener was served")
+			}
+		})
+	}
+}
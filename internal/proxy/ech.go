@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+
+	"snirect/internal/config"
+	"snirect/internal/interfaces"
+	"snirect/internal/tlsutil"
+)
+
+// errNoECH reports that a host with ech mode publishes no ECH configs.
+var errNoECH = errors.New("no ECH configs published")
+
+// echMode returns the [ech] mode for host, or the global ech.mode when no
+// rule matches.
+func (s *ProxyServer) echMode(host string) string {
+	if mode, ok := s.rules().GetECH(host); ok {
+		return mode
+	}
+	if cfg := s.cfg(); cfg != nil && cfg.ECH.Mode != "" {
+		return cfg.ECH.Mode
+	}
+	return config.ECHOff
+}
+
+// lookupECH returns the ECH configs host:port publishes, or nil when the
+// resolver cannot look them up.
+func (s *ProxyServer) lookupECH(ctx context.Context, host, port string) ([]byte, error) {
+	r, ok := s.Resolver.(interfaces.ECHResolver)
+	if !ok {
+		return nil, nil
+	}
+	return r.LookupECH(ctx, host, port)
+}
+
+// connectToRemoteECH is connectToRemote with Encrypted Client Hello: the
+// remote sees serverName only inside the encrypted inner ClientHello. When
+// the remote rejects configs but sends retry configs, it is dialed once more
+// with those, and the resolver keeps them for later connections.
+func (s *ProxyServer) connectToRemoteECH(ctx context.Context, host, port, clientAddr, serverName string, alpn []string, configs []byte) (tlsutil.Conn, error) {
+	policy, sec := s.certPolicy(host), s.cfg().Security
+	var store func([]byte)
+	if r, ok := s.Resolver.(interfaces.ECHResolver); ok {
+		store = func(retry []byte) { r.StoreECH(host, port, retry) }
+	}
+	return tlsutil.HandshakeECH(host, configs, func(configs []byte) (tlsutil.Conn, error) {
+		return s.dialRemoteTLS(ctx, host, port, clientAddr, tlsutil.ECHClientConfig(serverName, alpn, configs, policy, sec))
+	}, store)
+}
+
+// sniLabel returns the SNI of ctx for logging, marked when it was encrypted.
+func sniLabel(ctx *connectContext) string {
+	if ctx.ECH {
+		return ctx.TargetSNI + " (ECH)"
+	}
+	return ctx.TargetSNI
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"snirect/internal/cert"
+	"snirect/internal/config"
+)
+
+// newECHKey returns a server key for ECH with the given config ID and public
+// name, and the ECHConfigList a client needs to use it.
+func newECHKey(t *testing.T, id byte, publicName string) (tls.EncryptedClientHelloKey, []byte) {
+	t.Helper()
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate ECH key: %v", err)
+	}
+	pub := priv.PublicKey().Bytes()
+
+	var contents []byte
+	contents = append(contents, id)
+	contents = binary.BigEndian.AppendUint16(contents, 0x0020) // DHKEM(X25519, HKDF-SHA256)
+	contents = binary.BigEndian.AppendUint16(contents, uint16(len(pub)))
+	contents = append(contents, pub...)
+	contents = binary.BigEndian.AppendUint16(contents, 4)
+	contents = binary.BigEndian.AppendUint16(contents, 0x0001) // HKDF-SHA256
+	contents = binary.BigEndian.AppendUint16(contents, 0x0001) // AES-128-GCM
+	contents = append(contents, 0, byte(len(publicName)))      // maximum_name_length, public_name
+	contents = append(contents, publicName...)
+	contents = binary.BigEndian.AppendUint16(contents, 0) // No extensions
+
+	config := binary.BigEndian.AppendUint16(nil, 0xfe0d)
+	config = binary.BigEndian.AppendUint16(config, uint16(len(contents)))
+	config = append(config, contents...)
+	list := binary.BigEndian.AppendUint16(nil, uint16(len(config)))
+	list = append(list, config...)
+	return tls.EncryptedClientHelloKey{Config: config, PrivateKey: priv.Bytes(), SendAsRetry: true}, list
+}
+
+// echMockResolver is a mockResolver that serves ECH configs.
+type echMockResolver struct {
+	mockResolver
+	mu      sync.Mutex
+	configs []byte
+	stored  []byte
+}
+
+func (m *echMockResolver) LookupECH(ctx context.Context, host, port string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.configs, nil
+}
+
+func (m *echMockResolver) StoreECH(host, port string, configs []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.configs, m.stored = configs, configs
+}
+
+// TestProxy_ECH tests that a host with an [ech] rule is reached with
+// Encrypted Client Hello, retrying with the configs a server sends back when
+// the published ones are stale, and that ech mode fails rather than falling
+// back when no configs are published.
+func TestProxy_ECH(t *testing.T) {
+	certMgr, err := cert.NewCertificateManager(filepath.Join(t.TempDir(), "root.crt"), filepath.Join(t.TempDir(), "root.key"))
+	if err != nil {
+		t.Fatalf("NewCertificateManager: %v", err)
+	}
+	defer certMgr.Close()
+
+	key, configs := newECHKey(t, 1, "public.example")
+	_, stale := newECHKey(t, 2, "public.example")
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%v", r.TLS.ServerName, r.TLS.ECHAccepted)
+	}))
+	ts.TLS = &tls.Config{EncryptedClientHelloKeys: []tls.EncryptedClientHelloKey{key}}
+	ts.StartTLS()
+	defer ts.Close()
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+	for _, tc := range []struct {
+		name      string
+		mode      string
+		published []byte
+		wantBody  string // Empty when the request must fail
+		wantStore bool
+	}{
+		{"accepted", config.ECHOnly, configs, "ech.example|true", false},
+		{"retry", config.ECHOnly, stale, "ech.example|true", true},
+		{"no configs", config.ECHOnly, nil, "", false},
+		{"fallback", config.ECHThenRewrite, nil, "ech.example|false", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ps := newShutdownTestProxy()
+			resolver := &echMockResolver{mockResolver: *ps.Resolver.(*mockResolver), configs: tc.published}
+			ps.Resolver = resolver
+			portNum, _ := strconv.Atoi(port)
+			ps.Config.Server.InterceptPorts = []int{portNum}
+			ps.Rules.CertVerify["ech.example"] = false
+			ps.Rules.Init()
+			ps.Rules.ECH = map[string]string{"ech.example": tc.mode}
+			ps.CA = certMgr
+			proxyAddr := startTestProxy(t, ps)
+			defer ps.Close()
+
+			proxyURL, _ := url.Parse("http://" + proxyAddr)
+			client := &http.Client{Transport: &http.Transport{
+				Proxy:           http.ProxyURL(proxyURL),
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			}}
+			defer client.CloseIdleConnections()
+
+			resp, err := client.Get("https://ech.example:" + port + "/")
+			if tc.wantBody == "" {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("request succeeded without ECH configs")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GET through proxy: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != tc.wantBody {
+				t.Errorf("remote saw %s, want %s", body, tc.wantBody)
+			}
+			if stored := resolver.stored != nil; stored != tc.wantStore {
+				t.Errorf("retry configs stored = %v, want %v", stored, tc.wantStore)
+			}
+		})
+	}
+}
+
+// TestShouldIntercept_ECH tests that an ech or ech-then-rewrite rule forces
+// MITM and that an off rule does not.
+func TestShouldIntercept_ECH(t *testing.T) {
+	ps := newShutdownTestProxy()
+	ps.Rules.ECH = map[string]string{
+		"*example.com":    config.ECHThenRewrite,
+		"www.example.com": config.ECHOff,
+	}
+	if !ps.shouldIntercept("example.com", "443") {
+		t.Error("ech rule should intercept")
+	}
+	if ps.shouldIntercept("www.example.com", "443") {
+		t.Error("ech = off should not intercept")
+	}
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"snirect/internal/cert"
+	"snirect/internal/config"
+)
+
+// TestProxy_Fingerprint tests that remote handshakes use the ClientHello
+// profile of a [fingerprint] rule, or fingerprint.profile without one.
+func TestProxy_Fingerprint(t *testing.T) {
+	certMgr, err := cert.NewCertificateManager(filepath.Join(t.TempDir(), "root.crt"), filepath.Join(t.TempDir(), "root.key"))
+	if err != nil {
+		t.Fatalf("NewCertificateManager: %v", err)
+	}
+	defer certMgr.Close()
+
+	hellos := make(chan *tls.ClientHelloInfo, 1)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		hellos <- hello
+		return nil, nil
+	}}
+	ts.StartTLS()
+	defer ts.Close()
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+	ps := newShutdownTestProxy()
+	portNum, _ := strconv.Atoi(port)
+	ps.Config.Server.InterceptPorts = []int{portNum}
+	ps.Config.CheckHostname = false
+	ps.Config.Fingerprint.Profile = config.FingerprintRandomized
+	ps.Rules.Fingerprint = map[string]string{"go.example": config.FingerprintGo, "chrome.example": config.FingerprintChrome}
+	ps.CA = certMgr
+	proxyAddr := startTestProxy(t, ps)
+	defer ps.Close()
+
+	proxyURL, _ := url.Parse("http://" + proxyAddr)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:             http.ProxyURL(proxyURL),
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true, // A remote handshake per request
+	}}
+
+	// offered returns the suites and groups the remote was offered for host.
+	offered := func(host string) string {
+		t.Helper()
+		resp, err := client.Get("https://" + host + ":" + port + "/")
+		if err != nil {
+			t.Fatalf("GET %s through proxy: %v", host, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		hello := <-hellos
+		if hello.ServerName != host {
+			t.Fatalf("remote saw SNI %q, want %q", hello.ServerName, host)
+		}
+		return fmt.Sprint(hello.CipherSuites, hello.SupportedCurves)
+	}
+
+	def := offered("go.example")
+	if again := offered("go.example"); again != def {
+		t.Fatalf("go-default offered %s, then %s", def, again)
+	}
+	if offered("chrome.example") == def {
+		t.Fatal("chrome offered Go's default suites and groups")
+	}
+	for i := 0; ; i++ {
+		if offered("random.example") != def {
+			break
+		}
+		if i == 10 {
+			t.Fatal("randomized kept offering Go's default suites and groups")
+		}
+	}
+}
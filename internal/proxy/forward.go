@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+
+	"snirect/internal/logger"
+)
+
+// clientIPKey carries the requesting client's IP to dialForward for ECS.
+type clientIPKey struct{}
+
+// handleForward proxies an absolute-form plain-HTTP request (`GET http://host/path`).
+// Hosts with an [http_upgrade] rule are redirected to HTTPS instead.
+func (s *ProxyServer) handleForward(w http.ResponseWriter, r *http.Request) {
+	host := r.URL.Hostname()
+	if s.rules().GetHTTPUpgrade(host) {
+		target := *r.URL
+		target.Scheme = "https"
+		http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+		return
+	}
+	if r.URL.Scheme != "http" {
+		http.Error(w, fmt.Sprintf("unsupported scheme %q", r.URL.Scheme), http.StatusBadRequest)
+		return
+	}
+	release, ok := s.reserveClient(r.RemoteAddr)
+	if !ok {
+		http.Error(w, "Too many connections from this client", http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+	defer s.acquireSlot()()
+
+	// Proxy-Connection is the non-standard predecessor of Connection still sent by
+	// many clients. Mirror it so net/http applies its keep-alive handling.
+	if pc := r.Header.Get("Proxy-Connection"); pc != "" && r.Header.Get("Connection") == "" {
+		r.Header.Set("Connection", pc)
+		if strings.EqualFold(pc, "close") {
+			w.Header().Set("Connection", "close")
+		}
+	}
+
+	clientIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+	ctx := context.WithValue(r.Context(), clientIPKey{}, net.ParseIP(clientIP))
+
+	// The request and response are shaped rather than the remote
+	// connection, which the transport reuses across clients.
+	shape := s.shape(r.RemoteAddr, host)
+	defer shape.release()
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &shapedBody{ReadCloser: r.Body, shape: shape, stop: ctx.Done()}
+	}
+	w = &shapedResponseWriter{ResponseWriter: w, shape: shape, stop: ctx.Done()}
+
+	logger.Debug("HTTP: %s %s", r.Method, r.URL)
+	s.reverseProxy().ServeHTTP(w, r.WithContext(ctx))
+}
+
+// reverseProxy returns the shared forwarder, creating it on first use.
+func (s *ProxyServer) reverseProxy() *httputil.ReverseProxy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.forwarder == nil {
+		s.transport = &http.Transport{
+			DialContext:         s.dialForward,
+			MaxIdleConnsPerHost: 8,
+			IdleConnTimeout:     90 * time.Second,
+		}
+		s.forwarder = &httputil.ReverseProxy{
+			// The incoming URL is already absolute; keep it and the Host header as sent.
+			// Hop-by-hop headers, Proxy-Connection included, are stripped by ReverseProxy,
+			// and unlike Director, Rewrite adds no X-Forwarded-For.
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.Out.Host = pr.In.Host
+			},
+			Transport: s.transport,
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				logger.Warn("HTTP forward to %s failed: %v", r.URL.Host, err)
+				http.Error(w, err.Error(), http.StatusBadGateway)
+			},
+		}
+	}
+	return s.forwarder
+}
+
+// dialForward resolves addr through the Resolver (which applies [hosts] rules)
+// and dials it for the forwarding transport, through an upstream proxy when
+// the outbound rules select one.
+func (s *ProxyServer) dialForward(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	clientIP, _ := ctx.Value(clientIPKey{}).(net.IP)
+	conn, _, err := s.dialRemote(ctx, network, host, port, clientIP)
+	return conn, err
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"time"
+
+	"snirect/internal/config"
+	"snirect/internal/logger"
+)
+
+// sendFragmentedHello reads the ClientHello from clientConn and writes it to
+// remoteConn split according to strat. It returns the connection to tunnel
+// from: if the client did not start with a ClientHello, whatever was read is
+// replayed unchanged instead.
+func (s *ProxyServer) sendFragmentedHello(clientConn, remoteConn net.Conn, host string, strat config.FragmentStrategy) (net.Conn, error) {
+	var buf bytes.Buffer
+	clientConn.SetReadDeadline(deadlineAfter(s.clientHandshakeTimeout()))
+	hello, err := readClientHello(io.TeeReader(clientConn, &buf))
+	clientConn.SetReadDeadline(time.Time{})
+	if err != nil {
+		if errors.Is(err, errNotClientHello) {
+			logger.Debug("Fragment: %s did not start with a ClientHello, forwarding as-is", host)
+			return newPrefixConn(clientConn, buf.Bytes()), nil
+		}
+		return clientConn, fmt.Errorf("read ClientHello: %w", err)
+	}
+
+	chunks := fragmentClientHello(hello, strat)
+	logger.Debug("Fragment: ClientHello for %s sent as %d segment(s), mode %s", host, len(chunks), strat.Mode)
+	delay := time.Duration(strat.DelayMs) * time.Millisecond
+	for i, chunk := range chunks {
+		if i > 0 && delay > 0 {
+			time.Sleep(delay)
+		}
+		if _, err := remoteConn.Write(chunk); err != nil {
+			return clientConn, fmt.Errorf("write ClientHello: %w", err)
+		}
+	}
+	return clientConn, nil
+}
+
+// fragmentClientHello splits hello according to strat and returns the byte
+// chunks to write, one per TCP segment.
+func fragmentClientHello(hello *clientHello, strat config.FragmentStrategy) [][]byte {
+	msg, spans := reassembleHandshake(hello.Raw)
+	cuts := fragmentCuts(hello, spans, len(msg), strat)
+
+	if strat.Mode == config.FragmentTCP {
+		// Keep the original records and split the byte stream.
+		var chunks [][]byte
+		prev := 0
+		for _, c := range cuts {
+			off := rawOffset(spans, c)
+			chunks = append(chunks, hello.Raw[prev:off])
+			prev = off
+		}
+		return append(chunks, hello.Raw[prev:])
+	}
+
+	// Re-frame every piece of the handshake message as its own record,
+	// reusing the record version the client sent.
+	var records [][]byte
+	prev := 0
+	for _, c := range append(cuts, len(msg)) {
+		rec := make([]byte, recordHeaderLen, recordHeaderLen+c-prev)
+		rec[0] = recordTypeHandshake
+		copy(rec[1:3], hello.Raw[1:3])
+		binary.BigEndian.PutUint16(rec[3:], uint16(c-prev))
+		records = append(records, append(rec, msg[prev:c]...))
+		prev = c
+	}
+	if strat.Mode == config.FragmentBoth {
+		return records
+	}
+	return [][]byte{bytes.Join(records, nil)}
+}
+
+// fragmentCuts returns the sorted, distinct offsets in the handshake message
+// at which it is split.
+func fragmentCuts(hello *clientHello, spans []recordSpan, msgLen int, strat config.FragmentStrategy) []int {
+	set := make(map[int]bool)
+	if sniLen := hello.SNIEnd - hello.SNIStart; sniLen > 1 {
+		start := msgOffset(spans, hello.SNIStart)
+		points := strat.SNIPoints
+		if len(points) == 0 {
+			points = []int{sniLen / 2}
+		}
+		for _, p := range points {
+			if p < 0 {
+				p += sniLen
+			}
+			if p > 0 && p < sniLen {
+				set[start+p] = true
+			}
+		}
+	}
+	if strat.Size > 0 {
+		for off := strat.Size; off < msgLen; off += strat.Size {
+			set[off] = true
+		}
+	}
+
+	cuts := make([]int, 0, len(set))
+	for off := range set {
+		if off > 0 && off < msgLen {
+			cuts = append(cuts, off)
+		}
+	}
+	sort.Ints(cuts)
+	return cuts
+}
+
+// reassembleHandshake concatenates the payloads of the records in raw.
+func reassembleHandshake(raw []byte) ([]byte, []recordSpan) {
+	var msg []byte
+	var spans []recordSpan
+	for off := 0; off+recordHeaderLen <= len(raw); {
+		n := int(binary.BigEndian.Uint16(raw[off+3:]))
+		start := off + recordHeaderLen
+		spans = append(spans, recordSpan{raw: start, msg: len(msg), n: n})
+		msg = append(msg, raw[start:start+n]...)
+		off = start + n
+	}
+	return msg, spans
+}
+
+// msgOffset converts an offset in the raw record stream into an offset in
+// the reassembled handshake message; it is the inverse of rawOffset.
+func msgOffset(spans []recordSpan, off int) int {
+	for _, s := range spans {
+		if off >= s.raw && off < s.raw+s.n {
+			return s.msg + off - s.raw
+		}
+	}
+	return -1
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xihale/snirect-shared/rules"
+	"snirect/internal/config"
+)
+
+// TestFragmentClientHello_TLSRecords tests that record fragmentation splits the
+// SNI across records while preserving the handshake message.
+func TestFragmentClientHello_TLSRecords(t *testing.T) {
+	raw := captureClientHello(t, &tls.Config{ServerName: "www.example.com"})
+	hello, err := readClientHello(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("readClientHello: %v", err)
+	}
+
+	chunks := fragmentClientHello(hello, config.FragmentStrategy{Mode: config.FragmentTLS, SNIPoints: []int{3, -2}})
+	if len(chunks) != 1 {
+		t.Fatalf("tls mode produced %d chunks, want 1", len(chunks))
+	}
+
+	var payloads [][]byte
+	for rest := chunks[0]; len(rest) > 0; {
+		n := int(binary.BigEndian.Uint16(rest[3:5]))
+		payloads = append(payloads, rest[recordHeaderLen:recordHeaderLen+n])
+		rest = rest[recordHeaderLen+n:]
+	}
+	if len(payloads) != 3 {
+		t.Fatalf("got %d records, want 3", len(payloads))
+	}
+	for i, p := range payloads {
+		if bytes.Contains(p, []byte("www.example.com")) {
+			t.Errorf("record %d still contains the full SNI", i)
+		}
+	}
+
+	again, err := readClientHello(bytes.NewReader(chunks[0]))
+	if err != nil || again.ServerName != "www.example.com" {
+		t.Fatalf("fragmented ClientHello does not parse back: %v, %q", err, again.ServerName)
+	}
+}
+
+// TestFragmentClientHello_TCPSegments tests that segment mode only splits the byte stream.
+func TestFragmentClientHello_TCPSegments(t *testing.T) {
+	raw := captureClientHello(t, &tls.Config{ServerName: "www.example.com"})
+	hello, _ := readClientHello(bytes.NewReader(raw))
+
+	chunks := fragmentClientHello(hello, config.FragmentStrategy{Mode: config.FragmentTCP, Size: 100})
+	if len(chunks) < 3 {
+		t.Fatalf("got %d chunks, want at least 3", len(chunks))
+	}
+	if !bytes.Equal(bytes.Join(chunks, nil), raw) {
+		t.Fatal("segments do not reassemble to the original records")
+	}
+	for i, c := range chunks {
+		if bytes.Contains(c, []byte("www.example.com")) {
+			t.Errorf("segment %d still contains the full SNI", i)
+		}
+	}
+}
+
+// TestDirectTunnel_Fragment tests that a real TLS server accepts a fragmented ClientHello.
+func TestDirectTunnel_Fragment(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "fragmented ok")
+	}))
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+
+	for _, mode := range []string{config.FragmentTLS, config.FragmentTCP, config.FragmentBoth} {
+		t.Run(mode, func(t *testing.T) {
+			ps := newShutdownTestProxy()
+			ps.Rules = &config.Rules{
+				Rules: rules.NewRules(),
+				Fragment: map[string]config.FragmentStrategy{
+					"*frag.example": {Mode: mode, Size: 64, DelayMs: 1},
+				},
+			}
+			proxyAddr := startTestProxy(t, ps)
+			defer ps.Close()
+
+			conn := openDirectTunnel(t, proxyAddr, "www.frag.example:"+port)
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: "www.frag.example", InsecureSkipVerify: true})
+			if err := tlsConn.Handshake(); err != nil {
+				t.Fatalf("handshake through fragmenting tunnel: %v", err)
+			}
+			fmt.Fprintf(tlsConn, "GET / HTTP/1.1\r\nHost: www.frag.example\r\nConnection: close\r\n\r\n")
+			resp, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+			if err != nil {
+				t.Fatalf("read response: %v", err)
+			}
+			defer resp.Body.Close()
+			var body strings.Builder
+			bufio.NewReader(resp.Body).WriteTo(&body)
+			if body.String() != "fragmented ok" {
+				t.Fatalf("body = %q", body.String())
+			}
+		})
+	}
+}
+
+// TestShouldIntercept_FragmentRule tests that a fragment rule bypasses MITM even with an SNI rewrite.
+func TestShouldIntercept_FragmentRule(t *testing.T) {
+	r := rules.NewRules()
+	r.AlterHostname["*example.com"] = "front.example"
+	r.Init()
+	ps := &ProxyServer{
+		Config: &config.Config{CheckHostname: true},
+		Rules: &config.Rules{
+			Rules:    r,
+			Fragment: map[string]config.FragmentStrategy{"*example.com": {Mode: config.FragmentTLS}},
+		},
+	}
+	if ps.shouldIntercept("www.example.com", "443") {
+		t.Fatal("fragment rule should keep the connection direct")
+	}
+}
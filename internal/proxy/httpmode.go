@@ -0,0 +1,291 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"snirect/internal/config"
+	"snirect/internal/logger"
+	"snirect/internal/metrics"
+	"snirect/internal/tlsutil"
+)
+
+// httpErrorLog sends the messages of net/http servers and proxies to the
+// debug log.
+var httpErrorLog = log.New(debugWriter{}, "", 0)
+
+type debugWriter struct{}
+
+func (debugWriter) Write(p []byte) (int, error) {
+	logger.Debug("%s", strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+// httpMode returns the [http_mode] rule for an intercepted connection. Only
+// HTTP/1.1 and h2 can be parsed; other protocols are piped as bytes.
+func (s *ProxyServer) httpMode(ctx *connectContext) (*config.HTTPMode, bool) {
+	mode, ok := s.rules().GetHTTPMode(ctx.Host)
+	if !ok {
+		return nil, false
+	}
+	switch ctx.Protocol {
+	case "", "http/1.1", "h2":
+		return mode, true
+	}
+	logger.Debug("HTTP mode for %s: cannot parse ALPN %q, piping bytes", ctx.Host, ctx.Protocol)
+	return nil, false
+}
+
+// httpTunnel relays an intercepted connection as HTTP instead of opaque bytes,
+// rewriting requests and responses according to mode. The client is served
+// with the protocol the remote selected; requests go out through a transport
+// that starts with the already verified remote connection and dials the same
+// way again if the remote closes it. Both connections are closed on return.
+func (s *ProxyServer) httpTunnel(ctx *connectContext, mode *config.HTTPMode) tunnelStats {
+	metrics.TunnelsTotal.With(metrics.ModeMITM).Inc()
+	active := metrics.TunnelsActive.With(metrics.ModeMITM)
+	active.Inc()
+	defer active.Dec()
+
+	shape := s.shape(ctx.ClientAddr, ctx.Host)
+	defer shape.release()
+	client := &countingConn{Conn: newShapedConn(ctx.tlsClientConn, shape)}
+	defer client.Close()
+
+	var first atomic.Pointer[tlsutil.Conn]
+	first.Store(&ctx.remoteConn)
+	defer func() {
+		if conn := first.Swap(nil); conn != nil {
+			(*conn).Close()
+		}
+	}()
+	dial := func(dialCtx context.Context) (net.Conn, error) {
+		if conn := first.Swap(nil); conn != nil {
+			return *conn, nil
+		}
+		return s.redialHTTPRemote(dialCtx, ctx)
+	}
+	idle := time.Duration(s.cfg().Timeout.Idle) * time.Second
+	var transport interface {
+		http.RoundTripper
+		CloseIdleConnections()
+	}
+	if ctx.Protocol == "h2" {
+		// http.Transport speaks HTTP/2 only over a *tls.Conn, which the
+		// browser ClientHello profiles do not produce.
+		transport = &http2.Transport{
+			DialTLSContext: func(dialCtx context.Context, _, _ string, _ *tls.Config) (net.Conn, error) {
+				return dial(dialCtx)
+			},
+			IdleConnTimeout: idle,
+		}
+	} else {
+		transport = &http.Transport{
+			DialTLSContext: func(dialCtx context.Context, _, _ string) (net.Conn, error) {
+				return dial(dialCtx)
+			},
+			IdleConnTimeout: idle,
+		}
+	}
+	defer transport.CloseIdleConnections()
+
+	var handlers sync.WaitGroup
+	rp := s.httpModeProxy(ctx, mode, transport)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		logger.Debug("HTTP mode: %s %s%s", r.Method, r.Host, r.URL.RequestURI())
+		rp.ServeHTTP(w, r)
+	})
+
+	reason := closeClientEOF
+	if lifetime := time.Duration(s.cfg().Timeout.MaxLifetime) * time.Second; lifetime > 0 {
+		var expired atomic.Bool
+		timer := time.AfterFunc(lifetime, func() {
+			expired.Store(true)
+			client.Close()
+		})
+		defer func() {
+			if !timer.Stop() && expired.Load() {
+				reason = closeLifetime
+			}
+		}()
+	}
+
+	if ctx.Protocol == "h2" {
+		(&http2.Server{IdleTimeout: idle}).ServeConn(client, &http2.ServeConnOpts{
+			Context:    ctx.parentCtx,
+			BaseConfig: &http.Server{ErrorLog: httpErrorLog},
+			Handler:    handler,
+		})
+	} else {
+		ln := newConnListener(client)
+		srv := &http.Server{
+			Handler:     handler,
+			IdleTimeout: idle,
+			ErrorLog:    httpErrorLog,
+			BaseContext: func(net.Listener) context.Context { return ctx.parentCtx },
+			ConnState: func(_ net.Conn, state http.ConnState) {
+				if state == http.StateClosed || state == http.StateHijacked {
+					ln.Close()
+				}
+			},
+		}
+		srv.Serve(ln)
+	}
+	// Upgraded (WebSocket) connections are relayed by their handler after
+	// the server lets go of them.
+	handlers.Wait()
+
+	return tunnelStats{in: client.in.Load(), out: client.out.Load(), reason: reason}
+}
+
+// httpModeProxy returns the reverse proxy that sends the client's requests to
+// the remote of ctx through transport.
+func (s *ProxyServer) httpModeProxy(ctx *connectContext, mode *config.HTTPMode, transport http.RoundTripper) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = "https"
+			pr.Out.URL.Host = net.JoinHostPort(ctx.Host, ctx.Port)
+			pr.Out.Host = pr.In.Host
+			rewriteHeaders(pr.Out.Header, mode.RequestHeaders, &pr.Out.Host)
+			addVia(pr.Out.Header, pr.In.ProtoMajor, pr.In.ProtoMinor, mode.Via)
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			if mode.StripAltSvc && resp.Header.Get("Alt-Svc") != "" {
+				logger.Debug("HTTP mode: stripped Alt-Svc from %s", ctx.Host)
+				resp.Header.Del("Alt-Svc")
+			}
+			rewriteHeaders(resp.Header, mode.ResponseHeaders, nil)
+			addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor, mode.Via)
+			return nil
+		},
+		Transport:     transport,
+		FlushInterval: -1, // Stream responses such as server-sent events as they arrive
+		ErrorLog:      httpErrorLog,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.Warn("HTTP mode: %s %s%s failed: %v", r.Method, ctx.Host, r.URL.RequestURI(), err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		},
+	}
+}
+
+// redialHTTPRemote opens another connection to the remote of ctx, with the
+// SNI, ECH and protocol of the first one, for requests that outlive it.
+func (s *ProxyServer) redialHTTPRemote(dialCtx context.Context, ctx *connectContext) (net.Conn, error) {
+	var alpn []string
+	if ctx.Protocol != "" {
+		alpn = []string{ctx.Protocol}
+	}
+	var conn tlsutil.Conn
+	var err error
+	if ctx.ECH {
+		var configs []byte
+		if configs, err = s.lookupECH(dialCtx, ctx.Host, ctx.Port); err == nil && len(configs) == 0 {
+			err = errNoECH
+		}
+		if err == nil {
+			conn, err = s.connectToRemoteECH(dialCtx, ctx.Host, ctx.Port, ctx.ClientAddr, ctx.TargetSNI, alpn, configs)
+		}
+	} else {
+		conn, err = s.connectToRemote(dialCtx, ctx.Host, ctx.Port, ctx.ClientAddr, ctx.TargetSNI, alpn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !s.verifyServerCert(conn, ctx.Host, ctx.TargetSNI) {
+		conn.Close()
+		return nil, fmt.Errorf("certificate verification failed for %s", ctx.Host)
+	}
+	return conn, nil
+}
+
+// rewriteHeaders applies an [http_mode] header table to h: an empty value
+// removes the header, others replace it. Host is written to host instead,
+// when given.
+func rewriteHeaders(h http.Header, rules map[string]string, host *string) {
+	for name, value := range rules {
+		switch {
+		case strings.EqualFold(name, "Host"):
+			if host != nil {
+				*host = value
+			}
+		case value == "":
+			h.Del(name)
+		default:
+			h.Set(name, value)
+		}
+	}
+}
+
+// addVia appends this hop to the Via header when a pseudonym is configured.
+func addVia(h http.Header, major, minor int, pseudonym string) {
+	if pseudonym == "" {
+		return
+	}
+	version := fmt.Sprintf("%d.%d", major, minor)
+	if major >= 2 {
+		version = fmt.Sprint(major)
+	}
+	h.Add("Via", version+" "+pseudonym)
+}
+
+// countingConn counts the bytes read from and written to a connection.
+type countingConn struct {
+	net.Conn
+	in, out atomic.Int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.in.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.out.Add(int64(n))
+	return n, err
+}
+
+// connListener is a net.Listener that accepts a single connection and then
+// blocks until it is closed.
+type connListener struct {
+	conns chan net.Conn
+	addr  net.Addr
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	l := &connListener{conns: make(chan net.Conn, 1), addr: conn.LocalAddr(), done: make(chan struct{})}
+	l.conns <- conn
+	return l
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr { return l.addr }
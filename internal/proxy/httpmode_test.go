@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"snirect/internal/cert"
+	"snirect/internal/config"
+)
+
+// TestProxy_HTTPMode tests that a host with an [http_mode] rule is relayed as
+// HTTP: Alt-Svc is stripped, headers are rewritten both ways and Via is added,
+// over HTTP/1.1 and h2 alike.
+func TestProxy_HTTPMode(t *testing.T) {
+	certMgr, err := cert.NewCertificateManager(filepath.Join(t.TempDir(), "root.crt"), filepath.Join(t.TempDir(), "root.key"))
+	if err != nil {
+		t.Fatalf("NewCertificateManager: %v", err)
+	}
+	defer certMgr.Close()
+
+	for _, tc := range []struct {
+		name     string
+		remoteH2 bool
+		wantVia  string
+	}{
+		{"h2", true, "2 snirect"},
+		{"http/1.1", false, "1.1 snirect"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Alt-Svc", `h3=":443"; ma=86400`)
+				w.Header().Set("X-Remove", "1")
+				fmt.Fprintf(w, "%s|%s|%s|%q", r.Host, r.Header.Get("X-Added"), r.Header.Get("Via"), r.Header.Get("User-Agent"))
+			}))
+			ts.EnableHTTP2 = tc.remoteH2
+			ts.StartTLS()
+			defer ts.Close()
+			_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+			ps := newShutdownTestProxy()
+			portNum, _ := strconv.Atoi(port)
+			ps.Config.Server.InterceptPorts = []int{portNum}
+			ps.Config.CheckHostname = true
+			ps.Rules.CertVerify["mode.example"] = false
+			ps.Rules.Init()
+			ps.Rules.HTTPMode = map[string]*config.HTTPMode{"mode.example": {
+				StripAltSvc:     true,
+				Via:             "snirect",
+				RequestHeaders:  map[string]string{"Host": "front.example", "X-Added": "yes", "User-Agent": ""},
+				ResponseHeaders: map[string]string{"X-Remove": "", "X-Snirect": "1"},
+			}}
+			ps.CA = certMgr
+			proxyAddr := startTestProxy(t, ps)
+			defer ps.Close()
+
+			proxyURL, _ := url.Parse("http://" + proxyAddr)
+			client := &http.Client{Transport: &http.Transport{
+				Proxy:             http.ProxyURL(proxyURL),
+				TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+				ForceAttemptHTTP2: true,
+			}}
+			defer client.CloseIdleConnections()
+
+			// Two requests, so the second one reuses the relayed connection.
+			for i := 0; i < 2; i++ {
+				resp, err := client.Get("https://mode.example:" + port + "/")
+				if err != nil {
+					t.Fatalf("GET through proxy: %v", err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+
+				if want := `front.example|yes|` + tc.wantVia + `|""`; string(body) != want {
+					t.Errorf("remote saw %s, want %s", body, want)
+				}
+				if v := resp.Header.Get("Alt-Svc"); v != "" {
+					t.Errorf("Alt-Svc %q was not stripped", v)
+				}
+				if resp.Header.Get("X-Remove") != "" || resp.Header.Get("X-Snirect") != "1" {
+					t.Errorf("response headers not rewritten: %v", resp.Header)
+				}
+				if v := resp.Header.Get("Via"); v != tc.wantVia {
+					t.Errorf("response Via = %q, want %q", v, tc.wantVia)
+				}
+			}
+		})
+	}
+}
+
+// TestShouldIntercept_HTTPMode tests that an [http_mode] rule forces MITM,
+// and that an exempting rule does not.
+func TestShouldIntercept_HTTPMode(t *testing.T) {
+	ps := newShutdownTestProxy()
+	ps.Config.CheckHostname = true
+	ps.Rules.HTTPMode = map[string]*config.HTTPMode{
+		"*example.com":    {StripAltSvc: true},
+		"www.example.com": nil,
+	}
+	if !ps.shouldIntercept("example.com", "443") {
+		t.Error("http_mode rule should intercept")
+	}
+	if ps.shouldIntercept("www.example.com", "443") {
+		t.Error("exempted host should not be intercepted")
+	}
+}
@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"net"
+	"time"
+
+	"snirect/internal/metrics"
+)
+
+// countedTunnel runs tunnel for info while counting it under mode in the
+// tunnel metrics and shaping it with the bandwidth limits.
+func (s *ProxyServer) countedTunnel(mode string, info *ConnectInfo, client, remote net.Conn) tunnelStats {
+	metrics.TunnelsTotal.With(mode).Inc()
+	active := metrics.TunnelsActive.With(mode)
+	active.Inc()
+	defer active.Dec()
+	shape := s.shape(info.ClientAddr, info.Host)
+	defer shape.release()
+	return s.tunnel(client, remote, shape)
+}
+
+// resultLabel returns the result label value for err.
+func resultLabel(err error) string {
+	if err != nil {
+		return metrics.ResultError
+	}
+	return metrics.ResultOK
+}
+
+// observeLatency records the time since start in h, in seconds.
+func observeLatency(h *metrics.Histogram, start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
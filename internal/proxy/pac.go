@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"snirect/internal/config"
+	"snirect/internal/logger"
+	"snirect/internal/pac"
+)
+
+// pacScript is a generated PAC script and what it was generated from.
+type pacScript struct {
+	cfg      *config.Config
+	rules    *config.Rules
+	tmplPath string
+	tmplMod  time.Time
+	tmplSize int64
+
+	body []byte
+	etag string
+}
+
+// handlePAC serves the PAC script generated from the rules in effect. It is
+// cached until the config, the rules or the template file change, and
+// clients can revalidate it with If-None-Match.
+func (s *ProxyServer) handlePAC(w http.ResponseWriter, r *http.Request) {
+	script, err := s.pacScript()
+	if err != nil {
+		logger.Error("PAC: %v", err)
+		http.Error(w, "Failed to generate the PAC script", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", script.etag)
+	if etagMatches(r.Header.Get("If-None-Match"), script.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(script.body)
+}
+
+// pacScript returns the cached PAC script, generating it again when its
+// inputs changed.
+func (s *ProxyServer) pacScript() (*pacScript, error) {
+	cfg, rules := s.cfg(), s.rules()
+	next := &pacScript{cfg: cfg, rules: rules}
+
+	tmpl := pac.DefaultTemplate
+	legacy := cfg.Server.PACTemplate == ""
+	next.tmplPath = cfg.Server.PACTemplate
+	if legacy {
+		next.tmplPath = pac.LegacyFile
+	}
+	if !filepath.IsAbs(next.tmplPath) {
+		appDir, _ := config.GetAppDataDir()
+		next.tmplPath = filepath.Join(appDir, next.tmplPath)
+	}
+	if info, err := os.Stat(next.tmplPath); err == nil {
+		next.tmplMod, next.tmplSize = info.ModTime(), info.Size()
+	} else if legacy {
+		next.tmplPath = ""
+	} else {
+		return nil, err
+	}
+
+	if cur := s.pac.Load(); cur != nil && cur.cfg == next.cfg && cur.rules == next.rules &&
+		cur.tmplPath == next.tmplPath && cur.tmplMod.Equal(next.tmplMod) && cur.tmplSize == next.tmplSize {
+		return cur, nil
+	}
+
+	if next.tmplPath != "" {
+		content, err := os.ReadFile(next.tmplPath)
+		if err != nil {
+			return nil, err
+		}
+		// An unedited legacy file only holds the domains of an old release.
+		if !legacy || !pac.IsLegacyStock(content) {
+			tmpl = string(content)
+		}
+	}
+	data := pac.New(rules.Patterns(), cfg.Server.PACHost, cfg.Server.Port, cfg.Server.PACDirectFallback)
+	body, err := pac.Render(tmpl, data)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+	next.body = body
+	next.etag = `"` + hex.EncodeToString(sum[:8]) + `"`
+	s.pac.Store(next)
+	return next, nil
+}
+
+// etagMatches reports whether an If-None-Match header lists etag.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
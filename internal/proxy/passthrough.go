@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"slices"
+	"time"
+
+	"snirect/internal/logger"
+	"snirect/internal/passthrough"
+)
+
+// errClientCertRequested aborts a remote handshake in which the server asked
+// for a client certificate: only the client has one, and MITM cannot relay it.
+var errClientCertRequested = errors.New("remote requested a client certificate")
+
+// certAlerts are the alerts by which a client refuses the certificate it was
+// shown (RFC 8446 section 6), as crypto/tls names them.
+var certAlerts = []string{
+	"tls: bad certificate",               // bad_certificate
+	"tls: unsupported certificate",       // unsupported_certificate
+	"tls: revoked certificate",           // certificate_revoked
+	"tls: expired certificate",           // certificate_expired
+	"tls: unknown certificate",           // certificate_unknown
+	"tls: unknown certificate authority", // unknown_ca
+}
+
+// learnsPassthrough reports whether passthrough.learn is on.
+func (s *ProxyServer) learnsPassthrough() bool {
+	cfg := s.cfg()
+	return s.Passthrough != nil && cfg != nil && cfg.Passthrough.Learn
+}
+
+// refuseClientCert makes remote handshakes with tlsConfig fail with
+// errClientCertRequested when the server asks for a client certificate, if
+// passthrough.learn is on.
+func (s *ProxyServer) refuseClientCert(tlsConfig *tls.Config) {
+	if !s.learnsPassthrough() {
+		return
+	}
+	tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return nil, errClientCertRequested
+	}
+}
+
+// learnPassthrough adds host to the learned passthrough list.
+func (s *ProxyServer) learnPassthrough(host, reason string) {
+	if !s.learnsPassthrough() {
+		return
+	}
+	ttl := time.Duration(s.cfg().Passthrough.TTL) * time.Hour
+	if ttl <= 0 {
+		ttl = 7 * 24 * time.Hour
+	}
+	if err := s.Passthrough.Add(host, reason, ttl); err != nil {
+		logger.Warn("Failed to save passthrough list: %v", err)
+	}
+	logger.Info("Learned passthrough for %s (%s): tunnelling it directly for %v", host, reason, ttl)
+}
+
+// passthroughClientCert learns Host after its remote asked for a client
+// certificate and tunnels this connection directly, which still works as the
+// ClientHello was only peeked.
+func (s *ProxyServer) passthroughClientCert(ctx *connectContext) (Phase, error) {
+	s.learnPassthrough(ctx.Host, passthrough.ReasonClientCert)
+	ctx.Intercept = false
+	ctx.TargetSNI, ctx.ECH = "", false
+	return PhaseDirectDial, nil
+}
+
+// refusedCertificate reports whether err from the client handshake is an
+// alert by which the client refused the MITM certificate, as apps that pin
+// their server's certificate do. crypto/tls reports a received alert as a
+// *net.OpError with Op "remote error" around an unexported type, so it is
+// matched by its text; a tls.AlertError is matched the same way.
+func refusedCertificate(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" && opErr.Err != nil {
+		return slices.Contains(certAlerts, opErr.Err.Error())
+	}
+	var alert tls.AlertError
+	return errors.As(err, &alert) && slices.Contains(certAlerts, alert.Error())
+}
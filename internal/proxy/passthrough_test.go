@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"snirect/internal/cert"
+	"snirect/internal/passthrough"
+)
+
+// newPassthroughTest starts remote with TLS and a proxy intercepting its port
+// that learns passthrough hosts, and returns the proxy, its address and the
+// remote's port.
+func newPassthroughTest(t *testing.T, remote *httptest.Server) (*ProxyServer, string, string) {
+	t.Helper()
+	certMgr, err := cert.NewCertificateManager(filepath.Join(t.TempDir(), "root.crt"), filepath.Join(t.TempDir(), "root.key"))
+	if err != nil {
+		t.Fatalf("NewCertificateManager: %v", err)
+	}
+	t.Cleanup(func() { certMgr.Close() })
+	remote.StartTLS()
+	t.Cleanup(remote.Close)
+	_, port, _ := net.SplitHostPort(remote.Listener.Addr().String())
+
+	list, err := passthrough.Load(filepath.Join(t.TempDir(), passthrough.FileName))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	ps := newShutdownTestProxy()
+	portNum, _ := strconv.Atoi(port)
+	ps.Config.Server.InterceptPorts = []int{portNum}
+	ps.Config.CheckHostname = false
+	ps.Config.Passthrough.Learn = true
+	ps.Config.Passthrough.TTL = 1
+	ps.CA = certMgr
+	ps.Passthrough = list
+	proxyAddr := startTestProxy(t, ps)
+	t.Cleanup(func() { ps.Close() })
+	return ps, proxyAddr, port
+}
+
+// TestProxy_PassthroughClientCert tests that a remote asking for a client
+// certificate is tunnelled directly, on the same connection and later ones.
+func TestProxy_PassthroughClientCert(t *testing.T) {
+	remote := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	remote.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	ps, proxyAddr, port := newPassthroughTest(t, remote)
+	host := "mtls.example"
+
+	for i := range 2 {
+		conn := openDirectTunnel(t, proxyAddr, net.JoinHostPort(host, port))
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatalf("connection #%d: handshake: %v", i+1, err)
+		}
+		if got := tlsConn.ConnectionState().PeerCertificates[0]; !got.Equal(remote.Certificate()) {
+			t.Errorf("connection #%d: got certificate for %v, want the remote's own", i+1, got.DNSNames)
+		}
+		tlsConn.Close()
+	}
+	if !ps.Passthrough.Contains(host) {
+		t.Errorf("%s was not learned", host)
+	}
+}
+
+// TestProxy_PassthroughPinning tests that a client refusing the MITM
+// certificate has its host learned, so that the next connection is direct.
+func TestProxy_PassthroughPinning(t *testing.T) {
+	remote := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ps, proxyAddr, port := newPassthroughTest(t, remote)
+	host := "pinned.example"
+
+	conn := openDirectTunnel(t, proxyAddr, net.JoinHostPort(host, port))
+	// The system roots do not include the proxy's CA.
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+	if err := tlsConn.Handshake(); err == nil {
+		t.Fatal("handshake with the MITM certificate succeeded")
+	}
+	conn.Close()
+
+	// The proxy learns the host once its own handshake fails.
+	for deadline := time.Now().Add(5 * time.Second); !ps.Passthrough.Contains(host); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s was not learned", host)
+		}
+	}
+	if ps.shouldIntercept(host, port) {
+		t.Error("learned host is still intercepted")
+	}
+	if ps.Passthrough.Entries()[0].Reason != passthrough.ReasonPinning {
+		t.Errorf("reason = %q, want %q", ps.Passthrough.Entries()[0].Reason, passthrough.ReasonPinning)
+	}
+}
+
+// TestProxy_PassthroughOff tests that nothing is learned when
+// passthrough.learn is off.
+func TestProxy_PassthroughOff(t *testing.T) {
+	remote := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	remote.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	ps, proxyAddr, port := newPassthroughTest(t, remote)
+	ps.Config.Passthrough.Learn = false
+
+	conn := openDirectTunnel(t, proxyAddr, net.JoinHostPort("mtls.example", port))
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "mtls.example", InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if got := tlsConn.ConnectionState().PeerCertificates[0]; got.Equal(remote.Certificate()) {
+		t.Error("connection was tunnelled directly")
+	}
+	tlsConn.Close()
+	if len(ps.Passthrough.Entries()) != 0 {
+		t.Errorf("learned %v", ps.Passthrough.Entries())
+	}
+}
+
+// TestRefusedCertificate tests that a client handshake failing on the
+// client's certificate alert counts as a refused certificate, and that other
+// failures do not.
+func TestRefusedCertificate(t *testing.T) {
+	certMgr, err := cert.NewCertificateManager(filepath.Join(t.TempDir(), "root.crt"), filepath.Join(t.TempDir(), "root.key"))
+	if err != nil {
+		t.Fatalf("NewCertificateManager: %v", err)
+	}
+	defer certMgr.Close()
+	leaf, err := certMgr.GetCertificate(&tls.ClientHelloInfo{ServerName: "pinned.example"})
+	if err != nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+
+	// A client that does not trust the MITM CA sends a certificate alert.
+	client, server := net.Pipe()
+	go func() {
+		defer client.Close()
+		tls.Client(client, &tls.Config{ServerName: "pinned.example"}).Handshake()
+	}()
+	err = tls.Server(server, &tls.Config{Certificates: []tls.Certificate{*leaf}}).Handshake()
+	server.Close()
+	if !refusedCertificate(err) {
+		t.Errorf("refusedCertificate(%v) = false", err)
+	}
+
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{tls.AlertError(42), true},
+		{&net.OpError{Op: "remote error", Err: tls.AlertError(48)}, true},
+		{&net.OpError{Op: "remote error", Err: tls.AlertError(80)}, false},
+		{io.EOF, false},
+	} {
+		if got := refusedCertificate(tc.err); got != tc.want {
+			t.Errorf("refusedCertificate(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
@@ -4,6 +4,7 @@
 package proxy
 
 import (
+	"cmp"
 	"context"
 	"crypto/tls"
 	"errors"
@@ -11,16 +12,24 @@ import (
 	"io"
 	"net"
 	"net/http"
-	"os"
-	"path/filepath"
+	"net/http/httputil"
+	"net/netip"
+	"slices"
+	"snirect/internal/accesslog"
 	"snirect/internal/cert"
 	"snirect/internal/config"
+	"snirect/internal/dialer"
 	"snirect/internal/dns"
 	"snirect/internal/interfaces"
+	"snirect/internal/learned"
 	"snirect/internal/logger"
+	"snirect/internal/metrics"
+	"snirect/internal/passthrough"
 	"snirect/internal/tlsutil"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -30,7 +39,40 @@ type ProxyServer struct {
 	Rules     *config.Rules
 	CA        interfaces.CertificateManager
 	Resolver  interfaces.Resolver
-	semaphore chan struct{} //Limits concurrent connections
+	AccessLog *accesslog.Logger // Optional JSONL record of every CONNECT
+	semaphore chan struct{}     //Limits concurrent connections
+
+	Passthrough *passthrough.List // Optional hosts learned to tunnel directly, see learnPassthrough
+	Learned     *learned.Layer    // Optional rules layer written by block detection, see learnRewrite
+
+	mu       sync.Mutex
+	server   *http.Server
+	extraLns []net.Listener // Optional SOCKS5 and transparent listeners
+	closed   bool
+	conns    map[uint64]*trackedConn // Hijacked client connections, keyed by tunnel ID
+	tunnels  sync.WaitGroup          // Tracks every hijacked connection until its handler returns
+	nextConn atomic.Uint64
+	hooks    []PhaseHook              // CONNECT phase hooks, see AddHook
+	live     atomic.Pointer[settings] // Config and rules installed by Reload
+	stop     context.Context          // Canceled when Shutdown gives up on tunnels, see serverContext
+	stopAll  context.CancelFunc
+
+	perClient map[netip.Addr]int           // Open tunnels per client IP, see reserveClient
+	pac       atomic.Pointer[pacScript]    // Last generated PAC script, see handlePAC
+	filter    atomic.Pointer[clientFilter] // Parsed allow and deny lists, see allowsClient
+
+	transport *http.Transport        // Upstream transport for plain-HTTP forwarding
+	forwarder *httputil.ReverseProxy // Plain-HTTP forwarder, created on first use
+	router    *dialer.Router         // Outbound dialer selection, created on first use
+
+	sniWinners sync.Map // ClientHello host -> [sni_fallback] candidate that last completed the handshake
+	probing    sync.Map // Hosts being probed by block detection, see checkBlocked
+
+	sessions *sharedSessions // Remote TLS sessions, see sessionCache
+	tickets  ticketKeys      // Session ticket keys of the client-facing TLS servers
+	warm     *warmPool       // Pre-dialed remote connections, created on first use
+
+	bandwidth shaper // Token buckets and throughput of the tunnels, see shape
 }
 
 // NewProxyServer creates a new ProxyServer instance with default dependencies.
@@ -70,8 +112,12 @@ func NewProxyServerWithResolver(cfg *config.Config, rules *config.Rules, ca inte
 }
 
 // Start runs the proxy server on the configured address and port.
-// It blocks until the server is stopped or an error occurs.
+// It blocks until the server is stopped or an error occurs. A server stopped
+// through Shutdown or Close makes Start return nil.
 func (s *ProxyServer) Start() error {
+	if err := s.Config.CheckExposure(); err != nil {
+		return err
+	}
 	addr := fmt.Sprintf("%s:%d", s.Config.Server.Address, s.Config.Server.Port)
 
 	ln, err := net.Listen("tcp", addr)
@@ -85,13 +131,318 @@ func (s *ProxyServer) Start() error {
 		s.Config.Server.Port = actualAddr.Port
 	}
 
+	if s.Config.Server.SocksPort > 0 {
+		socksAddr := fmt.Sprintf("%s:%d", s.Config.Server.Address, s.Config.Server.SocksPort)
+		socksLn, err := net.Listen("tcp", socksAddr)
+		if err != nil {
+			return fmt.Errorf("SOCKS5 listener: %w", err)
+		}
+		logger.Info("SOCKS5 serving on %s", socksLn.Addr().String())
+		go func() {
+			if err := s.ServeSOCKS(socksLn); err != nil {
+				logger.Error("SOCKS5 server stopped: %v", err)
+			}
+		}()
+	}
+
+	if s.Config.Server.TransparentPort > 0 {
+		mode := s.Config.Server.TransparentMode
+		if mode == "" {
+			mode = TransparentRedirect
+		}
+		tpAddr := fmt.Sprintf("%s:%d", s.Config.Server.Address, s.Config.Server.TransparentPort)
+		tpLn, err := ListenTransparent(tpAddr, mode)
+		if err != nil {
+			return fmt.Errorf("transparent listener: %w", err)
+		}
+		logger.Info("Transparent proxy (%s) serving on %s", mode, tpLn.Addr().String())
+		go func() {
+			if err := s.ServeTransparent(tpLn, mode); err != nil {
+				logger.Error("Transparent proxy stopped: %v", err)
+			}
+		}()
+	}
+
 	logger.Info("Serving on %s", ln.Addr().String())
-	return http.Serve(ln, s)
+	return s.Serve(ln)
+}
+
+// Serve accepts proxy connections on ln until Shutdown or Close is called.
+// Clients refused by access_control.allow and deny are dropped on accept.
+// The listener is closed when Serve returns.
+func (s *ProxyServer) Serve(ln net.Listener) error {
+	ln = aclListener{Listener: ln, s: s}
+	srv := &http.Server{Handler: s, ReadHeaderTimeout: s.clientHandshakeTimeout()}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return nil
+	}
+	s.server = srv
+	s.mu.Unlock()
+
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown gracefully stops the proxy. It closes the listener so no new
+// connections are accepted, then waits for in-flight tunnels to finish.
+// Tunnels still open when ctx is done are force-closed and ctx.Err() is returned.
+func (s *ProxyServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	srv := s.server
+	extraLns := s.extraLns
+	transport := s.transport
+	warm := s.warm
+	s.mu.Unlock()
+
+	if warm != nil {
+		warm.close()
+	}
+
+	for _, ln := range extraLns {
+		ln.Close()
+	}
+
+	if srv != nil {
+		// http.Server.Shutdown does not track hijacked connections, so it
+		// only waits for plain HTTP requests (PAC, cert download).
+		if err := srv.Shutdown(ctx); err != nil && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+			logger.Debug("HTTP server shutdown: %v", err)
+		}
+	}
+
+	if transport != nil {
+		transport.CloseIdleConnections()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.tunnels.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	n := s.closeTunnels()
+	logger.Info("Shutdown deadline reached, force-closed %d tunnel(s)", n)
+	// Closing a client connection does not stop a handler that is still
+	// resolving or dialing the remote; canceling the server context does.
+	s.serverContext()
+	s.stopAll()
+	select {
+	case <-drained:
+	case <-time.After(shutdownGrace):
+		logger.Warn("Shutdown: %d handler(s) still running after the tunnels were closed", s.ActiveTunnels())
+	}
+	return ctx.Err()
+}
+
+// shutdownGrace bounds how long Shutdown waits for handlers once it has
+// force-closed their tunnels and canceled their dials.
+const shutdownGrace = 2 * time.Second
+
+// serverContext returns the context that Shutdown cancels once its deadline
+// passes, creating it on first use.
+func (s *ProxyServer) serverContext() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop == nil {
+		s.stop, s.stopAll = context.WithCancel(context.Background())
+	}
+	return s.stop
+}
+
+// boundToServer returns a context for the work of one connection that ends
+// with parent or when Shutdown cancels the server context. The hijacked
+// request context of a CONNECT is never canceled on its own.
+func (s *ProxyServer) boundToServer(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	stop := context.AfterFunc(s.serverContext(), cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// Close immediately stops the proxy and force-closes all open tunnels.
+func (s *ProxyServer) Close() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.Shutdown(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
+}
+
+// ActiveTunnels returns the number of hijacked connections currently being served.
+func (s *ProxyServer) ActiveTunnels() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// Connection describes a live connection, as listed by Connections.
+type Connection struct {
+	ConnectInfo
+	Phase Phase     // Phase the connection is in, empty before the state machine starts
+	Start time.Time // When the connection was accepted
+}
+
+// trackedConn is a connection registered by trackConn.
+type trackedConn struct {
+	conn  net.Conn
+	start time.Time
+	info  ConnectInfo // Snapshot taken by updateConn
+	phase Phase
+}
+
+// Connections returns the live connections, oldest first.
+func (s *ProxyServer) Connections() []Connection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Connection, 0, len(s.conns))
+	for id, tc := range s.conns {
+		c := Connection{ConnectInfo: tc.info, Phase: tc.phase, Start: tc.start}
+		c.ID = id
+		if c.ClientAddr == "" {
+			c.ClientAddr = tc.conn.RemoteAddr().String()
+		}
+		list = append(list, c)
+	}
+	slices.SortFunc(list, func(a, b Connection) int { return cmp.Compare(a.ID, b.ID) })
+	return list
+}
+
+// CloseConnection closes the client side of the live connection id, which
+// ends its tunnel. It returns false if there is no such connection.
+func (s *ProxyServer) CloseConnection(id uint64) bool {
+	s.mu.Lock()
+	tc, ok := s.conns[id]
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+	tc.conn.Close()
+	return true
+}
+
+// trackConn registers a hijacked client connection so Shutdown can drain or
+// force-close it. It returns false if the server is already shutting down.
+func (s *ProxyServer) trackConn(conn net.Conn) (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, false
+	}
+	if s.conns == nil {
+		s.conns = make(map[uint64]*trackedConn)
+	}
+	id := s.nextConn.Add(1)
+	s.conns[id] = &trackedConn{conn: conn, start: time.Now()}
+	s.tunnels.Add(1)
+	return id, true
+}
+
+// updateConn records the phase and a snapshot of info for Connections.
+func (s *ProxyServer) updateConn(phase Phase, info *ConnectInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tc, ok := s.conns[info.ID]; ok {
+		tc.phase = phase
+		tc.info = *info
+	}
+}
+
+// untrackConn removes a connection registered by trackConn.
+func (s *ProxyServer) untrackConn(id uint64) {
+	s.mu.Lock()
+	delete(s.conns, id)
+	s.mu.Unlock()
+	s.tunnels.Done()
+}
+
+// serveListener runs the accept loop of an auxiliary listener (SOCKS5,
+// transparent). Connections refused by access control are dropped; the others
+// are tracked like a hijacked CONNECT and passed to handle, which must close
+// them. The listener is closed on return.
+func (s *ProxyServer) serveListener(ln net.Listener, handle func(id uint64, conn net.Conn)) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return nil
+	}
+	s.extraLns = append(s.extraLns, ln)
+	s.mu.Unlock()
+	defer ln.Close()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		clientAddr := conn.RemoteAddr().String()
+		if !s.allowsClient(clientAddr) {
+			conn.Close()
+			continue
+		}
+		release, ok := s.reserveClient(clientAddr)
+		if !ok {
+			conn.Close()
+			continue
+		}
+		id, ok := s.trackConn(conn)
+		if !ok {
+			release()
+			conn.Close()
+			return nil
+		}
+		go func() {
+			defer s.untrackConn(id)
+			defer release()
+			handle(id, conn)
+		}()
+	}
+}
+
+// closeTunnels closes every tracked client connection and returns how many were closed.
+func (s *ProxyServer) closeTunnels() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, tc := range s.conns {
+		tc.conn.Close()
+	}
+	return len(s.conns)
 }
 
 // ServeHTTP handles HTTP requests by routing CONNECT to the proxy handler
-// and other requests to the HTTP handler for PAC/cert/redirect.
+// and other requests to the HTTP handler for PAC/cert/redirect. Proxy
+// requests need Proxy-Authorization when access_control.users is set.
 func (s *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if (r.Method == http.MethodConnect || r.URL.IsAbs()) && !s.authorized(r, "Proxy-Authorization") {
+		requireProxyAuth(w)
+		return
+	}
 	if r.Method == http.MethodConnect {
 		s.handleConnect(w, r)
 	} else {
@@ -99,48 +450,58 @@ func (s *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// handleHTTP handles standard HTTP requests (PAC, Cert download, or HTTP->HTTPS redirect).
+// handleHTTP handles standard HTTP requests: proxied absolute-form requests are
+// forwarded, while local ones serve the PAC file or the root certificate. The
+// certificate and metrics need Basic Authorization when users are configured.
 func (s *ProxyServer) handleHTTP(w http.ResponseWriter, r *http.Request) {
 	switch {
+	case r.URL.IsAbs():
+		s.handleForward(w, r)
 	case strings.HasPrefix(r.URL.Path, "/pac/"):
 		s.handlePAC(w, r)
 	case strings.HasPrefix(r.URL.Path, "/CERT/root."):
+		if !s.authorized(r, "Authorization") {
+			requireAuth(w)
+			return
+		}
 		s.handleCertDownload(w, r)
+	case r.URL.Path == "/metrics" && s.cfg().Server.Metrics:
+		if !s.authorized(r, "Authorization") {
+			requireAuth(w)
+			return
+		}
+		metrics.Handler().ServeHTTP(w, r)
 	default:
-		// Redirect HTTP to HTTPS
-		targetURL := "https://" + strings.TrimPrefix(r.URL.String(), "http://")
-		http.Redirect(w, r, targetURL, http.StatusMovedPermanently)
+		http.NotFound(w, r)
 	}
 }
 
-func (s *ProxyServer) handlePAC(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
-
-	appDir, _ := config.GetAppDataDir()
-	pacPath := filepath.Join(appDir, "pac")
-
-	if content, err := os.ReadFile(pacPath); err == nil {
-		sContent := strings.ReplaceAll(string(content), "{{port}}", fmt.Sprintf("%d", s.Config.Server.Port))
-		sContent = strings.ReplaceAll(sContent, "{{host}}", s.Config.Server.PACHost)
-		w.Write([]byte(sContent))
-		return
-	}
-
-	pacContent := fmt.Sprintf(`function FindProxyForURL(url, host) { return "PROXY %s:%d"; }`, s.Config.Server.PACHost, s.Config.Server.Port)
-	w.Write([]byte(pacContent))
-}
-
 func (s *ProxyServer) handleCertDownload(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/x-x509-ca-cert")
 	w.Write(s.CA.GetRootCACertPEM())
 }
 
+// acquireSlot waits for a free slot under limit.max_connections and returns
+// the function that releases it.
+func (s *ProxyServer) acquireSlot() (release func()) {
+	if s.semaphore == nil {
+		return func() {}
+	}
+	start := time.Now()
+	s.semaphore <- struct{}{}
+	metrics.ConnLimitWaitSeconds.With().Observe(time.Since(start).Seconds())
+	return func() { <-s.semaphore }
+}
+
 // handleConnect handles the HTTP CONNECT method for HTTPS tunneling.
 func (s *ProxyServer) handleConnect(w http.ResponseWriter, r *http.Request) {
-	if s.semaphore != nil {
-		s.semaphore <- struct{}{}
-		defer func() { <-s.semaphore }()
+	release, ok := s.reserveClient(r.RemoteAddr)
+	if !ok {
+		http.Error(w, "Too many connections from this client", http.StatusTooManyRequests)
+		return
 	}
+	defer release()
+	defer s.acquireSlot()()
 
 	host, port, err := net.SplitHostPort(r.Host)
 	if err != nil {
@@ -156,68 +517,35 @@ func (s *ProxyServer) handleConnect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// From this point on, we are responsible for closing clientConn.
-	// We delegate closure to the tunnel function or close on error.
-	defer func() {
-		// This defer is a safety net. The tunnel function typically closes connections.
-		// We only want to close here if we return early before establishing the tunnel.
-		// However, checking if it's closed is hard.
-		// The standard pattern is to hand off responsibility.
-		// For simplicity in this flow, we will ensure 'tunnel' closes them,
-		// and we close explicitly if we error before tunnel.
-	}()
-
-	// 2. Respond 200 OK to client
-	if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+	// runConnect closes it via cleanupConnect; early returns below close it explicitly.
+	id, ok := s.trackConn(clientConn)
+	if !ok {
 		clientConn.Close()
 		return
 	}
+	defer s.untrackConn(id)
 
-	// 3. Determine if we should intercept (MITM)
-	if !s.shouldIntercept(host, port) {
-		s.directTunnel(r.Context(), clientConn, host, port)
-		return
-	}
-
-	// 4. Perform TLS Handshake (Server-side) to get ClientHello
-	tlsClientConn, clientHelloHost, err := s.handshakeClient(clientConn, host)
-	if err != nil {
-		logger.Warn("TLS Handshake with client failed: %v", err)
+	// 2. Respond 200 OK to client
+	if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
 		clientConn.Close()
 		return
 	}
 
-	// 5. Connect to Remote (Client-side)
-	targetSNI := s.determineSNI(host, clientHelloHost)
-	remoteConn, err := s.connectToRemote(r.Context(), host, port, r.RemoteAddr, targetSNI)
-	if err != nil {
-		logger.Warn("Failed to connect to remote %s: %v", host, err)
-		tlsClientConn.Close()
-		return
+	// 3. Run the state machine, MITM or direct depending on the rules
+	ctx := &connectContext{
+		ConnectInfo: ConnectInfo{
+			ID:         id,
+			ClientAddr: r.RemoteAddr,
+			Host:       host,
+			Port:       port,
+			Intercept:  s.shouldIntercept(host, port),
+		},
+		clientConn: clientConn,
+		parentCtx:  r.Context(),
 	}
-
-	// 6. Verify Remote Certificate
-	if !s.verifyServerCert(remoteConn, host, targetSNI) {
-		state := remoteConn.ConnectionState()
-		var certInfo string
-		if len(state.PeerCertificates) > 0 {
-			cert := state.PeerCertificates[0]
-			if len(cert.DNSNames) > 0 {
-				certInfo = fmt.Sprintf("Server cert domains: %v", cert.DNSNames)
-			} else {
-				certInfo = fmt.Sprintf("Server cert subject: %s", cert.Subject.CommonName)
-			}
-		} else {
-			certInfo = "No certificates provided by server"
-		}
-		logger.Warn("Certificate verification failed for %s. %s", host, certInfo)
-		tlsClientConn.Close()
-		remoteConn.Close()
-		return
+	if err := s.runConnect(ctx); err != nil {
+		logger.Warn("CONNECT %s: %v", r.Host, err)
 	}
-
-	// 7. Tunnel Data
-	logger.Info("Tunnel: %s <-> %s (SNI: %s)", r.RemoteAddr, host, targetSNI)
-	s.tunnel(tlsClientConn, remoteConn)
 }
 
 func (s *ProxyServer) hijackConnection(w http.ResponseWriter) (net.Conn, error) {
@@ -230,18 +558,37 @@ func (s *ProxyServer) hijackConnection(w http.ResponseWriter) (net.Conn, error)
 }
 
 func (s *ProxyServer) shouldIntercept(host, port string) bool {
-	// Only intercept port 443
-	if port != "443" {
+	if !s.interceptsPort(host, port) {
 		return false
 	}
 
+	// MITM was found to break the host, see learnPassthrough.
+	if s.Passthrough.Contains(host) {
+		return false
+	}
+
+	// A fragmentation rule keeps the connection end-to-end, without MITM.
+	if _, ok := s.rules().GetFragment(host); ok {
+		return false
+	}
+
+	// HTTP-aware mode needs the decrypted traffic.
+	if _, ok := s.rules().GetHTTPMode(host); ok {
+		return true
+	}
+
+	// ECH encrypts the SNI the client sent, which needs the ClientHello.
+	if mode, ok := s.rules().GetECH(host); ok && mode != config.ECHOff {
+		return true
+	}
+
 	// Check rules
-	_, hasAlter := s.Rules.GetAlterHostname(host)
-	policy, hasCert := s.Rules.GetCertVerify(host)
+	_, hasAlter := s.rules().GetAlterHostname(host)
+	policy, hasCert := s.rules().GetCertVerify(host)
 
 	// If no specific rule, use global setting
 	if !hasCert {
-		policy, _ = config.ParseCertPolicy(s.Config.CheckHostname)
+		policy, _ = config.ParseCertPolicy(s.cfg().CheckHostname)
 	}
 
 	// If global verification is enabled (policy.Enabled == true) AND no SNI modification is needed,
@@ -251,7 +598,31 @@ func (s *ProxyServer) shouldIntercept(host, port string) bool {
 	return hasAlter || !policy.Enabled
 }
 
-func (s *ProxyServer) handshakeClient(clientConn net.Conn, defaultHost string) (*tls.Conn, string, error) {
+// interceptsPort reports whether a CONNECT to port may be intercepted for
+// host: the port must be listed in the host's [ports] rule or, without one, in
+// intercept_ports (default 443). With detect_tls every port qualifies and the
+// ClientHello decides, see stateClientHello.
+func (s *ProxyServer) interceptsPort(host, port string) bool {
+	if s.cfg().Server.DetectTLS {
+		return true
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+	ports, ok := s.rules().GetPorts(host)
+	if !ok {
+		ports = s.cfg().Server.InterceptPorts
+		if len(ports) == 0 {
+			ports = []int{443}
+		}
+	}
+	return slices.Contains(ports, n)
+}
+
+// handshakeClient completes the MITM TLS handshake with the client, offering
+// nextProtos for ALPN.
+func (s *ProxyServer) handshakeClient(clientConn net.Conn, defaultHost string, nextProtos []string) (*tls.Conn, error) {
 	tlsConfig := &tls.Config{
 		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 			if hello.ServerName == "" {
@@ -259,21 +630,23 @@ func (s *ProxyServer) handshakeClient(clientConn net.Conn, defaultHost string) (
 			}
 			return s.CA.GetCertificate(hello)
 		},
+		NextProtos: nextProtos,
 	}
+	s.setTicketKeys(tlsConfig)
 	tlsConn := tls.Server(clientConn, tlsConfig)
-	if err := tlsConn.Handshake(); err != nil {
-		return nil, "", err
-	}
-
-	sni := tlsConn.ConnectionState().ServerName
-	if sni == "" {
-		sni = defaultHost
+	tlsConn.SetDeadline(deadlineAfter(s.clientHandshakeTimeout()))
+	start := time.Now()
+	err := tlsConn.Handshake()
+	observeLatency(metrics.HandshakeSeconds.With(metrics.SideClient, resultLabel(err)), start)
+	if err != nil {
+		return nil, err
 	}
-	return tlsConn, sni, nil
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
 }
 
 func (s *ProxyServer) determineSNI(host, clientHelloHost string) string {
-	targetSNI, ok := s.Rules.GetAlterHostname(clientHelloHost)
+	targetSNI, ok := s.rules().GetAlterHostname(clientHelloHost)
 	if !ok {
 		return clientHelloHost
 	}
@@ -285,90 +658,232 @@ func (s *ProxyServer) determineSNI(host, clientHelloHost string) string {
 	return targetSNI
 }
 
-func (s *ProxyServer) connectToRemote(ctx context.Context, host, port, clientAddr, targetSNI string) (*tls.Conn, error) {
-	// Resolve IP
+// errRemoteHandshake wraps TLS handshake failures from connectToRemote, which
+// may succeed with another SNI, as opposed to resolution and dial failures.
+var errRemoteHandshake = errors.New("remote handshake failed")
+
+// connectToRemote resolves and dials host:port and completes the TLS handshake
+// with targetSNI, offering alpn to the remote.
+func (s *ProxyServer) connectToRemote(ctx context.Context, host, port, clientAddr, targetSNI string, alpn []string) (tlsutil.Conn, error) {
+	return s.dialRemoteTLS(ctx, host, port, clientAddr, &tls.Config{
+		ServerName:         targetSNI,
+		NextProtos:         alpn,
+		InsecureSkipVerify: true, // We verify manually
+	})
+}
+
+// dialRemoteTLS dials host:port and performs the TLS handshake with tlsConfig,
+// shaped by the host's ClientHello profile and resuming a cached session with
+// the reached address when there is one. Handshake failures wrap
+// errRemoteHandshake, and errClientCertRequested when the remote asked for a
+// client certificate.
+func (s *ProxyServer) dialRemoteTLS(ctx context.Context, host, port, clientAddr string, tlsConfig *tls.Config) (tlsutil.Conn, error) {
 	clientIP, _, _ := net.SplitHostPort(clientAddr)
-	remoteIP, err := s.Resolver.Resolve(ctx, host, net.ParseIP(clientIP))
+	netConn, remoteAddr, err := s.dialRemote(ctx, "tcp", host, port, net.ParseIP(clientIP))
 	if err != nil {
-		return nil, fmt.Errorf("DNS resolution failed: %w", err)
+		return nil, err
+	}
+	tlsConfig.ClientSessionCache = s.sessionCache(remoteAddr)
+	s.refuseClientCert(tlsConfig)
+	profile := s.fingerprint(host)
+	if profile != config.FingerprintGo {
+		logger.Debug("ClientHello profile for %s: %s", host, profile)
 	}
-	remoteAddr := net.JoinHostPort(remoteIP, port)
 
-	// Dial TCP
-	timeout := time.Duration(s.Config.Timeout.Dial) * time.Second
+	netConn.SetDeadline(deadlineAfter(s.remoteHandshakeTimeout()))
+	start := time.Now()
+	remoteConn, err := tlsutil.Handshake(ctx, netConn, tlsConfig, profile)
+	observeLatency(metrics.HandshakeSeconds.With(metrics.SideRemote, resultLabel(err)), start)
+	if err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("%w: %w", errRemoteHandshake, err)
+	}
+	netConn.SetDeadline(time.Time{})
+
+	return remoteConn, nil
+}
+
+// fingerprint returns the [fingerprint] profile for host, or the global
+// fingerprint.profile when no rule matches.
+func (s *ProxyServer) fingerprint(host string) string {
+	if profile, ok := s.rules().GetFingerprint(host); ok {
+		return profile
+	}
+	if cfg := s.cfg(); cfg != nil && cfg.Fingerprint.Profile != "" {
+		return cfg.Fingerprint.Profile
+	}
+	return config.FingerprintGo
+}
+
+// dialTimeout returns the configured remote dial timeout, defaulting to 30s.
+func (s *ProxyServer) dialTimeout() time.Duration {
+	timeout := time.Duration(s.cfg().Timeout.Dial) * time.Second
 	if timeout == 0 {
 		timeout = 30 * time.Second
 	}
-	dialer := &net.Dialer{Timeout: timeout}
-	netConn, err := dialer.DialContext(ctx, "tcp", remoteAddr)
+	return timeout
+}
+
+// dialRemote resolves host through the Resolver and dials it on the route the
+// outbound rules select for it, racing its addresses Happy Eyeballs style so
+// that an unreachable address falls through to the next one. When the route's
+// proxy resolves names itself, the host name is passed on unresolved. It
+// returns the connection and the address that was reached.
+func (s *ProxyServer) dialRemote(ctx context.Context, network, host, port string, clientIP net.IP) (net.Conn, string, error) {
+	return s.dialRemoteAt(ctx, network, host, "", port, clientIP)
+}
+
+// dialRemoteAt is dialRemote, except that a non-empty ip is dialed instead of
+// resolving host, which then only selects the route.
+func (s *ProxyServer) dialRemoteAt(ctx context.Context, network, host, ip, port string, clientIP net.IP) (net.Conn, string, error) {
+	s.mu.Lock()
+	if s.router == nil {
+		s.router = dialer.NewRouter(s.cfg(), s.rules(), s.dialTimeout())
+	}
+	router := s.router
+	s.mu.Unlock()
+
+	route, err := router.Route(host)
 	if err != nil {
-		s.Resolver.Invalidate(host)
-		return nil, fmt.Errorf("dial failed to %s: %w", remoteAddr, err)
+		return nil, "", err
 	}
 
-	// Handshake TLS
-	remoteConn := tls.Client(netConn, &tls.Config{
-		ServerName:         targetSNI,
-		InsecureSkipVerify: true, // We verify manually
-	})
+	remoteIPs := []string{host}
+	resolve := ip == "" && !route.RemoteDNS
+	if ip != "" {
+		remoteIPs = []string{ip}
+	}
+	if resolve {
+		remoteIPs, err = s.Resolver.ResolveAll(dns.WithPort(ctx, port), host, clientIP)
+		if err != nil {
+			return nil, "", fmt.Errorf("DNS resolution failed for %s: %w", host, err)
+		}
+	}
+	addrs := make([]string, len(remoteIPs))
+	for i, remoteIP := range remoteIPs {
+		addrs[i] = net.JoinHostPort(remoteIP, port)
+	}
 
-	if err := remoteConn.Handshake(); err != nil {
-		netConn.Close()
-		return nil, fmt.Errorf("remote handshake failed: %w", err)
+	if route.Proxy != "" {
+		logger.Debug("Dialing %s via %s", net.JoinHostPort(host, port), route.Proxy)
+	}
+	start := time.Now()
+	conn, remoteAddr, err := dialer.DialParallel(ctx, route, network, addrs, dialer.AttemptDelay)
+	observeLatency(metrics.DialSeconds.With(resultLabel(err)), start)
+	if err != nil {
+		if resolve {
+			s.Resolver.Invalidate(host)
+		}
+		return nil, "", fmt.Errorf("dial failed to %s: %w", net.JoinHostPort(host, port), err)
 	}
+	if remoteAddr != addrs[0] {
+		logger.Debug("Dial to %s fell through to %s", addrs[0], remoteAddr)
+	}
+	return conn, remoteAddr, nil
+}
 
-	return remoteConn, nil
+// clientHandshakeTimeout returns how long a client may take to send its
+// request headers, SOCKS5 greeting or TLS handshake; 0 means no limit.
+func (s *ProxyServer) clientHandshakeTimeout() time.Duration {
+	cfg := s.cfg()
+	if cfg == nil {
+		return 0
+	}
+	return time.Duration(cfg.Timeout.ClientHandshake) * time.Second
+}
+
+// remoteHandshakeTimeout returns how long the upstream TLS handshake may
+// take; 0 means no limit.
+func (s *ProxyServer) remoteHandshakeTimeout() time.Duration {
+	cfg := s.cfg()
+	if cfg == nil {
+		return 0
+	}
+	return time.Duration(cfg.Timeout.RemoteHandshake) * time.Second
 }
 
-func (s *ProxyServer) verifyServerCert(conn *tls.Conn, host, targetSNI string) bool {
-	policy, ok := s.Rules.GetCertVerify(host)
+// deadlineAfter returns the deadline d from now, or the zero time (no
+// deadline) when d is 0.
+func deadlineAfter(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+func (s *ProxyServer) verifyServerCert(conn tlsutil.Conn, host, targetSNI string) bool {
+	return tlsutil.VerifyCert(conn, host, targetSNI, s.certPolicy(host), s.cfg().Security)
+}
+
+// certPolicy returns the [cert_verify] policy for host, or the global
+// check_hostname policy when no rule matches.
+func (s *ProxyServer) certPolicy(host string) config.CertPolicy {
+	policy, ok := s.rules().GetCertVerify(host)
 	if !ok {
-		policy, _ = config.ParseCertPolicy(s.Config.CheckHostname)
+		policy, _ = config.ParseCertPolicy(s.cfg().CheckHostname)
 	}
-	return tlsutil.VerifyCert(conn, host, targetSNI, policy, s.Config.Security)
+	return policy
 }
 
-func (s *ProxyServer) directTunnel(ctx context.Context, clientConn net.Conn, host, port string) {
+// directTunnel dials info.Host:info.Port, or the IP dst on that port if set,
+// and pipes raw bytes between it and clientConn, recording the remote address
+// and tunnel statistics in info. clientConn is closed on every path.
+func (s *ProxyServer) directTunnel(ctx context.Context, clientConn net.Conn, info *ConnectInfo, dst string, answerTimeout time.Duration) error {
+	host, port := info.Host, info.Port
 	clientIP, _, _ := net.SplitHostPort(clientConn.RemoteAddr().String())
-	remoteIP, err := s.Resolver.Resolve(ctx, host, net.ParseIP(clientIP))
+	remoteConn, remoteAddr, err := s.dialRemoteAt(ctx, "tcp", host, dst, port, net.ParseIP(clientIP))
 	if err != nil {
-		logger.Warn("Direct Tunnel: DNS failed for %s: %v", host, err)
 		clientConn.Close()
-		return
+		return err
 	}
-
-	remoteAddr := net.JoinHostPort(remoteIP, port)
-	timeout := time.Duration(s.Config.Timeout.Dial) * time.Second
-	if timeout == 0 {
-		timeout = 30 * time.Second
+	info.RemoteAddr = remoteAddr
+	if answerTimeout > 0 {
+		remoteConn.SetReadDeadline(time.Now().Add(answerTimeout))
+		remoteConn = &answerConn{Conn: remoteConn}
 	}
-	dialer := &net.Dialer{Timeout: timeout}
-	remoteConn, err := dialer.DialContext(ctx, "tcp", remoteAddr)
-	if err != nil {
-		logger.Warn("Direct Tunnel: Connect failed %s: %v", remoteAddr, err)
-		clientConn.Close()
-		return
+
+	if strat, ok := s.rules().GetFragment(host); ok {
+		clientConn, err = s.sendFragmentedHello(clientConn, remoteConn, host, strat)
+		if err != nil {
+			clientConn.Close()
+			remoteConn.Close()
+			return fmt.Errorf("fragment ClientHello for %s: %w", host, err)
+		}
 	}
 
 	logger.Info("Direct Tunnel: %s <-> %s", clientConn.RemoteAddr(), remoteAddr)
-	s.tunnel(clientConn, remoteConn)
+	stats := s.countedTunnel(metrics.ModeDirect, info, clientConn, remoteConn)
+	info.BytesIn, info.BytesOut, info.CloseReason = stats.in, stats.out, stats.reason
+	return nil
 }
 
-// tunnel pipes data between c1 and c2. It closes both connections when done.
-// Fixed: Added context cancellation, error propagation, and timeout to prevent resource leaks.
-// Optimized: Uses configurable buffer size for better throughput.
-func (s *ProxyServer) tunnel(c1, c2 net.Conn) {
-	// 5 minute timeout to prevent indefinite blocking
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
-	defer cancel()
-
-	var wg sync.WaitGroup
-	wg.Add(2)
+// Close reasons reported by tunnel.
+const (
+	closeClientEOF   = "client_eof"   // The client finished sending first
+	closeRemoteEOF   = "remote_eof"   // The remote finished sending first
+	closeClientError = "client_error" // Reading from or writing to the client failed
+	closeRemoteError = "remote_error" // Reading from or writing to the remote failed
+	closeIdle        = "idle_timeout" // No traffic for the idle timeout
+	closeLifetime    = "max_lifetime" // The tunnel outlived the max lifetime
+	closeLocal       = "closed"       // Closed by the proxy, e.g. on shutdown
+)
 
-	errCh := make(chan error, 2) // Buffered to prevent goroutine leak
+// tunnelStats summarizes a finished tunnel.
+type tunnelStats struct {
+	in     int64  // Bytes copied from the client side (c1)
+	out    int64  // Bytes copied to the client side
+	reason string // What ended the tunnel first, one of the close* reasons
+}
 
+// tunnel pipes data between c1 and c2 until both directions finish or one
+// fails. It also ends a tunnel that carries no traffic in either direction for
+// the idle timeout, or that outlives the max lifetime, so long-lived streams
+// survive as long as bytes keep flowing. It closes both connections when done.
+// c1 is the client side and c2 the remote. Each read waits for the bandwidth
+// limits of shape before it is written; a nil shape is unlimited.
+func (s *ProxyServer) tunnel(c1, c2 net.Conn, shape *shaping) tunnelStats {
 	// Determine buffer size with bounds checking
-	bufSize := s.Config.Server.BufferSize
+	bufSize := s.cfg().Server.BufferSize
 	if bufSize <= 0 {
 		bufSize = 65536 // default 64KB
 	}
@@ -379,53 +894,111 @@ func (s *ProxyServer) tunnel(c1, c2 net.Conn) {
 		bufSize = 1048576 // maximum 1MB
 	}
 
-	pipe := func(dst, src net.Conn) {
+	var (
+		lastActive atomic.Int64 // UnixNano of the last successful read
+		in, out    atomic.Int64
+		closeOnce  sync.Once
+		reasonOnce sync.Once
+		reason     string
+		wg         sync.WaitGroup
+		stop       = make(chan struct{}) // Closed with the connections, ends waits for shape
+	)
+	setReason := func(r string) {
+		reasonOnce.Do(func() { reason = r })
+	}
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			close(stop)
+			c1.Close()
+			c2.Close()
+		})
+	}
+	lastActive.Store(time.Now().UnixNano())
+
+	pipe := func(dst, src net.Conn, up bool, count *atomic.Int64, srcEOF, srcErr, dstErr string) {
 		defer wg.Done()
-
-		// Check for cancellation before starting
-		select {
-		case <-ctx.Done():
-			return
-		default:
-		}
-
 		// Use a dedicated buffer for this direction
 		buf := make([]byte, bufSize)
-		_, err := io.CopyBuffer(dst, src, buf)
-		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
-			// Send error without blocking
-			select {
-			case errCh <- err:
-			default:
+		for {
+			n, err := src.Read(buf[:shape.chunk(up, bufSize)])
+			failed := srcErr
+			if n > 0 {
+				lastActive.Store(time.Now().UnixNano())
+				if !shape.wait(stop, up, n) {
+					return
+				}
+				written, werr := dst.Write(buf[:n])
+				count.Add(int64(written))
+				if werr != nil {
+					err, failed = werr, dstErr
+				}
 			}
-		}
-
-		// Attempt to close the write side of the destination connection
-		// This signals the other direction that we're done writing.
-		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
-			cw.CloseWrite()
+			if err == nil {
+				continue
+			}
+			if errors.Is(err, io.EOF) {
+				setReason(srcEOF)
+				// Close the write side of the destination so the other
+				// direction learns we're done writing.
+				if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+					cw.CloseWrite()
+				}
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				setReason(closeLocal)
+			} else {
+				setReason(failed)
+				logger.Debug("tunnel error: %v", err)
+			}
+			closeBoth()
+			return
 		}
 	}
 
-	go pipe(c1, c2)
-	go pipe(c2, c1)
-
-	// Wait for both goroutines or first error
+	done := make(chan struct{})
+	wg.Add(2)
+	go pipe(c1, c2, false, &out, closeRemoteEOF, closeRemoteError, closeClientError)
+	go pipe(c2, c1, true, &in, closeClientEOF, closeClientError, closeRemoteError)
 	go func() {
 		wg.Wait()
-		cancel()
+		close(done)
 	}()
 
-	// Wait for first error or cancellation
-	select {
-	case err := <-errCh:
-		if err != nil {
-			logger.Debug("tunnel error: %v", err)
-		}
-	case <-ctx.Done():
+	idle := time.Duration(s.cfg().Timeout.Idle) * time.Second
+	lifetime := time.Duration(s.cfg().Timeout.MaxLifetime) * time.Second
+	var idleTimer *time.Timer
+	var idleC, lifeC <-chan time.Time // nil channels never fire
+	if idle > 0 {
+		idleTimer = time.NewTimer(idle)
+		defer idleTimer.Stop()
+		idleC = idleTimer.C
+	}
+	if lifetime > 0 {
+		lifeTimer := time.NewTimer(lifetime)
+		defer lifeTimer.Stop()
+		lifeC = lifeTimer.C
 	}
 
-	// Ensure both connections are closed
-	c1.Close()
-	c2.Close()
+	for {
+		select {
+		case <-done:
+			closeBoth()
+			return tunnelStats{in: in.Load(), out: out.Load(), reason: reason}
+		case <-lifeC:
+			logger.Debug("Tunnel reached max lifetime %v, closing", lifetime)
+			setReason(closeLifetime)
+		case <-idleC:
+			since := time.Since(time.Unix(0, lastActive.Load()))
+			if since < idle {
+				idleTimer.Reset(idle - since)
+				continue
+			}
+			logger.Debug("Tunnel idle for %v, closing", since.Round(time.Second))
+			setReason(closeIdle)
+		}
+		closeBoth()
+		<-done
+		return tunnelStats{in: in.Load(), out: out.Load(), reason: reason}
+	}
 }
@@ -3,6 +3,8 @@ package proxy
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -12,11 +14,15 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	miekgdns "github.com/miekg/dns"
 	"github.com/xihale/snirect-shared/rules"
+	"snirect/internal/accesslog"
 	"snirect/internal/cert"
 	"snirect/internal/config"
 	"snirect/internal/dns"
@@ -53,7 +59,7 @@ func TestTunnel(t *testing.T) {
 
 	done := make(chan struct{})
 	go func() {
-		ps.tunnel(c1, c2)
+		ps.tunnel(c1, c2, nil)
 		close(done)
 	}()
 
@@ -119,7 +125,7 @@ func TestTunnel_SingleSideClose(t *testing.T) {
 
 	done := make(chan struct{})
 	go func() {
-		ps.tunnel(c1, c2)
+		ps.tunnel(c1, c2, nil)
 		close(done)
 	}()
 
@@ -169,7 +175,7 @@ func TestTunnel_GoroutineLeak(t *testing.T) {
 
 	done := make(chan struct{})
 	go func() {
-		ps.tunnel(c1, c2)
+		ps.tunnel(c1, c2, nil)
 		close(done)
 	}()
 
@@ -184,6 +190,127 @@ func TestTunnel_GoroutineLeak(t *testing.T) {
 	}
 }
 
+// newTimeoutTestProxy 返回带有指定隧道超时（秒）的 ProxyServer
+func newTimeoutTestProxy(idle, maxLifetime int) *ProxyServer {
+	return &ProxyServer{
+		Config: &config.Config{
+			Timeout: config.TimeoutConfig{Idle: idle, MaxLifetime: maxLifetime},
+		},
+	}
+}
+
+// TestTunnel_IdleTimeout 测试无流量的隧道在空闲超时后被关闭
+func TestTunnel_IdleTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	ps := newTimeoutTestProxy(1, 0)
+	done := make(chan struct{})
+	go func() {
+		ps.tunnel(c1, c2, nil)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("idle tunnel was not closed")
+	}
+}
+
+// TestTunnel_IdleResetByTraffic 测试持续的流量使隧道在空闲超时之后仍保持打开
+func TestTunnel_IdleResetByTraffic(t *testing.T) {
+	a, c1 := net.Pipe()
+	c2, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	ps := newTimeoutTestProxy(1, 0)
+	done := make(chan struct{})
+	go func() {
+		ps.tunnel(c1, c2, nil)
+		close(done)
+	}()
+
+	buf := make([]byte, 4)
+	deadline := time.Now().Add(2500 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		if _, err := a.Write([]byte("ping")); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if _, err := io.ReadFull(b, buf); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+
+	select {
+	case <-done:
+		t.Fatal("active tunnel was closed by the idle timeout")
+	default:
+	}
+	a.Close()
+	<-done
+}
+
+// TestTunnel_MaxLifetime 测试即使有流量，隧道也会在最长存活时间后被关闭
+func TestTunnel_MaxLifetime(t *testing.T) {
+	a, c1 := net.Pipe()
+	c2, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	ps := newTimeoutTestProxy(0, 1)
+	done := make(chan struct{})
+	go func() {
+		ps.tunnel(c1, c2, nil)
+		close(done)
+	}()
+	go io.Copy(io.Discard, b)
+	go func() {
+		for {
+			if _, err := a.Write([]byte("ping")); err != nil {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("tunnel outlived its max lifetime")
+	}
+}
+
+// TestHandshakeClient_Timeout 测试客户端迟迟不发送 ClientHello 时握手超时
+func TestHandshakeClient_Timeout(t *testing.T) {
+	ps := &ProxyServer{
+		Config: &config.Config{Timeout: config.TimeoutConfig{ClientHandshake: 1}},
+		CA:     &mockCertificateManager{},
+	}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := ps.handshakeClient(serverConn, "example.com", nil)
+		errc <- err
+	}()
+
+	select {
+	case err := <-errc:
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() {
+			t.Fatalf("err = %v, want a timeout", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("handshake did not time out")
+	}
+}
+
 // mockCertificateManager is a test double for interfaces.CertificateManager.
 type mockCertificateManager struct{}
 
@@ -195,10 +322,50 @@ func (m *mockCertificateManager) GetRootCACertPEM() []byte {
 }
 func (m *mockCertificateManager) Close() error { return nil }
 
-// TestHandleHTTP_PAC tests that the PAC endpoint returns correct JavaScript.
-// Skipped due to dependency on existing PAC file in user config directory.
+// TestHandleHTTP_PAC tests that the PAC endpoint is generated from the rules
+// in effect and can be revalidated with its ETag.
 func TestHandleHTTP_PAC(t *testing.T) {
-	t.Skip("requires isolated config directory; to be revisited")
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir()) // No legacy pac file
+	r := rules.NewRules()
+	r.AlterHostname["*.example.com"] = "front.example"
+	r.Init()
+	cfg := &config.Config{Server: config.ServerConfig{PACHost: "127.0.0.1", Port: 7654, PACDirectFallback: true}}
+	ps := &ProxyServer{Config: cfg, Rules: &config.Rules{Rules: r}}
+
+	get := func(etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/pac/", nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rr := httptest.NewRecorder()
+		ps.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := get("")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rr.Code)
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, `"PROXY 127.0.0.1:7654; DIRECT"`) || !strings.Contains(body, `"example.com":1`) {
+		t.Errorf("PAC content unexpected: %s", body)
+	}
+	etag := rr.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+	if rr := get(etag); rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+		t.Errorf("revalidation: got %d with %d bytes, want 304", rr.Code, rr.Body.Len())
+	}
+
+	next := rules.NewRules()
+	next.Hosts["added.test"] = "192.0.2.1"
+	next.Init()
+	ps.Reload(cfg, &config.Rules{Rules: next})
+	rr = get(etag)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"added.test":1`) {
+		t.Errorf("after reload: got %d, %s", rr.Code, rr.Body.String())
+	}
 }
 
 // TestHandleHTTP_CertDownload tests that the CERT endpoint returns the root CA PEM.
@@ -223,7 +390,28 @@ func TestHandleHTTP_CertDownload(t *testing.T) {
 	}
 }
 
-// TestHandleHTTP_Redirect tests that non-PAC/CERT requests redirect to HTTPS.
+// TestHandleHTTP_Metrics tests that /metrics is served only when enabled.
+func TestHandleHTTP_Metrics(t *testing.T) {
+	ps := &ProxyServer{Config: &config.Config{}}
+
+	rr := httptest.NewRecorder()
+	ps.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("disabled: expected status 404, got %d", rr.Code)
+	}
+
+	ps.Config.Server.Metrics = true
+	rr = httptest.NewRecorder()
+	ps.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("enabled: expected status 200, got %d", rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "# TYPE snirect_tunnels_total counter") {
+		t.Errorf("response body lacks snirect_tunnels_total:\n%s", rr.Body.String())
+	}
+}
+
+// TestHandleHTTP_Redirect tests that hosts with an http_upgrade rule are redirected to HTTPS.
 func TestHandleHTTP_Redirect(t *testing.T) {
 	ps := &ProxyServer{
 		Config: &config.Config{
@@ -231,6 +419,10 @@ func TestHandleHTTP_Redirect(t *testing.T) {
 				Port: 7654,
 			},
 		},
+		Rules: &config.Rules{
+			Rules:       rules.NewRules(),
+			HTTPUpgrade: map[string]bool{"*example.com": true},
+		},
 		CA: &mockCertificateManager{},
 	}
 
@@ -249,6 +441,85 @@ func TestHandleHTTP_Redirect(t *testing.T) {
 	}
 }
 
+// TestHandleHTTP_Forward tests that absolute-form requests are forwarded with keep-alive.
+func TestHandleHTTP_Forward(t *testing.T) {
+	var resolved []string
+	var mu sync.Mutex
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Connection") != "" {
+			t.Errorf("Proxy-Connection header leaked upstream")
+		}
+		fmt.Fprintf(w, "%s %s", r.Host, r.URL.Path)
+	}))
+	defer backend.Close()
+	_, backendPort, _ := net.SplitHostPort(backend.Listener.Addr().String())
+
+	ps := newShutdownTestProxy()
+	ps.Resolver = &mockResolver{
+		resolveFunc: func(ctx context.Context, host string, clientIP net.IP) (string, error) {
+			mu.Lock()
+			resolved = append(resolved, host)
+			mu.Unlock()
+			return "127.0.0.1", nil
+		},
+	}
+	proxyAddr := startTestProxy(t, ps)
+	defer ps.Close()
+
+	proxyURL, _ := url.Parse("http://" + proxyAddr)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	defer client.CloseIdleConnections()
+
+	target := "http://plain.example:" + backendPort
+	for _, path := range []string{"/a", "/b"} {
+		req, _ := http.NewRequest("GET", target+path, nil)
+		req.Header.Set("Proxy-Connection", "keep-alive")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if want := "plain.example:" + backendPort + " " + path; string(body) != want {
+			t.Fatalf("body = %q, want %q", body, want)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(resolved) != 1 || resolved[0] != "plain.example" {
+		t.Fatalf("resolved = %v, want a single lookup of plain.example (upstream keep-alive)", resolved)
+	}
+}
+
+// TestHandleHTTP_ProxyConnectionClose tests that Proxy-Connection: close ends the client connection.
+func TestHandleHTTP_ProxyConnectionClose(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	ps := newShutdownTestProxy()
+	proxyAddr := startTestProxy(t, ps)
+	defer ps.Close()
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: %s\r\nProxy-Connection: close\r\n\r\n", backend.URL, backend.Listener.Addr())
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	raw, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if !strings.Contains(string(raw), "Connection: close") || !strings.HasSuffix(string(raw), "ok") {
+		t.Fatalf("unexpected response: %q", raw)
+	}
+}
+
 // TestShouldIntercept tests the logic of deciding whether to MITM.
 func TestShouldIntercept(t *testing.T) {
 	baseRules := rules.NewRules()
@@ -292,6 +563,65 @@ func TestShouldIntercept(t *testing.T) {
 	}
 }
 
+// TestShouldIntercept_Ports tests intercept_ports, [ports] overrides and detect_tls.
+func TestShouldIntercept_Ports(t *testing.T) {
+	rls := &config.Rules{
+		Rules: rules.NewRules(),
+		Ports: map[string][]int{"*alt.example": {2053}},
+	}
+	tests := []struct {
+		name   string
+		server config.ServerConfig
+		host   string
+		port   string
+		want   bool
+	}{
+		{"default 443", config.ServerConfig{}, "example.com", "443", true},
+		{"default excludes 8443", config.ServerConfig{}, "example.com", "8443", false},
+		{"listed 8443", config.ServerConfig{InterceptPorts: []int{443, 8443}}, "example.com", "8443", true},
+		{"rule port", config.ServerConfig{}, "www.alt.example", "2053", true},
+		{"rule replaces global", config.ServerConfig{}, "www.alt.example", "443", false},
+		{"detect any port", config.ServerConfig{DetectTLS: true}, "example.com", "9000", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps := &ProxyServer{
+				Config: &config.Config{CheckHostname: false, Server: tt.server},
+				Rules:  rls,
+			}
+			if got := ps.shouldIntercept(tt.host, tt.port); got != tt.want {
+				t.Fatalf("shouldIntercept(%s, %s) = %v, want %v", tt.host, tt.port, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestConnect_DetectTLSFallsBack tests that with detect_tls a CONNECT whose
+// client does not send a ClientHello is tunnelled unchanged.
+func TestConnect_DetectTLSFallsBack(t *testing.T) {
+	echoAddr := newEchoServer(t)
+	ps := newShutdownTestProxy()
+	ps.Config.CheckHostname = false
+	ps.Config.Server.DetectTLS = true
+	proxyAddr := startTestProxy(t, ps)
+	defer ps.Close()
+
+	conn := openDirectTunnel(t, proxyAddr, echoAddr)
+	defer conn.Close()
+	msg := "PLAIN TEXT PROTOCOL\r\n"
+	if _, err := io.WriteString(conn, msg); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read echo: %v", err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("echo = %q, want %q", buf, msg)
+	}
+}
+
 // TestDetermineSNI tests SNI determination based on rules.
 func TestDetermineSNI(t *testing.T) {
 	baseRules := rules.NewRules()
@@ -321,6 +651,7 @@ func TestDetermineSNI(t *testing.T) {
 // mockResolver is a test double for interfaces.Resolver.
 type mockResolver struct {
 	resolveFunc    func(ctx context.Context, host string, clientIP net.IP) (string, error)
+	resolveAllFunc func(ctx context.Context, host string, clientIP net.IP) ([]string, error)
 	invalidateFunc func(host string)
 }
 
@@ -328,6 +659,18 @@ func (m *mockResolver) Resolve(ctx context.Context, host string, clientIP net.IP
 	return m.resolveFunc(ctx, host, clientIP)
 }
 
+// ResolveAll uses resolveAllFunc if set, otherwise the single address from resolveFunc.
+func (m *mockResolver) ResolveAll(ctx context.Context, host string, clientIP net.IP) ([]string, error) {
+	if m.resolveAllFunc != nil {
+		return m.resolveAllFunc(ctx, host, clientIP)
+	}
+	ip, err := m.resolveFunc(ctx, host, clientIP)
+	if err != nil {
+		return nil, err
+	}
+	return []string{ip}, nil
+}
+
 func (m *mockResolver) Invalidate(host string) {
 	if m.invalidateFunc != nil {
 		m.invalidateFunc(host)
@@ -336,6 +679,83 @@ func (m *mockResolver) Invalidate(host string) {
 
 func (m *mockResolver) Close() error { return nil }
 
+// TestDialRemote_FastestPreference tests that in fastest mode a CONNECT dials
+// the address with the lowest connect latency first, not the first answer.
+func TestDialRemote_FastestPreference(t *testing.T) {
+	echoAddr := newEchoServer(t)
+	_, echoPort, _ := net.SplitHostPort(echoAddr)
+
+	// Nothing listens on 127.0.0.2, so only 127.0.0.1 passes the latency test.
+	handler := miekgdns.HandlerFunc(func(w miekgdns.ResponseWriter, q *miekgdns.Msg) {
+		m := new(miekgdns.Msg)
+		m.SetReply(q)
+		if q.Question[0].Qtype == miekgdns.TypeA {
+			for _, ip := range []string{"127.0.0.2", "127.0.0.1"} {
+				rr, _ := miekgdns.NewRR(q.Question[0].Name + " 60 IN A " + ip)
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		w.WriteMsg(m)
+	})
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	started := make(chan struct{})
+	srv := &miekgdns.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+	<-started
+
+	// Route through a SOCKS5 upstream that records every address it is asked for.
+	var mu sync.Mutex
+	var dialed []string
+	up := newShutdownTestProxy()
+	up.Resolver = &mockResolver{
+		resolveFunc: func(ctx context.Context, host string, clientIP net.IP) (string, error) {
+			return host, nil
+		},
+	}
+	up.AddHook(PhaseHook{
+		Before: func(phase Phase, info *ConnectInfo) error {
+			mu.Lock()
+			dialed = append(dialed, info.Host)
+			mu.Unlock()
+			return nil
+		},
+	})
+	upAddr := startTestSOCKS(t, up)
+	defer up.Close()
+
+	ps := newShutdownTestProxy()
+	ps.Config.IPv6 = true
+	ps.Config.DNS.Nameserver = []string{pc.LocalAddr().String()}
+	ps.Config.Preference = config.PreferenceConfig{Mode: config.IPPreferenceFastest, TestTimeoutMs: 500}
+	ps.Config.Outbound.Proxy = "socks5://" + upAddr
+	resolver := dns.NewResolver(ps.Config, ps.Rules)
+	defer resolver.Close()
+	ps.Resolver = resolver
+	proxyAddr := startTestProxy(t, ps)
+	defer ps.Close()
+
+	conn := openDirectTunnel(t, proxyAddr, net.JoinHostPort("fast.example", echoPort))
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo = %q, %v", buf, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(dialed) != 1 || dialed[0] != "127.0.0.1" {
+		t.Fatalf("dialed %v, want only the fastest address [127.0.0.1]", dialed)
+	}
+}
+
 // TestDirectTunnel_DNSFailure tests that directTunnel handles DNS resolution failure gracefully.
 func TestDirectTunnel_DNSFailure(t *testing.T) {
 	mock := &mockResolver{
@@ -349,7 +769,7 @@ func TestDirectTunnel_DNSFailure(t *testing.T) {
 	}
 	c1, c2 := net.Pipe()
 	// directTunnel should call c1.Close() and return without panicking.
-	ps.directTunnel(context.Background(), c1, "example.com", "443")
+	ps.directTunnel(context.Background(), c1, &ConnectInfo{Host: "example.com", Port: "443"}, "", 0)
 	// c1 should be closed
 	_, err := c1.Write([]byte("test"))
 	if err == nil {
@@ -374,7 +794,7 @@ func TestDirectTunnel_ConnectFailure(t *testing.T) {
 	}
 	c1, _ := net.Pipe()
 	// Use a port that is unlikely to be listening
-	ps.directTunnel(context.Background(), c1, "example.com", "9") // port 9 is typically unused
+	ps.directTunnel(context.Background(), c1, &ConnectInfo{Host: "example.com", Port: "9"}, "", 0) // port 9 is typically unused
 	// Should attempt dial, fail, close c1
 	_, err := c1.Write([]byte("test"))
 	if err == nil {
@@ -382,6 +802,37 @@ func TestDirectTunnel_ConnectFailure(t *testing.T) {
 	}
 }
 
+// TestDirectTunnel_FailsOverToNextIP tests that a CONNECT succeeds when the
+// first resolved address refuses the connection but a later one accepts it.
+func TestDirectTunnel_FailsOverToNextIP(t *testing.T) {
+	echoAddr := newEchoServer(t)
+	_, port, _ := net.SplitHostPort(echoAddr)
+
+	ps := newShutdownTestProxy()
+	ps.Config.Timeout.Dial = 5
+	ps.Resolver = &mockResolver{
+		resolveAllFunc: func(ctx context.Context, host string, clientIP net.IP) ([]string, error) {
+			// The echo server only listens on 127.0.0.1.
+			return []string{"127.0.0.2", "127.0.0.1"}, nil
+		},
+		invalidateFunc: func(host string) {
+			t.Errorf("Invalidate(%s) called although a later address answered", host)
+		},
+	}
+	proxyAddr := startTestProxy(t, ps)
+
+	conn := openDirectTunnel(t, proxyAddr, net.JoinHostPort("example.com", port))
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo = %q, %v", buf, err)
+	}
+}
+
 // TestConnectToRemote_DNSFailure tests that connectToRemote returns error when DNS resolution fails.
 func TestConnectToRemote_DNSFailure(t *testing.T) {
 	mock := &mockResolver{
@@ -393,7 +844,7 @@ func TestConnectToRemote_DNSFailure(t *testing.T) {
 		Config:   &config.Config{},
 		Resolver: mock,
 	}
-	_, err := ps.connectToRemote(context.Background(), "example.com", "443", "192.168.1.1", "example.com")
+	_, err := ps.connectToRemote(context.Background(), "example.com", "443", "192.168.1.1", "example.com", nil)
 	if err == nil {
 		t.Fatal("expected DNS error")
 	}
@@ -416,7 +867,7 @@ func TestConnectToRemote_DialFailure(t *testing.T) {
 		Resolver: mock,
 	}
 	// Port 9 is typically unused and will cause connection refused.
-	_, err := ps.connectToRemote(context.Background(), "example.com", "9", "192.168.1.1", "example.com")
+	_, err := ps.connectToRemote(context.Background(), "example.com", "9", "192.168.1.1", "example.com", nil)
 	if err == nil {
 		t.Fatal("expected dial failure")
 	}
@@ -454,12 +905,155 @@ func TestConnectToRemote_TLSFailure(t *testing.T) {
 		Resolver: mock,
 	}
 
-	_, err = ps.connectToRemote(context.Background(), "example.com", port, "192.168.1.1", "example.com")
+	_, err = ps.connectToRemote(context.Background(), "example.com", port, "192.168.1.1", "example.com", nil)
 	if err == nil {
 		t.Fatal("expected TLS handshake failure")
 	}
 }
 
+// TestProxy_ALPNMirroring tests that an intercepted connection uses the
+// protocol the remote selected from the client's ALPN list.
+func TestProxy_ALPNMirroring(t *testing.T) {
+	certMgr, err := cert.NewCertificateManager(filepath.Join(t.TempDir(), "root.crt"), filepath.Join(t.TempDir(), "root.key"))
+	if err != nil {
+		t.Fatalf("NewCertificateManager: %v", err)
+	}
+	defer certMgr.Close()
+
+	for _, tc := range []struct {
+		name      string
+		remoteH2  bool
+		wantProto int
+	}{
+		{"h2 remote", true, 2},
+		{"http/1.1 remote", false, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, r.Proto)
+			}))
+			ts.EnableHTTP2 = tc.remoteH2
+			ts.StartTLS()
+			defer ts.Close()
+			_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+			ps := newShutdownTestProxy()
+			ps.Config.CheckHostname = false
+			ps.CA = certMgr
+
+			// Only port 443 is intercepted through CONNECT, so run the MITM
+			// state machine directly for the test server's port.
+			clientConn, proxyConn := net.Pipe()
+			done := make(chan error, 1)
+			go func() {
+				done <- ps.runConnect(&connectContext{
+					ConnectInfo: ConnectInfo{ClientAddr: "127.0.0.1:1", Host: "alpn.example", Port: port, Intercept: true},
+					clientConn:  proxyConn,
+					parentCtx:   context.Background(),
+				})
+			}()
+
+			client := &http.Client{Transport: &http.Transport{
+				DialTLSContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					conn := tls.Client(clientConn, &tls.Config{
+						ServerName:         "alpn.example",
+						InsecureSkipVerify: true,
+						NextProtos:         []string{"h2", "http/1.1"},
+					})
+					return conn, conn.HandshakeContext(ctx)
+				},
+				ForceAttemptHTTP2: true,
+			}}
+			resp, err := client.Get("https://alpn.example:" + port + "/")
+			if err != nil {
+				t.Fatalf("GET through the MITM: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			client.CloseIdleConnections()
+			if err := <-done; err != nil {
+				t.Errorf("runConnect: %v", err)
+			}
+
+			if resp.ProtoMajor != tc.wantProto {
+				t.Errorf("client spoke %s, want HTTP/%d", resp.Proto, tc.wantProto)
+			}
+			if want := fmt.Sprintf("HTTP/%d", tc.wantProto); !strings.HasPrefix(string(body), want) {
+				t.Errorf("remote saw %s, want %s", body, want)
+			}
+		})
+	}
+}
+
+// TestProxy_SNIFallbackLadder tests that a failed remote handshake is retried
+// with the [sni_fallback] candidates within the same connection, and that the
+// candidate that worked is tried first next time.
+func TestProxy_SNIFallbackLadder(t *testing.T) {
+	certMgr, err := cert.NewCertificateManager(filepath.Join(t.TempDir(), "root.crt"), filepath.Join(t.TempDir(), "root.key"))
+	if err != nil {
+		t.Fatalf("NewCertificateManager: %v", err)
+	}
+	defer certMgr.Close()
+
+	var mu sync.Mutex
+	var seen []string
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	ts.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		mu.Lock()
+		seen = append(seen, hello.ServerName)
+		mu.Unlock()
+		if hello.ServerName != "ladder.example" {
+			return nil, fmt.Errorf("SNI %q blocked", hello.ServerName)
+		}
+		return nil, nil
+	}}
+	ts.StartTLS()
+	defer ts.Close()
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+	ps := newShutdownTestProxy()
+	ps.Config.CheckHostname = false
+	portNum, _ := strconv.Atoi(port)
+	ps.Config.Server.InterceptPorts = []int{portNum}
+	ps.CA = certMgr
+	ps.Rules.AlterHostname["ladder.example"] = "rewritten.example"
+	ps.Rules.SNIFallback = map[string][]string{"ladder.example": {"", "__AUTO__"}}
+	proxyAddr := startTestProxy(t, ps)
+	defer ps.Close()
+
+	proxyURL, _ := url.Parse("http://" + proxyAddr)
+	get := func() {
+		t.Helper()
+		client := &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+		defer client.CloseIdleConnections()
+		resp, err := client.Get("https://ladder.example:" + port + "/")
+		if err != nil {
+			t.Fatalf("GET through proxy: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	get()
+	mu.Lock()
+	if want := []string{"rewritten.example", "", "ladder.example"}; fmt.Sprint(seen) != fmt.Sprint(want) {
+		t.Errorf("first connection tried SNIs %q, want %q", seen, want)
+	}
+	seen = nil
+	mu.Unlock()
+
+	get()
+	mu.Lock()
+	if want := []string{"ladder.example"}; fmt.Sprint(seen) != fmt.Sprint(want) {
+		t.Errorf("second connection tried SNIs %q, want %q", seen, want)
+	}
+	mu.Unlock()
+}
+
 // nonHijacker is a http.ResponseWriter that does NOT implement Hijacker.
 type nonHijacker struct{}
 
@@ -587,13 +1181,14 @@ func TestHandshakeClient_Error(t *testing.T) {
 		clientConn.Close()
 	}()
 
-	_, _, err := ps.handshakeClient(serverConn, "example.com")
+	_, err := ps.handshakeClient(serverConn, "example.com", nil)
 	if err == nil {
 		t.Error("expected handshake error")
 	}
 }
 
-// TestHandleHTTP_PAC_WithFile tests the PAC endpoint when a custom pac file exists in the config directory.
+// TestHandleHTTP_PAC_WithFile tests the PAC endpoint with a custom template in
+// the config directory, named by pac_template or left by an older version.
 func TestHandleHTTP_PAC_WithFile(t *testing.T) {
 	// Save and restore XDG_CONFIG_HOME to isolate test environment
 	origEnv := os.Getenv("XDG_CONFIG_HOME")
@@ -617,8 +1212,9 @@ func TestHandleHTTP_PAC_WithFile(t *testing.T) {
 	ps := &ProxyServer{
 		Config: &config.Config{
 			Server: config.ServerConfig{
-				PACHost: "custom.com",
-				Port:    9999,
+				PACHost:     "custom.com",
+				Port:        9999,
+				PACTemplate: "pac",
 			},
 		},
 		CA: &mockCertificateManager{},
@@ -637,4 +1233,420 @@ func TestHandleHTTP_PAC_WithFile(t *testing.T) {
 	if !strings.Contains(rr.Header().Get("Content-Type"), "application/x-ns-proxy-autoconfig") {
 		t.Errorf("Content-Type: got %q, want application/x-ns-proxy-autoconfig", rr.Header().Get("Content-Type"))
 	}
+
+	legacy := &ProxyServer{Config: &config.Config{Server: config.ServerConfig{PACHost: "127.0.0.1", Port: 7654}}}
+	rr = httptest.NewRecorder()
+	legacy.ServeHTTP(rr, httptest.NewRequest("GET", "/pac/", nil))
+	if !strings.Contains(rr.Body.String(), "PROXY custom.com:9999") {
+		t.Errorf("PAC without pac_template ignored the edited pac file: %s", rr.Body.String())
+	}
+}
+
+// startTestProxy serves ps on a random loopback port and returns its address.
+func startTestProxy(t *testing.T, ps *ProxyServer) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	go ps.Serve(ln)
+	return ln.Addr().String()
+}
+
+// openDirectTunnel issues a CONNECT through the proxy and returns the established connection.
+func openDirectTunnel(t *testing.T, proxyAddr, target string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	buf := make([]byte, len("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read CONNECT response: %v", err)
+	}
+	if !strings.HasPrefix(string(buf), "HTTP/1.1 200") {
+		t.Fatalf("unexpected CONNECT response: %q", buf)
+	}
+	return conn
+}
+
+// newEchoServer starts a TCP server that echoes everything it receives.
+func newEchoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func newShutdownTestProxy() *ProxyServer {
+	return &ProxyServer{
+		Config: &config.Config{CheckHostname: true},
+		Rules:  &config.Rules{Rules: rules.NewRules()},
+		Resolver: &mockResolver{
+			resolveFunc: func(ctx context.Context, host string, clientIP net.IP) (string, error) {
+				return "127.0.0.1", nil
+			},
+		},
+	}
+}
+
+// TestShutdown_DrainsTunnels tests that Shutdown waits for open tunnels to finish on their own.
+func TestShutdown_DrainsTunnels(t *testing.T) {
+	echoAddr := newEchoServer(t)
+	ps := newShutdownTestProxy()
+	proxyAddr := startTestProxy(t, ps)
+
+	conn := openDirectTunnel(t, proxyAddr, echoAddr)
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Fatalf("echo through tunnel: %q, %v", reply, err)
+	}
+
+	// Finish the tunnel shortly after Shutdown starts waiting.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		conn.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ps.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown returned %v, want nil after drain", err)
+	}
+	if n := ps.ActiveTunnels(); n != 0 {
+		t.Fatalf("ActiveTunnels = %d after shutdown, want 0", n)
+	}
+	if _, err := net.Dial("tcp", proxyAddr); err == nil {
+		t.Fatal("proxy still accepting connections after Shutdown")
+	}
+}
+
+// TestConnections_ListAndClose tests that a live tunnel is listed and that
+// CloseConnection ends it.
+func TestConnections_ListAndClose(t *testing.T) {
+	echoAddr := newEchoServer(t)
+	ps := newShutdownTestProxy()
+	proxyAddr := startTestProxy(t, ps)
+	defer ps.Close()
+
+	conn := openDirectTunnel(t, proxyAddr, echoAddr)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatalf("read echo: %v", err)
+	}
+
+	list := ps.Connections()
+	if len(list) != 1 {
+		t.Fatalf("Connections() = %+v, want 1 connection", list)
+	}
+	c := list[0]
+	if c.Host != "127.0.0.1" || c.Intercept || c.Phase != PhaseDirectDial {
+		t.Errorf("connection = %+v, want a direct tunnel to %s", c, echoAddr)
+	}
+
+	if ps.CloseConnection(c.ID + 100) {
+		t.Error("CloseConnection of an unknown ID returned true")
+	}
+	if !ps.CloseConnection(c.ID) {
+		t.Fatal("CloseConnection returned false")
+	}
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("read after close: %v", err)
+	}
+}
+
+// TestReload_SwapsRules tests that Reload replaces the rules and keeps the
+// listener settings of the running configuration.
+func TestReload_SwapsRules(t *testing.T) {
+	ps := newShutdownTestProxy()
+	ps.Config.Server.Port = 7654
+	if got := ps.determineSNI("example.com", "example.com"); got != "example.com" {
+		t.Fatalf("determineSNI before reload = %q", got)
+	}
+
+	newRules := &config.Rules{Rules: rules.NewRules()}
+	newRules.AlterHostname["example.com"] = ""
+	ps.Reload(&config.Config{Server: config.ServerConfig{Port: 9999, DetectTLS: true}}, newRules)
+
+	if got := ps.determineSNI("example.com", "example.com"); got != "" {
+		t.Errorf("determineSNI after reload = %q, want the SNI stripped", got)
+	}
+	cfg := ps.EffectiveConfig()
+	if cfg.Server.Port != 7654 || !cfg.Server.DetectTLS {
+		t.Errorf("effective server config = %+v, want port 7654 kept and detect_tls applied", cfg.Server)
+	}
+}
+
+// TestShutdown_ForceClosesAfterDeadline tests that tunnels still open at the deadline are closed.
+func TestShutdown_ForceClosesAfterDeadline(t *testing.T) {
+	echoAddr := newEchoServer(t)
+	ps := newShutdownTestProxy()
+	proxyAddr := startTestProxy(t, ps)
+
+	conn := openDirectTunnel(t, proxyAddr, echoAddr)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := ps.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown returned %v, want deadline exceeded", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected tunnel to be closed by Shutdown")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("tunnel was not force-closed")
+	}
+}
+
+// TestShutdown_CancelsDials tests that Shutdown returns soon after its
+// deadline even when a handler is still resolving the remote.
+func TestShutdown_CancelsDials(t *testing.T) {
+	ps := newShutdownTestProxy()
+	resolving := make(chan struct{})
+	ps.Resolver = &mockResolver{
+		resolveFunc: func(ctx context.Context, host string, clientIP net.IP) (string, error) {
+			close(resolving)
+			<-ctx.Done()
+			return "", ctx.Err()
+		},
+	}
+	proxyAddr := startTestProxy(t, ps)
+
+	conn := openDirectTunnel(t, proxyAddr, "stuck.example:443")
+	defer conn.Close()
+	<-resolving
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := ps.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown returned %v, want deadline exceeded", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Shutdown took %v with a handler stuck resolving", d)
+	}
+	if n := ps.ActiveTunnels(); n != 0 {
+		t.Errorf("%d tunnel(s) left after Shutdown", n)
+	}
+}
+
+// TestConnectHooks_ObservePhases tests that hooks see every phase of a direct tunnel.
+func TestConnectHooks_ObservePhases(t *testing.T) {
+	echoAddr := newEchoServer(t)
+	ps := newShutdownTestProxy()
+
+	var mu sync.Mutex
+	var events []string
+	done := make(chan struct{})
+	ps.AddHook(PhaseHook{
+		Before: func(phase Phase, info *ConnectInfo) error {
+			mu.Lock()
+			events = append(events, "before:"+string(phase)+":"+info.Host)
+			mu.Unlock()
+			return nil
+		},
+		After: func(phase Phase, info *ConnectInfo, err error) {
+			mu.Lock()
+			events = append(events, fmt.Sprintf("after:%s:%v", phase, err))
+			mu.Unlock()
+			close(done)
+		},
+	})
+	proxyAddr := startTestProxy(t, ps)
+	defer ps.Close()
+
+	conn := openDirectTunnel(t, proxyAddr, echoAddr)
+	conn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("After hook was not called")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	host, _, _ := net.SplitHostPort(echoAddr)
+	want := []string{"before:direct_dial:" + host, "after:direct_dial:<nil>"}
+	if strings.Join(events, ",") != strings.Join(want, ",") {
+		t.Fatalf("events = %v, want %v", events, want)
+	}
+}
+
+// TestConnectHooks_BeforeAborts tests that a failing Before hook drops the connection.
+func TestConnectHooks_BeforeAborts(t *testing.T) {
+	echoAddr := newEchoServer(t)
+	ps := newShutdownTestProxy()
+
+	dialed := false
+	ps.Resolver = &mockResolver{
+		resolveFunc: func(ctx context.Context, host string, clientIP net.IP) (string, error) {
+			dialed = true
+			return "127.0.0.1", nil
+		},
+	}
+	afterErr := make(chan error, 1)
+	ps.AddHook(PhaseHook{
+		Before: func(Phase, *ConnectInfo) error { return errors.New("denied") },
+		After:  func(_ Phase, _ *ConnectInfo, err error) { afterErr <- err },
+	})
+	proxyAddr := startTestProxy(t, ps)
+	defer ps.Close()
+
+	conn := openDirectTunnel(t, proxyAddr, echoAddr)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected connection to be closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("connection was not closed after hook abort")
+	}
+	if err := <-afterErr; err == nil || err.Error() != "denied" {
+		t.Fatalf("After hook got %v, want denied", err)
+	}
+	if dialed {
+		t.Fatal("phase ran despite Before hook error")
+	}
+}
+
+// readAccessLog shuts ps down so every connection has been logged, then
+// returns the records in path.
+func readAccessLog(t *testing.T, ps *ProxyServer, path string) []accesslog.Record {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ps.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	ps.AccessLog.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read access log: %v", err)
+	}
+	var recs []accesslog.Record
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var rec accesslog.Record
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("access log line %q: %v", line, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+// TestAccessLog_DirectTunnel tests the access log record of a direct tunnel.
+func TestAccessLog_DirectTunnel(t *testing.T) {
+	echoAddr := newEchoServer(t)
+	path := filepath.Join(t.TempDir(), "access.jsonl")
+	ps := newShutdownTestProxy()
+	al, err := accesslog.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	ps.AccessLog = al
+	proxyAddr := startTestProxy(t, ps)
+
+	conn := openDirectTunnel(t, proxyAddr, echoAddr)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatalf("read echo: %v", err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	io.Copy(io.Discard, conn)
+	conn.Close()
+
+	recs := readAccessLog(t, ps, path)
+	if len(recs) != 1 {
+		t.Fatalf("got %d records, want 1", len(recs))
+	}
+	rec := recs[0]
+	if rec.Mode != accesslog.ModeDirect || rec.Host != "127.0.0.1" || rec.RemoteAddr != echoAddr {
+		t.Errorf("record = %+v, want a direct tunnel to %s", rec, echoAddr)
+	}
+	if rec.BytesIn != 4 || rec.BytesOut != 4 {
+		t.Errorf("bytes in/out = %d/%d, want 4/4", rec.BytesIn, rec.BytesOut)
+	}
+	if rec.CloseReason != closeClientEOF || rec.Error != "" {
+		t.Errorf("close reason = %q, error = %q, want %q", rec.CloseReason, rec.Error, closeClientEOF)
+	}
+	if _, ok := rec.PhasesMs[string(PhaseDirectDial)]; !ok {
+		t.Errorf("phases = %v, want %s timed", rec.PhasesMs, PhaseDirectDial)
+	}
+}
+
+// TestAccessLog_VerifyFailure tests the access log record of an intercepted
+// connection whose remote certificate does not match the host.
+func TestAccessLog_VerifyFailure(t *testing.T) {
+	certMgr, err := cert.NewCertificateManager(filepath.Join(t.TempDir(), "root.crt"), filepath.Join(t.TempDir(), "root.key"))
+	if err != nil {
+		t.Fatalf("NewCertificateManager: %v", err)
+	}
+	defer certMgr.Close()
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+	path := filepath.Join(t.TempDir(), "access.jsonl")
+	ps := newShutdownTestProxy()
+	portNum, _ := strconv.Atoi(port)
+	ps.Config.Server.InterceptPorts = []int{portNum}
+	ps.CA = certMgr
+	ps.Rules.AlterHostname["verify.example"] = "verify.example"
+	if ps.AccessLog, err = accesslog.Open(path); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	proxyAddr := startTestProxy(t, ps)
+
+	conn := openDirectTunnel(t, proxyAddr, net.JoinHostPort("verify.example", port))
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := tls.Client(conn, &tls.Config{ServerName: "verify.example", InsecureSkipVerify: true}).Handshake(); err == nil {
+		t.Error("expected the client handshake to fail")
+	}
+	conn.Close()
+
+	recs := readAccessLog(t, ps, path)
+	if len(recs) != 1 {
+		t.Fatalf("got %d records, want 1", len(recs))
+	}
+	rec := recs[0]
+	if rec.Mode != accesslog.ModeMITM || rec.ClientSNI != "verify.example" || rec.TargetSNI != "verify.example" {
+		t.Errorf("record = %+v, want an intercepted connection for verify.example", rec)
+	}
+	if rec.Verify != "failed" || !strings.Contains(rec.VerifyReason, "example.com") {
+		t.Errorf("verify = %q (%q), want failed with the server's domains", rec.Verify, rec.VerifyReason)
+	}
+	if rec.CloseReason != "error" || !strings.HasPrefix(rec.Error, string(PhaseVerifyCert)) {
+		t.Errorf("close reason = %q, error = %q, want a %s error", rec.CloseReason, rec.Error, PhaseVerifyCert)
+	}
+	for _, phase := range []Phase{PhaseClientHello, PhaseDetermineSNI, PhaseRemoteDial, PhaseVerifyCert} {
+		if _, ok := rec.PhasesMs[string(phase)]; !ok {
+			t.Errorf("phases = %v, want %s timed", rec.PhasesMs, phase)
+		}
+	}
 }
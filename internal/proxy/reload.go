@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"snirect/internal/config"
+	"snirect/internal/logger"
+)
+
+// settings is a configuration installed by Reload.
+type settings struct {
+	cfg   *config.Config
+	rules *config.Rules
+}
+
+// rulesSetter and configSetter are implemented by resolvers whose rules and
+// configuration can be replaced at runtime, such as *dns.Resolver.
+type rulesSetter interface {
+	SetRules(rules *config.Rules)
+}
+
+type configSetter interface {
+	SetConfig(cfg *config.Config)
+}
+
+// cfg returns the configuration in effect: the one passed to the last Reload,
+// or Config.
+func (s *ProxyServer) cfg() *config.Config {
+	if l := s.live.Load(); l != nil {
+		return l.cfg
+	}
+	return s.Config
+}
+
+// rules returns the rules in effect: the ones passed to the last Reload, or
+// Rules.
+func (s *ProxyServer) rules() *config.Rules {
+	if l := s.live.Load(); l != nil {
+		return l.rules
+	}
+	return s.Rules
+}
+
+// EffectiveConfig returns the configuration the proxy is currently using.
+func (s *ProxyServer) EffectiveConfig() *config.Config {
+	return s.cfg()
+}
+
+// Reload replaces the configuration and rules the proxy uses from now on;
+// tunnels that are already open are not interrupted. The listeners and
+// limit.max_connections cannot change without a restart, so their settings
+// are carried over from the running configuration. The configuration and
+// rules are also passed to the Resolver when it supports replacing them.
+func (s *ProxyServer) Reload(cfg *config.Config, rules *config.Rules) {
+	old := s.cfg()
+	next := *cfg
+	if listenersChanged(old, &next) || old.Limit.MaxConns != next.Limit.MaxConns {
+		logger.Warn("Reload: listener and max_connections changes take effect after a restart")
+	}
+	next.Server.Address = old.Server.Address
+	next.Server.Port = old.Server.Port
+	next.Server.SocksPort = old.Server.SocksPort
+	next.Server.TransparentPort = old.Server.TransparentPort
+	next.Server.TransparentMode = old.Server.TransparentMode
+	next.Limit.MaxConns = old.Limit.MaxConns
+
+	s.mu.Lock()
+	s.live.Store(&settings{cfg: &next, rules: rules})
+	// The router caches the outbound proxies of both.
+	s.router = nil
+	s.mu.Unlock()
+
+	s.applyBandwidth(&next, rules)
+
+	if cs, ok := s.Resolver.(configSetter); ok {
+		cs.SetConfig(&next)
+	}
+	if rs, ok := s.Resolver.(rulesSetter); ok {
+		rs.SetRules(rules)
+	}
+}
+
+// updateRules replaces the rules the proxy uses with what update returns for
+// the current ones, leaving the configuration, the router and the Resolver as
+// they are. It is for rule changes that none of those depend on.
+func (s *ProxyServer) updateRules(update func(cur *config.Rules) *config.Rules) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.live.Store(&settings{cfg: s.cfg(), rules: update(s.rules())})
+}
+
+func listenersChanged(a, b *config.Config) bool {
+	return a.Server.Address != b.Server.Address ||
+		(b.Server.Port != 0 && a.Server.Port != b.Server.Port) ||
+		a.Server.SocksPort != b.Server.SocksPort ||
+		a.Server.TransparentPort != b.Server.TransparentPort ||
+		a.Server.TransparentMode != b.Server.TransparentMode
+}
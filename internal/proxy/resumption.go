@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+)
+
+// sharedSessions is the ClientSessionCache shared by remote handshakes, with
+// the session_cache_size it was created for.
+type sharedSessions struct {
+	tls.ClientSessionCache
+	size int
+}
+
+// addrSessions keys a shared ClientSessionCache by the remote IP as well as
+// by the SNI crypto/tls uses, so that sessions are only offered to the
+// server that issued them when one name resolves to several.
+type addrSessions struct {
+	shared tls.ClientSessionCache
+	ip     string
+}
+
+func (c addrSessions) Get(key string) (*tls.ClientSessionState, bool) {
+	return c.shared.Get(c.ip + "|" + key)
+}
+
+func (c addrSessions) Put(key string, cs *tls.ClientSessionState) {
+	c.shared.Put(c.ip+"|"+key, cs)
+}
+
+// sessionCache returns the session cache for a remote handshake with addr,
+// or nil when resumption.session_cache_size disables it. The shared cache is
+// replaced when the size changes.
+func (s *ProxyServer) sessionCache(addr string) tls.ClientSessionCache {
+	cfg := s.cfg()
+	if cfg == nil || cfg.Resumption.SessionCacheSize <= 0 {
+		return nil
+	}
+	size := cfg.Resumption.SessionCacheSize
+	s.mu.Lock()
+	if s.sessions == nil || s.sessions.size != size {
+		s.sessions = &sharedSessions{ClientSessionCache: tls.NewLRUClientSessionCache(size), size: size}
+	}
+	shared := s.sessions
+	s.mu.Unlock()
+
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		ip = addr
+	}
+	return addrSessions{shared: shared, ip: ip}
+}
+
+// ticketKeys holds the session ticket keys of the client-facing TLS servers.
+// Tickets are issued with the newest key and accepted with the previous one
+// too, so they stay valid for up to two rotation periods.
+type ticketKeys struct {
+	mu      sync.Mutex
+	keys    [][32]byte
+	rotated time.Time
+}
+
+// get returns the keys in effect at now, first rotating them when every has
+// elapsed since the last rotation.
+func (k *ticketKeys) get(now time.Time, every time.Duration) [][32]byte {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.keys == nil || now.Sub(k.rotated) >= every {
+		var key [32]byte
+		rand.Read(key[:])
+		k.keys = append([][32]byte{key}, k.keys...)[:min(len(k.keys)+1, 2)]
+		k.rotated = now
+	}
+	return k.keys
+}
+
+// setTicketKeys enables session tickets on a client-facing tls.Config with
+// the shared, rotating keys, or disables them when
+// resumption.ticket_key_rotation is 0.
+func (s *ProxyServer) setTicketKeys(c *tls.Config) {
+	cfg := s.cfg()
+	if cfg == nil || cfg.Resumption.TicketKeyRotation <= 0 {
+		c.SessionTicketsDisabled = true
+		return
+	}
+	c.SetSessionTicketKeys(s.tickets.get(time.Now(), time.Duration(cfg.Resumption.TicketKeyRotation)*time.Hour))
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"snirect/internal/cert"
+)
+
+func TestTicketKeys(t *testing.T) {
+	var k ticketKeys
+	now := time.Now()
+	first := k.get(now, time.Hour)
+	if len(first) != 1 {
+		t.Fatalf("got %d keys, want 1", len(first))
+	}
+	if again := k.get(now.Add(time.Minute), time.Hour); len(again) != 1 || again[0] != first[0] {
+		t.Fatal("keys rotated before the rotation period elapsed")
+	}
+	rotated := k.get(now.Add(time.Hour), time.Hour)
+	if len(rotated) != 2 || rotated[0] == first[0] || rotated[1] != first[0] {
+		t.Fatal("rotation did not prepend a new key and keep the previous one")
+	}
+	if len(k.get(now.Add(2*time.Hour), time.Hour)) != 2 {
+		t.Fatal("more than two keys kept")
+	}
+}
+
+// startResumptionTest starts remote with TLS and a proxy intercepting its
+// port, and returns the port and a client that opens a tunnel per request.
+func startResumptionTest(t *testing.T, ps *ProxyServer, remote *httptest.Server) (string, *http.Client) {
+	t.Helper()
+	certMgr, err := cert.NewCertificateManager(filepath.Join(t.TempDir(), "root.crt"), filepath.Join(t.TempDir(), "root.key"))
+	if err != nil {
+		t.Fatalf("NewCertificateManager: %v", err)
+	}
+	t.Cleanup(func() { certMgr.Close() })
+
+	remote.StartTLS()
+	t.Cleanup(remote.Close)
+	_, port, _ := net.SplitHostPort(remote.Listener.Addr().String())
+
+	portNum, _ := strconv.Atoi(port)
+	ps.Config.Server.InterceptPorts = []int{portNum}
+	ps.Config.CheckHostname = false
+	ps.CA = certMgr
+	proxyAddr := startTestProxy(t, ps)
+	t.Cleanup(func() { ps.Close() })
+
+	proxyURL, _ := url.Parse("http://" + proxyAddr)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			ClientSessionCache: tls.NewLRUClientSessionCache(8),
+		},
+		DisableKeepAlives: true,
+	}}
+	return port, client
+}
+
+// tlsStateServer returns an unstarted server that reports the TLS state of
+// each request on states.
+func tlsStateServer(states chan<- *tls.ConnectionState) *httptest.Server {
+	return httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		states <- r.TLS
+	}))
+}
+
+// TestProxy_Resumption tests that a second tunnel to the same remote resumes
+// both the remote TLS session and the client's session with the proxy.
+func TestProxy_Resumption(t *testing.T) {
+	ps := newShutdownTestProxy()
+	ps.Config.Resumption.SessionCacheSize = 16
+	ps.Config.Resumption.TicketKeyRotation = 24
+	states := make(chan *tls.ConnectionState, 2)
+	port, client := startResumptionTest(t, ps, tlsStateServer(states))
+
+	for i, wantResume := range []bool{false, true} {
+		resp, err := client.Get("https://resume.example:" + port + "/")
+		if err != nil {
+			t.Fatalf("GET #%d through proxy: %v", i+1, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		if remote := <-states; remote.DidResume != wantResume {
+			t.Errorf("GET #%d: remote DidResume = %v, want %v", i+1, remote.DidResume, wantResume)
+		}
+		if resp.TLS.DidResume != wantResume {
+			t.Errorf("GET #%d: client DidResume = %v, want %v", i+1, resp.TLS.DidResume, wantResume)
+		}
+	}
+}
+
+// TestProxy_ResumptionDisabled tests that a zero session cache size and ticket
+// key rotation turn resumption off on both legs.
+func TestProxy_ResumptionDisabled(t *testing.T) {
+	ps := newShutdownTestProxy()
+	states := make(chan *tls.ConnectionState, 2)
+	port, client := startResumptionTest(t, ps, tlsStateServer(states))
+
+	for i := range 2 {
+		resp, err := client.Get("https://resume.example:" + port + "/")
+		if err != nil {
+			t.Fatalf("GET #%d through proxy: %v", i+1, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		if remote := <-states; remote.DidResume || resp.TLS.DidResume {
+			t.Errorf("GET #%d resumed: remote %v, client %v", i+1, remote.DidResume, resp.TLS.DidResume)
+		}
+	}
+}
+
+// TestProxy_Warmup tests that a connection to a busy remote pre-dials the
+// next one, which the following tunnel then uses.
+func TestProxy_Warmup(t *testing.T) {
+	ps := newShutdownTestProxy()
+	ps.Config.Warmup.Hosts = 1
+	ps.Config.Warmup.MaxIdle = 30
+
+	var mu sync.Mutex
+	var accepted, served []string
+	remote := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		served = append(served, r.RemoteAddr)
+		mu.Unlock()
+	}))
+	remote.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			accepted = append(accepted, c.RemoteAddr().String())
+			mu.Unlock()
+		}
+	}
+	port, client := startResumptionTest(t, ps, remote)
+
+	get := func() {
+		t.Helper()
+		resp, err := client.Get("https://warm.example:" + port + "/")
+		if err != nil {
+			t.Fatalf("GET through proxy: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(accepted)
+	}
+
+	get()
+	for deadline := time.Now().Add(5 * time.Second); count() < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no connection was pre-dialed")
+		}
+	}
+	get()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(served) != 2 || served[1] != accepted[1] {
+		t.Fatalf("second request served on %v, want the pre-dialed %s (accepted %v)", served, accepted[1], accepted)
+	}
+}
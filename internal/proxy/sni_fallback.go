@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"slices"
+
+	ruleslib "github.com/xihale/snirect-shared/rules"
+)
+
+// sniLadder returns the SNIs to try, in order, for a connection whose client
+// sent clientHello: rewritten (the alter_hostname result) followed by the
+// host's [sni_fallback] candidates, without duplicates. The candidate that last
+// completed the handshake for the host is moved to the front.
+func (s *ProxyServer) sniLadder(clientHello, rewritten string) []string {
+	ladder := []string{rewritten}
+	fallback, ok := s.rules().GetSNIFallback(clientHello)
+	if !ok {
+		return ladder
+	}
+	for _, sni := range fallback {
+		if sni == ruleslib.DefaultAutoMarker {
+			sni = clientHello
+		}
+		if !slices.Contains(ladder, sni) {
+			ladder = append(ladder, sni)
+		}
+	}
+
+	if v, ok := s.sniWinners.Load(clientHello); ok {
+		if i := slices.Index(ladder, v.(string)); i > 0 {
+			ladder = slices.Insert(slices.Delete(ladder, i, i+1), 0, v.(string))
+		}
+	}
+	return ladder
+}
+
+// rememberSNI records that sni completed the remote handshake for clientHello,
+// so that later connections try it first.
+func (s *ProxyServer) rememberSNI(clientHello, sni string, ladder []string) {
+	if len(ladder) < 2 {
+		return
+	}
+	s.sniWinners.Store(clientHello, sni)
+}
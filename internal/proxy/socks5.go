@@ -0,0 +1,400 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"snirect/internal/logger"
+	"snirect/internal/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// SOCKS5 protocol constants (RFC 1928).
+const (
+	socksVersion = 0x05
+
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthNoAcceptable = 0xff
+
+	// Username/password subnegotiation (RFC 1929).
+	socksPasswordVersion = 0x01
+	socksPasswordOK      = 0x00
+	socksPasswordFailure = 0x01
+
+	socksCmdConnect      = 0x01
+	socksCmdUDPAssociate = 0x03
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksRepSucceeded        = 0x00
+	socksRepGeneralFailure   = 0x01
+	socksRepCmdNotSupported  = 0x07
+	socksRepAtypNotSupported = 0x08
+)
+
+const (
+	socksDefaultDNSTimeout = 5 * time.Second
+	socksDNSAnswerTTL      = 60
+	socksMaxDatagram       = 65535
+	socksMaxDNSQueries     = 32 // Queries answered at once per association; more are dropped
+)
+
+var errSocksAtyp = errors.New("unsupported address type")
+
+// ServeSOCKS accepts SOCKS5 connections on ln until Shutdown or Close is called.
+// CONNECT requests run through the same state machine as HTTP CONNECT, and
+// UDP ASSOCIATE relays DNS queries to the Resolver.
+func (s *ProxyServer) ServeSOCKS(ln net.Listener) error {
+	return s.serveListener(ln, s.handleSOCKS)
+}
+
+// handleSOCKS negotiates a SOCKS5 session and dispatches its command.
+func (s *ProxyServer) handleSOCKS(id uint64, conn net.Conn) {
+	conn.SetDeadline(deadlineAfter(s.clientHandshakeTimeout()))
+	var auth func(user, password string) bool
+	if s.needsAuth(conn.RemoteAddr().String()) {
+		auth = s.accessControl().Authenticate
+	}
+	cmd, host, port, err := socksHandshake(conn, auth)
+	if err != nil {
+		logger.Debug("SOCKS5 handshake from %s failed: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	switch cmd {
+	case socksCmdConnect:
+		s.socksConnect(id, conn, host, port)
+	case socksCmdUDPAssociate:
+		s.socksUDPAssociate(conn)
+	}
+}
+
+// socksConnect answers a CONNECT request and hands the connection to the state machine.
+func (s *ProxyServer) socksConnect(id uint64, conn net.Conn, host, port string) {
+	defer s.acquireSlot()()
+
+	if err := writeSocksReply(conn, socksRepSucceeded, nil); err != nil {
+		conn.Close()
+		return
+	}
+
+	ctx := &connectContext{
+		ConnectInfo: ConnectInfo{
+			ID:         id,
+			ClientAddr: conn.RemoteAddr().String(),
+			Host:       host,
+			Port:       port,
+			Intercept:  s.shouldIntercept(host, port),
+		},
+		clientConn: conn,
+		parentCtx:  context.Background(),
+	}
+	if err := s.runConnect(ctx); err != nil {
+		logger.Warn("SOCKS5 CONNECT %s: %v", net.JoinHostPort(host, port), err)
+	}
+}
+
+// socksUDPAssociate serves a UDP ASSOCIATE request. Only DNS (port 53) datagrams
+// are relayed; they are answered through the Resolver so rules and encrypted
+// upstreams apply. The association lasts as long as the control connection.
+func (s *ProxyServer) socksUDPAssociate(ctrl net.Conn) {
+	defer ctrl.Close()
+
+	localIP := net.IPv4zero
+	if addr, ok := ctrl.LocalAddr().(*net.TCPAddr); ok {
+		localIP = addr.IP
+	}
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		logger.Warn("SOCKS5 UDP ASSOCIATE: listen failed: %v", err)
+		writeSocksReply(ctrl, socksRepGeneralFailure, nil)
+		return
+	}
+	defer pc.Close()
+
+	if err := writeSocksReply(ctrl, socksRepSucceeded, pc.LocalAddr()); err != nil {
+		return
+	}
+
+	var clientIP net.IP
+	if addr, ok := ctrl.RemoteAddr().(*net.TCPAddr); ok {
+		clientIP = addr.IP
+	}
+	go func() {
+		io.Copy(io.Discard, ctrl)
+		pc.Close()
+	}()
+
+	inflight := make(chan struct{}, socksMaxDNSQueries)
+	buf := make([]byte, socksMaxDatagram)
+	for {
+		n, from, err := pc.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		// Only the client that opened the association may use it.
+		if clientIP != nil && !from.IP.Equal(clientIP) {
+			continue
+		}
+		select {
+		case inflight <- struct{}{}:
+		default:
+			logger.Debug("SOCKS5 UDP: %d queries from %s in flight, dropping datagram", socksMaxDNSQueries, from)
+			continue
+		}
+		pkt := make([]byte, n)
+		copy(pkt, buf[:n])
+		go func() {
+			defer func() { <-inflight }()
+			s.socksRelayDNS(pc, from, pkt)
+		}()
+	}
+}
+
+// socksRelayDNS answers one SOCKS5 UDP datagram carrying a DNS query.
+func (s *ProxyServer) socksRelayDNS(pc *net.UDPConn, from *net.UDPAddr, pkt []byte) {
+	// RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT DATA; fragmentation is not supported.
+	if len(pkt) < 4 || pkt[0] != 0 || pkt[1] != 0 || pkt[2] != 0 {
+		return
+	}
+	r := bytes.NewReader(pkt[3:])
+	host, port, err := readSocksAddr(r)
+	if err != nil {
+		return
+	}
+	if port != "53" {
+		logger.Debug("SOCKS5 UDP: dropping datagram to %s, only DNS is relayed", net.JoinHostPort(host, port))
+		return
+	}
+	header := pkt[:len(pkt)-r.Len()]
+
+	req := new(dns.Msg)
+	if err := req.Unpack(pkt[len(header):]); err != nil {
+		return
+	}
+
+	timeout := time.Duration(s.cfg().Timeout.DNS) * time.Second
+	if timeout == 0 {
+		timeout = socksDefaultDNSTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resp, err := s.answerDNS(ctx, req, from.IP).Pack()
+	if err != nil {
+		return
+	}
+	pc.WriteToUDP(append(header, resp...), from)
+}
+
+// answerDNS builds a reply to req using the Resolver. Only A and AAAA
+// questions are supported.
+func (s *ProxyServer) answerDNS(ctx context.Context, req *dns.Msg, clientIP net.IP) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+
+	if len(req.Question) != 1 {
+		resp.Rcode = dns.RcodeFormatError
+		return resp
+	}
+	q := req.Question[0]
+	if q.Qclass != dns.ClassINET || (q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA) {
+		resp.Rcode = dns.RcodeNotImplemented
+		return resp
+	}
+
+	host := strings.TrimSuffix(q.Name, ".")
+	addrs, err := s.Resolver.ResolveAll(ctx, host, clientIP)
+	if err != nil {
+		logger.Debug("SOCKS5 DNS: resolve %s failed: %v", host, err)
+		resp.Rcode = dns.RcodeServerFailure
+		return resp
+	}
+
+	// Addresses of the other family are left out; a question with none of
+	// its own gets an empty (NODATA) answer.
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: socksDNSAnswerTTL}
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		switch {
+		case ip == nil:
+		case q.Qtype == dns.TypeA && ip.To4() != nil:
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: ip.To4()})
+		case q.Qtype == dns.TypeAAAA && ip.To4() == nil:
+			resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return resp
+}
+
+// socksHandshake performs method negotiation and reads the request. When
+// auth is set, the client must authenticate with a username and password.
+// It returns the command and destination host and port.
+func socksHandshake(conn net.Conn, auth func(user, password string) bool) (byte, string, string, error) {
+	// Greeting: VER NMETHODS METHODS...
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return 0, "", "", err
+	}
+	if hdr[0] != socksVersion {
+		return 0, "", "", fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return 0, "", "", err
+	}
+	method := byte(socksAuthNone)
+	if auth != nil {
+		method = socksAuthPassword
+	}
+	if bytes.IndexByte(methods, method) < 0 {
+		conn.Write([]byte{socksVersion, socksAuthNoAcceptable})
+		return 0, "", "", errors.New("no acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return 0, "", "", err
+	}
+	if auth != nil {
+		if err := socksAuthenticate(conn, auth); err != nil {
+			return 0, "", "", err
+		}
+	}
+
+	// Request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	var req [3]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return 0, "", "", err
+	}
+	if req[0] != socksVersion {
+		return 0, "", "", fmt.Errorf("unsupported SOCKS version %d", req[0])
+	}
+	host, port, err := readSocksAddr(conn)
+	if err != nil {
+		if errors.Is(err, errSocksAtyp) {
+			writeSocksReply(conn, socksRepAtypNotSupported, nil)
+		}
+		return 0, "", "", err
+	}
+
+	cmd := req[1]
+	if cmd != socksCmdConnect && cmd != socksCmdUDPAssociate {
+		writeSocksReply(conn, socksRepCmdNotSupported, nil)
+		return 0, "", "", fmt.Errorf("unsupported command %d", cmd)
+	}
+	return cmd, host, port, nil
+}
+
+// socksAuthenticate runs the username/password subnegotiation:
+// VER ULEN UNAME PLEN PASSWD, answered with VER STATUS.
+func socksAuthenticate(conn net.Conn, auth func(user, password string) bool) error {
+	var ver [1]byte
+	if _, err := io.ReadFull(conn, ver[:]); err != nil {
+		return err
+	}
+	if ver[0] != socksPasswordVersion {
+		return fmt.Errorf("unsupported authentication version %d", ver[0])
+	}
+	user, err := readSocksString(conn)
+	if err != nil {
+		return err
+	}
+	password, err := readSocksString(conn)
+	if err != nil {
+		return err
+	}
+	if !auth(user, password) {
+		metrics.ClientsRejected.With(rejectAuth).Inc()
+		conn.Write([]byte{socksPasswordVersion, socksPasswordFailure})
+		return fmt.Errorf("authentication failed for user %q", user)
+	}
+	_, err = conn.Write([]byte{socksPasswordVersion, socksPasswordOK})
+	return err
+}
+
+// readSocksString reads a length-prefixed string.
+func readSocksString(r io.Reader) (string, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", err
+	}
+	buf := make([]byte, n[0])
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// readSocksAddr reads ATYP DST.ADDR DST.PORT. Domain names are returned as-is
+// so host rules still match on them.
+func readSocksAddr(r io.Reader) (string, string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == socksAtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", "", err
+		}
+		host = ip.String()
+	case socksAtypDomain:
+		name, err := readSocksString(r)
+		if err != nil {
+			return "", "", err
+		}
+		host = name
+	default:
+		return "", "", fmt.Errorf("%w %d", errSocksAtyp, atyp[0])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", "", err
+	}
+	return host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))), nil
+}
+
+// writeSocksReply sends VER REP RSV ATYP BND.ADDR BND.PORT. A nil or non-IP
+// bind address is sent as 0.0.0.0:0.
+func writeSocksReply(w io.Writer, rep byte, bind net.Addr) error {
+	ip := net.IPv4zero
+	port := 0
+	if addr, ok := bind.(*net.UDPAddr); ok {
+		ip, port = addr.IP, addr.Port
+	} else if addr, ok := bind.(*net.TCPAddr); ok {
+		ip, port = addr.IP, addr.Port
+	}
+
+	buf := []byte{socksVersion, rep, 0}
+	if ip4 := ip.To4(); ip4 != nil {
+		buf = append(buf, socksAtypIPv4)
+		buf = append(buf, ip4...)
+	} else {
+		buf = append(buf, socksAtypIPv6)
+		buf = append(buf, ip.To16()...)
+	}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(port))
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,322 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	xproxy "golang.org/x/net/proxy"
+)
+
+// startTestSOCKS serves ps's SOCKS5 listener on a random loopback port.
+func startTestSOCKS(t *testing.T, ps *ProxyServer) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	go ps.ServeSOCKS(ln)
+	return ln.Addr().String()
+}
+
+// TestSOCKS5_ConnectDomain tests that a domain-name CONNECT reaches the resolver
+// by name and tunnels data through the direct pipeline.
+func TestSOCKS5_ConnectDomain(t *testing.T) {
+	echoAddr := newEchoServer(t)
+	_, echoPort, _ := net.SplitHostPort(echoAddr)
+
+	var mu sync.Mutex
+	var resolved []string
+	ps := newShutdownTestProxy()
+	ps.Resolver = &mockResolver{
+		resolveFunc: func(ctx context.Context, host string, clientIP net.IP) (string, error) {
+			mu.Lock()
+			resolved = append(resolved, host)
+			mu.Unlock()
+			return "127.0.0.1", nil
+		},
+	}
+	socksAddr := startTestSOCKS(t, ps)
+	defer ps.Close()
+
+	dialer, err := xproxy.SOCKS5("tcp", socksAddr, nil, xproxy.Direct)
+	if err != nil {
+		t.Fatalf("SOCKS5 dialer: %v", err)
+	}
+	conn, err := dialer.Dial("tcp", net.JoinHostPort("echo.example", echoPort))
+	if err != nil {
+		t.Fatalf("dial through SOCKS5: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	reply := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Fatalf("echo through tunnel: %q, %v", reply, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(resolved) != 1 || resolved[0] != "echo.example" {
+		t.Fatalf("resolved = %v, want [echo.example]", resolved)
+	}
+}
+
+// TestSOCKS5_UDPAssociateDNS tests that DNS queries sent over UDP ASSOCIATE are
+// answered through the resolver.
+func TestSOCKS5_UDPAssociateDNS(t *testing.T) {
+	ps := newShutdownTestProxy()
+	ps.Resolver = &mockResolver{
+		resolveFunc: func(ctx context.Context, host string, clientIP net.IP) (string, error) {
+			return "192.0.2.7", nil
+		},
+	}
+	socksAddr := startTestSOCKS(t, ps)
+	defer ps.Close()
+
+	ctrl, relay, pc := openSOCKSAssociation(t, socksAddr)
+	defer ctrl.Close()
+	defer pc.Close()
+
+	header := socksDNSHeader()
+	if _, err := pc.WriteToUDP(append(header, dnsQuery("blocked.example.")...), relay); err != nil {
+		t.Fatalf("send query: %v", err)
+	}
+
+	buf := make([]byte, 1500)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("read answer: %v", err)
+	}
+	if n < len(header) || string(buf[:len(header)]) != string(header) {
+		t.Fatalf("reply header = %v, want %v", buf[:len(header)], header)
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(buf[len(header):n]); err != nil {
+		t.Fatalf("unpack answer: %v", err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("answers = %v, want one A record", resp.Answer)
+	}
+	if a, ok := resp.Answer[0].(*dns.A); !ok || a.A.String() != "192.0.2.7" {
+		t.Fatalf("answer = %v, want 192.0.2.7", resp.Answer[0])
+	}
+}
+
+// TestAnswerDNS tests that DNS answers carry every address the Resolver
+// returns of the asked family, and none of the other.
+func TestAnswerDNS(t *testing.T) {
+	ps := newShutdownTestProxy()
+	ps.Resolver = &mockResolver{
+		resolveAllFunc: func(ctx context.Context, host string, clientIP net.IP) ([]string, error) {
+			return []string{"2001:db8::1", "192.0.2.1", "192.0.2.2"}, nil
+		},
+	}
+	for _, tc := range []struct {
+		qtype uint16
+		want  []string
+	}{
+		{dns.TypeA, []string{"192.0.2.1", "192.0.2.2"}},
+		{dns.TypeAAAA, []string{"2001:db8::1"}},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion("dual.example.", tc.qtype)
+		resp := ps.answerDNS(context.Background(), req, nil)
+		var got []string
+		for _, rr := range resp.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				got = append(got, rr.A.String())
+			case *dns.AAAA:
+				got = append(got, rr.AAAA.String())
+			}
+			if rr.Header().Rrtype != tc.qtype {
+				t.Errorf("%s answer has type %s", dns.TypeToString[tc.qtype], dns.TypeToString[rr.Header().Rrtype])
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%s answers = %v, want %v", dns.TypeToString[tc.qtype], got, tc.want)
+		}
+	}
+}
+
+// openSOCKSAssociation performs a UDP ASSOCIATE and returns the control
+// connection, the relay address and a UDP socket to talk to it.
+func openSOCKSAssociation(t *testing.T, socksAddr string) (net.Conn, *net.UDPAddr, *net.UDPConn) {
+	t.Helper()
+	ctrl, err := net.Dial("tcp", socksAddr)
+	if err != nil {
+		t.Fatalf("dial SOCKS5: %v", err)
+	}
+	ctrl.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Greeting, then UDP ASSOCIATE with an unspecified client address.
+	ctrl.Write([]byte{socksVersion, 1, socksAuthNone})
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(ctrl, method); err != nil || method[1] != socksAuthNone {
+		t.Fatalf("method selection: %v, %v", method, err)
+	}
+	ctrl.Write([]byte{socksVersion, socksCmdUDPAssociate, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	rep := make([]byte, 10)
+	if _, err := io.ReadFull(ctrl, rep); err != nil || rep[1] != socksRepSucceeded {
+		t.Fatalf("UDP ASSOCIATE reply: %v, %v", rep, err)
+	}
+	relay := &net.UDPAddr{IP: net.IP(rep[4:8]), Port: int(binary.BigEndian.Uint16(rep[8:10]))}
+
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("listen UDP: %v", err)
+	}
+	return ctrl, relay, pc
+}
+
+// socksDNSHeader is the SOCKS5 UDP header of a datagram to dns.google:53.
+func socksDNSHeader() []byte {
+	header := []byte{0, 0, 0, socksAtypDomain, byte(len("dns.google"))}
+	header = append(header, "dns.google"...)
+	return binary.BigEndian.AppendUint16(header, 53)
+}
+
+func dnsQuery(name string) []byte {
+	query := new(dns.Msg)
+	query.SetQuestion(name, dns.TypeA)
+	payload, _ := query.Pack()
+	return payload
+}
+
+// TestSOCKS5_UDPQueryLimit tests that an association answers at most
+// socksMaxDNSQueries queries at once and drops the datagrams beyond that.
+func TestSOCKS5_UDPQueryLimit(t *testing.T) {
+	var (
+		mu             sync.Mutex
+		inflight, peak int
+	)
+	unblock := make(chan struct{})
+	ps := newShutdownTestProxy()
+	ps.Resolver = &mockResolver{
+		resolveFunc: func(ctx context.Context, host string, clientIP net.IP) (string, error) {
+			mu.Lock()
+			inflight++
+			peak = max(peak, inflight)
+			mu.Unlock()
+			<-unblock
+			mu.Lock()
+			inflight--
+			mu.Unlock()
+			return "192.0.2.7", nil
+		},
+	}
+	socksAddr := startTestSOCKS(t, ps)
+	defer ps.Close()
+
+	ctrl, relay, pc := openSOCKSAssociation(t, socksAddr)
+	defer ctrl.Close()
+	defer pc.Close()
+
+	header := socksDNSHeader()
+	for i := 0; i < socksMaxDNSQueries*2; i++ {
+		pc.WriteToUDP(append(header, dnsQuery(fmt.Sprintf("q%d.example.", i))...), relay)
+	}
+	time.Sleep(200 * time.Millisecond)
+	close(unblock)
+
+	answers := 0
+	buf := make([]byte, 1500)
+	for {
+		pc.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		if _, _, err := pc.ReadFromUDP(buf); err != nil {
+			break
+		}
+		answers++
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if p := peak; p > socksMaxDNSQueries {
+		t.Errorf("%d queries resolved at once, want at most %d", p, socksMaxDNSQueries)
+	}
+	if answers == 0 || answers > socksMaxDNSQueries {
+		t.Errorf("%d answers, want 1 to %d", answers, socksMaxDNSQueries)
+	}
+}
+
+// TestSOCKS5_RejectsUnsupportedCommand tests that BIND is refused with the proper reply code.
+func TestSOCKS5_RejectsUnsupportedCommand(t *testing.T) {
+	ps := newShutdownTestProxy()
+	socksAddr := startTestSOCKS(t, ps)
+	defer ps.Close()
+
+	conn, err := net.Dial("tcp", socksAddr)
+	if err != nil {
+		t.Fatalf("dial SOCKS5: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte{socksVersion, 1, socksAuthNone})
+	io.ReadFull(conn, make([]byte, 2))
+	conn.Write([]byte{socksVersion, 0x02, 0, socksAtypIPv4, 127, 0, 0, 1, 0, 80})
+	rep := make([]byte, 10)
+	if _, err := io.ReadFull(conn, rep); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if rep[1] != socksRepCmdNotSupported {
+		t.Fatalf("reply code = %d, want %d", rep[1], socksRepCmdNotSupported)
+	}
+}
+
+// TestConnectToRemote_ChainedSOCKS5 tests that an [outbound_proxy] rule sends
+// the remote dial through a SOCKS5 proxy that resolves the name itself, while
+// the rewritten SNI still reaches the remote.
+func TestConnectToRemote_ChainedSOCKS5(t *testing.T) {
+	sniSeen := make(chan string, 1)
+	ts := httptest.NewUnstartedServer(http.NotFoundHandler())
+	ts.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sniSeen <- hello.ServerName
+			return nil, nil
+		},
+	}
+	ts.StartTLS()
+	defer ts.Close()
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+	// The upstream SOCKS5 proxy is another snirect instance.
+	upstream := newShutdownTestProxy()
+	socksAddr := startTestSOCKS(t, upstream)
+	defer upstream.Close()
+
+	ps := newShutdownTestProxy()
+	ps.Rules.OutboundProxy = map[string]string{"*.corp.example": "socks5h://" + socksAddr}
+	ps.Rules.AlterHostname["git.corp.example"] = "front.example"
+	ps.Resolver = &mockResolver{
+		resolveFunc: func(ctx context.Context, host string, clientIP net.IP) (string, error) {
+			t.Errorf("local resolver used for %s despite socks5h", host)
+			return "", errors.New("unexpected resolve")
+		},
+	}
+
+	targetSNI := ps.determineSNI("git.corp.example", "git.corp.example")
+	conn, err := ps.connectToRemote(context.Background(), "git.corp.example", port, "127.0.0.1:1", targetSNI, nil)
+	if err != nil {
+		t.Fatalf("connectToRemote: %v", err)
+	}
+	conn.Close()
+
+	if got := <-sniSeen; got != "front.example" {
+		t.Errorf("remote saw SNI %q, want front.example", got)
+	}
+}
@@ -8,26 +8,174 @@ import (
 	"net"
 	"time"
 
+	"snirect/internal/config"
+	"snirect/internal/dns"
 	"snirect/internal/logger"
+	"snirect/internal/metrics"
+	"snirect/internal/passthrough"
+	"snirect/internal/tlsutil"
 )
 
+// Phase names one step of the CONNECT state machine.
+type Phase string
+
+// A MITM'd connection runs PhaseClientHello, PhaseDetermineSNI,
+// PhaseRemoteDial, PhaseVerifyCert, PhaseClientTLS and PhaseTunnel in that
+// order: the remote is dialed first so that the client can be offered the
+// protocol the remote selected through ALPN.
+const (
+	PhaseClientHello  Phase = "client_hello"  // Read the client's ClientHello (MITM)
+	PhaseDetermineSNI Phase = "determine_sni" // Pick the SNI sent to the remote
+	PhaseRemoteDial   Phase = "remote_dial"   // Resolve, dial and handshake with the remote
+	PhaseVerifyCert   Phase = "verify_cert"   // Verify the remote certificate
+	PhaseClientTLS    Phase = "client_tls"    // TLS handshake with the client (MITM)
+	PhaseTunnel       Phase = "tunnel"        // Pipe data between client and remote
+	PhaseDirectDial   Phase = "direct_dial"   // Bypass MITM and tunnel raw bytes
+
+	phaseDone Phase = ""
+)
+
+// ConnectInfo describes a CONNECT request as it moves through the state machine.
+// Fields are filled in as phases complete; hooks may read them but must not keep
+// the pointer after the connection ends.
+type ConnectInfo struct {
+	ID          uint64   // Tunnel ID, unique per ProxyServer
+	ClientAddr  string   // Remote address of the client
+	Host        string   // Host from the CONNECT request
+	Port        string   // Port from the CONNECT request
+	Intercept   bool     // Whether the connection is MITM'd
+	ClientHello string   // SNI presented by the client (MITM only)
+	TargetSNI   string   // SNI sent to the remote (MITM only)
+	RemoteAddr  string   // Address of the remote once dialed
+	DNSSource   string   // DNS upstream that resolved Host, or hosts/cache/system, see dns.WithSource
+	ALPN        []string // Protocols offered by the client (MITM only)
+	Protocol    string   // Protocol the remote selected, mirrored to the client (MITM only)
+	ECH         bool     // Whether TargetSNI was sent encrypted with ECH (MITM only)
+
+	Verify       string // Certificate check: "passed", "failed" or "skipped" (MITM only)
+	VerifyReason string // Why the certificate check failed (MITM only)
+	BytesIn      int64  // Bytes received from the client while tunnelling
+	BytesOut     int64  // Bytes sent to the client while tunnelling
+	CloseReason  string // Why the tunnel ended, see tunnelStats
+}
+
+// PhaseHook observes the CONNECT state machine. Before runs ahead of each phase;
+// a non-nil error aborts the connection. After runs once the phase returns, with
+// its error. Either callback may be nil.
+type PhaseHook struct {
+	Before func(phase Phase, info *ConnectInfo) error
+	After  func(phase Phase, info *ConnectInfo, err error)
+}
+
+// AddHook registers a hook for all subsequent CONNECT requests.
+func (s *ProxyServer) AddHook(h PhaseHook) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = append(s.hooks, h)
+}
+
 // connectContext holds shared data during the connection state machine.
 type connectContext struct {
+	ConnectInfo
 	clientConn    net.Conn
+	hello         *clientHello // Peeked ClientHello; callers that already read it may set it
 	tlsClientConn *tls.Conn
-	remoteConn    net.Conn
-	host          string
-	port          string
-	clientHello   string
-	targetSNI     string
+	remoteConn    tlsutil.Conn
 	parentCtx     context.Context
+	sniLadder     []string // SNIs to try in order; TargetSNI is the one in use
+	echMode       string   // ECH mode for Host, see config.ECHConfig
+	echConfigs    []byte   // ECHConfigList to try before sniLadder, if any
+	dst           string   // Original destination IP of a transparent connection, dialed by direct tunnels
+
+	start  time.Time               // When the state machine started
+	phases map[Phase]time.Duration // Time spent in each phase that ran
 }
 
 // connectState represents one step in the connection state machine.
-type connectState func(ctx *connectContext) (connectState, error)
+// It returns the next phase, or phaseDone when the machine should stop.
+type connectState func(ctx *connectContext) (Phase, error)
+
+// state returns the step implementing phase.
+func (s *ProxyServer) state(phase Phase) connectState {
+	switch phase {
+	case PhaseClientHello:
+		return s.stateClientHello
+	case PhaseDetermineSNI:
+		return s.stateDetermineSNI
+	case PhaseRemoteDial:
+		return s.stateRemoteDial
+	case PhaseVerifyCert:
+		return s.stateVerifyCert
+	case PhaseClientTLS:
+		return s.stateClientTLS
+	case PhaseTunnel:
+		return s.stateTunnel
+	case PhaseDirectDial:
+		return s.stateDirectDial
+	}
+	return nil
+}
+
+// runConnect drives the state machine until it finishes or a phase fails,
+// starting with the MITM handshake or a direct dial depending on ctx.Intercept.
+// Connections left open are closed by cleanupConnect, and the connection is
+// then written to the access log.
+func (s *ProxyServer) runConnect(ctx *connectContext) (err error) {
+	ctx.start = time.Now()
+	ctx.phases = make(map[Phase]time.Duration)
+	parent, release := s.boundToServer(ctx.parentCtx)
+	defer release()
+	ctx.parentCtx = dns.WithSource(parent, &ctx.DNSSource)
+	defer func() {
+		s.cleanupConnect(ctx)
+		s.logAccess(ctx, err)
+	}()
+
+	first := PhaseDirectDial
+	if ctx.Intercept {
+		first = PhaseClientHello
+	}
+
+	s.mu.Lock()
+	hooks := s.hooks
+	s.mu.Unlock()
+
+	for phase := first; phase != phaseDone; {
+		step := s.state(phase)
+		if step == nil {
+			return fmt.Errorf("unknown phase %q", phase)
+		}
+
+		s.updateConn(phase, &ctx.ConnectInfo)
+		var next Phase
+		started := time.Now()
+		for _, h := range hooks {
+			if h.Before == nil {
+				continue
+			}
+			if err = h.Before(phase, &ctx.ConnectInfo); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			next, err = step(ctx)
+		}
+		ctx.phases[phase] += time.Since(started)
+		for _, h := range hooks {
+			if h.After != nil {
+				h.After(phase, &ctx.ConnectInfo, err)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", phase, err)
+		}
+		phase = next
+	}
+	return nil
+}
 
 // cleanupConnect closes all connections that are still open.
-func (ps *ProxyServer) cleanupConnect(ctx *connectContext) {
+func (s *ProxyServer) cleanupConnect(ctx *connectContext) {
 	if ctx.tlsClientConn != nil {
 		ctx.tlsClientConn.Close()
 	}
@@ -39,108 +187,218 @@ func (ps *ProxyServer) cleanupConnect(ctx *connectContext) {
 	}
 }
 
-// extractClientIP parses the client IP from a remote address.
-func extractClientIP(remoteAddr net.Addr) net.IP {
-	clientIP, _, _ := net.SplitHostPort(remoteAddr.String())
-	return net.ParseIP(clientIP)
-}
-
 // ========== State Methods ==========
 
-// stateClientTLS performs TLS handshake with the client to extract SNI.
-func (ps *ProxyServer) stateClientTLS(ctx *connectContext) (connectState, error) {
-	tlsClientConn, clientHello, err := ps.handshakeClient(ctx.clientConn, ctx.host)
-	if err != nil {
-		return nil, fmt.Errorf("TLS handshake with client failed: %w", err)
+// stateClientHello reads the client's ClientHello without consuming it, to
+// learn the SNI and the ALPN protocols it offers. A client that does not speak
+// TLS is tunnelled directly instead.
+func (s *ProxyServer) stateClientHello(ctx *connectContext) (Phase, error) {
+	if ctx.hello == nil {
+		ctx.clientConn.SetReadDeadline(deadlineAfter(s.clientHandshakeTimeout()))
+		hello, conn, err := peekClientHello(ctx.clientConn)
+		ctx.clientConn = conn
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			// With detect_tls, a silent client may be waiting for a
+			// server-first protocol such as SSH or SMTP.
+			var ne net.Error
+			if errors.Is(err, errNotClientHello) || (s.cfg().Server.DetectTLS && errors.As(err, &ne) && ne.Timeout()) {
+				logger.Debug("No ClientHello for %s (%v), tunnelling directly", net.JoinHostPort(ctx.Host, ctx.Port), err)
+				ctx.Intercept = false
+				return PhaseDirectDial, nil
+			}
+			return phaseDone, fmt.Errorf("read ClientHello: %w", err)
+		}
+		ctx.hello = hello
 	}
-	ctx.tlsClientConn = tlsClientConn
-	ctx.clientHello = clientHello
-	return ps.stateDetermineSNI, nil
+	ctx.ClientHello = ctx.hello.ServerName
+	if ctx.ClientHello == "" {
+		ctx.ClientHello = ctx.Host
+	}
+	ctx.ALPN = ctx.hello.ALPN
+	return PhaseDetermineSNI, nil
 }
 
-// stateDetermineSNI determines what SNI to use for the remote connection.
-func (ps *ProxyServer) stateDetermineSNI(ctx *connectContext) (connectState, error) {
-	targetSNI, ok := ps.Rules.GetAlterHostname(ctx.clientHello)
-	if !ok {
-		targetSNI = ctx.clientHello
+// stateDetermineSNI determines what SNI to use for the remote connection,
+// along with the fallbacks to try if the remote handshake fails. When ECH
+// applies, the host's ECH configs are looked up to be tried first.
+func (s *ProxyServer) stateDetermineSNI(ctx *connectContext) (Phase, error) {
+	ctx.sniLadder = s.sniLadder(ctx.ClientHello, s.determineSNI(ctx.Host, ctx.ClientHello))
+	ctx.TargetSNI = ctx.sniLadder[0]
+	if len(ctx.sniLadder) > 1 {
+		logger.Debug("SNI ladder for %s: %q", ctx.Host, ctx.sniLadder)
 	}
-	if targetSNI == "" {
-		logger.Debug("Stripping SNI for %s", ctx.host)
-	} else if targetSNI != ctx.clientHello {
-		logger.Debug("Replacing SNI for %s with %s", ctx.host, targetSNI)
-	}
-	ctx.targetSNI = targetSNI
-	return ps.stateRemoteDial, nil
-}
 
-// stateRemoteDial connects to the remote server.
-func (ps *ProxyServer) stateRemoteDial(ctx *connectContext) (connectState, error) {
-	// Resolve IP
-	clientIP := extractClientIP(ctx.clientConn.RemoteAddr())
-	remoteIP, err := ps.Resolver.Resolve(ctx.parentCtx, ctx.host, clientIP)
+	if ctx.echMode = s.echMode(ctx.Host); ctx.echMode == config.ECHOff {
+		return PhaseRemoteDial, nil
+	}
+	configs, err := s.lookupECH(ctx.parentCtx, ctx.Host, ctx.Port)
 	if err != nil {
-		ps.Resolver.Invalidate(ctx.host)
-		return nil, fmt.Errorf("DNS resolution failed: %w", err)
+		logger.Debug("ECH lookup for %s failed: %v", ctx.Host, err)
+	}
+	if len(configs) == 0 {
+		if ctx.echMode == config.ECHOnly {
+			if err == nil {
+				err = errNoECH
+			}
+			return phaseDone, fmt.Errorf("ECH required for %s: %w", ctx.Host, err)
+		}
+		logger.Debug("ECH unavailable for %s, using SNI %q", ctx.Host, ctx.TargetSNI)
+		return PhaseRemoteDial, nil
 	}
-	remoteAddr := net.JoinHostPort(remoteIP, ctx.port)
+	ctx.echConfigs = configs
+	return PhaseRemoteDial, nil
+}
 
-	// Dial TCP
-	timeout := time.Duration(ps.Config.Timeout.Dial) * time.Second
-	if timeout == 0 {
-		timeout = 30 * time.Second
+// stateRemoteDial connects to the remote server, offering the client's ALPN list.
+// A pre-dialed connection is used when one is waiting. ECH is tried first
+// when configs were found; with ech-then-rewrite a failed ECH handshake falls
+// back to the SNI ladder. A failed TLS handshake moves on to the next SNI in
+// the ladder. A remote that asks for a client certificate is tunnelled
+// directly instead.
+func (s *ProxyServer) stateRemoteDial(ctx *connectContext) (Phase, error) {
+	var remoteConn tlsutil.Conn
+	var err error
+	session := metrics.SessionFull
+	if ctx.echConfigs == nil {
+		if remoteConn = s.takeWarm(ctx); remoteConn != nil {
+			ctx.TargetSNI, session = ctx.sniLadder[0], metrics.SessionWarm
+			logger.Debug("Using a pre-dialed connection to %s (SNI: %q)", ctx.Host, ctx.TargetSNI)
+		}
+	} else {
+		remoteConn, err = s.connectToRemoteECH(ctx.parentCtx, ctx.Host, ctx.Port, ctx.ClientAddr, ctx.ClientHello, ctx.ALPN, ctx.echConfigs)
+		switch {
+		case err == nil:
+			ctx.TargetSNI, ctx.ECH = ctx.ClientHello, true
+		case errors.Is(err, errClientCertRequested):
+			return s.passthroughClientCert(ctx)
+		case ctx.echMode == config.ECHOnly || !errors.Is(err, errRemoteHandshake) || ctx.parentCtx.Err() != nil:
+			return phaseDone, fmt.Errorf("failed to connect to remote %s with ECH: %w", ctx.Host, err)
+		default:
+			logger.Debug("ECH for %s failed (%v), trying SNI %q", ctx.Host, err, ctx.sniLadder[0])
+		}
+	}
+	for i, sni := range ctx.sniLadder {
+		if remoteConn != nil {
+			break
+		}
+		ctx.TargetSNI = sni
+		remoteConn, err = s.connectToRemote(ctx.parentCtx, ctx.Host, ctx.Port, ctx.ClientAddr, sni, ctx.ALPN)
+		if err == nil {
+			s.rememberSNI(ctx.ClientHello, sni, ctx.sniLadder)
+			break
+		}
+		if !errors.Is(err, errRemoteHandshake) || errors.Is(err, errClientCertRequested) || ctx.parentCtx.Err() != nil || i == len(ctx.sniLadder)-1 {
+			break
+		}
+		logger.Debug("SNI ladder for %s: %q failed (%v), trying %q", ctx.Host, sni, err, ctx.sniLadder[i+1])
+	}
+	if errors.Is(err, errClientCertRequested) {
+		return s.passthroughClientCert(ctx)
 	}
-	dialer := &net.Dialer{Timeout: timeout}
-	netConn, err := dialer.DialContext(ctx.parentCtx, "tcp", remoteAddr)
 	if err != nil {
-		ps.Resolver.Invalidate(ctx.host)
-		return nil, fmt.Errorf("dial failed to %s: %w", remoteAddr, err)
+		return phaseDone, fmt.Errorf("failed to connect to remote %s: %w", ctx.Host, err)
 	}
+	ctx.remoteConn = remoteConn
+	ctx.RemoteAddr = remoteConn.RemoteAddr().String()
+	state := remoteConn.ConnectionState()
+	ctx.Protocol = state.NegotiatedProtocol
+	if session == metrics.SessionFull && state.DidResume {
+		session = metrics.SessionResumed
+	}
+	metrics.RemoteSessions.With(session).Inc()
+	logger.Debug("ALPN for %s: client offered %v, remote selected %q", ctx.Host, ctx.ALPN, ctx.Protocol)
+	return PhaseVerifyCert, nil
+}
 
-	// TLS handshake
-	remoteConn := tls.Client(netConn, &tls.Config{
-		ServerName:         ctx.targetSNI,
-		InsecureSkipVerify: true,
-	})
-	if err := remoteConn.Handshake(); err != nil {
-		netConn.Close()
-		return nil, fmt.Errorf("remote handshake failed: %w", err)
+// stateVerifyCert verifies the remote server's certificate.
+func (s *ProxyServer) stateVerifyCert(ctx *connectContext) (Phase, error) {
+	if s.verifyServerCert(ctx.remoteConn, ctx.Host, ctx.TargetSNI) {
+		ctx.Verify = "passed"
+		if !s.certPolicy(ctx.Host).Enabled {
+			ctx.Verify = "skipped"
+		}
+		if !ctx.ECH {
+			s.warmUp(ctx)
+		}
+		return PhaseClientTLS, nil
 	}
 
-	ctx.remoteConn = remoteConn
-	return ps.stateVerifyCert, nil
+	state := ctx.remoteConn.ConnectionState()
+	var certInfo string
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		if len(cert.DNSNames) > 0 {
+			certInfo = fmt.Sprintf("Server cert domains: %v", cert.DNSNames)
+		} else {
+			certInfo = fmt.Sprintf("Server cert subject: %s", cert.Subject.CommonName)
+		}
+	} else {
+		certInfo = "No certificates provided by server"
+	}
+	ctx.Verify, ctx.VerifyReason = "failed", certInfo
+	return phaseDone, fmt.Errorf("certificate verification failed for %s. %s", ctx.Host, certInfo)
 }
 
-// stateVerifyCert verifies the remote server's certificate.
-func (ps *ProxyServer) stateVerifyCert(ctx *connectContext) (connectState, error) {
-	// verifyServerCert expects *tls.Conn
-	remoteTLS, ok := ctx.remoteConn.(*tls.Conn)
-	if !ok {
-		return nil, errors.New("remote connection is not TLS")
+// stateClientTLS performs the TLS handshake with the client, offering only
+// the protocol the remote selected so both sides speak the same one. A client
+// that refuses the MITM certificate has its host learned as passthrough.
+func (s *ProxyServer) stateClientTLS(ctx *connectContext) (Phase, error) {
+	var nextProtos []string
+	if ctx.Protocol != "" {
+		nextProtos = []string{ctx.Protocol}
 	}
-	if !ps.verifyServerCert(remoteTLS, ctx.host, ctx.targetSNI) {
-		// verifyServerCert already logged details
-		return nil, errors.New("certificate verification failed")
+	tlsClientConn, err := s.handshakeClient(ctx.clientConn, ctx.Host, nextProtos)
+	if err != nil {
+		if refusedCertificate(err) {
+			s.learnPassthrough(ctx.Host, passthrough.ReasonPinning)
+		}
+		return phaseDone, fmt.Errorf("TLS handshake with client failed: %w", err)
 	}
-	return ps.stateTunnel, nil
+	ctx.tlsClientConn = tlsClientConn
+	return PhaseTunnel, nil
 }
 
-// stateTunnel pipes data between client and remote and terminates the state machine.
-func (ps *ProxyServer) stateTunnel(ctx *connectContext) (connectState, error) {
-	ps.tunnel(ctx.clientConn, ctx.remoteConn)
-	// Mark connections as cleaned to avoid double-close
-	ctx.clientConn = nil
-	ctx.remoteConn = nil
-	if ctx.tlsClientConn != nil {
-		ctx.tlsClientConn.Close()
-		ctx.tlsClientConn = nil
+// stateTunnel pipes data between client and remote, or relays it as HTTP
+// for hosts with an [http_mode] rule, and terminates the state machine.
+func (s *ProxyServer) stateTunnel(ctx *connectContext) (Phase, error) {
+	protocol := ctx.Protocol
+	if protocol == "" {
+		protocol = "none"
+	}
+	var stats tunnelStats
+	if mode, ok := s.httpMode(ctx); ok {
+		logger.Info("HTTP tunnel: %s <-> %s (SNI: %s, ALPN: %s)", ctx.ClientAddr, ctx.Host, sniLabel(ctx), protocol)
+		stats = s.httpTunnel(ctx, mode)
+	} else {
+		logger.Info("Tunnel: %s <-> %s (SNI: %s, ALPN: %s)", ctx.ClientAddr, ctx.Host, sniLabel(ctx), protocol)
+		stats = s.countedTunnel(metrics.ModeMITM, &ctx.ConnectInfo, ctx.tlsClientConn, ctx.remoteConn)
 	}
-	return nil, nil
+	ctx.BytesIn, ctx.BytesOut, ctx.CloseReason = stats.in, stats.out, stats.reason
+	// Both tunnels close both ends, which also closes the raw client connection.
+	ctx.tlsClientConn = nil
+	ctx.remoteConn = nil
+	ctx.clientConn = nil
+	return phaseDone, nil
 }
 
-// stateDirectDial bypasses MITM and connects client directly to remote.
-func (ps *ProxyServer) stateDirectDial(ctx *connectContext) (connectState, error) {
-	ps.directTunnel(ctx.parentCtx, ctx.clientConn, ctx.host, ctx.port)
-	// directTunnel closes clientConn via tunnel; mark as nil to avoid double-close
+// stateDirectDial bypasses MITM and connects client directly to remote. With
+// block_detection, a tunnel that looks blocked has its host probed for an SNI
+// that gets through, see checkBlocked.
+func (s *ProxyServer) stateDirectDial(ctx *connectContext) (Phase, error) {
+	var answerTimeout time.Duration
+	if s.watchBlocking(ctx) {
+		answerTimeout = s.blockTimeout()
+	}
+	start := time.Now()
+	err := s.directTunnel(ctx.parentCtx, ctx.clientConn, &ctx.ConnectInfo, ctx.dst, answerTimeout)
+	// directTunnel closes clientConn on every path.
 	ctx.clientConn = nil
-	return nil, nil
+	if err != nil {
+		return phaseDone, fmt.Errorf("direct tunnel: %w", err)
+	}
+	if answerTimeout > 0 {
+		s.checkBlocked(ctx, time.Since(start), answerTimeout)
+	}
+	return phaseDone, nil
 }
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"snirect/internal/logger"
+)
+
+// Transparent proxy modes for ServerConfig.TransparentMode.
+const (
+	TransparentRedirect = "redirect" // iptables/nftables REDIRECT, destination via SO_ORIGINAL_DST
+	TransparentTProxy   = "tproxy"   // TPROXY, destination is the socket's local address
+)
+
+// ListenTransparent opens a listener for firewall-redirected connections.
+// In TPROXY mode the socket is marked IP_TRANSPARENT, which needs CAP_NET_ADMIN.
+func ListenTransparent(addr, mode string) (net.Listener, error) {
+	return listenTransparent(addr, mode == TransparentTProxy)
+}
+
+// ServeTransparent accepts firewall-redirected connections on ln. Each one is
+// routed by the SNI of its ClientHello, as if a CONNECT for that host had
+// arrived; connections without a ClientHello are tunnelled to their original
+// destination unchanged.
+func (s *ProxyServer) ServeTransparent(ln net.Listener, mode string) error {
+	tproxy := mode == TransparentTProxy
+	return s.serveListener(ln, func(id uint64, conn net.Conn) {
+		dst, err := originalDstOf(conn, tproxy)
+		if err != nil {
+			logger.Warn("Transparent: cannot recover original destination of %s: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		// Serving a connection made straight to the listener would loop
+		// back into snirect.
+		if notRedirected(ln, conn, dst, tproxy) {
+			logger.Warn("Transparent: connection from %s was not redirected, dropping", conn.RemoteAddr())
+			conn.Close()
+			return
+		}
+		s.handleTransparent(id, conn, dst)
+	})
+}
+
+// originalDstOf is originalDst, replaced in tests that have no firewall.
+var originalDstOf = originalDst
+
+// notRedirected reports whether conn, accepted on ln with original
+// destination dst, was made straight to the listener. With REDIRECT such a
+// connection reports its own local address as the original destination. With
+// TPROXY the original destination always is the local address, so dst is
+// compared with the address ln is bound to instead; a listener on the
+// unspecified address matches any destination with its port.
+func notRedirected(ln net.Listener, conn net.Conn, dst *net.TCPAddr, tproxy bool) bool {
+	addr := conn.LocalAddr()
+	if tproxy {
+		addr = ln.Addr()
+	}
+	local, ok := addr.(*net.TCPAddr)
+	if !ok || local.Port != dst.Port {
+		return false
+	}
+	return local.IP.Equal(dst.IP) || (tproxy && local.IP.IsUnspecified())
+}
+
+// handleTransparent routes a redirected connection whose original destination is dst.
+func (s *ProxyServer) handleTransparent(id uint64, conn net.Conn, dst *net.TCPAddr) {
+	defer s.acquireSlot()()
+
+	conn.SetReadDeadline(deadlineAfter(s.clientHandshakeTimeout()))
+	hello, conn, err := peekClientHello(conn)
+	conn.SetReadDeadline(time.Time{})
+
+	host := dst.IP.String()
+	port := strconv.Itoa(dst.Port)
+	intercept := false
+	if err != nil {
+		logger.Debug("Transparent: no ClientHello from %s (%v), tunnelling to %s", conn.RemoteAddr(), err, dst)
+	} else {
+		if hello.ServerName != "" {
+			host = hello.ServerName
+		}
+		intercept = s.shouldIntercept(host, port)
+	}
+
+	ctx := &connectContext{
+		ConnectInfo: ConnectInfo{
+			ID:         id,
+			ClientAddr: conn.RemoteAddr().String(),
+			Host:       host,
+			Port:       port,
+			Intercept:  intercept,
+		},
+		clientConn: conn,
+		hello:      hello,
+		parentCtx:  context.Background(),
+		dst:        dst.IP.String(),
+	}
+	if err := s.runConnect(ctx); err != nil {
+		logger.Warn("Transparent %s: %v", net.JoinHostPort(host, port), err)
+	}
+}
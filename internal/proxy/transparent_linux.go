@@ -0,0 +1,101 @@
+//go:build linux
+
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ip6tSOOriginalDst is IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv6/ip6_tables.h,
+// which x/sys/unix does not export.
+const ip6tSOOriginalDst = 80
+
+func listenTransparent(addr string, tproxy bool) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if tproxy {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				level, opt := unix.SOL_IP, unix.IP_TRANSPARENT
+				if network == "tcp6" {
+					level, opt = unix.SOL_IPV6, unix.IPV6_TRANSPARENT
+				}
+				serr = unix.SetsockoptInt(int(fd), level, opt, 1)
+			})
+			if err != nil {
+				return err
+			}
+			if serr != nil {
+				return fmt.Errorf("set IP_TRANSPARENT: %w", serr)
+			}
+			return nil
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// originalDst returns the destination the client originally connected to.
+// With TPROXY the socket is bound to that address; with REDIRECT it is read
+// back from conntrack through SO_ORIGINAL_DST.
+func originalDst(conn net.Conn, tproxy bool) (*net.TCPAddr, error) {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("not a TCP connection")
+	}
+	if tproxy {
+		return local, nil
+	}
+
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("not a TCP connection")
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var dst *net.TCPAddr
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			// struct sockaddr_in fits in the 16-byte Multiaddr of ipv6_mreq.
+			mreq, e := unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+			if e != nil {
+				serr = e
+				return
+			}
+			sa := mreq.Multiaddr
+			dst = &net.TCPAddr{
+				IP:   net.IPv4(sa[4], sa[5], sa[6], sa[7]),
+				Port: int(binary.BigEndian.Uint16(sa[2:4])),
+			}
+			return
+		}
+
+		info, e := unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, ip6tSOOriginalDst)
+		if e != nil {
+			serr = e
+			return
+		}
+		var port [2]byte
+		binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+		dst = &net.TCPAddr{
+			IP:   net.IP(info.Addr.Addr[:]),
+			Port: int(binary.BigEndian.Uint16(port[:])),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		return nil, fmt.Errorf("SO_ORIGINAL_DST: %w", serr)
+	}
+	return dst, nil
+}
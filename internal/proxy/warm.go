@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"snirect/internal/logger"
+	"snirect/internal/tlsutil"
+)
+
+const (
+	warmHalfLife = 5 * time.Minute // How quickly past connections stop counting towards a host's rank
+	warmMaxKeys  = 1024            // Hosts whose use is tracked
+)
+
+// warmKey identifies remote connections that can stand in for each other:
+// same remote, SNI and ALPN offer.
+type warmKey struct {
+	host, port, sni, alpn string
+}
+
+func newWarmKey(ctx *connectContext, sni string) warmKey {
+	return warmKey{host: ctx.Host, port: ctx.Port, sni: sni, alpn: strings.Join(ctx.ALPN, ",")}
+}
+
+type warmEntry struct {
+	score   float64      // Connections, halved every warmHalfLife
+	seen    time.Time    // Last connection, from which score decays
+	conn    tlsutil.Conn // Pre-dialed connection waiting for a client
+	dialing bool         // A connection is being pre-dialed
+}
+
+// decayed returns the score of e at now.
+func (e *warmEntry) decayed(now time.Time) float64 {
+	return e.score * math.Exp2(-float64(now.Sub(e.seen))/float64(warmHalfLife))
+}
+
+// warmPool keeps one pre-dialed, handshaken remote connection for each of the
+// busiest warmKeys, so that the next client connection to them skips the dial
+// and the handshake.
+type warmPool struct {
+	mu      sync.Mutex
+	entries map[warmKey]*warmEntry
+	closed  bool
+}
+
+func newWarmPool() *warmPool {
+	return &warmPool{entries: make(map[warmKey]*warmEntry)}
+}
+
+// take returns the pre-dialed connection for k, if there is one that the
+// remote has not closed in the meantime.
+func (p *warmPool) take(k warmKey) tlsutil.Conn {
+	p.mu.Lock()
+	var conn tlsutil.Conn
+	if e := p.entries[k]; e != nil {
+		conn, e.conn = e.conn, nil
+	}
+	p.mu.Unlock()
+	if conn != nil && !connAlive(conn) {
+		conn.Close()
+		return nil
+	}
+	return conn
+}
+
+// use counts a connection to k and reports whether k is now among the hosts
+// busiest keys and lacks a pre-dialed connection. The caller must then dial
+// one and pass it to put.
+func (p *warmPool) use(k warmKey, hosts int) bool {
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	e := p.entries[k]
+	if e == nil {
+		if len(p.entries) >= warmMaxKeys {
+			p.evictLocked(now)
+		}
+		e = &warmEntry{}
+		p.entries[k] = e
+	}
+	e.score = e.decayed(now) + 1
+	e.seen = now
+	if e.conn != nil || e.dialing {
+		return false
+	}
+	busier := 0
+	for other, o := range p.entries {
+		if other != k && o.decayed(now) > e.score {
+			busier++
+		}
+	}
+	if busier >= hosts {
+		return false
+	}
+	e.dialing = true
+	return true
+}
+
+// put stores conn, pre-dialed for k after use asked for it, and closes it if
+// no client takes it within maxIdle. A nil conn marks a failed dial.
+func (p *warmPool) put(k warmKey, conn tlsutil.Conn, maxIdle time.Duration) {
+	p.mu.Lock()
+	e := p.entries[k]
+	if e != nil {
+		e.dialing = false
+	}
+	if p.closed || e == nil || conn == nil {
+		p.mu.Unlock()
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
+	e.conn = conn
+	p.mu.Unlock()
+
+	time.AfterFunc(maxIdle, func() {
+		p.mu.Lock()
+		expired := e.conn == conn
+		if expired {
+			e.conn = nil
+		}
+		p.mu.Unlock()
+		if expired {
+			conn.Close()
+		}
+	})
+}
+
+// evictLocked forgets the least busy key to make room for another.
+func (p *warmPool) evictLocked(now time.Time) {
+	var coldest warmKey
+	low := math.Inf(1)
+	for k, e := range p.entries {
+		if score := e.decayed(now); score < low && !e.dialing {
+			coldest, low = k, score
+		}
+	}
+	if e := p.entries[coldest]; e != nil && e.conn != nil {
+		e.conn.Close()
+	}
+	delete(p.entries, coldest)
+}
+
+// close closes the waiting connections and stops pre-dialing.
+func (p *warmPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, e := range p.entries {
+		if e.conn != nil {
+			e.conn.Close()
+			e.conn = nil
+		}
+	}
+}
+
+// connAlive reports whether conn is still open and has nothing to read, as
+// expected of a connection on which no request was sent yet.
+func connAlive(conn tlsutil.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	defer conn.SetReadDeadline(time.Time{})
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// warmConns returns the pool of pre-dialed connections, creating it on first
+// use.
+func (s *ProxyServer) warmConns() *warmPool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.warm == nil {
+		s.warm = newWarmPool()
+		if s.closed {
+			s.warm.closed = true
+		}
+	}
+	return s.warm
+}
+
+// takeWarm returns a pre-dialed connection for the first SNI of ctx, or nil
+// when warm-up is disabled or none is waiting.
+func (s *ProxyServer) takeWarm(ctx *connectContext) tlsutil.Conn {
+	if cfg := s.cfg(); cfg == nil || cfg.Warmup.Hosts <= 0 {
+		return nil
+	}
+	return s.warmConns().take(newWarmKey(ctx, ctx.sniLadder[0]))
+}
+
+// warmUp counts the connection of ctx to its remote and, when that makes the
+// remote one of the busiest, pre-dials a connection for the next client in
+// the background.
+func (s *ProxyServer) warmUp(ctx *connectContext) {
+	cfg := s.cfg()
+	if cfg == nil || cfg.Warmup.Hosts <= 0 {
+		return
+	}
+	k := newWarmKey(ctx, ctx.TargetSNI)
+	pool := s.warmConns()
+	if !pool.use(k, cfg.Warmup.Hosts) {
+		return
+	}
+	maxIdle := time.Duration(cfg.Warmup.MaxIdle) * time.Second
+	if maxIdle <= 0 {
+		maxIdle = 30 * time.Second
+	}
+	clientAddr, alpn := ctx.ClientAddr, ctx.ALPN
+	go func() {
+		dialCtx, cancel := context.WithTimeout(context.Background(), s.dialTimeout())
+		defer cancel()
+		conn, err := s.connectToRemote(dialCtx, k.host, k.port, clientAddr, k.sni, alpn)
+		if err != nil {
+			logger.Debug("Warm-up: pre-dialing %s failed: %v", net.JoinHostPort(k.host, k.port), err)
+			pool.put(k, nil, maxIdle)
+			return
+		}
+		logger.Debug("Warm-up: pre-dialed %s (SNI: %s)", net.JoinHostPort(k.host, k.port), k.sni)
+		pool.put(k, conn, maxIdle)
+	}()
+}
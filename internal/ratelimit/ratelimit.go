@@ -0,0 +1,159 @@
+// Package ratelimit shapes byte streams with token buckets and measures the
+// throughput that passes through them.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket that refills at a rate in bytes per second and
+// holds at most one second's worth. Takers may overdraw it and pay the debt by
+// waiting, so a read of any size can go through. A rate of 0 is unlimited; so
+// is the zero Bucket.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a full bucket for rate bytes per second.
+func NewBucket(rate int64) *Bucket {
+	b := &Bucket{}
+	b.SetRate(rate)
+	return b
+}
+
+// SetRate changes the rate; negative is unlimited. A bucket that was
+// unlimited starts full.
+func (b *Bucket) SetRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.refillLocked(now)
+	was := b.rate
+	b.rate = float64(max(rate, 0))
+	if was == 0 {
+		b.tokens = b.rate
+	}
+	b.tokens = min(b.tokens, b.rate)
+	b.last = now
+}
+
+// Rate returns the rate in bytes per second, 0 when unlimited.
+func (b *Bucket) Rate() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int64(b.rate)
+}
+
+// Take removes n tokens and returns how long the caller has to wait before
+// using them.
+func (b *Bucket) Take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate == 0 {
+		return 0
+	}
+	b.refillLocked(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *Bucket) refillLocked(now time.Time) {
+	if b.rate > 0 && !b.last.IsZero() {
+		b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.rate)
+	}
+	b.last = now
+}
+
+// Wait takes n tokens from each bucket, nil ones included, and sleeps until
+// the slowest of them is paid. It returns false early if stop is closed.
+func Wait(stop <-chan struct{}, n int, buckets ...*Bucket) bool {
+	var wait time.Duration
+	for _, b := range buckets {
+		if b != nil {
+			wait = max(wait, b.Take(n))
+		}
+	}
+	if wait <= 0 {
+		return true
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// Chunk returns how many bytes to move at once through the buckets: size, or
+// a tenth of a second's worth of the slowest bucket so that limited streams
+// stay smooth, but at least minChunk.
+func Chunk(size int, buckets ...*Bucket) int {
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+		if rate := b.Rate(); rate > 0 {
+			size = min(size, max(int(rate/10), minChunk))
+		}
+	}
+	return size
+}
+
+const minChunk = 1024
+
+// meterSlots is the number of one-second slots a Meter keeps. The newest one
+// is still filling, so the rate is measured over the others.
+const meterSlots = 5
+
+// Meter measures throughput over the last few seconds. The zero Meter is
+// ready to use.
+type Meter struct {
+	mu    sync.Mutex
+	slots [meterSlots]int64
+	sec   int64 // Unix second of the newest slot
+}
+
+// Add counts n bytes.
+func (m *Meter) Add(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().Unix()
+	m.advanceLocked(now)
+	m.slots[now%meterSlots] += int64(n)
+}
+
+// Rate returns the bytes per second counted over the last complete seconds.
+func (m *Meter) Rate() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().Unix()
+	m.advanceLocked(now)
+	var sum int64
+	for i, n := range m.slots {
+		if int64(i) != now%meterSlots {
+			sum += n
+		}
+	}
+	return sum / (meterSlots - 1)
+}
+
+// advanceLocked clears the slots of the seconds between the newest slot and now.
+func (m *Meter) advanceLocked(now int64) {
+	if now-m.sec >= meterSlots {
+		clear(m.slots[:])
+	} else {
+		for sec := m.sec + 1; sec <= now; sec++ {
+			m.slots[sec%meterSlots] = 0
+		}
+	}
+	m.sec = max(m.sec, now)
+}
@@ -0,0 +1,78 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	b := NewBucket(1000)
+	if wait := b.Take(1000); wait != 0 {
+		t.Fatalf("full bucket: wait %v, want 0", wait)
+	}
+	if wait := b.Take(500); wait < 400*time.Millisecond || wait > 500*time.Millisecond {
+		t.Fatalf("overdrawn bucket: wait %v, want about 500ms", wait)
+	}
+
+	b.SetRate(0)
+	if wait := b.Take(1 << 20); wait != 0 {
+		t.Fatalf("unlimited bucket: wait %v, want 0", wait)
+	}
+	b.SetRate(2000)
+	if wait := b.Take(2000); wait != 0 {
+		t.Fatalf("bucket limited again: wait %v, want 0 (starts full)", wait)
+	}
+
+	var zero Bucket
+	if zero.Take(1<<20) != 0 || zero.Rate() != 0 {
+		t.Fatal("zero bucket is limited")
+	}
+}
+
+func TestWait(t *testing.T) {
+	b := NewBucket(1000)
+	stop := make(chan struct{})
+	start := time.Now()
+	if !Wait(stop, 1100, b, nil) {
+		t.Fatal("Wait stopped")
+	}
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Errorf("Wait returned after %v, want about 100ms", d)
+	}
+
+	close(stop)
+	if Wait(stop, 10000, b) {
+		t.Error("Wait ignored stop")
+	}
+
+	if got := Chunk(65536, NewBucket(100000), nil); got != 10000 {
+		t.Errorf("Chunk = %d, want 10000", got)
+	}
+	if got := Chunk(65536, NewBucket(100)); got != minChunk {
+		t.Errorf("Chunk at a low rate = %d, want %d", got, minChunk)
+	}
+	if got := Chunk(65536, &Bucket{}); got != 65536 {
+		t.Errorf("Chunk unlimited = %d, want 65536", got)
+	}
+}
+
+func TestMeter(t *testing.T) {
+	var m Meter
+	if m.Rate() != 0 {
+		t.Fatal("new meter has a rate")
+	}
+	// Pretend the last second carried 4000 bytes.
+	now := time.Now().Unix()
+	m.Add(1)
+	m.slots[(now-1)%meterSlots] = 4000
+	if got := m.Rate(); got != 1000 {
+		t.Errorf("Rate = %d, want 1000", got)
+	}
+
+	m.mu.Lock()
+	m.sec -= meterSlots
+	m.mu.Unlock()
+	if got := m.Rate(); got != 0 {
+		t.Errorf("Rate after the window passed = %d, want 0", got)
+	}
+}
@@ -0,0 +1,149 @@
+// Package reload applies edits to config.toml and rules.toml to a running
+// instance. Both files are parsed and validated before anything is applied,
+// so an edit that does not load leaves the running configuration in place.
+package reload
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"snirect/internal/config"
+	"snirect/internal/learned"
+	"snirect/internal/logger"
+)
+
+// DefaultInterval is how often Watch checks the files when no interval is set.
+const DefaultInterval = 2 * time.Second
+
+// stamp identifies one version of a file on disk.
+type stamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// Reloader re-reads the config and rules files and hands them to Apply.
+type Reloader struct {
+	ConfigPath string
+	RulesPath  string
+	Apply      func(cfg *config.Config, rules *config.Rules)
+	// Learned is the layer the running proxy writes learned rules to, if
+	// any. Watch ignores the proxy's own writes, which it already applied.
+	Learned *learned.Layer
+
+	mu     sync.Mutex
+	stamps map[string]stamp // File versions seen by the last reload
+}
+
+// New returns a Reloader for the files and records their current versions,
+// which are assumed to be the ones already loaded.
+func New(configPath, rulesPath string, apply func(cfg *config.Config, rules *config.Rules)) *Reloader {
+	r := &Reloader{ConfigPath: configPath, RulesPath: rulesPath, Apply: apply}
+	r.stamps = r.snapshot()
+	return r
+}
+
+// Reload loads and validates both files and applies them. On error nothing
+// is applied.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Recorded even when loading fails, so Watch does not retry a broken
+	// edit until the file changes again.
+	r.stamps = r.snapshot()
+
+	cfg, err := config.LoadConfig(r.ConfigPath)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filepath.Base(r.ConfigPath), err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("%s: %w", filepath.Base(r.ConfigPath), err)
+	}
+	rules, err := config.LoadRules(r.RulesPath)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filepath.Base(r.RulesPath), err)
+	}
+	r.Apply(cfg, rules)
+	return nil
+}
+
+// Trigger is Reload that also logs the outcome; reason names what asked for
+// the reload.
+func (r *Reloader) Trigger(reason string) error {
+	if err := r.Reload(); err != nil {
+		logger.Error("Reload (%s) rejected, keeping the running configuration: %v", reason, err)
+		return err
+	}
+	logger.Info("Reloaded config.toml and rules.toml (%s)", reason)
+	return nil
+}
+
+// Watch checks the files every interval until ctx is done and reloads once a
+// change has settled, i.e. the files looked the same on two checks in a row,
+// so that a file is not read while an editor is still writing it.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var pending map[string]stamp
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current := r.snapshot()
+		r.mu.Lock()
+		r.ignoreOwnWrites(current)
+		changed := !maps.Equal(current, r.stamps)
+		r.mu.Unlock()
+		switch {
+		case !changed:
+			pending = nil
+		case pending != nil && maps.Equal(current, pending):
+			pending = nil
+			r.Trigger("file change")
+		default:
+			pending = current
+		}
+	}
+}
+
+// ignoreOwnWrites makes the learned rules layer look unchanged in current
+// when the file is the one Learned last saved.
+func (r *Reloader) ignoreOwnWrites(current map[string]stamp) {
+	path := r.learnedPath()
+	st, ok := current[path]
+	if !ok || !r.Learned.Wrote(st.modTime, st.size) {
+		return
+	}
+	if prev, ok := r.stamps[path]; ok {
+		current[path] = prev
+	} else {
+		delete(current, path)
+	}
+}
+
+func (r *Reloader) learnedPath() string {
+	return filepath.Join(filepath.Dir(r.RulesPath), learned.FileName)
+}
+
+// snapshot returns the current versions of the files, including the learned
+// rules layer next to the rules file; missing files are left out.
+func (r *Reloader) snapshot() map[string]stamp {
+	stamps := make(map[string]stamp, 3)
+	for _, path := range []string{r.ConfigPath, r.RulesPath, r.learnedPath()} {
+		if info, err := os.Stat(path); err == nil {
+			stamps[path] = stamp{modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+	return stamps
+}
@@ -0,0 +1,131 @@
+package reload
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"snirect/internal/config"
+	"snirect/internal/learned"
+)
+
+// newTestReloader writes the files into a temporary directory and returns a
+// Reloader for them that sends applied configurations to the channel.
+func newTestReloader(t *testing.T, cfgTOML, rulesTOML string) (*Reloader, chan *config.Config) {
+	t.Helper()
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "config.toml")
+	rulesPath := filepath.Join(dir, "rules.toml")
+	writeFile(t, cfgPath, cfgTOML)
+	writeFile(t, rulesPath, rulesTOML)
+
+	applied := make(chan *config.Config, 4)
+	r := New(cfgPath, rulesPath, func(cfg *config.Config, rules *config.Rules) { applied <- cfg })
+	return r, applied
+}
+
+// writeFile writes content and moves the modification time forward, so the
+// change is visible even on file systems with a coarse timestamp resolution.
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Duration(len(content)) * time.Second)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	r, applied := newTestReloader(t, "[server]\npac_host = \"a.example\"\n", "")
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if cfg := <-applied; cfg.Server.PACHost != "a.example" {
+		t.Errorf("PACHost = %q, want a.example", cfg.Server.PACHost)
+	}
+}
+
+func TestReload_RejectsInvalidEdits(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   string
+		rules string
+	}{
+		{"syntax", "[server\n", ""},
+		{"validation", "ca_install = \"sometimes\"\n", ""},
+		{"rules", "", "[hosts\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, applied := newTestReloader(t, tt.cfg, tt.rules)
+			if err := r.Reload(); err == nil {
+				t.Fatal("Reload accepted an invalid edit")
+			}
+			if len(applied) != 0 {
+				t.Error("an invalid edit was applied")
+			}
+		})
+	}
+}
+
+func TestWatch(t *testing.T) {
+	r, applied := newTestReloader(t, "", "")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Watch(ctx, 10*time.Millisecond)
+
+	writeFile(t, r.ConfigPath, "[server]\npac_host = \"b.example\"\n")
+	select {
+	case cfg := <-applied:
+		if cfg.Server.PACHost != "b.example" {
+			t.Errorf("PACHost = %q, want b.example", cfg.Server.PACHost)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch did not reload after the file changed")
+	}
+
+	// A broken edit is rejected once, not on every check.
+	writeFile(t, r.ConfigPath, "[server\n")
+	time.Sleep(100 * time.Millisecond)
+	if len(applied) != 0 {
+		t.Error("a broken edit was applied")
+	}
+}
+
+func TestWatch_IgnoresOwnLearnedWrites(t *testing.T) {
+	r, applied := newTestReloader(t, "", "")
+	layer, err := learned.Load(filepath.Join(filepath.Dir(r.RulesPath), learned.FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Learned = layer
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Watch(ctx, 10*time.Millisecond)
+
+	if err := layer.Add("blocked.example", "", learned.ReasonReset, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if len(applied) != 0 {
+		t.Fatal("Watch reloaded after the proxy saved a learned rule")
+	}
+
+	// "snirect learned forget" in another process.
+	other, err := learned.Load(filepath.Join(filepath.Dir(r.RulesPath), learned.FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-applied:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch did not reload after another process changed the learned rules")
+	}
+}
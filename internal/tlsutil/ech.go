@@ -0,0 +1,82 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"snirect/internal/config"
+	"snirect/internal/logger"
+	"snirect/internal/metrics"
+)
+
+// ECHClientConfig returns a client configuration that encrypts the
+// ClientHello for host with the given ECHConfigList, so that only the public
+// name of the configs is sent in the clear. The certificate of an accepted
+// handshake is left to VerifyCert like any other. When the server rejects ECH,
+// its certificate must be valid for the public name before its retry configs
+// are trusted, unless policy disables verification.
+func ECHClientConfig(host string, alpn []string, configs []byte, policy config.CertPolicy, sec config.SecurityConfig) *tls.Config {
+	outer := config.CertPolicy{Enabled: policy.Enabled, Strict: true}
+	return &tls.Config{
+		ServerName:                     host,
+		NextProtos:                     alpn,
+		MinVersion:                     tls.VersionTLS13,
+		InsecureSkipVerify:             true, // We verify manually
+		EncryptedClientHelloConfigList: configs,
+		EncryptedClientHelloRejectionVerify: func(cs tls.ConnectionState) error {
+			if !VerifyCert(connState(cs), cs.ServerName, "", outer, sec) {
+				return fmt.Errorf("ECH rejected and certificate not valid for public name %s", cs.ServerName)
+			}
+			return nil
+		},
+	}
+}
+
+// ECHRetryConfigs returns the retry configs carried by an ECH rejection in
+// err. ok is false when err is not an ECH rejection; a rejection without
+// configs means the server has disabled ECH.
+func ECHRetryConfigs(err error) (configs []byte, ok bool) {
+	var rejection *tls.ECHRejectionError
+	if !errors.As(err, &rejection) {
+		return nil, false
+	}
+	return rejection.RetryConfigList, true
+}
+
+// HandshakeECH connects to host with handshake, passing it the ECHConfigList
+// to encrypt the ClientHello with. When the server rejects configs but sends
+// retry configs, they are handed to store, if not nil, and the handshake is
+// tried once more with them. Outcomes are counted in metrics.ECHHandshakes.
+func HandshakeECH(host string, configs []byte, handshake func(configs []byte) (Conn, error), store func(retry []byte)) (Conn, error) {
+	conn, err := handshake(configs)
+	if err == nil {
+		metrics.ECHHandshakes.With(metrics.ECHAccepted).Inc()
+		return conn, nil
+	}
+	retry, ok := ECHRetryConfigs(err)
+	if !ok || len(retry) == 0 {
+		if ok {
+			logger.Debug("ECH: %s rejected ECH without retry configs", host)
+		}
+		metrics.ECHHandshakes.With(metrics.ECHRejected).Inc()
+		return nil, err
+	}
+
+	logger.Debug("ECH: %s rejected its published configs, retrying with the ones it sent", host)
+	if store != nil {
+		store(retry)
+	}
+	conn, err = handshake(retry)
+	if err != nil {
+		metrics.ECHHandshakes.With(metrics.ECHRejected).Inc()
+		return nil, err
+	}
+	metrics.ECHHandshakes.With(metrics.ECHRetried).Inc()
+	return conn, nil
+}
+
+// connState adapts a ConnectionState to TLSConnection.
+type connState tls.ConnectionState
+
+func (c connState) ConnectionState() tls.ConnectionState { return tls.ConnectionState(c) }
@@ -0,0 +1,183 @@
+package tlsutil
+
+import (
+	"context"
+	"crypto/tls"
+	"math/rand/v2"
+	"net"
+	"slices"
+
+	utls "github.com/refraction-networking/utls"
+
+	"snirect/internal/config"
+)
+
+// Conn is a client TLS connection: a *tls.Conn, or the uTLS connection of a
+// browser ClientHello profile.
+type Conn interface {
+	net.Conn
+	ConnectionState() tls.ConnectionState
+}
+
+// browserHellos are the uTLS ClientHellos of the browser profiles, which
+// reproduce the browsers' extensions and their order, GREASE included.
+var browserHellos = map[string]utls.ClientHelloID{
+	config.FingerprintChrome:  utls.HelloChrome_Auto,
+	config.FingerprintFirefox: utls.HelloFirefox_Auto,
+	config.FingerprintSafari:  utls.HelloSafari_Auto,
+}
+
+// Handshake completes a client TLS handshake over conn with c, sending the
+// ClientHello of profile. Browser profiles hand shake with uTLS, which takes
+// the server name, ALPN list, verification settings and client certificate
+// callback from c but neither resumes sessions nor does ECH; connections with
+// ECH configs are left to crypto/tls. The other profiles shape c, see
+// ApplyFingerprint.
+func Handshake(ctx context.Context, conn net.Conn, c *tls.Config, profile string) (Conn, error) {
+	id, browser := browserHellos[profile]
+	if !browser || c.EncryptedClientHelloConfigList != nil {
+		ApplyFingerprint(c, profile)
+		tlsConn := tls.Client(conn, c)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+
+	spec, err := utls.UTLSIdToSpec(id)
+	if err != nil {
+		return nil, err
+	}
+	spec.Extensions = offerALPN(spec.Extensions, c.NextProtos)
+	uconn := utls.UClient(conn, uConfig(c), utls.HelloCustom)
+	if err := uconn.ApplyPreset(&spec); err != nil {
+		return nil, err
+	}
+	if err := uconn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return &uConn{uconn}, nil
+}
+
+// uConfig returns the uTLS equivalent of the client settings in c.
+func uConfig(c *tls.Config) *utls.Config {
+	uc := &utls.Config{
+		ServerName:            c.ServerName,
+		NextProtos:            c.NextProtos,
+		InsecureSkipVerify:    c.InsecureSkipVerify,
+		RootCAs:               c.RootCAs,
+		VerifyPeerCertificate: c.VerifyPeerCertificate,
+		KeyLogWriter:          c.KeyLogWriter,
+	}
+	if get := c.GetClientCertificate; get != nil {
+		uc.GetClientCertificate = func(req *utls.CertificateRequestInfo) (*utls.Certificate, error) {
+			cert, err := get(&tls.CertificateRequestInfo{AcceptableCAs: req.AcceptableCAs, Version: req.Version})
+			if err != nil || cert == nil {
+				return nil, err
+			}
+			return &utls.Certificate{Certificate: cert.Certificate, PrivateKey: cert.PrivateKey, Leaf: cert.Leaf}, nil
+		}
+	}
+	return uc
+}
+
+// offerALPN makes the ALPN extension of a browser ClientHello offer protos
+// instead of the browser's own list, so that the remote cannot select a
+// protocol the client did not offer. Without protos ALPN is left out, and so
+// is ALPS when it names a protocol that protos lacks.
+func offerALPN(exts []utls.TLSExtension, protos []string) []utls.TLSExtension {
+	return slices.DeleteFunc(exts, func(ext utls.TLSExtension) bool {
+		switch e := ext.(type) {
+		case *utls.ALPNExtension:
+			e.AlpnProtocols = protos
+			return len(protos) == 0
+		case *utls.ApplicationSettingsExtension:
+			return !containsAll(protos, e.SupportedProtocols)
+		case *utls.ApplicationSettingsExtensionNew:
+			return !containsAll(protos, e.SupportedProtocols)
+		}
+		return false
+	})
+}
+
+func containsAll(list, items []string) bool {
+	for _, item := range items {
+		if !slices.Contains(list, item) {
+			return false
+		}
+	}
+	return true
+}
+
+// uConn is a uTLS connection that reports its state as crypto/tls does.
+type uConn struct {
+	*utls.UConn
+}
+
+func (c *uConn) ConnectionState() tls.ConnectionState {
+	s := c.UConn.ConnectionState()
+	return tls.ConnectionState{
+		Version:                     s.Version,
+		HandshakeComplete:           s.HandshakeComplete,
+		DidResume:                   s.DidResume,
+		CipherSuite:                 s.CipherSuite,
+		NegotiatedProtocol:          s.NegotiatedProtocol,
+		ServerName:                  s.ServerName,
+		PeerCertificates:            s.PeerCertificates,
+		VerifiedChains:              s.VerifiedChains,
+		SignedCertificateTimestamps: s.SignedCertificateTimestamps,
+		OCSPResponse:                s.OCSPResponse,
+		TLSUnique:                   s.TLSUnique,
+		ECHAccepted:                 s.ECHAccepted,
+	}
+}
+
+// ApplyFingerprint shapes the ClientHello that crypto/tls produces with c
+// after profile. go-default, empty, unknown and browser profiles leave c
+// unchanged; browser profiles need Handshake. crypto/tls decides the order
+// of cipher suites and groups and the extensions it sends, so randomized
+// only varies which ones are offered, so that connections do not share Go's
+// fingerprint.
+func ApplyFingerprint(c *tls.Config, profile string) {
+	if profile != config.FingerprintRandomized {
+		return
+	}
+	c.CipherSuites, c.CurvePreferences = randomSuites(), randomCurves()
+}
+
+// randomSuites returns a random selection of forward-secret TLS 1.2 cipher
+// suites. The AES-128-GCM suites are always kept, so that servers still find a
+// match. TLS 1.3 suites are not configurable and always offered.
+func randomSuites() []uint16 {
+	suites := []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	}
+	for _, id := range []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	} {
+		if rand.N(2) == 0 {
+			suites = append(suites, id)
+		}
+	}
+	return suites
+}
+
+// randomCurves returns a random selection of key exchange groups. X25519 and
+// P-256 are always kept.
+func randomCurves() []tls.CurveID {
+	curves := []tls.CurveID{tls.X25519, tls.CurveP256}
+	for _, id := range []tls.CurveID{tls.X25519MLKEM768, tls.CurveP384, tls.CurveP521} {
+		if rand.N(2) == 0 {
+			curves = append(curves, id)
+		}
+	}
+	return curves
+}
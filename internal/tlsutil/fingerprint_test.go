@@ -0,0 +1,121 @@
+package tlsutil
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"snirect/internal/config"
+)
+
+// clientHello returns what a server sees of the ClientHello sent with c.
+func clientHello(t *testing.T, c *tls.Config) *tls.ClientHelloInfo {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	hellos := make(chan *tls.ClientHelloInfo, 1)
+	go func() {
+		defer server.Close()
+		tls.Server(server, &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			hellos <- hello
+			return nil, net.ErrClosed
+		}}).Handshake()
+	}()
+	tls.Client(client, c).Handshake()
+	return <-hellos
+}
+
+func TestApplyFingerprint(t *testing.T) {
+	c := &tls.Config{ServerName: "example.com"}
+	ApplyFingerprint(c, config.FingerprintGo)
+	if c.CipherSuites != nil || c.CurvePreferences != nil {
+		t.Errorf("go-default changed the config: %v, %v", c.CipherSuites, c.CurvePreferences)
+	}
+
+	// Every TLS 1.2 suite Go offers by default is forward secret.
+	def := clientHello(t, &tls.Config{ServerName: "example.com"})
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		c := &tls.Config{ServerName: "example.com"}
+		ApplyFingerprint(c, config.FingerprintRandomized)
+		if c.SessionTicketsDisabled {
+			t.Fatal("randomized disabled session tickets")
+		}
+		hello := clientHello(t, c)
+		for _, id := range hello.CipherSuites {
+			if !slices.Contains(def.CipherSuites, id) {
+				t.Fatalf("randomized offered %s, which Go does not offer by default", tls.CipherSuiteName(id))
+			}
+		}
+		if !slices.Contains(hello.CipherSuites, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256) ||
+			!slices.Contains(hello.SupportedCurves, tls.X25519) || !slices.Contains(hello.SupportedCurves, tls.CurveP256) {
+			t.Fatalf("randomized dropped a mandatory suite or group: %x, %v", hello.CipherSuites, hello.SupportedCurves)
+		}
+		seen[fmt.Sprint(hello.CipherSuites, hello.SupportedCurves)] = true
+	}
+	if len(seen) < 2 {
+		t.Error("randomized sent the same ClientHello 20 times")
+	}
+}
+
+// TestHandshake_Browser tests that browser profiles send the browser's
+// ClientHello, offering the ALPN list of the config, and give a working
+// connection.
+func TestHandshake_Browser(t *testing.T) {
+	hellos := make(chan *tls.ClientHelloInfo, 1)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	ts.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		hellos <- hello
+		return nil, nil
+	}}
+	ts.StartTLS()
+	defer ts.Close()
+	def := clientHello(t, &tls.Config{ServerName: "example.com"})
+
+	for _, profile := range []string{config.FingerprintChrome, config.FingerprintFirefox, config.FingerprintSafari} {
+		t.Run(profile, func(t *testing.T) {
+			conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer conn.Close()
+			c := &tls.Config{ServerName: "example.com", NextProtos: []string{"http/1.1"}, InsecureSkipVerify: true}
+			tlsConn, err := Handshake(context.Background(), conn, c, profile)
+			if err != nil {
+				t.Fatalf("Handshake: %v", err)
+			}
+			hello := <-hellos
+			if hello.ServerName != "example.com" || !slices.Equal(hello.SupportedProtos, c.NextProtos) {
+				t.Errorf("remote saw SNI %q and ALPN %q", hello.ServerName, hello.SupportedProtos)
+			}
+			if slices.Equal(hello.CipherSuites, def.CipherSuites) && slices.Equal(hello.SupportedCurves, def.SupportedCurves) {
+				t.Error("sent Go's ClientHello")
+			}
+			state := tlsConn.ConnectionState()
+			if !state.HandshakeComplete || state.NegotiatedProtocol != "http/1.1" || len(state.PeerCertificates) == 0 {
+				t.Fatalf("state: complete %v, protocol %q, %d certificates", state.HandshakeComplete, state.NegotiatedProtocol, len(state.PeerCertificates))
+			}
+
+			req, _ := http.NewRequest("GET", "https://example.com/", nil)
+			if err := req.Write(tlsConn); err != nil {
+				t.Fatalf("write request: %v", err)
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(tlsConn), req)
+			if err != nil {
+				t.Fatalf("read response: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("status %d", resp.StatusCode)
+			}
+		})
+	}
+}
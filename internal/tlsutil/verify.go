@@ -7,6 +7,7 @@ import (
 	"os"
 	"snirect/internal/config"
 	"snirect/internal/logger"
+	"snirect/internal/metrics"
 	"strings"
 	"time"
 
@@ -93,7 +94,7 @@ func VerifyCert(conn TLSConnection, host, targetSNI string, policy config.CertPo
 	state := conn.ConnectionState()
 	if len(state.PeerCertificates) == 0 {
 		logger.Warn("no peer certificates presented")
-		return false
+		return verifyFailed("no_certificate")
 	}
 	leaf := state.PeerCertificates[0]
 
@@ -102,11 +103,11 @@ func VerifyCert(conn TLSConnection, host, targetSNI string, policy config.CertPo
 		now := time.Now()
 		if now.Before(leaf.NotBefore) {
 			logger.Warn("certificate not valid yet: %s", leaf.NotBefore.Format(time.RFC3339))
-			return false
+			return verifyFailed("not_yet_valid")
 		}
 		if now.After(leaf.NotAfter) {
 			logger.Warn("certificate expired: %s", leaf.NotAfter.Format(time.RFC3339))
-			return false
+			return verifyFailed("expired")
 		}
 	}
 
@@ -114,14 +115,14 @@ func VerifyCert(conn TLSConnection, host, targetSNI string, policy config.CertPo
 	if sec.ValidateChain {
 		if err := verifyCertificateChain(leaf, state, sec, nil); err != nil {
 			logger.Warn("chain validation: %v", err)
-			return false
+			return verifyFailed("chain")
 		}
 	}
 
 	// 3. EKU check
 	if sec.CheckEKU && !hasServerAuthEKU(leaf) {
 		logger.Warn("certificate missing serverAuth EKU")
-		return false
+		return verifyFailed("eku")
 	}
 
 	// 4. Allowed list (highest priority)
@@ -137,7 +138,7 @@ func VerifyCert(conn TLSConnection, host, targetSNI string, policy config.CertPo
 			}
 		}
 		logger.Debug("cert domains %v did not match allowed list %v", leaf.DNSNames, policy.Allowed)
-		return false
+		return verifyFailed("not_allowed")
 	}
 
 	// 5. Standard hostname verification (original host)
@@ -154,6 +155,12 @@ func VerifyCert(conn TLSConnection, host, targetSNI string, policy config.CertPo
 	}
 
 	logger.Debug("hostname %s (SNI: %s) does not match cert domains %v", host, targetSNI, leaf.DNSNames)
+	return verifyFailed("hostname")
+}
+
+// verifyFailed counts a rejected certificate and returns false.
+func verifyFailed(reason string) bool {
+	metrics.CertVerifyFailures.With(reason).Inc()
 	return false
 }
 
@@ -91,6 +91,11 @@ func NewManager(cfg *config.Config, rules *config.Rules) *Manager {
 	}
 }
 
+// Close releases the resolver of the manager's upstream client.
+func (m *Manager) Close() error {
+	return m.client.Close()
+}
+
 // CheckForUpdate checks if there's a new version available by querying GitHub releases API
 // using the internal network stack (Fake SNI + IP logic).
 func (m *Manager) CheckForUpdate(currentVersion string) (bool, string, error) {
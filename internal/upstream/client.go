@@ -16,6 +16,7 @@ import (
 	"time"
 
 	"snirect/internal/config"
+	"snirect/internal/dialer"
 	"snirect/internal/dns"
 	"snirect/internal/interfaces"
 	"snirect/internal/logger"
@@ -25,11 +26,13 @@ import (
 // Client is a minimal HTTP client that routes through Snirect's internal network stack,
 // applying DNS resolution, SNI rewriting, and certificate verification according to rules.
 type Client struct {
+	mu          sync.RWMutex // Guards cfg, rules and router, which Reload replaces
 	cfg         *config.Config
 	rules       *config.Rules
 	resolver    interfaces.Resolver
-	timeout     time.Duration
+	router      *dialer.Router
 	rateLimiter *simpleRateLimiter
+	ownResolver bool // resolver was created by New and must be closed by Close
 }
 
 type simpleRateLimiter struct {
@@ -62,37 +65,64 @@ func (rl *simpleRateLimiter) Wait() {
 	rl.last = time.Now()
 }
 
-// New creates a new upstream client.
-func New(cfg *config.Config, rules *config.Rules) *Client {
+// dialTimeout returns the timeout for remote dials, defaulting to 30 seconds.
+func dialTimeout(cfg *config.Config) time.Duration {
 	timeout := time.Duration(cfg.Timeout.Dial) * time.Second
 	if timeout == 0 {
 		timeout = 30 * time.Second
 	}
+	return timeout
+}
+
+// New creates a new upstream client.
+func New(cfg *config.Config, rules *config.Rules) *Client {
 	return &Client{
 		cfg:         cfg,
 		rules:       rules,
 		resolver:    dns.NewResolver(cfg, rules),
-		timeout:     timeout,
+		router:      dialer.NewRouter(cfg, rules, dialTimeout(cfg)),
 		rateLimiter: newSimpleRateLimiter(cfg.Update.UpstreamRateLimit),
+		ownResolver: true,
 	}
 }
 
 // NewWithResolver creates a new upstream client with a custom resolver.
 // This is used by the container for dependency injection.
 func NewWithResolver(cfg *config.Config, rules *config.Rules, resolver interfaces.Resolver) *Client {
-	timeout := time.Duration(cfg.Timeout.Dial) * time.Second
-	if timeout == 0 {
-		timeout = 30 * time.Second
-	}
 	return &Client{
 		cfg:         cfg,
 		rules:       rules,
 		resolver:    resolver,
-		timeout:     timeout,
+		router:      dialer.NewRouter(cfg, rules, dialTimeout(cfg)),
 		rateLimiter: newSimpleRateLimiter(cfg.Update.UpstreamRateLimit),
 	}
 }
 
+// Reload replaces the configuration and rules used by later requests. The
+// rate limit is kept; it only changes with a restart.
+func (c *Client) Reload(cfg *config.Config, rules *config.Rules) {
+	router := dialer.NewRouter(cfg, rules, dialTimeout(cfg))
+	c.mu.Lock()
+	c.cfg, c.rules, c.router = cfg, rules, router
+	c.mu.Unlock()
+}
+
+// current returns the configuration, rules and router in effect.
+func (c *Client) current() (*config.Config, *config.Rules, *dialer.Router) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cfg, c.rules, c.router
+}
+
+// Close releases resources owned by the client. A resolver injected through
+// NewWithResolver is left open; its owner is responsible for closing it.
+func (c *Client) Close() error {
+	if c.ownResolver && c.resolver != nil {
+		return c.resolver.Close()
+	}
+	return nil
+}
+
 // Get performs an HTTP GET request to the given URL, routing through Snirect's internal stack.
 // The request will go through DNS resolution with rule-based IP overrides, SNI modification,
 // and certificate verification according to config and rules.
@@ -112,35 +142,46 @@ func (c *Client) Get(ctx context.Context, url string) (*http.Response, error) {
 		port = "443" // Assume HTTPS for upstream requests
 	}
 
-	// Resolve IP using Snirect's resolver (applies host overrides and DNS settings)
-	clientIP := net.ParseIP("127.0.0.1") // Use localhost as client IP for ECS
-	remoteIP, err := c.resolver.Resolve(ctx, host, clientIP)
+	_, _, router := c.current()
+	route, err := router.Route(host)
 	if err != nil {
-		return nil, fmt.Errorf("DNS resolution failed for %s: %w", host, err)
+		return nil, err
 	}
-	remoteAddr := net.JoinHostPort(remoteIP, port)
-	logger.Debug("Upstream: resolving %s -> %s", host, remoteIP)
 
-	// Dial TCP connection
-	dialer := &net.Dialer{Timeout: c.timeout}
-	netConn, err := dialer.DialContext(ctx, "tcp", remoteAddr)
-	if err != nil {
-		c.resolver.Invalidate(host)
-		return nil, fmt.Errorf("dial failed to %s: %w", remoteAddr, err)
+	// Resolve IPs using Snirect's resolver (applies host overrides and DNS settings),
+	// unless the outbound proxy resolves names itself
+	remoteIPs := []string{host}
+	if !route.RemoteDNS {
+		clientIP := net.ParseIP("127.0.0.1") // Use localhost as client IP for ECS
+		remoteIPs, err = c.resolver.ResolveAll(dns.WithPort(ctx, port), host, clientIP)
+		if err != nil {
+			return nil, fmt.Errorf("DNS resolution failed for %s: %w", host, err)
+		}
+		logger.Debug("Upstream: resolving %s -> %v", host, remoteIPs)
+	}
+	addrs := make([]string, len(remoteIPs))
+	for i, ip := range remoteIPs {
+		addrs[i] = net.JoinHostPort(ip, port)
 	}
 
-	// Determine SNI (apply rules)
-	targetSNI := c.determineSNI(host)
-	logger.Debug("Upstream: SNI for %s -> %s", host, targetSNI)
+	// Dial TCP connection across all addresses, through the outbound proxy if one applies
+	if route.Proxy != "" {
+		logger.Debug("Upstream: dialing %s via %s", net.JoinHostPort(host, port), route.Proxy)
+	}
+	dial := func() (net.Conn, error) {
+		netConn, _, err := dialer.DialParallel(ctx, route, "tcp", addrs, dialer.AttemptDelay)
+		if err != nil {
+			if !route.RemoteDNS {
+				c.resolver.Invalidate(host)
+			}
+			return nil, fmt.Errorf("dial failed to %s: %w", net.JoinHostPort(host, port), err)
+		}
+		return netConn, nil
+	}
 
-	// Perform TLS handshake - force HTTP/1.1 (avoid HTTP/2 complexity)
-	tlsConn := tls.Client(netConn, &tls.Config{
-		ServerName:         targetSNI,
-		InsecureSkipVerify: true, // We verify manually below
-		NextProtos:         []string{"http/1.1"},
-	})
-	if err := tlsConn.Handshake(); err != nil {
-		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	tlsConn, targetSNI, err := c.handshake(ctx, dial, host, port)
+	if err != nil {
+		return nil, err
 	}
 
 	// Verify certificate
@@ -198,8 +239,105 @@ func (b *connClosingBody) Close() error {
 	return err
 }
 
+// handshake dials and completes the TLS handshake for host, with Encrypted
+// Client Hello when its ECH mode and published configs allow it, otherwise
+// with the SNI the rules select. It returns the connection and the SNI used.
+func (c *Client) handshake(ctx context.Context, dial func() (net.Conn, error), host, port string) (tlsutil.Conn, string, error) {
+	// Force HTTP/1.1 (avoid HTTP/2 complexity)
+	alpn := []string{"http/1.1"}
+
+	if mode := c.echMode(host); mode != config.ECHOff {
+		var configs []byte
+		var err error
+		if r, ok := c.resolver.(interfaces.ECHResolver); ok {
+			configs, err = r.LookupECH(ctx, host, port)
+		}
+		if len(configs) > 0 {
+			var conn tlsutil.Conn
+			if conn, err = c.handshakeECH(ctx, dial, host, port, alpn, configs); err == nil {
+				logger.Debug("Upstream: ECH accepted by %s", host)
+				return conn, host, nil
+			}
+		} else if err == nil {
+			err = fmt.Errorf("no ECH configs published")
+		}
+		if mode == config.ECHOnly || ctx.Err() != nil {
+			return nil, "", fmt.Errorf("ECH required for %s: %w", host, err)
+		}
+		logger.Debug("Upstream: ECH for %s unavailable (%v), using SNI", host, err)
+	}
+
+	// Determine SNI (apply rules)
+	targetSNI := c.determineSNI(host)
+	logger.Debug("Upstream: SNI for %s -> %s", host, targetSNI)
+	tlsConn, err := c.tlsHandshake(ctx, dial, host, &tls.Config{
+		ServerName:         targetSNI,
+		InsecureSkipVerify: true, // We verify manually below
+		NextProtos:         alpn,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return tlsConn, targetSNI, nil
+}
+
+// handshakeECH completes an ECH handshake with configs, retrying once with
+// the configs the server sends back when it rejects them.
+func (c *Client) handshakeECH(ctx context.Context, dial func() (net.Conn, error), host, port string, alpn []string, configs []byte) (tlsutil.Conn, error) {
+	cfg, _, _ := c.current()
+	policy := c.certPolicy(host)
+	var store func([]byte)
+	if r, ok := c.resolver.(interfaces.ECHResolver); ok {
+		store = func(retry []byte) { r.StoreECH(host, port, retry) }
+	}
+	return tlsutil.HandshakeECH(host, configs, func(configs []byte) (tlsutil.Conn, error) {
+		return c.tlsHandshake(ctx, dial, host, tlsutil.ECHClientConfig(host, alpn, configs, policy, cfg.Security))
+	}, store)
+}
+
+// tlsHandshake dials and performs the TLS handshake with tlsConfig, shaped by
+// the ClientHello profile of host.
+func (c *Client) tlsHandshake(ctx context.Context, dial func() (net.Conn, error), host string, tlsConfig *tls.Config) (tlsutil.Conn, error) {
+	netConn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	tlsConn, err := tlsutil.Handshake(ctx, netConn, tlsConfig, c.fingerprint(host))
+	if err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	return tlsConn, nil
+}
+
+// echMode returns the [ech] mode for host, or the global ech.mode.
+func (c *Client) echMode(host string) string {
+	cfg, rules, _ := c.current()
+	if mode, ok := rules.GetECH(host); ok {
+		return mode
+	}
+	if cfg.ECH.Mode != "" {
+		return cfg.ECH.Mode
+	}
+	return config.ECHOff
+}
+
+// fingerprint returns the [fingerprint] profile for host, or the global
+// fingerprint.profile.
+func (c *Client) fingerprint(host string) string {
+	cfg, rules, _ := c.current()
+	if profile, ok := rules.GetFingerprint(host); ok {
+		return profile
+	}
+	if cfg.Fingerprint.Profile != "" {
+		return cfg.Fingerprint.Profile
+	}
+	return config.FingerprintGo
+}
+
 func (c *Client) determineSNI(host string) string {
-	targetSNI, ok := c.rules.GetAlterHostname(host)
+	_, rules, _ := c.current()
+	targetSNI, ok := rules.GetAlterHostname(host)
 	if !ok {
 		return host
 	}
@@ -214,12 +352,20 @@ func (c *Client) determineSNI(host string) string {
 	return targetSNI
 }
 
-func (c *Client) verifyCert(conn *tls.Conn, host, targetSNI string) bool {
-	policy, ok := c.rules.GetCertVerify(host)
+func (c *Client) verifyCert(conn tlsutil.Conn, host, targetSNI string) bool {
+	cfg, _, _ := c.current()
+	return tlsutil.VerifyCert(conn, host, targetSNI, c.certPolicy(host), cfg.Security)
+}
+
+// certPolicy returns the [cert_verify] policy for host, or the global
+// check_hostname policy when no rule matches.
+func (c *Client) certPolicy(host string) config.CertPolicy {
+	cfg, rules, _ := c.current()
+	policy, ok := rules.GetCertVerify(host)
 	if !ok {
-		policy, _ = config.ParseCertPolicy(c.cfg.CheckHostname)
+		policy, _ = config.ParseCertPolicy(cfg.CheckHostname)
 	}
-	return tlsutil.VerifyCert(conn, host, targetSNI, policy, c.cfg.Security)
+	return policy
 }
 
 // DownloadFile downloads a file from the given URL to the destination path.
@@ -2,6 +2,10 @@ package upstream
 
 import (
 	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
@@ -54,6 +58,19 @@ func TestDetermineSNI(t *testing.T) {
 	}
 }
 
+func TestReload(t *testing.T) {
+	cfg := &config.Config{}
+	client := NewWithResolver(cfg, &config.Rules{Rules: rules.NewRules()}, &mockResolver{})
+
+	r := rules.NewRules()
+	r.AlterHostname["example.com"] = "changed.com"
+	client.Reload(cfg, &config.Rules{Rules: r})
+
+	if sn := client.determineSNI("example.com"); sn != "changed.com" {
+		t.Errorf("after Reload: got %s, want changed.com", sn)
+	}
+}
+
 func TestConnClosingBody(t *testing.T) {
 	called := false
 	inner := &testReadCloser{closed: false}
@@ -88,6 +105,7 @@ func (t *testReadCloser) Close() error {
 // mockResolver is a test double for interfaces.Resolver.
 type mockResolver struct {
 	resolveFunc    func(ctx context.Context, host string, clientIP net.IP) (string, error)
+	resolveAllFunc func(ctx context.Context, host string, clientIP net.IP) ([]string, error)
 	invalidateFunc func(host string)
 }
 
@@ -95,6 +113,18 @@ func (m *mockResolver) Resolve(ctx context.Context, host string, clientIP net.IP
 	return m.resolveFunc(ctx, host, clientIP)
 }
 
+// ResolveAll uses resolveAllFunc if set, otherwise the single address from resolveFunc.
+func (m *mockResolver) ResolveAll(ctx context.Context, host string, clientIP net.IP) ([]string, error) {
+	if m.resolveAllFunc != nil {
+		return m.resolveAllFunc(ctx, host, clientIP)
+	}
+	ip, err := m.resolveFunc(ctx, host, clientIP)
+	if err != nil {
+		return nil, err
+	}
+	return []string{ip}, nil
+}
+
 func (m *mockResolver) Invalidate(host string) {
 	if m.invalidateFunc != nil {
 		m.invalidateFunc(host)
@@ -330,3 +360,93 @@ func TestDownloadFile_HTTPError(t *testing.T) {
 		t.Errorf("error message: got %q, expected containing 404 Not Found", err.Error())
 	}
 }
+
+// echResolver is a mockResolver that serves ECH configs.
+type echResolver struct {
+	mockResolver
+	configs, stored []byte
+}
+
+func (m *echResolver) LookupECH(ctx context.Context, host, port string) ([]byte, error) {
+	return m.configs, nil
+}
+
+func (m *echResolver) StoreECH(host, port string, configs []byte) {
+	m.configs, m.stored = configs, configs
+}
+
+// newECHKey returns a server key for ECH with the given config ID and the
+// ECHConfigList a client needs to use it.
+func newECHKey(t *testing.T, id byte) (tls.EncryptedClientHelloKey, []byte) {
+	t.Helper()
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate ECH key: %v", err)
+	}
+	pub := priv.PublicKey().Bytes()
+	publicName := "public.example"
+
+	contents := []byte{id}
+	contents = binary.BigEndian.AppendUint16(contents, 0x0020) // DHKEM(X25519, HKDF-SHA256)
+	contents = binary.BigEndian.AppendUint16(contents, uint16(len(pub)))
+	contents = append(contents, pub...)
+	contents = binary.BigEndian.AppendUint16(contents, 4)
+	contents = binary.BigEndian.AppendUint16(contents, 0x0001) // HKDF-SHA256
+	contents = binary.BigEndian.AppendUint16(contents, 0x0001) // AES-128-GCM
+	contents = append(contents, 0, byte(len(publicName)))
+	contents = append(contents, publicName...)
+	contents = binary.BigEndian.AppendUint16(contents, 0) // No extensions
+
+	echConfig := binary.BigEndian.AppendUint16(nil, 0xfe0d)
+	echConfig = binary.BigEndian.AppendUint16(echConfig, uint16(len(contents)))
+	echConfig = append(echConfig, contents...)
+	list := binary.BigEndian.AppendUint16(nil, uint16(len(echConfig)))
+	list = append(list, echConfig...)
+	return tls.EncryptedClientHelloKey{Config: echConfig, PrivateKey: priv.Bytes(), SendAsRetry: true}, list
+}
+
+// TestGet_ECH tests that Get uses Encrypted Client Hello under ech.mode,
+// retrying with the server's configs when the published ones are stale.
+func TestGet_ECH(t *testing.T) {
+	key, _ := newECHKey(t, 1)
+	_, stale := newECHKey(t, 2)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%v", r.TLS.ServerName, r.TLS.ECHAccepted)
+	}))
+	ts.TLS = &tls.Config{EncryptedClientHelloKeys: []tls.EncryptedClientHelloKey{key}}
+	ts.StartTLS()
+	defer ts.Close()
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+	resolver := &echResolver{
+		mockResolver: mockResolver{resolveFunc: func(ctx context.Context, h string, clientIP net.IP) (string, error) {
+			return "127.0.0.1", nil
+		}},
+		configs: stale,
+	}
+	cfg := &config.Config{
+		CheckHostname: false,
+		Timeout:       config.TimeoutConfig{Dial: 30},
+		ECH:           config.ECHConfig{Mode: config.ECHOnly},
+	}
+	client := NewWithResolver(cfg, &config.Rules{}, resolver)
+
+	resp, err := client.Get(context.Background(), "https://ech.example:"+port+"/")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if want := "ech.example|true"; string(body) != want {
+		t.Errorf("server saw %s, want %s", body, want)
+	}
+	if resolver.stored == nil {
+		t.Error("retry configs were not stored")
+	}
+
+	resolver.configs = nil
+	if resp, err := client.Get(context.Background(), "https://other.example:"+port+"/"); err == nil {
+		resp.Body.Close()
+		t.Error("Get succeeded without ECH configs under ech mode")
+	}
+}